@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var contextFileHeader = regexp.MustCompile(`(?m)^// File: (.+)$`)
+
+// splitTextContextFiles recovers the individual files from a context built
+// by generatePromptContext
+func splitTextContextFiles(codeContext string) []FileContent {
+	var files []FileContent
+
+	matches := contextFileHeader.FindAllStringSubmatchIndex(codeContext, -1)
+	for i, match := range matches {
+		start := match[1] + 1
+		end := len(codeContext)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		if start > end {
+			start = end
+		}
+
+		content := codeContext[start:end]
+		if sep := strings.LastIndex(content, "\n\n---\n"); sep != -1 {
+			content = content[:sep]
+		}
+
+		files = append(files, FileContent{
+			Path:    strings.TrimSpace(codeContext[match[2]:match[3]]),
+			Content: content,
+			Size:    len(content),
+		})
+	}
+
+	return files
+}
+
+type parsedGoFile struct {
+	Path string
+	File *ast.File
+}
+
+// parseGoFiles parses the Go files of the context, skipping the ones that
+// do not parse
+func parseGoFiles(files []FileContent) (*token.FileSet, []parsedGoFile) {
+	fset := token.NewFileSet()
+	var parsed []parsedGoFile
+
+	for _, file := range files {
+		if strings.ToLower(filepath.Ext(file.Path)) != ".go" {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file.Path, file.Content, parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		parsed = append(parsed, parsedGoFile{Path: file.Path, File: f})
+	}
+
+	return fset, parsed
+}
+
+// funcDisplayName returns Name or Type.Name for methods
+func funcDisplayName(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	recv := decl.Recv.List[0].Type
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+	if index, ok := recv.(*ast.IndexExpr); ok {
+		recv = index.X
+	}
+	if ident, ok := recv.(*ast.Ident); ok {
+		return ident.Name + "." + decl.Name.Name
+	}
+	return decl.Name.Name
+}
+
+var scriptFuncDecl = regexp.MustCompile(`(?m)^\s*(?:def|function|async function|async def)\s+(\w+)\s*\(`)
+
+// findRecursiveFunctions lists functions that call themselves directly,
+// using the AST for Go and a definition-scoped search for Python/JavaScript
+func findRecursiveFunctions(codeContext string) []string {
+	files := splitContextFiles(codeContext)
+	found := map[string]bool{}
+
+	_, goFiles := parseGoFiles(files)
+	for _, goFile := range goFiles {
+		for _, decl := range goFile.File.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				switch fun := call.Fun.(type) {
+				case *ast.Ident:
+					if fn.Recv == nil && fun.Name == fn.Name.Name {
+						found[funcDisplayName(fn)] = true
+					}
+				case *ast.SelectorExpr:
+					if fn.Recv != nil && fun.Sel.Name == fn.Name.Name {
+						if recv, ok := fun.X.(*ast.Ident); ok && len(fn.Recv.List) > 0 && len(fn.Recv.List[0].Names) > 0 && recv.Name == fn.Recv.List[0].Names[0].Name {
+							found[funcDisplayName(fn)] = true
+						}
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Path))
+		if ext != ".py" && ext != ".js" && ext != ".ts" && ext != ".jsx" && ext != ".tsx" {
+			continue
+		}
+		decls := scriptFuncDecl.FindAllStringSubmatchIndex(file.Content, -1)
+		for i, decl := range decls {
+			name := file.Content[decl[2]:decl[3]]
+			end := len(file.Content)
+			if i+1 < len(decls) {
+				end = decls[i+1][0]
+			}
+			if strings.Contains(file.Content[decl[1]:end], name+"(") {
+				found[name] = true
+			}
+		}
+	}
+
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var hotPathName = regexp.MustCompile(`^(?i:parse|encode|decode|marshal|unmarshal|serialize|deserialize|hash|compress|decompress|tokenize|scan|lex|match|format|render|escape|normalize|validate)`)
+
+// findHotPathFunctions flags exported Go functions whose names suggest they
+// run on every request or every byte of input
+func findHotPathFunctions(codeContext string) []string {
+	var names []string
+	_, goFiles := parseGoFiles(splitContextFiles(codeContext))
+	for _, goFile := range goFiles {
+		for _, decl := range goFile.File.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || !fn.Name.IsExported() {
+				continue
+			}
+			if hotPathName.MatchString(fn.Name.Name) {
+				names = append(names, funcDisplayName(fn))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type sharedStateFinding struct {
+	File string
+	Line int
+	Var  string
+	Func string
+}
+
+// findUnsyncedSharedState reports package-level variables mutated by
+// functions that take no lock, in packages that run code concurrently
+// (goroutines or HTTP handlers)
+func findUnsyncedSharedState(codeContext string) []sharedStateFinding {
+	fset, goFiles := parseGoFiles(splitContextFiles(codeContext))
+
+	byDir := map[string][]parsedGoFile{}
+	for _, goFile := range goFiles {
+		dir := path.Dir(slashPath(goFile.Path))
+		byDir[dir] = append(byDir[dir], goFile)
+	}
+
+	var findings []sharedStateFinding
+	for _, files := range byDir {
+		pkgVars := map[string]bool{}
+		pkgSpecs := map[*ast.ValueSpec]bool{}
+		concurrent := false
+
+		for _, goFile := range files {
+			for _, decl := range goFile.File.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					valueSpec := spec.(*ast.ValueSpec)
+					pkgSpecs[valueSpec] = true
+					if valueSpec.Type != nil && isSyncType(valueSpec.Type) {
+						continue
+					}
+					for _, name := range valueSpec.Names {
+						if name.Name != "_" {
+							pkgVars[name.Name] = true
+						}
+					}
+				}
+			}
+			ast.Inspect(goFile.File, func(n ast.Node) bool {
+				switch node := n.(type) {
+				case *ast.GoStmt:
+					concurrent = true
+				case *ast.SelectorExpr:
+					if pkg, ok := node.X.(*ast.Ident); ok && pkg.Name == "http" && node.Sel.Name == "ResponseWriter" {
+						concurrent = true
+					}
+				}
+				return !concurrent
+			})
+		}
+
+		if !concurrent || len(pkgVars) == 0 {
+			continue
+		}
+
+		for _, goFile := range files {
+			for _, decl := range goFile.File.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Body == nil || fn.Name.Name == "init" || takesLock(fn.Body) {
+					continue
+				}
+				reported := map[string]bool{}
+				report := func(ident *ast.Ident) {
+					if !pkgVars[ident.Name] || reported[ident.Name] || isLocalObject(ident, pkgSpecs) {
+						return
+					}
+					reported[ident.Name] = true
+					findings = append(findings, sharedStateFinding{
+						File: goFile.Path,
+						Line: fset.Position(ident.Pos()).Line,
+						Var:  ident.Name,
+						Func: funcDisplayName(fn),
+					})
+				}
+				ast.Inspect(fn.Body, func(n ast.Node) bool {
+					switch node := n.(type) {
+					case *ast.AssignStmt:
+						if node.Tok == token.DEFINE {
+							return true
+						}
+						for _, lhs := range node.Lhs {
+							if ident := rootIdent(lhs); ident != nil {
+								report(ident)
+							}
+						}
+					case *ast.IncDecStmt:
+						if ident := rootIdent(node.X); ident != nil {
+							report(ident)
+						}
+					case *ast.CallExpr:
+						if fun, ok := node.Fun.(*ast.Ident); ok && fun.Name == "delete" && len(node.Args) > 0 {
+							if ident := rootIdent(node.Args[0]); ident != nil {
+								report(ident)
+							}
+						}
+					}
+					return true
+				})
+			}
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return findings[i].File < findings[j].File
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
+
+func isSyncType(expr ast.Expr) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if index, ok := expr.(*ast.IndexExpr); ok {
+		expr = index.X
+	}
+	if sel, ok := expr.(*ast.SelectorExpr); ok {
+		if pkg, ok := sel.X.(*ast.Ident); ok {
+			return pkg.Name == "sync" || pkg.Name == "atomic"
+		}
+	}
+	return false
+}
+
+func takesLock(body *ast.BlockStmt) bool {
+	locked := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && (sel.Sel.Name == "Lock" || sel.Sel.Name == "RLock") {
+				locked = true
+			}
+		}
+		return !locked
+	})
+	return locked
+}
+
+// rootIdent returns x for x, x[k], x.f and *x
+func rootIdent(expr ast.Expr) *ast.Ident {
+	for {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			return e
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.SelectorExpr:
+			expr = e.X
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		default:
+			return nil
+		}
+	}
+}
+
+// isLocalObject reports whether the parser resolved the identifier to a
+// declaration inside a function, i.e. a local shadowing a package variable
+func isLocalObject(ident *ast.Ident, pkgSpecs map[*ast.ValueSpec]bool) bool {
+	if ident.Obj == nil {
+		return false
+	}
+	switch decl := ident.Obj.Decl.(type) {
+	case *ast.ValueSpec:
+		return !pkgSpecs[decl]
+	case *ast.AssignStmt, *ast.Field:
+		return true
+	}
+	return false
+}
+
+func sharedStateFindingNames(codeContext string) []string {
+	var names []string
+	for _, finding := range findUnsyncedSharedState(codeContext) {
+		names = append(names, fmt.Sprintf("%s written by %s (%s:%d)", finding.Var, finding.Func, finding.File, finding.Line))
+	}
+	return names
+}
+
+// sharedStateWarnings turns the shared state findings into warnings, linked
+// to the race tests that target the offending function
+func sharedStateWarnings(codeContext string, testCases []GeminiTestCase) []AnalysisWarning {
+	var warnings []AnalysisWarning
+	for _, finding := range findUnsyncedSharedState(codeContext) {
+		funcName := finding.Func
+		if dot := strings.LastIndex(funcName, "."); dot != -1 {
+			funcName = funcName[dot+1:]
+		}
+
+		var testIDs []string
+		for _, testCase := range testCases {
+			if testCase.TestType == "race" && (strings.Contains(testCase.Code, funcName) || strings.Contains(testCase.Name, funcName)) {
+				testIDs = append(testIDs, testCase.ID)
+			}
+		}
+
+		warnings = append(warnings, AnalysisWarning{
+			Kind:    "shared-state",
+			File:    finding.File,
+			Line:    finding.Line,
+			Symbol:  finding.Var,
+			Message: fmt.Sprintf("package-level %s is written by %s without holding a lock while the package runs concurrently", finding.Var, finding.Func),
+			TestIDs: testIDs,
+		})
+	}
+	return warnings
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Team analytics for engineering managers. Runs are attributed to the
+// tenant they were generated for, and CI reports which of the generated
+// files were merged, which turns the coverage measured at generation time
+// into gaps actually closed.
+
+// Team of runs generated without a tenant
+const unassignedTeam = "unassigned"
+
+var analyticsSorts = []string{"testsMerged", "gapsClosed", "coverageGained", "runs"}
+
+// RunOutcome records what became of the generated files of a run
+type RunOutcome struct {
+	MergedFiles []string  `json:"mergedFiles"`
+	MergedTests int       `json:"mergedTests"`
+	PullRequest string    `json:"pullRequest,omitempty"`
+	RecordedAt  time.Time `json:"recordedAt"`
+}
+
+// runOutcomeRequest reports the generated files that were merged
+type runOutcomeRequest struct {
+	// Artifact paths merged, all artifacts of the run when empty
+	Files []string `json:"files,omitempty"`
+	// Overrides the number of tests counted in the merged files
+	MergedTests *int   `json:"mergedTests,omitempty"`
+	PullRequest string `json:"pullRequest,omitempty"`
+}
+
+func (req *runOutcomeRequest) validate() fieldErrors {
+	var errs fieldErrors
+	if req.MergedTests != nil {
+		errs.min("mergedTests", *req.MergedTests, 0)
+	}
+	errs.maxLen("pullRequest", req.PullRequest, 512)
+	return errs
+}
+
+// TeamMetrics aggregates the runs of one team
+type TeamMetrics struct {
+	Team           string  `json:"team"`
+	Runs           int     `json:"runs"`
+	TestsGenerated int     `json:"testsGenerated"`
+	FilesGenerated int     `json:"filesGenerated"`
+	RunsMerged     int     `json:"runsMerged"`
+	TestsMerged    int     `json:"testsMerged"`
+	FilesMerged    int     `json:"filesMerged"`
+	MergeRate      float64 `json:"mergeRate"` // share of runs with merged files
+	// Exported functions without tests that merged tests now refer to
+	GapsClosed int `json:"gapsClosed"`
+	// Percentage points of static coverage gained, summed over repositories
+	CoverageGained float64       `json:"coverageGained"`
+	LastRunAt      *time.Time    `json:"lastRunAt,omitempty"`
+	Repositories   []RepoMetrics `json:"repositories,omitempty"`
+}
+
+// RepoMetrics is the share of a repository in the metrics of a team
+type RepoMetrics struct {
+	Repo           string  `json:"repo"`
+	Runs           int     `json:"runs"`
+	TestsMerged    int     `json:"testsMerged"`
+	GapsClosed     int     `json:"gapsClosed"`
+	CoverageGained float64 `json:"coverageGained"`
+}
+
+// Test declarations of the languages tests are generated for
+var testFunctionPattern = map[string]*regexp.Regexp{
+	".go":   regexp.MustCompile(`(?m)^func (?:Test|Benchmark|Fuzz)\w*\(`),
+	".js":   regexp.MustCompile(`(?m)^\s*(?:it|test)(?:\.each\([^)]*\))?\(`),
+	".py":   regexp.MustCompile(`(?m)^\s*(?:async )?def test_?\w*\(`),
+	".java": regexp.MustCompile(`@(?:Test|ParameterizedTest)\b`),
+	".rs":   regexp.MustCompile(`#\[(?:tokio::)?test\]`),
+}
+
+func init() {
+	for _, ext := range []string{".ts", ".tsx", ".jsx", ".mjs"} {
+		testFunctionPattern[ext] = testFunctionPattern[".js"]
+	}
+	testFunctionPattern[".kt"] = testFunctionPattern[".java"]
+}
+
+// countTestFunctions counts the tests declared in a generated file
+func countTestFunctions(filePath, content string) int {
+	pattern, ok := testFunctionPattern[strings.ToLower(path.Ext(filePath))]
+	if !ok {
+		return 0
+	}
+	return len(pattern.FindAllStringIndex(content, -1))
+}
+
+// runOutcomeHandler serves POST /api/runs/{id}/outcome, reported once the
+// generated files have been reviewed. Reporting again replaces the outcome.
+func runOutcomeHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req runOutcomeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	var run Run
+	if err := loadJSON("runs", runID, &run); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+
+	artifacts := map[string]GeneratedArtifact{}
+	for _, artifact := range run.Response.Artifacts {
+		artifacts[artifact.Path] = artifact
+	}
+	files := req.Files
+	if len(files) == 0 {
+		for _, artifact := range run.Response.Artifacts {
+			files = append(files, artifact.Path)
+		}
+	}
+	var errs fieldErrors
+	outcome := RunOutcome{MergedFiles: []string{}, PullRequest: req.PullRequest, RecordedAt: time.Now().UTC()}
+	for i, file := range files {
+		artifact, ok := artifacts[file]
+		if !ok {
+			errs.add(fmt.Sprintf("files[%d]", i), "artifact", "%s is not a file of run %s", file, runID)
+			continue
+		}
+		outcome.MergedFiles = append(outcome.MergedFiles, file)
+		outcome.MergedTests += countTestFunctions(artifact.Path, artifact.Content)
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if req.MergedTests != nil {
+		outcome.MergedTests = *req.MergedTests
+	}
+
+	run.Outcome = &outcome
+	if err := saveJSON("runs", run.ID, run); err != nil {
+		log.Printf("Error saving outcome of run %s: %v", run.ID, err)
+		http.Error(w, "Failed to save outcome", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Run %s: %d files with %d tests merged", run.ID, len(outcome.MergedFiles), outcome.MergedTests)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(outcome)
+}
+
+// runCoverageSamples maps run ids to the static coverage samples recorded
+// for them, one per source repository
+func runCoverageSamples() (map[string][]repoSample, error) {
+	ids, err := listJSON("coverage")
+	if err != nil {
+		return nil, err
+	}
+	samples := map[string][]repoSample{}
+	for _, id := range ids {
+		var history RepoCoverage
+		if err := loadJSON("coverage", id, &history); err != nil {
+			log.Printf("Warning: Could not read coverage %s: %v", id, err)
+			continue
+		}
+		for _, sample := range history.Samples {
+			if sample.Method == "static" && sample.RunID != "" {
+				samples[sample.RunID] = append(samples[sample.RunID], repoSample{history.Owner + "/" + history.Repo, sample})
+			}
+		}
+	}
+	return samples, nil
+}
+
+type repoSample struct {
+	repo   string
+	sample CoverageSample
+}
+
+// gapsClosed counts the untested functions the merged files refer to,
+// capped by what all generated files together cover
+func gapsClosed(sample CoverageSample, merged []string) int {
+	closed := 0
+	for _, file := range merged {
+		closed += sample.GapsClosedBy[file]
+	}
+	if limit := sample.ProjectedCovered - sample.Covered; closed > limit {
+		closed = limit
+	}
+	return closed
+}
+
+// teamMetrics aggregates the runs created in [since, until), until zero
+// meaning now
+func teamMetrics(since, until time.Time) (map[string]*TeamMetrics, map[string]map[string]*RepoMetrics, error) {
+	ids, err := listJSON("runs")
+	if err != nil {
+		return nil, nil, err
+	}
+	samples, err := runCoverageSamples()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	teams := map[string]*TeamMetrics{}
+	repos := map[string]map[string]*RepoMetrics{}
+	for _, id := range ids {
+		var run Run
+		if err := loadJSON("runs", id, &run); err != nil || run.Response == nil {
+			continue
+		}
+		if run.CreatedAt.Before(since) || (!until.IsZero() && !run.CreatedAt.Before(until)) {
+			continue
+		}
+		team := run.Tenant
+		if team == "" {
+			team = unassignedTeam
+		}
+		metrics := teams[team]
+		if metrics == nil {
+			metrics = &TeamMetrics{Team: team}
+			teams[team] = metrics
+			repos[team] = map[string]*RepoMetrics{}
+		}
+		metrics.Runs++
+		metrics.TestsGenerated += len(run.Response.TestCases)
+		metrics.FilesGenerated += len(run.Response.Artifacts)
+		if metrics.LastRunAt == nil || run.CreatedAt.After(*metrics.LastRunAt) {
+			createdAt := run.CreatedAt
+			metrics.LastRunAt = &createdAt
+		}
+
+		// Runs without a coverage sample still count for their sources
+		runRepos := samples[run.ID]
+		if len(runRepos) == 0 && run.Response.Provenance != nil {
+			for _, source := range strings.Split(run.Response.Provenance.Source, ",") {
+				if owner, repo, _, ok := parseSource(source); ok {
+					runRepos = append(runRepos, repoSample{repo: owner + "/" + repo})
+				}
+			}
+		}
+		for _, rs := range runRepos {
+			if repos[team][rs.repo] == nil {
+				repos[team][rs.repo] = &RepoMetrics{Repo: rs.repo}
+			}
+			repos[team][rs.repo].Runs++
+		}
+
+		if run.Outcome == nil || len(run.Outcome.MergedFiles) == 0 {
+			continue
+		}
+		metrics.RunsMerged++
+		metrics.TestsMerged += run.Outcome.MergedTests
+		metrics.FilesMerged += len(run.Outcome.MergedFiles)
+		for i, rs := range runRepos {
+			repo := repos[team][rs.repo]
+			repo.TestsMerged += run.Outcome.MergedTests
+			if rs.sample.Total == 0 {
+				continue
+			}
+			closed := gapsClosed(rs.sample, run.Outcome.MergedFiles)
+			gained := float64(closed) * 100 / float64(rs.sample.Total)
+			repo.GapsClosed += closed
+			repo.CoverageGained += gained
+			metrics.CoverageGained += gained
+			// Multi-repo contexts are measured as a whole, count the gaps once
+			if i == 0 {
+				metrics.GapsClosed += closed
+			}
+		}
+	}
+
+	for team, metrics := range teams {
+		metrics.MergeRate = math.Round(float64(metrics.RunsMerged)*1000/float64(metrics.Runs)) / 1000
+		metrics.CoverageGained = math.Round(metrics.CoverageGained*10) / 10
+		for _, repo := range repos[team] {
+			repo.CoverageGained = math.Round(repo.CoverageGained*10) / 10
+		}
+	}
+	return teams, repos, nil
+}
+
+func sortValue(metrics *TeamMetrics, by string) float64 {
+	switch by {
+	case "gapsClosed":
+		return float64(metrics.GapsClosed)
+	case "coverageGained":
+		return metrics.CoverageGained
+	case "runs":
+		return float64(metrics.Runs)
+	}
+	return float64(metrics.TestsMerged)
+}
+
+// analyticsHandler serves the team leaderboard and the metrics of a team:
+//
+//	GET /api/analytics/teams?since=2026-01-01&until=2026-04-01&sort=gapsClosed
+//	GET /api/analytics/teams/{team}?since=2026-01-01
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/analytics/"), "/"), "/")
+	if parts[0] != "teams" || len(parts) > 2 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var errs fieldErrors
+	since, err := parseTimeQuery("since", query.Get("since"))
+	if err != nil {
+		errs.add("since", "format", "%v", err)
+	}
+	until, err := parseTimeQuery("until", query.Get("until"))
+	if err != nil {
+		errs.add("until", "format", "%v", err)
+	}
+	sortBy := query.Get("sort")
+	if sortBy != "" {
+		errs.oneOf("sort", sortBy, analyticsSorts...)
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	teams, repos, err := teamMetrics(since, until)
+	if err != nil {
+		log.Printf("Error aggregating team metrics: %v", err)
+		http.Error(w, "Failed to read runs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(parts) == 2 {
+		metrics, ok := teams[parts[1]]
+		if !ok {
+			metrics = &TeamMetrics{Team: parts[1]}
+		}
+		metrics.Repositories = []RepoMetrics{}
+		for _, repo := range repos[parts[1]] {
+			metrics.Repositories = append(metrics.Repositories, *repo)
+		}
+		sort.Slice(metrics.Repositories, func(i, j int) bool {
+			return metrics.Repositories[i].Repo < metrics.Repositories[j].Repo
+		})
+		json.NewEncoder(w).Encode(metrics)
+		return
+	}
+
+	leaderboard := make([]*TeamMetrics, 0, len(teams))
+	for _, metrics := range teams {
+		leaderboard = append(leaderboard, metrics)
+	}
+	sort.Slice(leaderboard, func(i, j int) bool {
+		a, b := sortValue(leaderboard[i], sortBy), sortValue(leaderboard[j], sortBy)
+		if a != b {
+			return a > b
+		}
+		return leaderboard[i].Team < leaderboard[j].Team
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{"teams": leaderboard})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Claude is called through Anthropic's Messages API. Unlike the other
+// providers it requires max_tokens on every request and answers with a
+// list of content blocks rather than a single text.
+
+const (
+	claudeModel       = "claude-3-5-haiku-latest"
+	claudeSonnetModel = "claude-3-5-sonnet-latest"
+	anthropicVersion  = "2023-06-01"
+)
+
+// claudeProvider calls Anthropic's Messages API
+type claudeProvider struct{}
+
+func (claudeProvider) Name() string { return "claude" }
+func (claudeProvider) Tiers() ModelTiers {
+	return ModelTiers{Standard: claudeModel, LongContext: claudeSonnetModel}
+}
+
+func (claudeProvider) GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error) {
+	requestBody := map[string]interface{}{
+		"model":      opts.Model,
+		"max_tokens": opts.MaxOutputTokens,
+		"messages": []map[string]interface{}{
+			{
+				"role": "user",
+				"content": []map[string]string{
+					{"type": "text", "text": prompt},
+				},
+			},
+		},
+		"temperature": 0.7,
+	}
+
+	header := http.Header{}
+	header.Set("x-api-key", opts.APIKey)
+	header.Set("anthropic-version", anthropicVersion)
+	body, err := postProvider(ctx, "Claude", "https://api.anthropic.com/v1/messages", header, requestBody, opts.Meter)
+	if err != nil {
+		return "", err
+	}
+
+	var message struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return "", errors.New("Failed to parse Claude response")
+	}
+
+	// Record token usage, falling back to the streamed estimate
+	opts.Meter.record(message.Usage.InputTokens, message.Usage.OutputTokens)
+
+	// The text may be split over several blocks
+	var text strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", errors.New("Invalid Claude response format")
+	}
+	// Cut off JSON never parses, say why instead
+	if message.StopReason == "max_tokens" {
+		return "", fmt.Errorf("Claude stopped at the limit of %d output tokens", opts.MaxOutputTokens)
+	}
+	return text.String(), nil
+}
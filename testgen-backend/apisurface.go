@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"path"
+	"sort"
+	"strings"
+)
+
+// renderAPISurface lists the exported identifiers and signatures of a
+// package, one per line and sorted. apiSurfaceTestTemplate carries a copy of
+// this function, keep the two in sync or the golden files will not match.
+func renderAPISurface(fset *token.FileSet, files []*ast.File) string {
+	var lines []string
+	node := func(n ast.Node) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, n)
+		return strings.Join(strings.Fields(buf.String()), " ")
+	}
+
+	exportedTypes := map[string]bool{}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			if decl, ok := d.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					if s := spec.(*ast.TypeSpec); s.Name.IsExported() {
+						exportedTypes[s.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, f := range files {
+		for _, d := range f.Decls {
+			switch decl := d.(type) {
+			case *ast.FuncDecl:
+				if !decl.Name.IsExported() {
+					continue
+				}
+				sig := strings.TrimPrefix(node(decl.Type), "func")
+				if decl.Recv == nil || len(decl.Recv.List) == 0 {
+					lines = append(lines, "func "+decl.Name.Name+sig)
+					continue
+				}
+				recv := decl.Recv.List[0].Type
+				base := recv
+				if star, ok := base.(*ast.StarExpr); ok {
+					base = star.X
+				}
+				if index, ok := base.(*ast.IndexExpr); ok {
+					base = index.X
+				}
+				if index, ok := base.(*ast.IndexListExpr); ok {
+					base = index.X
+				}
+				if ident, ok := base.(*ast.Ident); ok && exportedTypes[ident.Name] {
+					lines = append(lines, "method ("+node(recv)+") "+decl.Name.Name+sig)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if !s.Name.IsExported() {
+							continue
+						}
+						switch t := s.Type.(type) {
+						case *ast.StructType:
+							lines = append(lines, "type "+s.Name.Name+" struct")
+							for _, field := range t.Fields.List {
+								if len(field.Names) == 0 {
+									lines = append(lines, "embed "+s.Name.Name+" "+node(field.Type))
+								}
+								for _, name := range field.Names {
+									if name.IsExported() {
+										lines = append(lines, "field "+s.Name.Name+"."+name.Name+" "+node(field.Type))
+									}
+								}
+							}
+						case *ast.InterfaceType:
+							lines = append(lines, "type "+s.Name.Name+" interface")
+							for _, method := range t.Methods.List {
+								if len(method.Names) == 0 {
+									lines = append(lines, "embed "+s.Name.Name+" "+node(method.Type))
+								}
+								for _, name := range method.Names {
+									lines = append(lines, "method "+s.Name.Name+"."+name.Name+strings.TrimPrefix(node(method.Type), "func"))
+								}
+							}
+						default:
+							lines = append(lines, "type "+s.Name.Name+" "+node(s.Type))
+						}
+					case *ast.ValueSpec:
+						for _, name := range s.Names {
+							if !name.IsExported() {
+								continue
+							}
+							line := decl.Tok.String() + " " + name.Name
+							if s.Type != nil {
+								line += " " + node(s.Type)
+							}
+							lines = append(lines, line)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+type libraryPackage struct {
+	Dir   string
+	Name  string
+	Files []*ast.File
+}
+
+// findLibraryPackages groups the Go files of the context by directory and
+// keeps the importable packages: not main, not internal, not tests
+func findLibraryPackages(codeContext string) (*token.FileSet, []libraryPackage) {
+	return libraryPackages(splitContextFiles(codeContext))
+}
+
+// libraryPackages is findLibraryPackages over files
+func libraryPackages(files []FileContent) (*token.FileSet, []libraryPackage) {
+	fset, goFiles := parseGoFiles(files)
+	byDir := map[string]*libraryPackage{}
+
+	for _, goFile := range goFiles {
+		filePath := slashPath(goFile.Path)
+		name := goFile.File.Name.Name
+		if strings.HasSuffix(filePath, "_test.go") || name == "main" || strings.HasSuffix(name, "_test") {
+			continue
+		}
+		dir := path.Dir(filePath)
+		if dir == "internal" || strings.HasPrefix(dir, "internal/") || strings.Contains(dir, "/internal/") || strings.HasSuffix(dir, "/internal") {
+			continue
+		}
+		pkg, ok := byDir[dir]
+		if !ok {
+			pkg = &libraryPackage{Dir: dir, Name: name}
+			byDir[dir] = pkg
+		}
+		if pkg.Name == name {
+			pkg.Files = append(pkg.Files, goFile.File)
+		}
+	}
+
+	var packages []libraryPackage
+	for _, pkg := range byDir {
+		if strings.TrimSpace(renderAPISurface(fset, pkg.Files)) != "" {
+			packages = append(packages, *pkg)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Dir < packages[j].Dir
+	})
+	return fset, packages
+}
+
+func findLibraryPackageDirs(codeContext string) []string {
+	_, packages := findLibraryPackages(codeContext)
+	var dirs []string
+	for _, pkg := range packages {
+		dirs = append(dirs, pkg.Dir)
+	}
+	return dirs
+}
+
+// apiSurfaceArtifacts emits a golden API surface snapshot and the test
+// asserting it for every library package in the context
+func apiSurfaceArtifacts(codeContext string) []GeneratedArtifact {
+	fset, packages := findLibraryPackages(codeContext)
+	var artifacts []GeneratedArtifact
+
+	for _, pkg := range packages {
+		artifacts = append(artifacts,
+			GeneratedArtifact{
+				Type:        "api-surface",
+				Path:        path.Join(pkg.Dir, "api_surface_test.go"),
+				Language:    "go",
+				Description: fmt.Sprintf("Golden public API surface test for package %s", pkg.Name),
+				Content:     fmt.Sprintf(apiSurfaceTestTemplate, pkg.Name),
+			},
+			GeneratedArtifact{
+				Type:        "api-surface",
+				Path:        path.Join(pkg.Dir, "testdata", "api_surface.golden"),
+				Description: fmt.Sprintf("Exported identifiers and signatures of package %s", pkg.Name),
+				Content:     renderAPISurface(fset, pkg.Files),
+			},
+		)
+	}
+
+	return artifacts
+}
+
+const apiSurfaceTestTemplate = `package %s
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateAPISurface = flag.Bool("update-api-surface", false, "rewrite testdata/api_surface.golden")
+
+// TestAPISurface fails when an exported identifier or signature changes.
+// Run with -update-api-surface after an intentional API change.
+func TestAPISurface(t *testing.T) {
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, p := range paths {
+		if strings.HasSuffix(p, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, p, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	got := renderAPISurface(fset, files)
+
+	golden := filepath.Join("testdata", "api_surface.golden")
+	if *updateAPISurface {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("reading golden file: %%v (run with -update-api-surface to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("exported API changed:\n--- want\n%%s\n+++ got\n%%s", want, got)
+	}
+}
+
+func renderAPISurface(fset *token.FileSet, files []*ast.File) string {
+	var lines []string
+	node := func(n ast.Node) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, n)
+		return strings.Join(strings.Fields(buf.String()), " ")
+	}
+
+	exportedTypes := map[string]bool{}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			if decl, ok := d.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					if s := spec.(*ast.TypeSpec); s.Name.IsExported() {
+						exportedTypes[s.Name.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, f := range files {
+		for _, d := range f.Decls {
+			switch decl := d.(type) {
+			case *ast.FuncDecl:
+				if !decl.Name.IsExported() {
+					continue
+				}
+				sig := strings.TrimPrefix(node(decl.Type), "func")
+				if decl.Recv == nil || len(decl.Recv.List) == 0 {
+					lines = append(lines, "func "+decl.Name.Name+sig)
+					continue
+				}
+				recv := decl.Recv.List[0].Type
+				base := recv
+				if star, ok := base.(*ast.StarExpr); ok {
+					base = star.X
+				}
+				if index, ok := base.(*ast.IndexExpr); ok {
+					base = index.X
+				}
+				if index, ok := base.(*ast.IndexListExpr); ok {
+					base = index.X
+				}
+				if ident, ok := base.(*ast.Ident); ok && exportedTypes[ident.Name] {
+					lines = append(lines, "method ("+node(recv)+") "+decl.Name.Name+sig)
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if !s.Name.IsExported() {
+							continue
+						}
+						switch t := s.Type.(type) {
+						case *ast.StructType:
+							lines = append(lines, "type "+s.Name.Name+" struct")
+							for _, field := range t.Fields.List {
+								if len(field.Names) == 0 {
+									lines = append(lines, "embed "+s.Name.Name+" "+node(field.Type))
+								}
+								for _, name := range field.Names {
+									if name.IsExported() {
+										lines = append(lines, "field "+s.Name.Name+"."+name.Name+" "+node(field.Type))
+									}
+								}
+							}
+						case *ast.InterfaceType:
+							lines = append(lines, "type "+s.Name.Name+" interface")
+							for _, method := range t.Methods.List {
+								if len(method.Names) == 0 {
+									lines = append(lines, "embed "+s.Name.Name+" "+node(method.Type))
+								}
+								for _, name := range method.Names {
+									lines = append(lines, "method "+s.Name.Name+"."+name.Name+strings.TrimPrefix(node(method.Type), "func"))
+								}
+							}
+						default:
+							lines = append(lines, "type "+s.Name.Name+" "+node(s.Type))
+						}
+					case *ast.ValueSpec:
+						for _, name := range s.Names {
+							if !name.IsExported() {
+								continue
+							}
+							line := decl.Tok.String() + " " + name.Name
+							if s.Type != nil {
+								line += " " + node(s.Type)
+							}
+							lines = append(lines, line)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+`
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Azure OpenAI serves OpenAI's models from the customer's own Azure
+// resource, for enterprises whose code may not leave their tenancy. The
+// resource endpoint, deployment and api-version come from the request or
+// from TESTGEN_AZURE_OPENAI_ENDPOINT, TESTGEN_AZURE_OPENAI_DEPLOYMENT and
+// TESTGEN_AZURE_OPENAI_API_VERSION.
+
+const defaultAzureAPIVersion = "2024-10-21"
+
+var (
+	validAzureDeployment = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+	validAzureAPIVersion = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(-preview)?$`)
+)
+
+// azureProvider calls the chat completions API of an Azure OpenAI resource
+type azureProvider struct{}
+
+func (azureProvider) Name() string { return "azure" }
+
+// Deployments are commonly named after their model, the tier's model is
+// the deployment called unless one is configured
+func (azureProvider) Tiers() ModelTiers {
+	return ModelTiers{Standard: openAIModel, LongContext: openAILongContextModel}
+}
+
+func (azureProvider) DefaultEndpoint() string { return os.Getenv("TESTGEN_AZURE_OPENAI_ENDPOINT") }
+
+func (p azureProvider) GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = p.DefaultEndpoint()
+	}
+	deployment := firstNonEmpty(opts.Deployment, os.Getenv("TESTGEN_AZURE_OPENAI_DEPLOYMENT"), opts.Model)
+	apiVersion := firstNonEmpty(opts.APIVersion, os.Getenv("TESTGEN_AZURE_OPENAI_API_VERSION"), defaultAzureAPIVersion)
+	completionsURL := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		strings.TrimSuffix(endpoint, "/"), url.PathEscape(deployment), url.QueryEscape(apiVersion))
+
+	// The deployment picks the model, the body names none
+	requestBody := map[string]interface{}{
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+		"temperature": 0.7,
+		"max_tokens":  opts.MaxOutputTokens,
+	}
+	if opts.Logprobs && chatLogprobs(deployment) {
+		requestBody["logprobs"] = true
+	}
+
+	header := http.Header{}
+	header.Set("api-key", opts.APIKey)
+	body, err := postProvider(ctx, "Azure OpenAI", completionsURL, header, requestBody, opts.Meter)
+	if err != nil {
+		return "", err
+	}
+	return parseChatCompletion(body, "Azure OpenAI", opts.Meter)
+}
+
+// validateAzure checks the deployment and api-version of a request, which
+// only Azure OpenAI takes
+func validateAzure(errs *fieldErrors, req *GeminiRequest) {
+	if _, ok := req.provider().(azureProvider); !ok {
+		if req.Deployment != "" {
+			errs.add("deployment", "unsupported", "deployment is only used by the azure provider")
+		}
+		if req.APIVersion != "" {
+			errs.add("apiVersion", "unsupported", "apiVersion is only used by the azure provider")
+		}
+		return
+	}
+	if req.Deployment != "" && !validAzureDeployment.MatchString(req.Deployment) {
+		errs.add("deployment", "deployment", "deployment must be an Azure OpenAI deployment name")
+	}
+	if req.APIVersion != "" && !validAzureAPIVersion.MatchString(req.APIVersion) {
+		errs.add("apiVersion", "api_version", "apiVersion must be a date such as %s, optionally with -preview", defaultAzureAPIVersion)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
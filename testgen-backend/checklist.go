@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Every run carries a checklist for its reviewers: what the model assumed,
+// which expected values nobody computed by running the code, which mocks
+// stand in for real dependencies and what the analysis warned about. It is
+// derived from the run alone, without a model call, and served as markdown
+// by GET /api/runs/{id}/checklist.
+
+// ReviewItem is one thing a reviewer of a run should check by hand
+type ReviewItem struct {
+	// assumption, unverified-expected, mock, service or warning
+	Category string   `json:"category"`
+	File     string   `json:"file,omitempty"`
+	TestIDs  []string `json:"testIds,omitempty"`
+	Item     string   `json:"item"`
+}
+
+var reviewCategoryTitles = []struct{ category, title string }{
+	{"assumption", "Assumptions the model made"},
+	{"unverified-expected", "Expected values not verified by execution"},
+	{"mock", "Mocks and fakes"},
+	{"service", "Required services"},
+	{"warning", "Analysis warnings"},
+}
+
+var (
+	// Descriptions that admit to a guess
+	assumptionWords = regexp.MustCompile(`(?i)\b(assum\w*|presumabl\w*|probabl\w*|hypothetical\w*|if (?:it|this|the \w+) exists)\b`)
+	// Test doubles across the common test libraries
+	mockPattern = regexp.MustCompile(`gomock\.NewController|mock\.Mock\b|jest\.(?:mock|fn|spyOn)\(|\bMagicMock\b|\bMock\(|mock\.patch|@patch\(|\bpatch\(\s*['"]|sinon\.(?:stub|mock|fake|spy)|vi\.(?:mock|fn|spyOn)\(|Mockito\.|@Mock\b|httptest\.NewServer|\b\w*(?:Fake|Mock|Stub)[A-Z]\w*`)
+)
+
+// Tests and doubles named in one checklist item, the rest are counted or
+// left out
+const maxReviewItemTests = 8
+
+// buildReviewChecklist lists what a reviewer should check in a generated
+// response
+func buildReviewChecklist(resp *GeminiResponse) []ReviewItem {
+	var items []ReviewItem
+	names := map[string]string{}
+	for _, testCase := range resp.TestCases {
+		names[testCase.ID] = testCase.Name
+	}
+	testList := func(ids []string) string {
+		var list []string
+		for i, id := range ids {
+			if i == maxReviewItemTests {
+				list = append(list, fmt.Sprintf("%d more", len(ids)-i))
+				break
+			}
+			list = append(list, "`"+names[id]+"`")
+		}
+		return strings.Join(list, ", ")
+	}
+
+	// Assumptions
+	for _, refactor := range resp.RefactorSuggestions {
+		items = append(items, ReviewItem{
+			Category: "assumption",
+			File:     refactor.File,
+			TestIDs:  refactor.TestIDs,
+			Item:     fmt.Sprintf("The tests assume a change to the code that is not made yet: %s", refactor.Description),
+		})
+	}
+	var unplaced []string
+	for _, testCase := range resp.TestCases {
+		if testCase.SuggestedPath == "" {
+			unplaced = append(unplaced, testCase.ID)
+		}
+		if match := assumptionWords.FindString(testCase.Description); match != "" {
+			items = append(items, ReviewItem{
+				Category: "assumption",
+				File:     testCase.SuggestedPath,
+				TestIDs:  []string{testCase.ID},
+				Item:     fmt.Sprintf("`%s` is written on a guess: %s", testCase.Name, testCase.Description),
+			})
+		}
+	}
+	if len(unplaced) > 0 {
+		items = append(items, ReviewItem{
+			Category: "assumption",
+			TestIDs:  unplaced,
+			Item:     fmt.Sprintf("The code under test of %s was not found in the context, check it exists with the signature the tests call", testList(unplaced)),
+		})
+	}
+
+	// Expected values, by test file. Ones confirmed in the sandbox need no
+	// check, ones it contradicts are listed alone.
+	byFile := map[string][]string{}
+	for _, testCase := range resp.TestCases {
+		if testCase.Expected == nil {
+			continue
+		}
+		switch verification := testCase.Verification; {
+		case verification != nil && verification.Status == "passed":
+		case verification != nil && verification.Status == "failed":
+			items = append(items, ReviewItem{
+				Category: "unverified-expected",
+				File:     testCase.SuggestedPath,
+				TestIDs:  []string{testCase.ID},
+				Item:     fmt.Sprintf("`%s` expects a value the code did not return when run, it returned %s; fix the expected value or the code", testCase.Name, verification.Output),
+			})
+		default:
+			byFile[testCase.SuggestedPath] = append(byFile[testCase.SuggestedPath], testCase.ID)
+		}
+	}
+	files := make([]string, 0, len(byFile))
+	for file := range byFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	modelWritten := resp.Provenance != nil && resp.Provenance.Model != ""
+	for _, file := range files {
+		ids := byFile[file]
+		item := fmt.Sprintf("The expected values of %s are placeholders from the skeleton, fill them in", testList(ids))
+		if modelWritten {
+			item = fmt.Sprintf("The expected values of %s were written by the model and not computed by running the code, check them against the specification or compute them with POST /api/sandbox/run", testList(ids))
+		}
+		items = append(items, ReviewItem{Category: "unverified-expected", File: file, TestIDs: ids, Item: item})
+	}
+
+	// Test doubles, in the generated files and the test cases without one
+	doubles := func(code string) []string {
+		var found []string
+		for _, match := range mockPattern.FindAllString(code, -1) {
+			if match = strings.TrimSpace(strings.TrimRight(match, "(")); !containsString(found, match) {
+				found = append(found, match)
+			}
+			if len(found) == maxReviewItemTests {
+				break
+			}
+		}
+		return found
+	}
+	artifactPaths := map[string]bool{}
+	for _, artifact := range resp.Artifacts {
+		artifactPaths[artifact.Path] = true
+		if found := doubles(artifact.Content); len(found) > 0 {
+			items = append(items, ReviewItem{
+				Category: "mock",
+				File:     artifact.Path,
+				Item:     fmt.Sprintf("Uses %s, check each double behaves like the dependency it replaces, including its errors", strings.Join(found, ", ")),
+			})
+		}
+	}
+	for _, testCase := range resp.TestCases {
+		if artifactPaths[testCase.SuggestedPath] {
+			continue
+		}
+		if found := doubles(testCase.Code); len(found) > 0 {
+			items = append(items, ReviewItem{
+				Category: "mock",
+				File:     testCase.SuggestedPath,
+				TestIDs:  []string{testCase.ID},
+				Item:     fmt.Sprintf("`%s` uses %s, check each double behaves like the dependency it replaces, including its errors", testCase.Name, strings.Join(found, ", ")),
+			})
+		}
+	}
+
+	// Services
+	byService := map[string][]string{}
+	var services []string
+	for _, testCase := range resp.TestCases {
+		for _, service := range testCase.Services {
+			if _, ok := byService[service]; !ok {
+				services = append(services, service)
+			}
+			byService[service] = append(byService[service], testCase.ID)
+		}
+	}
+	for _, service := range services {
+		items = append(items, ReviewItem{
+			Category: "service",
+			TestIDs:  byService[service],
+			Item:     fmt.Sprintf("%s is needed by %s, check the schema, data and configuration the tests assume match the real one", service, testList(byService[service])),
+		})
+	}
+
+	for _, warning := range resp.Warnings {
+		items = append(items, ReviewItem{
+			Category: "warning",
+			File:     warning.File,
+			TestIDs:  warning.TestIDs,
+			Item:     fmt.Sprintf("%s: %s", warning.Kind, warning.Message),
+		})
+	}
+	return items
+}
+
+// renderReviewChecklist renders a run's checklist as markdown task lists.
+// Runs recorded before checklists were kept get theirs built here.
+func renderReviewChecklist(run *Run) string {
+	checklist := run.Response.Checklist
+	if checklist == nil {
+		checklist = buildReviewChecklist(run.Response)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Review checklist for run %s\n", run.ID)
+	if len(checklist) == 0 {
+		b.WriteString("\nNothing found that needs a closer look.\n")
+		return b.String()
+	}
+	for _, section := range reviewCategoryTitles {
+		first := true
+		for _, item := range checklist {
+			if item.Category != section.category {
+				continue
+			}
+			if first {
+				fmt.Fprintf(&b, "\n## %s\n\n", section.title)
+				first = false
+			}
+			if item.File != "" {
+				fmt.Fprintf(&b, "- [ ] `%s`: %s\n", item.File, item.Item)
+			} else {
+				fmt.Fprintf(&b, "- [ ] %s\n", item.Item)
+			}
+		}
+	}
+	return b.String()
+}
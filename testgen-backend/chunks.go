@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Repositories whose prompt exceeds the model's context budget are
+// generated in chunks instead of being cut down to fit one call. Files are
+// grouped by directory, which is the package in Go and most other
+// languages, the groups are packed into chunks that fit, the model is
+// called once per chunk and the test cases are merged. Only a directory
+// too large on its own is split between chunks, and only a file too large
+// on its own is shortened, see contextbudget.go.
+
+// Chunks above this many are not generated, the context is shortened to
+// the budget instead
+const maxContextChunks = 16
+
+// contextChunk is the files of one model call of a chunked generation
+type contextChunk struct {
+	Dirs  []string
+	Files []FileContent
+}
+
+// chunkContextFiles packs the files of a context into chunks of about
+// budget tokens, keeping each directory in one chunk where it fits
+func chunkContextFiles(files []FileContent, budget int) []contextChunk {
+	byDir := map[string][]FileContent{}
+	var dirs []string
+	for _, file := range files {
+		dir := path.Dir(slashPath(file.Path))
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], file)
+	}
+	// Neighbouring directories share a chunk more often in path order
+	sort.Strings(dirs)
+
+	var chunks []contextChunk
+	var current contextChunk
+	used := 0
+	flush := func() {
+		if len(current.Files) > 0 {
+			chunks = append(chunks, current)
+		}
+		current = contextChunk{}
+		used = 0
+	}
+	for _, dir := range dirs {
+		dirTokens := 0
+		for _, file := range byDir[dir] {
+			dirTokens += estimateTokens(file.Content)
+		}
+		if used > 0 && used+dirTokens > budget {
+			flush()
+		}
+		current.Dirs = append(current.Dirs, dir)
+		for _, file := range byDir[dir] {
+			tokens := estimateTokens(file.Content)
+			// A directory too large for one chunk continues in the next
+			if used > 0 && used+tokens > budget {
+				flush()
+				current.Dirs = []string{dir}
+			}
+			current.Files = append(current.Files, file)
+			used += tokens
+		}
+	}
+	flush()
+	return chunks
+}
+
+// contextChunks splits the context of a generation whose prompt exceeds
+// the budget, or returns nil when it fits, chunking is off or the chunks
+// would be too many
+func (req GeminiRequest) contextChunks(prompt, standing string, budget int) []contextChunk {
+	if req.Mode == "hybrid" || req.Chunking == "off" || estimateTokens(prompt) <= budget {
+		return nil
+	}
+	// What a chunk's prompt takes besides its files, with a tenth to spare
+	// for the directory names
+	emptyPrompt, _, _ := generationPrompt(chunkRequest(req, contextChunk{}, 0, 1), standing)
+	filesBudget := (budget - estimateTokens(emptyPrompt)) * 9 / 10
+	if filesBudget <= 0 {
+		return nil
+	}
+	chunks := chunkContextFiles(splitContextFiles(req.CodeContext), filesBudget)
+	if len(chunks) > maxContextChunks {
+		log.Printf("Context needs %d chunks, more than %d, shortening it instead", len(chunks), maxContextChunks)
+		return nil
+	}
+	if len(chunks) < 2 {
+		return nil
+	}
+	return chunks
+}
+
+// chunkRequest is the generation request of one chunk, its context holding
+// the chunk's files with the sources and glossary of the whole context
+func chunkRequest(req GeminiRequest, chunk contextChunk, index, count int) GeminiRequest {
+	chunkReq := req
+	extras := contextExtras{Sources: contextSources(req.CodeContext)}
+	chunkReq.CodeContext = attachGlossary(generatePromptContext(chunk.Files, extras), req.Repo)
+	chunkReq.AdditionalPrompt = strings.TrimSpace(req.AdditionalPrompt + fmt.Sprintf(
+		"\n\nThe repository is too large for one request and is split by directory. This is part %d of %d, with %s. Only generate tests for the code in this part; the other parts are tested separately.",
+		index+1, count, strings.Join(chunk.Dirs, ", ")))
+	return chunkReq
+}
+
+// generateChunked generates the test cases of each chunk of a context that
+// does not fit one prompt and merges them. A chunk that fails is reported
+// as a warning as long as another one succeeds. prompt is all prompts
+// sent, for the provenance.
+func generateChunked(req GeminiRequest, standing string, chunks []contextChunk, budget int, meter *tokenMeter) (GeminiResponse, string, []AnalysisWarning, error) {
+	var merged GeminiResponse
+	var prompts strings.Builder
+	var warnings []AnalysisWarning
+	var firstErr error
+	contextTokens := 0
+	seen := map[string]bool{}
+	for i, chunk := range chunks {
+		req.report("model-called", 20+60*i/len(chunks))
+		chunkReq := chunkRequest(req, chunk, i, len(chunks))
+		prompt, _, _, budgetWarnings, err := fitPromptContext(chunkReq, standing, budget)
+		var chunkResponse GeminiResponse
+		if err == nil {
+			contextTokens = max(contextTokens, estimateTokens(prompt))
+			prompts.WriteString(prompt)
+			var generatedText string
+			generatedText, err = generateTestCases(chunkReq, prompt, meter)
+			if err == nil {
+				chunkResponse, err = parseTestResponse(generatedText)
+			}
+		}
+		var busy *providerBusyError
+		if errors.As(err, &busy) || errors.Is(err, errOutputBudgetExceeded) {
+			// The remaining chunks would fail the same way
+			return GeminiResponse{}, "", nil, err
+		}
+		if err != nil {
+			log.Printf("Chunk %d of %d failed: %v", i+1, len(chunks), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "chunk",
+				Message: fmt.Sprintf("part %d of %d (%s) failed, its code has no tests: %v", i+1, len(chunks), strings.Join(chunk.Dirs, ", "), err),
+			})
+			continue
+		}
+		warnings = append(warnings, budgetWarnings...)
+		mergeChunkResponse(&merged, chunkResponse, seen)
+	}
+	if len(merged.TestCases) == 0 && firstErr != nil {
+		return GeminiResponse{}, "", nil, firstErr
+	}
+	meter.recordContext(contextTokens, budget)
+	// Ids are numbered again across the chunks
+	for i := range merged.TestCases {
+		merged.TestCases[i].ID = ""
+	}
+	countTestSummary(&merged)
+	return merged, prompts.String(), warnings, nil
+}
+
+// mergeChunkResponse adds the test cases and files of a chunk, leaving out
+// test cases an earlier chunk already has and files it already wrote
+func mergeChunkResponse(merged *GeminiResponse, chunk GeminiResponse, seen map[string]bool) {
+	for _, testCase := range chunk.TestCases {
+		key := chunkTestKey(testCase)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged.TestCases = append(merged.TestCases, testCase)
+	}
+	merged.RefactorSuggestions = append(merged.RefactorSuggestions, chunk.RefactorSuggestions...)
+	for _, artifact := range chunk.Artifacts {
+		if key := "artifact\x00" + artifact.Path; !seen[key] {
+			seen[key] = true
+			merged.Artifacts = append(merged.Artifacts, artifact)
+		}
+	}
+}
+
+// chunkTestKey identifies a test case across chunks: the same name for the
+// same test file, or the same code
+func chunkTestKey(testCase GeminiTestCase) string {
+	if testCase.Name != "" {
+		return "name\x00" + testCase.SuggestedPath + "\x00" + strings.ToLower(testCase.Name)
+	}
+	return "code\x00" + strings.Join(strings.Fields(testCase.Code), " ")
+}
+
+// countTestSummary counts the test cases of a response by type
+func countTestSummary(response *GeminiResponse) {
+	response.Summary.TotalTests = len(response.TestCases)
+	response.Summary.UnitTests = 0
+	response.Summary.IntegrationTests = 0
+	response.Summary.EdgeCases = 0
+	response.Summary.ErrorHandlingTests = 0
+	for _, testCase := range response.TestCases {
+		switch testCase.TestType {
+		case "integration":
+			response.Summary.IntegrationTests++
+		case "edge-case":
+			response.Summary.EdgeCases++
+		case "error-handling":
+			response.Summary.ErrorHandlingTests++
+		default:
+			response.Summary.UnitTests++
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Runs are published back to GitLab and Bitbucket from their pipelines:
+// the run archive is uploaded next to the project and a comment
+// summarizing it is posted on the merge or pull request. The CI templates
+// served under /api/ci/ do the whole round trip from a pipeline.
+
+var publishProviders = []string{"gitlab", "bitbucket"}
+
+// publishRunRequest is the body of POST /api/runs/{id}/publish
+type publishRunRequest struct {
+	Provider string `json:"provider"`
+	// GitLab project id or path, or Bitbucket workspace/repo
+	Project string `json:"project"`
+	// Merge request iid or pull request id to comment on, 0 skips the comment
+	MergeRequest int `json:"mergeRequest,omitempty"`
+	// Defaults to TESTGEN_GITLAB_TOKEN or TESTGEN_BITBUCKET_TOKEN
+	Token string `json:"token,omitempty"`
+	// GitLab instance URL, defaults to https://gitlab.com, or Bitbucket API
+	// URL, defaults to https://api.bitbucket.org/2.0
+	BaseURL string `json:"baseUrl,omitempty"`
+	// Upload the run archive, defaults to true
+	UploadArtifacts *bool `json:"uploadArtifacts,omitempty"`
+}
+
+func (req *publishRunRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.required("provider", req.Provider)
+	errs.oneOf("provider", req.Provider, publishProviders...)
+	errs.required("project", req.Project)
+	if req.Provider == "bitbucket" && strings.Count(req.Project, "/") != 1 {
+		errs.add("project", "workspace_repo", "project must be workspace/repo for bitbucket")
+	}
+	errs.min("mergeRequest", req.MergeRequest, 0)
+	if req.BaseURL != "" {
+		if u, err := url.Parse(req.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("baseUrl", "url", "baseUrl must be an http or https URL")
+		}
+	}
+	return errs
+}
+
+// PublishResult lists where a run was published
+type PublishResult struct {
+	Provider    string `json:"provider"`
+	ArtifactURL string `json:"artifactUrl,omitempty"`
+	CommentURL  string `json:"commentUrl,omitempty"`
+}
+
+var publishClient = &http.Client{Timeout: 30 * time.Second}
+
+// publishRunHandler serves POST /api/runs/{id}/publish
+func publishRunHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req publishRunRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Token == "" {
+		req.Token = os.Getenv("TESTGEN_" + strings.ToUpper(req.Provider) + "_TOKEN")
+	}
+	if req.Token == "" {
+		writeFieldErrors(w, fieldErrors{{Field: "token", Constraint: "required", Message: "token is required unless TESTGEN_" + strings.ToUpper(req.Provider) + "_TOKEN is set"}})
+		return
+	}
+
+	var run Run
+	if err := loadJSON("runs", runID, &run); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+
+	accepted, err := acceptedRun(&run)
+	if err != nil {
+		log.Printf("Error selecting the accepted tests of run %s: %v", run.ID, err)
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+	result, err := publishRun(accepted, req)
+	if err != nil {
+		log.Printf("Error publishing run %s to %s: %v", run.ID, req.Provider, err)
+		http.Error(w, fmt.Sprintf("Failed to publish run: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Published run %s to %s %s", run.ID, req.Provider, req.Project)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func publishRun(run *Run, req publishRunRequest) (*PublishResult, error) {
+	result := &PublishResult{Provider: req.Provider}
+	archiveName := fmt.Sprintf("testgen-run-%s.tar.gz", run.ID)
+
+	if req.UploadArtifacts == nil || *req.UploadArtifacts {
+		archive, err := buildRunArchive(run)
+		if err != nil {
+			return nil, err
+		}
+		switch req.Provider {
+		case "gitlab":
+			result.ArtifactURL, err = uploadGitLabPackage(req, run.ID, archiveName, archive)
+		case "bitbucket":
+			result.ArtifactURL, err = uploadBitbucketDownload(req, archiveName, archive)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("uploading archive: %v", err)
+		}
+	}
+
+	if req.MergeRequest > 0 {
+		comment := runComment(run, result.ArtifactURL)
+		var err error
+		switch req.Provider {
+		case "gitlab":
+			result.CommentURL, err = commentGitLabMergeRequest(req, comment)
+		case "bitbucket":
+			result.CommentURL, err = commentBitbucketPullRequest(req, comment)
+		}
+		if err != nil {
+			return result, fmt.Errorf("commenting: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// sendPublishRequest sends one request to a provider API, decoding a JSON
+// response into out when given
+func sendPublishRequest(req *http.Request, out interface{}) error {
+	resp, err := publishClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func gitlabBaseURL(req publishRunRequest) string {
+	if req.BaseURL != "" {
+		return strings.TrimSuffix(req.BaseURL, "/")
+	}
+	return "https://gitlab.com"
+}
+
+func gitlabProjectURL(req publishRunRequest) string {
+	return gitlabBaseURL(req) + "/api/v4/projects/" + url.PathEscape(req.Project)
+}
+
+// uploadGitLabPackage stores the archive in the project's generic package
+// registry, under the run id as the package version
+func uploadGitLabPackage(req publishRunRequest, runID, name string, archive []byte) (string, error) {
+	packageURL := gitlabProjectURL(req) + "/packages/generic/testgen/" + url.PathEscape(runID) + "/" + url.PathEscape(name)
+	httpReq, err := http.NewRequest("PUT", packageURL, bytes.NewReader(archive))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("PRIVATE-TOKEN", req.Token)
+	httpReq.Header.Set("Content-Type", "application/gzip")
+	if err := sendPublishRequest(httpReq, nil); err != nil {
+		return "", err
+	}
+	return packageURL, nil
+}
+
+func commentGitLabMergeRequest(req publishRunRequest, comment string) (string, error) {
+	body, err := json.Marshal(map[string]string{"body": comment})
+	if err != nil {
+		return "", err
+	}
+	notesURL := fmt.Sprintf("%s/merge_requests/%d/notes", gitlabProjectURL(req), req.MergeRequest)
+	httpReq, err := http.NewRequest("POST", notesURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("PRIVATE-TOKEN", req.Token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	var note struct {
+		ID int64 `json:"id"`
+	}
+	if err := sendPublishRequest(httpReq, &note); err != nil {
+		return "", err
+	}
+	// Numeric project ids have no web path, link to the API note instead
+	if _, err := strconv.Atoi(req.Project); err == nil {
+		return fmt.Sprintf("%s/%d", notesURL, note.ID), nil
+	}
+	return fmt.Sprintf("%s/%s/-/merge_requests/%d#note_%d", gitlabBaseURL(req), req.Project, req.MergeRequest, note.ID), nil
+}
+
+func bitbucketRepoURL(req publishRunRequest) string {
+	base := "https://api.bitbucket.org/2.0"
+	if req.BaseURL != "" {
+		base = strings.TrimSuffix(req.BaseURL, "/")
+	}
+	workspace, repo, _ := strings.Cut(req.Project, "/")
+	return base + "/repositories/" + url.PathEscape(workspace) + "/" + url.PathEscape(repo)
+}
+
+// uploadBitbucketDownload attaches the archive to the repository downloads
+func uploadBitbucketDownload(req publishRunRequest, name string, archive []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(archive)
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	downloadsURL := bitbucketRepoURL(req) + "/downloads"
+	httpReq, err := http.NewRequest("POST", downloadsURL, &body)
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+	httpReq.Header.Set("Content-Type", form.FormDataContentType())
+	if err := sendPublishRequest(httpReq, nil); err != nil {
+		return "", err
+	}
+	return downloadsURL + "/" + url.PathEscape(name), nil
+}
+
+func commentBitbucketPullRequest(req publishRunRequest, comment string) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{"content": map[string]string{"raw": comment}})
+	if err != nil {
+		return "", err
+	}
+	commentsURL := fmt.Sprintf("%s/pullrequests/%d/comments", bitbucketRepoURL(req), req.MergeRequest)
+	httpReq, err := http.NewRequest("POST", commentsURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	var created struct {
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	}
+	if err := sendPublishRequest(httpReq, &created); err != nil {
+		return "", err
+	}
+	return created.Links.HTML.Href, nil
+}
+
+// runComment renders the markdown comment posted for a run
+func runComment(run *Run, artifactURL string) string {
+	resp := run.Response
+	var comment strings.Builder
+	comment.WriteString(fmt.Sprintf("### testgen generated %d test cases\n\n", resp.Summary.TotalTests))
+	comment.WriteString("| | |\n|---|---|\n")
+	comment.WriteString(fmt.Sprintf("| Unit | %d |\n", resp.Summary.UnitTests))
+	comment.WriteString(fmt.Sprintf("| Integration | %d |\n", resp.Summary.IntegrationTests))
+	comment.WriteString(fmt.Sprintf("| Edge cases | %d |\n", resp.Summary.EdgeCases))
+	comment.WriteString(fmt.Sprintf("| Error handling | %d |\n", resp.Summary.ErrorHandlingTests))
+	if resp.Provenance != nil && resp.Provenance.Source != "" {
+		comment.WriteString(fmt.Sprintf("| Source | `%s` |\n", resp.Provenance.Source))
+	}
+	comment.WriteString(fmt.Sprintf("| Run | `%s` |\n", run.ID))
+
+	if len(resp.Artifacts) > 0 {
+		comment.WriteString("\nGenerated files:\n\n")
+		for _, artifact := range resp.Artifacts {
+			comment.WriteString(fmt.Sprintf("- `%s` %s\n", artifact.Path, artifact.Description))
+		}
+	}
+	if artifactURL != "" {
+		comment.WriteString(fmt.Sprintf("\nThe files and their signed manifest are in [%s](%s).\n", fmt.Sprintf("testgen-run-%s.tar.gz", run.ID), artifactURL))
+	}
+	return comment.String()
+}
+
+// ciScript builds a context from the checkout, generates tests, keeps the
+// run archive as a job artifact and publishes the run back. The templates
+// map their CI variables onto REPO, SHA and MR first.
+const ciScript = `apk add --no-cache curl jq git >/dev/null
+set -eu
+auth="Authorization: Bearer ${TESTGEN_TOKEN:-}"
+{
+  printf 'Source: %s@%s\n\n' "$REPO" "$SHA"
+  git ls-files -- '*.go' '*.py' '*.js' '*.ts' '*.java' ':!:vendor/*' ':!:node_modules/*' | while IFS= read -r f; do
+    printf '// File: %s\n' "$f"; cat "$f"; printf '\n\n---\n'
+  done
+} > testgen-context.txt
+jq -Rs --arg mode "$TESTGEN_MODE" --arg source "$REPO@$SHA" '{codeContext: ., mode: $mode, source: $source}' testgen-context.txt > testgen-request.json
+curl -sSf -H "$auth" -H 'Content-Type: application/json' --data-binary @testgen-request.json "$TESTGEN_URL/api/v1/generate-tests" > testgen-response.json
+run_id=$(jq -r .runId testgen-response.json)
+curl -sSf -H "$auth" -o testgen-run.tar.gz "$TESTGEN_URL/api/v1/runs/$run_id/archive"
+mkdir -p testgen && tar -xzf testgen-run.tar.gz -C testgen
+jq -n --arg provider "$PROVIDER" --arg project "$PROJECT" --arg mr "${MR:-0}" --arg base "${BASE_URL:-}" --arg token "$PROVIDER_TOKEN" \
+  '{provider: $provider, project: $project, mergeRequest: ($mr | tonumber), baseUrl: $base, token: $token} | with_entries(select(.value != ""))' |
+  curl -sSf -H "$auth" -H 'Content-Type: application/json' --data-binary @- "$TESTGEN_URL/api/v1/runs/$run_id/publish"`
+
+var ciTemplates = map[string]*template.Template{
+	"gitlab": template.Must(template.New("gitlab").Parse(`# testgen GitLab CI component, generated by testgen {{.Version}}
+#
+# Generates tests for merge requests, keeps them as the job artifact
+# testgen/ and comments on the merge request. Save it as
+# templates/testgen.yml in a component project, or include it directly:
+#
+#   include:
+#     - remote: {{.Self}}
+#       inputs:
+#         mode: hybrid
+#
+# Set TESTGEN_GITLAB_TOKEN (api scope) and, with access control,
+# TESTGEN_TOKEN as masked CI/CD variables.
+spec:
+  inputs:
+    url:
+      default: {{.Server}}
+    mode:
+      default: skeleton
+      options: [skeleton, hybrid, llm]
+    stage:
+      default: test
+---
+testgen:
+  stage: $[[ inputs.stage ]]
+  image: alpine:3.20
+  rules:
+    - if: $CI_PIPELINE_SOURCE == "merge_request_event"
+  variables:
+    TESTGEN_URL: $[[ inputs.url ]]
+    TESTGEN_MODE: $[[ inputs.mode ]]
+  script:
+    - |
+      PROVIDER=gitlab PROJECT="$CI_PROJECT_PATH" REPO="$CI_PROJECT_PATH" SHA="$CI_COMMIT_SHA"
+      MR="${CI_MERGE_REQUEST_IID:-0}" BASE_URL="$CI_SERVER_URL" PROVIDER_TOKEN="${TESTGEN_GITLAB_TOKEN:-}"
+{{.Script}}
+  artifacts:
+    name: testgen-$CI_COMMIT_SHORT_SHA
+    paths:
+      - testgen/
+    expire_in: 1 week
+`)),
+	"bitbucket": template.Must(template.New("bitbucket").Parse(`# testgen Bitbucket Pipelines step, generated by testgen {{.Version}}
+#
+# Generates tests for pull requests, keeps them as the step artifact
+# testgen/ and comments on the pull request. Merge it into
+# bitbucket-pipelines.yml and set TESTGEN_BITBUCKET_TOKEN (a repository
+# access token with pull request write access) and, with access control,
+# TESTGEN_TOKEN as secured repository variables.
+definitions:
+  steps:
+    - step: &testgen
+        name: testgen
+        image: alpine:3.20
+        script:
+          - |
+            default_url={{.ShellServer}}
+            TESTGEN_URL="${TESTGEN_URL:-$default_url}" TESTGEN_MODE="${TESTGEN_MODE:-skeleton}"
+            PROVIDER=bitbucket PROJECT="$BITBUCKET_REPO_FULL_NAME" REPO="$BITBUCKET_REPO_FULL_NAME" SHA="$BITBUCKET_COMMIT"
+            MR="${BITBUCKET_PR_ID:-0}" BASE_URL="" PROVIDER_TOKEN="${TESTGEN_BITBUCKET_TOKEN:-}"
+{{.Script}}
+        artifacts:
+          - testgen/**
+
+pipelines:
+  pull-requests:
+    '**':
+      - step: *testgen
+`)),
+}
+
+// ciTemplateHandler serves GET /api/ci/gitlab and GET /api/ci/bitbucket
+func ciTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/ci/"), "/")
+	tmpl, ok := ciTemplates[name]
+	if !ok {
+		http.Error(w, "CI template not found", http.StatusNotFound)
+		return
+	}
+	server, err := hookServerURL(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	indent := "      "
+	if name == "bitbucket" {
+		indent = "            "
+	}
+	var script strings.Builder
+	for _, line := range strings.Split(ciScript, "\n") {
+		script.WriteString(indent + line + "\n")
+	}
+
+	// JSON strings are valid YAML double-quoted scalars
+	quotedServer, _ := json.Marshal(server)
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	tmpl.Execute(w, map[string]string{
+		"Version":     toolVersion,
+		"Server":      string(quotedServer),
+		"ShellServer": shellQuote(server),
+		"Self":        server + "/api/v1/ci/" + name,
+		"Script":      strings.TrimSuffix(script.String(), "\n"),
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Every test case of a run carries a confidence score, so UIs can select
+// the cases likely right and leave the rest for review. It starts from the
+// probability the model gave the tokens of the case, where the provider
+// reports log probabilities, and is lowered by what static checks find:
+// code under test missing from the context, assumed refactors, hedged
+// descriptions and analysis warnings. Requests with verify run the code
+// under test on the case's input in the sandbox, a matching result raises
+// the score and a different one sinks it.
+
+// TestConfidence is how far a test case can be trusted without review
+type TestConfidence struct {
+	Score float64 `json:"score"` // 0 to 1
+	// high, medium or low, UIs select the high ones by default
+	Level   string   `json:"level"`
+	Signals []string `json:"signals,omitempty"` // what the score is made of
+}
+
+// TestVerification is the outcome of calling the code under test with a
+// test case's input in the sandbox
+type TestVerification struct {
+	// passed, failed or error
+	Status string          `json:"status"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+const (
+	highConfidence   = 0.75
+	mediumConfidence = 0.5
+
+	// Score of a model-written case whose provider reports no log
+	// probabilities
+	defaultModelConfidence = 0.7
+	// Score of a skeleton, whose expected values are placeholders
+	skeletonConfidence = 0.3
+
+	// Test cases verified in the sandbox per generation, the rest keep
+	// their expected values unverified
+	maxVerifiedTestCases = 20
+)
+
+// scoreTestCases verifies the test cases of a response when the request
+// asks for it and scores each of them
+func scoreTestCases(resp *GeminiResponse, req GeminiRequest) {
+	if req.Verify {
+		verifyTestCases(resp)
+	}
+	warned := map[string][]string{}
+	for _, warning := range resp.Warnings {
+		for _, id := range warning.TestIDs {
+			if !containsString(warned[id], warning.Kind) {
+				warned[id] = append(warned[id], warning.Kind)
+			}
+		}
+	}
+	modelWritten := resp.Provenance != nil && resp.Provenance.Model != ""
+	for i := range resp.TestCases {
+		resp.TestCases[i].Confidence = testConfidence(&resp.TestCases[i], modelWritten, warned[resp.TestCases[i].ID])
+	}
+}
+
+// testConfidence scores a test case from the signals about it
+func testConfidence(testCase *GeminiTestCase, modelWritten bool, warnings []string) *TestConfidence {
+	var signals []string
+	score := defaultModelConfidence
+	switch {
+	case !modelWritten:
+		score = skeletonConfidence
+		signals = append(signals, "skeleton, its expected values are placeholders")
+	case testCase.tokenProb > 0:
+		score = testCase.tokenProb
+		signals = append(signals, fmt.Sprintf("model token probability %.2f", testCase.tokenProb))
+	}
+	lower := func(by float64, signal string) {
+		score -= by
+		signals = append(signals, signal)
+	}
+
+	// Static checks
+	if testCase.SuggestedPath == "" {
+		lower(0.2, "code under test not found in the context")
+	}
+	if testCase.Refactor != nil {
+		lower(0.15, "assumes a change to the code under test")
+	}
+	if assumptionWords.MatchString(testCase.Description) {
+		lower(0.1, "description admits a guess")
+	}
+	if testCase.Expected == nil && len(testCase.TestVectors) == 0 {
+		lower(0.1, "no expected value")
+	}
+	if len(testCase.Services) > 0 {
+		lower(0.05, "needs "+strings.Join(testCase.Services, ", "))
+	}
+	for i, kind := range warnings {
+		// Warnings beyond the third tell little more
+		if i < 3 {
+			score -= 0.1
+		}
+		signals = append(signals, "warned about: "+kind)
+	}
+
+	if verification := testCase.Verification; verification != nil {
+		switch verification.Status {
+		case "passed":
+			score += (1 - score) * 0.7
+			signals = append(signals, "expected value confirmed by running the code")
+		case "failed":
+			score = math.Min(score, 0.15)
+			signals = append(signals, fmt.Sprintf("the code returned %s when run, not the expected value", verification.Output))
+		default:
+			signals = append(signals, "could not be verified: "+verification.Error)
+		}
+	}
+
+	score = math.Round(math.Max(0, math.Min(1, score))*100) / 100
+	level := "low"
+	if score >= highConfidence {
+		level = "high"
+	} else if score >= mediumConfidence {
+		level = "medium"
+	}
+	return &TestConfidence{Score: score, Level: level, Signals: signals}
+}
+
+// attachTokenProbabilities gives each test case parsed from a response the
+// geometric mean probability of its tokens. The tokens must spell the
+// response, otherwise nothing is attached.
+func attachTokenProbabilities(resp *GeminiResponse, generatedText string, tokens []tokenLogprob) {
+	if len(tokens) == 0 {
+		return
+	}
+	starts := make([]int, len(tokens))
+	offset := 0
+	for i, token := range tokens {
+		starts[i] = offset
+		offset += len(token.Token)
+	}
+	spans := testCaseSpans(generatedText)
+	if offset != len(generatedText) || len(spans) != len(resp.TestCases) {
+		return
+	}
+	next := 0
+	for i, span := range spans {
+		sum, n := 0.0, 0
+		for ; next < len(tokens) && starts[next] < span[1]; next++ {
+			if starts[next] >= span[0] {
+				sum += tokens[next].Logprob
+				n++
+			}
+		}
+		if n > 0 {
+			resp.TestCases[i].tokenProb = math.Exp(sum / float64(n))
+		}
+	}
+}
+
+// testCaseSpans are the offsets of the objects of the testCases array of a
+// response, like testCaseScanner finds them
+func testCaseSpans(text string) [][2]int {
+	key := strings.Index(text, `"testCases"`)
+	if key == -1 {
+		return nil
+	}
+	open := strings.IndexByte(text[key:], '[')
+	if open == -1 {
+		return nil
+	}
+	var spans [][2]int
+	pos := key + open + 1
+	for {
+		for pos < len(text) && strings.IndexByte(" \t\r\n,", text[pos]) != -1 {
+			pos++
+		}
+		if pos == len(text) || text[pos] != '{' {
+			return spans
+		}
+		end := jsonObjectEnd(text, pos)
+		if end == -1 {
+			return spans
+		}
+		spans = append(spans, [2]int{pos, end})
+		pos = end
+	}
+}
+
+// verifyTestCases calls the code under test of the test cases the sandbox
+// can run with their input and compares the result with their expected
+// value
+func verifyTestCases(resp *GeminiResponse) {
+	toolchains := sandboxToolchains()
+	var wg sync.WaitGroup
+	verified := 0
+	for i := range resp.TestCases {
+		testCase := &resp.TestCases[i]
+		sandboxReq, ok := verificationRequest(testCase)
+		if !ok || toolchains[sandboxReq.Language] == "" {
+			continue
+		}
+		if verified == maxVerifiedTestCases {
+			break
+		}
+		verified++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testCase.Verification = runVerification(sandboxReq, testCase.Expected)
+		}()
+	}
+	wg.Wait()
+	if verified > 0 {
+		log.Printf("Verified %d test cases in the sandbox", verified)
+	}
+}
+
+// verificationRequest is the sandbox call of a test case: its code under
+// test called with its input as the argument list, or as the only argument
+// when it is not a list. ok is false for cases the sandbox cannot run.
+func verificationRequest(testCase *GeminiTestCase) (*sandboxRequest, bool) {
+	if testCase.Code == "" || testCase.Expected == nil {
+		return nil, false
+	}
+	var language string
+	switch strings.ToLower(filepath.Ext(testCase.SuggestedPath)) {
+	case ".go":
+		language = "go"
+	case ".js", ".mjs":
+		language = "javascript"
+	case ".py":
+		language = "python"
+	default:
+		return nil, false
+	}
+	args, ok := testCase.Input.([]interface{})
+	if !ok {
+		args = []interface{}{testCase.Input}
+	}
+	if testCase.Input == nil {
+		args = []interface{}{}
+	}
+	input, err := json.Marshal(args)
+	if err != nil {
+		return nil, false
+	}
+	sandboxReq := &sandboxRequest{
+		Language: language,
+		Code:     testCase.Code,
+		Inputs:   []json.RawMessage{input},
+		// The first run of a Go program compiles it to machine code
+		TimeoutMs: maxSandboxTimeoutMs,
+	}
+	if errs := sandboxReq.validate(); len(errs) > 0 {
+		return nil, false
+	}
+	return sandboxReq, true
+}
+
+// runVerification runs a verification request and compares its result
+// with the expected value
+func runVerification(sandboxReq *sandboxRequest, expected interface{}) *TestVerification {
+	response, err := executeSandbox(context.Background(), sandboxReq)
+	if err != nil {
+		return &TestVerification{Status: "error", Error: err.Error()}
+	}
+	result := response.Results[0]
+	if result.Error != "" {
+		return &TestVerification{Status: "error", Error: result.Error}
+	}
+	var output interface{}
+	if err := json.Unmarshal(result.Output, &output); err != nil {
+		return &TestVerification{Status: "error", Error: "the output is not JSON"}
+	}
+	// Models often write structured expected values as JSON text
+	text, _ := expected.(string)
+	if reflect.DeepEqual(output, expected) || text == strings.TrimSpace(string(result.Output)) {
+		return &TestVerification{Status: "passed", Output: result.Output}
+	}
+	return &TestVerification{Status: "failed", Output: result.Output}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Generated Go files are checked against the files of the context and the
+// artifacts before them, so materializing them does not fail to compile
+// on a duplicate symbol. A file that already exists in the same package is
+// merged into, otherwise written next to it under a free name. Top-level
+// names already declared in the package are renamed, TestParse becoming
+// TestParse2 like the skeletons do. Every conflict is reported.
+
+// goPackageKey is a package of a directory, the external test package of a
+// directory is a package of its own
+type goPackageKey struct {
+	Dir  string
+	Name string
+}
+
+type testConflicts struct {
+	files     map[string]string                  // contents by path, of the context and the artifacts so far
+	artifacts map[string]int                     // artifact indexes by path
+	declared  map[goPackageKey]map[string]string // declaring files by top-level name
+}
+
+// declare records the top-level names of a Go file, methods as Type.Method
+func (conflicts *testConflicts) declare(filePath, content string) {
+	file, err := parser.ParseFile(token.NewFileSet(), filePath, content, parser.SkipObjectResolution)
+	if err != nil {
+		return
+	}
+	key := goPackageKey{path.Dir(filePath), file.Name.Name}
+	if conflicts.declared[key] == nil {
+		conflicts.declared[key] = map[string]string{}
+	}
+	for name := range topLevelNames(file) {
+		conflicts.declared[key][name] = filePath
+	}
+}
+
+// topLevelNames lists the package-level names a file declares. init and
+// blank names may repeat and are left out.
+func topLevelNames(file *ast.File) map[string]*ast.Ident {
+	names := map[string]*ast.Ident{}
+	add := func(ident *ast.Ident, name string) {
+		if ident.Name != "_" && name != "init" {
+			names[name] = ident
+		}
+	}
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			add(decl.Name, funcDisplayName(decl))
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						add(name, name.Name)
+					}
+				case *ast.TypeSpec:
+					add(spec.Name, spec.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// freePath is a path next to filePath no file has, the way the skeletons
+// name a second test file of a source file
+func (conflicts *testConflicts) freePath(filePath string) string {
+	base, suffix := strings.TrimSuffix(filePath, "_test.go"), "_test.go"
+	if base == filePath {
+		suffix = path.Ext(filePath)
+		base = strings.TrimSuffix(filePath, suffix)
+	}
+	candidate := filePath
+	for i := 1; ; i++ {
+		if _, taken := conflicts.files[candidate]; !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_gen%d%s", base, i, suffix)
+	}
+}
+
+// resolveTestConflicts merges or moves generated Go files that collide with
+// existing ones and renames the symbols the package already declares. Test
+// cases follow their file and test function.
+func resolveTestConflicts(testResponse *GeminiResponse, codeContext string) []AnalysisWarning {
+	conflicts := &testConflicts{files: map[string]string{}, artifacts: map[string]int{}, declared: map[goPackageKey]map[string]string{}}
+	for _, file := range splitContextFiles(codeContext) {
+		filePath := slashPath(file.Path)
+		conflicts.files[filePath] = file.Content
+		if strings.HasSuffix(filePath, ".go") {
+			conflicts.declare(filePath, file.Content)
+		}
+	}
+
+	var kept []GeneratedArtifact
+	var warnings []AnalysisWarning
+	for _, artifact := range testResponse.Artifacts {
+		existing, exists := conflicts.files[artifact.Path]
+		index, fromArtifact := conflicts.artifacts[artifact.Path]
+		if exists && strings.TrimSpace(existing) == strings.TrimSpace(artifact.Content) {
+			if !fromArtifact {
+				warnings = append(warnings, AnalysisWarning{
+					Kind:    "conflict",
+					File:    artifact.Path,
+					Message: fmt.Sprintf("%s is already in the repository as generated, left out", artifact.Path),
+				})
+			}
+			continue
+		}
+		if !strings.HasSuffix(artifact.Path, ".go") {
+			if exists {
+				warnings = append(warnings, AnalysisWarning{
+					Kind:    "conflict",
+					File:    artifact.Path,
+					Message: fmt.Sprintf("%s already exists and is replaced by the generated %s", artifact.Path, artifact.Type),
+				})
+			}
+			conflicts.files[artifact.Path] = artifact.Content
+			conflicts.artifacts[artifact.Path] = len(kept) + 1
+			kept = append(kept, artifact)
+			continue
+		}
+
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, artifact.Path, artifact.Content, parser.ParseComments)
+		if err != nil {
+			conflicts.files[artifact.Path] = artifact.Content
+			conflicts.artifacts[artifact.Path] = len(kept) + 1
+			kept = append(kept, artifact)
+			continue
+		}
+
+		// The same package merges, anything else moves to a free path
+		merge := false
+		if exists {
+			existingFile, err := parser.ParseFile(token.NewFileSet(), artifact.Path, existing, parser.ImportsOnly)
+			merge = err == nil && existingFile.Name.Name == file.Name.Name
+			if !merge {
+				oldPath := artifact.Path
+				artifact.Path = conflicts.freePath(oldPath)
+				movePlacedTests(testResponse.TestCases, file, oldPath, artifact.Path)
+				warnings = append(warnings, AnalysisWarning{
+					Kind:    "conflict",
+					File:    artifact.Path,
+					Message: fmt.Sprintf("%s already exists outside package %s, the generated file is written to %s", oldPath, file.Name.Name, artifact.Path),
+				})
+			}
+		}
+
+		key := goPackageKey{path.Dir(artifact.Path), file.Name.Name}
+		content, renameWarnings := renameDeclared(artifact, fset, file, conflicts.declared[key], testResponse.TestCases)
+		warnings = append(warnings, renameWarnings...)
+
+		if merge {
+			merged, err := mergeGoFiles(existing, content)
+			if err == nil {
+				warnings = append(warnings, AnalysisWarning{
+					Kind:    "conflict",
+					File:    artifact.Path,
+					Message: fmt.Sprintf("%s already exists, the generated tests are merged into it", artifact.Path),
+				})
+				conflicts.declare(artifact.Path, content)
+				conflicts.files[artifact.Path] = merged
+				if fromArtifact {
+					kept[index-1].Content = merged
+					continue
+				}
+				artifact.Content = merged
+				conflicts.artifacts[artifact.Path] = len(kept) + 1
+				kept = append(kept, artifact)
+				continue
+			}
+			oldPath := artifact.Path
+			artifact.Path = conflicts.freePath(oldPath)
+			movePlacedTests(testResponse.TestCases, file, oldPath, artifact.Path)
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "conflict",
+				File:    artifact.Path,
+				Message: fmt.Sprintf("%s already exists and could not be merged with, the generated file is written to %s: %v", oldPath, artifact.Path, err),
+			})
+		}
+
+		artifact.Content = content
+		conflicts.declare(artifact.Path, content)
+		conflicts.files[artifact.Path] = content
+		conflicts.artifacts[artifact.Path] = len(kept) + 1
+		kept = append(kept, artifact)
+	}
+	testResponse.Artifacts = kept
+	return warnings
+}
+
+// movePlacedTests points the test cases of the functions of a moved file
+// at its new path
+func movePlacedTests(testCases []GeminiTestCase, file *ast.File, oldPath, newPath string) {
+	names := topLevelNames(file)
+	for i := range testCases {
+		if _, ok := names[testCases[i].Name]; ok && testCases[i].SuggestedPath == oldPath {
+			testCases[i].SuggestedPath = newPath
+		}
+	}
+}
+
+// renameDeclared renames the top-level names of a generated file that its
+// package declares already, along with every reference in the file.
+// Methods cannot be renamed safely and are only reported.
+func renameDeclared(artifact GeneratedArtifact, fset *token.FileSet, file *ast.File, declared map[string]string, testCases []GeminiTestCase) (string, []AnalysisWarning) {
+	generated := topLevelNames(file)
+	var names []string
+	for name := range generated {
+		if _, ok := declared[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var warnings []AnalysisWarning
+	renames := map[*ast.Object]string{}
+	renamed := map[string]bool{}
+	for _, name := range names {
+		ident := generated[name]
+		// Methods move along with their renamed type
+		if dot := strings.Index(name, "."); dot != -1 && renamed[name[:dot]] {
+			continue
+		}
+		if ident.Obj == nil {
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "conflict",
+				File:    artifact.Path,
+				Symbol:  name,
+				Message: fmt.Sprintf("%s is already declared in %s, remove one of them", name, declared[name]),
+			})
+			continue
+		}
+		newName := name
+		for n := 2; ; n++ {
+			newName = name + strconv.Itoa(n)
+			_, taken := declared[newName]
+			if _, ok := generated[newName]; !taken && !ok {
+				break
+			}
+		}
+		renames[ident.Obj] = newName
+		renamed[name] = true
+		generated[newName] = ident
+		warnings = append(warnings, AnalysisWarning{
+			Kind:    "conflict",
+			File:    artifact.Path,
+			Symbol:  newName,
+			Message: fmt.Sprintf("%s is already declared in %s, the generated one is renamed to %s", name, declared[name], newName),
+		})
+		for i := range testCases {
+			if testCases[i].SuggestedPath == artifact.Path && testCases[i].Name == name {
+				testCases[i].Name = newName
+			}
+		}
+	}
+	if len(renames) == 0 {
+		return artifact.Content, warnings
+	}
+
+	type replacement struct {
+		offset int
+		old    string
+		new    string
+	}
+	var replacements []replacement
+	ast.Inspect(file, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && ident.Obj != nil {
+			if newName, ok := renames[ident.Obj]; ok {
+				replacements = append(replacements, replacement{fset.Position(ident.Pos()).Offset, ident.Name, newName})
+			}
+		}
+		return true
+	})
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].offset > replacements[j].offset })
+	content := artifact.Content
+	for _, r := range replacements {
+		content = content[:r.offset] + r.new + content[r.offset+len(r.old):]
+	}
+	return content, warnings
+}
+
+// importsEnd is the offset after the imports of a file, or after its
+// package clause when it has none
+func importsEnd(fset *token.FileSet, file *ast.File) int {
+	end := fset.Position(file.Name.End()).Offset
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			end = fset.Position(gen.End()).Offset
+		}
+	}
+	return end
+}
+
+// mergeGoFiles appends the declarations of a generated file to an existing
+// file of the same package, importing what the existing file does not
+func mergeGoFiles(existing, generated string) (string, error) {
+	fset := token.NewFileSet()
+	existingFile, err := parser.ParseFile(fset, "existing.go", existing, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	generatedFile, err := parser.ParseFile(fset, "generated.go", generated, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+
+	imported := map[string]bool{}
+	for _, spec := range existingFile.Imports {
+		imported[importSpecText(spec)] = true
+	}
+	var extra []string
+	for _, spec := range generatedFile.Imports {
+		if text := importSpecText(spec); !imported[text] {
+			extra = append(extra, text)
+			imported[text] = true
+		}
+	}
+
+	// Into the last import block, or a block of their own
+	insert := importsEnd(fset, existingFile)
+	var block strings.Builder
+	if len(extra) > 0 {
+		var last *ast.GenDecl
+		for _, decl := range existingFile.Decls {
+			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+				last = gen
+			}
+		}
+		if last != nil && last.Rparen.IsValid() {
+			insert = fset.Position(last.Rparen).Offset
+		} else {
+			block.WriteString("\n\nimport (\n")
+		}
+		for _, spec := range extra {
+			block.WriteString("\t" + spec + "\n")
+		}
+		if last == nil || !last.Rparen.IsValid() {
+			block.WriteString(")")
+		}
+	}
+	var b strings.Builder
+	b.WriteString(existing[:insert])
+	b.WriteString(block.String())
+	b.WriteString(strings.TrimRight(existing[insert:], "\n"))
+	b.WriteString("\n\n")
+	b.WriteString(strings.TrimLeft(generated[importsEnd(fset, generatedFile):], "\n"))
+
+	formatted, err := format.Source([]byte(b.String()))
+	if err != nil {
+		return "", err
+	}
+	return string(formatted), nil
+}
+
+// importSpecText is an import spec as written in an import block
+func importSpecText(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name + " " + spec.Path.Value
+	}
+	return spec.Path.Value
+}
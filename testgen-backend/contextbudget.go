@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Prompts are fitted to the context window of the model they are sent to,
+// providers answer larger ones with a 400 after the whole upload. Over the
+// budget, the lowest weighted files are summarized to their declarations
+// first and then cut short until the prompt fits, so source files outlast
+// configuration, see fileWeight. Only the prompt is fitted, the analysis of
+// the response sees the whole context.
+
+// Context windows of model families in tokens, the first matching prefix
+// applies. Unknown models, such as most self-hosted ones, get
+// defaultContextWindow.
+var modelContextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gemini-1.5-pro", 2097152},
+	{"gemini-", 1048576},
+	{"gpt-4.1", 1047576},
+	{"gpt-4o", 128000},
+	{"o1", 200000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"claude-", 200000},
+	{"qwen2.5-coder", 32768},
+	{"codellama", 16384},
+}
+
+const defaultContextWindow = 32768
+
+// Fitting is repeated while prompt parts derived from the context, such as
+// hybrid skeletons, keep it over the budget
+const maxContextFitRounds = 3
+
+func contextWindow(model string) int {
+	for _, window := range modelContextWindows {
+		if strings.HasPrefix(model, window.prefix) {
+			return window.tokens
+		}
+	}
+	return defaultContextWindow
+}
+
+// promptBudget is the prompt tokens a generation may send: the request's
+// contextBudget, or what the model's window leaves beside the answer with
+// a twentieth kept for estimation errors
+func (req GeminiRequest) promptBudget(meter *tokenMeter) int {
+	if req.ContextBudget > 0 {
+		return req.ContextBudget
+	}
+	window := contextWindow(req.Model)
+	return window - max(meter.remaining(8192), 0) - window/20
+}
+
+// fitPromptContext shrinks the context of a generation until its prompt
+// fits the budget, rebuilding the prompt from the fitted context. The
+// warnings name the files that were shortened.
+func fitPromptContext(req GeminiRequest, standing string, budget int) (string, []testFocus, GeminiResponse, []AnalysisWarning, error) {
+	prompt, focuses, testResponse := generationPrompt(req, standing)
+	fitted := map[string]string{}
+	for round := 0; round < maxContextFitRounds; round++ {
+		tokens := estimateTokens(prompt)
+		if tokens <= budget {
+			break
+		}
+		var ok bool
+		req.CodeContext, ok = shrinkContext(req.CodeContext, tokens-budget, fitted)
+		prompt, focuses, testResponse = generationPrompt(req, standing)
+		if !ok {
+			return "", nil, GeminiResponse{}, nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+				"The prompt needs about %d tokens with every file of the context cut, above the context budget of %d", estimateTokens(prompt), budget)}
+		}
+	}
+	if tokens := estimateTokens(prompt); tokens > budget {
+		return "", nil, GeminiResponse{}, nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"The prompt needs about %d tokens, above the context budget of %d", tokens, budget)}
+	}
+
+	var warnings []AnalysisWarning
+	for _, file := range splitContextFiles(req.CodeContext) {
+		how, ok := fitted[file.Path]
+		if !ok {
+			continue
+		}
+		warnings = append(warnings, AnalysisWarning{
+			Kind:    "context-budget",
+			File:    file.Path,
+			Message: fmt.Sprintf("%s to fit the context budget of %d tokens, tests may miss what was left out", how, budget),
+		})
+	}
+	return prompt, focuses, testResponse, warnings, nil
+}
+
+// shrinkContext takes at least overflow tokens out of the files of a
+// context, lowest weight first, recording in fitted how each file was
+// shortened. ok is false when cutting every file does not take enough.
+func shrinkContext(codeContext string, overflow int, fitted map[string]string) (string, bool) {
+	files, _ := prioritizeFiles(splitContextFiles(codeContext), 0)
+	var replaced []FileContent
+	replace := func(i int, content, how string) {
+		saved := estimateTokens(files[i].Content) - estimateTokens(content)
+		if saved <= 0 {
+			return
+		}
+		files[i].Content = content
+		replaced = append(replaced, files[i])
+		fitted[files[i].Path] = how
+		overflow -= saved
+	}
+
+	// Declarations tell most of what a file does, summarize every file
+	// before cutting any
+	for i := len(files) - 1; i >= 0 && overflow > 0; i-- {
+		if _, done := fitted[files[i].Path]; !done {
+			replace(i, summarizeDeclarations(files[i]), "summarized to its declarations")
+		}
+	}
+	for i := len(files) - 1; i >= 0 && overflow > 0; i-- {
+		keep := estimateTokens(files[i].Content) - overflow
+		replace(i, truncateToTokens(files[i].Content, keep), "cut short")
+	}
+	return overrideContextFiles(codeContext, replaced), overflow <= 0
+}
+
+// Lines declaring something in the languages without a parser here
+var declarationLine = regexp.MustCompile(`^\s*(?:(?:export|default|public|private|protected|internal|static|abstract|final|async|override|pub(?:\([a-z]+\))?|open|sealed|data)\s+)*(?:func|function\*?|def|class|interface|type|struct|enum|trait|impl|fn|object|module|namespace|package|import|from|using|const|let|var|val)\b`)
+
+const summarizedMarker = "[summarized to its declarations to fit the context budget]"
+
+// summarizeDeclarations shortens a file to its declarations: Go files to
+// their declarations without function bodies, others to their declaring
+// lines
+func summarizeDeclarations(file FileContent) string {
+	if strings.ToLower(filepath.Ext(file.Path)) == ".go" {
+		fset := token.NewFileSet()
+		parsed, err := parser.ParseFile(fset, file.Path, file.Content, parser.SkipObjectResolution)
+		if err == nil {
+			for _, decl := range parsed.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok {
+					fn.Body = nil
+				}
+			}
+			var buf bytes.Buffer
+			if err := printer.Fprint(&buf, fset, parsed); err == nil {
+				return "// " + summarizedMarker + "\n" + buf.String()
+			}
+		}
+	}
+	var summary strings.Builder
+	summary.WriteString(summarizedMarker + "\n")
+	for _, line := range strings.Split(file.Content, "\n") {
+		if declarationLine.MatchString(line) {
+			summary.WriteString(strings.TrimRight(line, " \t{") + "\n")
+		}
+	}
+	return summary.String()
+}
+
+// truncateToTokens keeps the leading lines of content that fit in about
+// keep tokens and notes how many lines were cut
+func truncateToTokens(content string, keep int) string {
+	lines := strings.SplitAfter(content, "\n")
+	var kept strings.Builder
+	used := 0
+	n := 0
+	for ; n < len(lines); n++ {
+		tokens := estimateTokens(lines[n])
+		if used+tokens > keep {
+			break
+		}
+		used += tokens
+		kept.WriteString(lines[n])
+	}
+	if n == len(lines) {
+		return content
+	}
+	if kept.Len() > 0 && !strings.HasSuffix(kept.String(), "\n") {
+		kept.WriteString("\n")
+	}
+	fmt.Fprintf(&kept, "[%d more lines cut to fit the context budget]\n", len(lines)-n)
+	return kept.String()
+}
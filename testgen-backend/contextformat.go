@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Contexts can be built in other serializations than the default text
+// layout, some models follow per-file records or XML tags more reliably.
+// splitContextFiles reads all of them back.
+
+var contextFormats = []string{"text", "json", "jsonl", "xml"}
+
+const (
+	contextJSONFormat    = "testgen-context/v1"
+	contextInstructions  = "This context contains all source code files from the cloned repository. Generate comprehensive test cases based on the functions, methods, and logic found in these files."
+	xmlFileClose         = "</file>"
+	xmlEscapedFileClose  = "&lt;/file>"
+	jsonlFileRecordStart = `{"type":"file"`
+)
+
+type contextRecord struct {
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	Content string `json:"content"`
+}
+
+type contextDocument struct {
+	Format       string          `json:"format"`
+	Instructions string          `json:"instructions"`
+	Sources      []string        `json:"sources,omitempty"`
+	Repositories []string        `json:"repositories,omitempty"`
+	Summary      string          `json:"summary,omitempty"`
+	Glossary     string          `json:"glossary,omitempty"`
+	Docs         []contextRecord `json:"docs,omitempty"`
+	Files        []contextRecord `json:"files"`
+}
+
+// buildContext serializes the files in the given format, "" is text
+func buildContext(files []FileContent, extras contextExtras, format string) string {
+	switch format {
+	case "json":
+		return buildJSONContext(files, extras)
+	case "jsonl":
+		return buildJSONLContext(files, extras)
+	case "xml":
+		return buildXMLContext(files, extras)
+	}
+	return generatePromptContext(files, extras)
+}
+
+// marshalContextJSON encodes without HTML escaping, which would turn every
+// < and > in the code into unicode escapes
+func marshalContextJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func buildJSONContext(files []FileContent, extras contextExtras) string {
+	doc := contextDocument{
+		Format:       contextJSONFormat,
+		Instructions: contextInstructions,
+		Sources:      extras.Sources,
+		Repositories: extras.Repos,
+		Summary:      strings.TrimSpace(extras.Summary),
+		Glossary:     extras.Glossary,
+		Files:        []contextRecord{},
+	}
+	for _, d := range extras.Docs {
+		doc.Docs = append(doc.Docs, contextRecord{Type: "doc", Path: d.Path, Content: d.Content})
+	}
+	for _, file := range files {
+		doc.Files = append(doc.Files, contextRecord{Type: "file", Path: file.Path, Content: file.Content})
+	}
+	return marshalContextJSON(doc) + "\n"
+}
+
+func buildJSONLContext(files []FileContent, extras contextExtras) string {
+	var context strings.Builder
+	write := func(record contextRecord) {
+		context.WriteString(marshalContextJSON(record) + "\n")
+	}
+	write(contextRecord{Type: "instructions", Content: contextInstructions})
+	for _, source := range extras.Sources {
+		write(contextRecord{Type: "source", Content: source})
+	}
+	if extras.Summary != "" {
+		write(contextRecord{Type: "summary", Content: strings.TrimSpace(extras.Summary)})
+	}
+	if len(extras.Repos) > 1 {
+		write(contextRecord{Type: "repositories", Content: strings.Join(extras.Repos, "\n")})
+	}
+	if strings.TrimSpace(extras.Glossary) != "" {
+		write(contextRecord{Type: "glossary", Content: extras.Glossary})
+	}
+	for _, doc := range extras.Docs {
+		write(contextRecord{Type: "doc", Path: doc.Path, Content: doc.Content})
+	}
+	for _, file := range files {
+		write(contextRecord{Type: "file", Path: file.Path, Content: file.Content})
+	}
+	return context.String()
+}
+
+func buildXMLContext(files []FileContent, extras contextExtras) string {
+	var context strings.Builder
+	context.WriteString("<context>\n")
+	context.WriteString("<instructions>" + contextInstructions + "</instructions>\n")
+	for _, source := range extras.Sources {
+		context.WriteString("<source>" + html.EscapeString(source) + "</source>\n")
+	}
+	if extras.Summary != "" {
+		context.WriteString("<summary>\n" + html.EscapeString(strings.TrimSpace(extras.Summary)) + "\n</summary>\n")
+	}
+	if len(extras.Repos) > 1 {
+		context.WriteString("<repositories>\n")
+		for _, repo := range extras.Repos {
+			context.WriteString(fmt.Sprintf("<repository prefix=\"%s/\"/>\n", html.EscapeString(repo)))
+		}
+		context.WriteString("</repositories>\n")
+	}
+	if strings.TrimSpace(extras.Glossary) != "" {
+		context.WriteString("<glossary>\n" + strings.TrimSpace(extras.Glossary) + "\n</glossary>\n")
+	}
+	for _, doc := range extras.Docs {
+		context.WriteString(fmt.Sprintf("<doc path=\"%s\">\n%s\n</doc>\n", html.EscapeString(doc.Path), doc.Content))
+	}
+	// Contents stay unescaped so code reads naturally, only a literal
+	// closing tag is escaped to keep the file boundaries unambiguous
+	for _, file := range files {
+		content := strings.ReplaceAll(file.Content, xmlFileClose, xmlEscapedFileClose)
+		context.WriteString(fmt.Sprintf("<file path=\"%s\">\n%s\n%s\n", html.EscapeString(file.Path), content, xmlFileClose))
+	}
+	context.WriteString("</context>\n")
+	return context.String()
+}
+
+var xmlFileOpen = regexp.MustCompile(`(?m)^<file path="([^"]*)">\n`)
+
+// decodeJSONContext finds a JSON context document, which may be preceded
+// by sections attached after the context was built
+func decodeJSONContext(codeContext string) (*contextDocument, bool) {
+	i := strings.Index(codeContext, `{"format":"`+contextJSONFormat+`"`)
+	if i == -1 {
+		return nil, false
+	}
+	var doc contextDocument
+	if err := json.NewDecoder(strings.NewReader(codeContext[i:])).Decode(&doc); err != nil {
+		return nil, false
+	}
+	return &doc, true
+}
+
+// splitContextFiles recovers the individual files from a context built in
+// any of the context formats. Contexts in any other shape yield no files.
+func splitContextFiles(codeContext string) []FileContent {
+	codeContext = normalizeLineEndings(codeContext)
+	if doc, ok := decodeJSONContext(codeContext); ok {
+		var files []FileContent
+		for _, record := range doc.Files {
+			files = append(files, FileContent{Path: record.Path, Content: record.Content, Size: len(record.Content)})
+		}
+		return files
+	}
+	if strings.Contains(codeContext, jsonlFileRecordStart) {
+		return splitJSONLContextFiles(codeContext)
+	}
+	if xmlFileOpen.MatchString(codeContext) {
+		return splitXMLContextFiles(codeContext)
+	}
+	return splitTextContextFiles(codeContext)
+}
+
+func splitJSONLContextFiles(codeContext string) []FileContent {
+	var files []FileContent
+	scanner := bufio.NewScanner(strings.NewReader(codeContext))
+	scanner.Buffer(make([]byte, 64*1024), len(codeContext)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, jsonlFileRecordStart) {
+			continue
+		}
+		var record contextRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			continue
+		}
+		files = append(files, FileContent{Path: record.Path, Content: record.Content, Size: len(record.Content)})
+	}
+	return files
+}
+
+func splitXMLContextFiles(codeContext string) []FileContent {
+	var files []FileContent
+	for _, match := range xmlFileOpen.FindAllStringSubmatchIndex(codeContext, -1) {
+		rest := codeContext[match[1]:]
+		end := strings.Index(rest, "\n"+xmlFileClose)
+		if end == -1 {
+			continue
+		}
+		content := strings.ReplaceAll(rest[:end], xmlEscapedFileClose, xmlFileClose)
+		files = append(files, FileContent{
+			Path:    html.UnescapeString(codeContext[match[2]:match[3]]),
+			Content: content,
+			Size:    len(content),
+		})
+	}
+	return files
+}
+
+// contextHasGlossary reports whether a context already carries a glossary
+func contextHasGlossary(codeContext string) bool {
+	if doc, ok := decodeJSONContext(codeContext); ok && doc.Glossary != "" {
+		return true
+	}
+	return strings.Contains(codeContext, glossaryHeader) ||
+		strings.Contains(codeContext, "\n<glossary>\n") ||
+		strings.Contains(codeContext, `{"type":"glossary"`)
+}
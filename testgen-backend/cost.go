@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cost attribution. Generation requests carry key/value tags such as
+// team, project or ticket, the run keeps them with its token usage and the
+// usage report adds the spend up per tag so platform teams can charge it
+// back to cost centers.
+
+const (
+	maxTags        = 20
+	maxTagValueLen = 256
+)
+
+var validTagKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// Dimensions the usage report groups by besides tag keys
+var usageDimensions = []string{"tenant", "model", "month"}
+
+// ModelPrice is what a provider charges per million tokens, in US dollars
+type ModelPrice struct {
+	PromptPerMillion float64 `json:"promptPerMillion"`
+	OutputPerMillion float64 `json:"outputPerMillion"`
+}
+
+// List prices of the models the server calls, TESTGEN_PRICING_FILE
+// overrides or extends them
+var modelPricing = map[string]ModelPrice{
+	geminiModel:            {PromptPerMillion: 0.075, OutputPerMillion: 0.30},
+	geminiProModel:         {PromptPerMillion: 1.25, OutputPerMillion: 5.00},
+	openAIModel:            {PromptPerMillion: 2.50, OutputPerMillion: 10.00},
+	openAILongContextModel: {PromptPerMillion: 2.00, OutputPerMillion: 8.00},
+	claudeModel:            {PromptPerMillion: 0.80, OutputPerMillion: 4.00},
+	claudeSonnetModel:      {PromptPerMillion: 3.00, OutputPerMillion: 15.00},
+}
+
+// loadModelPricing merges the prices in the JSON file named by
+// TESTGEN_PRICING_FILE, a map from model name to ModelPrice
+func loadModelPricing() error {
+	path := os.Getenv("TESTGEN_PRICING_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var prices map[string]ModelPrice
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return fmt.Errorf("invalid pricing file %s: %v", path, err)
+	}
+	for model, price := range prices {
+		if price.PromptPerMillion < 0 || price.OutputPerMillion < 0 {
+			return fmt.Errorf("negative price for model %s", model)
+		}
+		modelPricing[model] = price
+	}
+	return nil
+}
+
+// usageCost prices the tokens of a generation, 0 for unknown models
+func usageCost(usage *TokenUsage, model string) float64 {
+	price, ok := modelPricing[model]
+	if usage == nil || !ok {
+		return 0
+	}
+	cost := float64(usage.PromptTokens)*price.PromptPerMillion/1e6 + float64(usage.OutputTokens)*price.OutputPerMillion/1e6
+	return math.Round(cost*1e6) / 1e6
+}
+
+// validateTags checks the tags of a generation request
+func validateTags(errs *fieldErrors, tags map[string]string) {
+	if len(tags) > maxTags {
+		errs.add("tags", "max", "tags must have at most %d entries", maxTags)
+	}
+	for key, value := range tags {
+		field := "tags." + key
+		if !validTagKey.MatchString(key) {
+			errs.add(field, "key", "tag keys may only contain letters, digits, '.', '_' and '-'")
+			continue
+		}
+		errs.maxLen(field, value, maxTagValueLen)
+	}
+}
+
+// UsageGroup is the spend of the runs sharing the values of the grouped
+// dimensions
+type UsageGroup struct {
+	Key          map[string]string `json:"key"`
+	Runs         int               `json:"runs"`
+	PromptTokens int               `json:"promptTokens"`
+	OutputTokens int               `json:"outputTokens"`
+	CostUSD      float64           `json:"costUsd"`
+}
+
+func (g *UsageGroup) add(usage *TokenUsage) {
+	g.Runs++
+	if usage != nil {
+		g.PromptTokens += usage.PromptTokens
+		g.OutputTokens += usage.OutputTokens
+		g.CostUSD += usage.CostUSD
+	}
+}
+
+// UsageReport is the spend in a period grouped by tags
+type UsageReport struct {
+	Since   *time.Time   `json:"since,omitempty"`
+	Until   *time.Time   `json:"until,omitempty"`
+	GroupBy []string     `json:"groupBy"`
+	Groups  []UsageGroup `json:"groups"`
+	Total   UsageGroup   `json:"total"`
+}
+
+// runDimension returns the value of a grouping dimension for a run
+func runDimension(run *Run, dimension string) string {
+	switch dimension {
+	case "tenant":
+		return run.Tenant
+	case "model":
+		if run.Response.Provenance != nil {
+			return run.Response.Provenance.Model
+		}
+		return ""
+	case "month":
+		return run.CreatedAt.UTC().Format("2006-01")
+	}
+	return run.Tags[dimension]
+}
+
+// usageReport adds up the usage of the runs created in [since, until)
+// matching every filter tag
+func usageReport(since, until time.Time, groupBy []string, filters map[string]string) (*UsageReport, error) {
+	ids, err := listJSON("runs")
+	if err != nil {
+		return nil, err
+	}
+	report := &UsageReport{GroupBy: groupBy, Groups: []UsageGroup{}, Total: UsageGroup{Key: map[string]string{}}}
+	if !since.IsZero() {
+		report.Since = &since
+	}
+	if !until.IsZero() {
+		report.Until = &until
+	}
+
+	groups := map[string]*UsageGroup{}
+	for _, id := range ids {
+		var run Run
+		if err := loadJSON("runs", id, &run); err != nil || run.Response == nil {
+			continue
+		}
+		if run.CreatedAt.Before(since) || (!until.IsZero() && !run.CreatedAt.Before(until)) {
+			continue
+		}
+		matches := true
+		for key, value := range filters {
+			if runDimension(&run, key) != value {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		key := map[string]string{}
+		values := make([]string, len(groupBy))
+		for i, dimension := range groupBy {
+			values[i] = runDimension(&run, dimension)
+			key[dimension] = values[i]
+		}
+		encoded, _ := json.Marshal(values)
+		id := string(encoded)
+		group := groups[id]
+		if group == nil {
+			group = &UsageGroup{Key: key}
+			groups[id] = group
+		}
+		group.add(run.Response.Usage)
+		report.Total.add(run.Response.Usage)
+	}
+
+	for _, group := range groups {
+		group.CostUSD = math.Round(group.CostUSD*1e6) / 1e6
+		report.Groups = append(report.Groups, *group)
+	}
+	report.Total.CostUSD = math.Round(report.Total.CostUSD*1e6) / 1e6
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].CostUSD != report.Groups[j].CostUSD {
+			return report.Groups[i].CostUSD > report.Groups[j].CostUSD
+		}
+		for _, dimension := range groupBy {
+			if a, b := report.Groups[i].Key[dimension], report.Groups[j].Key[dimension]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	return report, nil
+}
+
+// writeCSV renders the report for spreadsheets and chargeback imports
+func (report *UsageReport) writeCSV(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="testgen-usage.csv"`)
+	out := csv.NewWriter(w)
+	out.Write(append(append([]string{}, report.GroupBy...), "runs", "prompt_tokens", "output_tokens", "cost_usd"))
+	row := func(group UsageGroup, label string) {
+		var record []string
+		for i, dimension := range report.GroupBy {
+			value := group.Key[dimension]
+			if label != "" && i == 0 {
+				value = label
+			}
+			record = append(record, value)
+		}
+		record = append(record,
+			strconv.Itoa(group.Runs),
+			strconv.Itoa(group.PromptTokens),
+			strconv.Itoa(group.OutputTokens),
+			strconv.FormatFloat(group.CostUSD, 'f', 6, 64))
+		out.Write(record)
+	}
+	for _, group := range report.Groups {
+		row(group, "")
+	}
+	if len(report.GroupBy) > 0 {
+		row(report.Total, "TOTAL")
+	}
+	out.Flush()
+}
+
+// usageHandler serves the usage and cost report:
+//
+//	GET /api/usage?groupBy=team,project&since=2026-01-01&until=2026-02-01
+//	GET /api/usage?groupBy=month&tag=team:payments&format=csv
+//
+// groupBy takes tag keys and tenant, model or month. tag filters by
+// key:value and may repeat.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var errs fieldErrors
+	since, err := parseTimeQuery("since", query.Get("since"))
+	if err != nil {
+		errs.add("since", "format", "%v", err)
+	}
+	until, err := parseTimeQuery("until", query.Get("until"))
+	if err != nil {
+		errs.add("until", "format", "%v", err)
+	}
+
+	groupBy := []string{}
+	if value := query.Get("groupBy"); value != "" {
+		for _, dimension := range strings.Split(value, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if !validTagKey.MatchString(dimension) {
+				errs.add("groupBy", "key", "%q is not a tag key or one of %s", dimension, strings.Join(usageDimensions, ", "))
+				continue
+			}
+			groupBy = append(groupBy, dimension)
+		}
+	}
+	filters := map[string]string{}
+	for _, filter := range query["tag"] {
+		key, value, ok := strings.Cut(filter, ":")
+		if !ok || !validTagKey.MatchString(key) {
+			errs.add("tag", "format", "tag filters must have the form key:value")
+			continue
+		}
+		filters[key] = value
+	}
+	format := query.Get("format")
+	if format != "" {
+		errs.oneOf("format", format, "json", "csv")
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	report, err := usageReport(since, until, groupBy, filters)
+	if err != nil {
+		log.Printf("Error building usage report: %v", err)
+		http.Error(w, "Failed to read runs", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "csv" {
+		report.writeCSV(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
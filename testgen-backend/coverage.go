@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coverage history lets a team chart how the coverage of a repository
+// moves over the weeks it uses the tool. Every run records a static
+// measurement, the share of exported Go functions its tests refer to, and
+// CI can report what its coverage tool measured.
+
+// Samples kept per repository, the oldest are dropped first
+const maxCoverageSamples = 2000
+
+var coverageMethods = []string{"static", "reported"}
+
+var coverageIntervals = []string{"day", "week", "month"}
+
+// CoverageSample is one coverage measurement of a repository
+type CoverageSample struct {
+	MeasuredAt time.Time `json:"measuredAt"`
+	Method     string    `json:"method"` // static or reported
+	Commit     string    `json:"commit,omitempty"`
+	RunID      string    `json:"runId,omitempty"`
+	Covered    int       `json:"covered,omitempty"`
+	Total      int       `json:"total,omitempty"`
+	Percent    float64   `json:"percent"`
+	// Static samples only, the coverage once the generated tests are added
+	ProjectedPercent *float64 `json:"projectedPercent,omitempty"`
+	ProjectedCovered int      `json:"projectedCovered,omitempty"`
+	// Untested functions each generated test file refers to
+	GapsClosedBy map[string]int `json:"gapsClosedBy,omitempty"`
+}
+
+// RepoCoverage is the coverage history of a repository
+type RepoCoverage struct {
+	Owner   string           `json:"owner"`
+	Repo    string           `json:"repo"`
+	Samples []CoverageSample `json:"samples"`
+}
+
+// CoveragePoint is the coverage at the end of one interval
+type CoveragePoint struct {
+	Start            time.Time `json:"start"`
+	Percent          float64   `json:"percent"`
+	ProjectedPercent *float64  `json:"projectedPercent,omitempty"`
+	Commit           string    `json:"commit,omitempty"`
+	Samples          int       `json:"samples"`
+}
+
+// CoverageTrend is the time series answered by the coverage endpoint
+type CoverageTrend struct {
+	Owner    string `json:"owner"`
+	Repo     string `json:"repo"`
+	Interval string `json:"interval,omitempty"`
+	// Percentage points gained between the first and last sample, per method
+	Change  map[string]float64         `json:"change"`
+	Samples []CoverageSample           `json:"samples,omitempty"`
+	Series  map[string][]CoveragePoint `json:"series,omitempty"`
+}
+
+// coverageReport is what CI posts after running its coverage tool, either
+// the percentage or the covered and total counts
+type coverageReport struct {
+	Percent *float64 `json:"percent,omitempty"`
+	Covered int      `json:"covered,omitempty"`
+	Total   int      `json:"total,omitempty"`
+	Commit  string   `json:"commit,omitempty"`
+	RunID   string   `json:"runId,omitempty"`
+}
+
+func (req *coverageReport) validate() fieldErrors {
+	var errs fieldErrors
+	switch {
+	case req.Percent != nil:
+		if *req.Percent < 0 || *req.Percent > 100 {
+			errs.add("percent", "range", "percent must be between 0 and 100")
+		}
+	case req.Total > 0:
+		if req.Covered < 0 || req.Covered > req.Total {
+			errs.add("covered", "range", "covered must be between 0 and total")
+		}
+	default:
+		errs.add("percent", "required", "percent or covered and total are required")
+	}
+	errs.maxLen("commit", req.Commit, 64)
+	errs.maxLen("runId", req.RunID, 128)
+	return errs
+}
+
+var coverageMu sync.Mutex
+
+func coverageID(owner, repo string) string {
+	return repoSlug(owner, repo)
+}
+
+func coveragePercent(covered, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(covered)*1000/float64(total)) / 10
+}
+
+// appendCoverage adds a sample to the history of a repository
+func appendCoverage(owner, repo string, sample CoverageSample) error {
+	coverageMu.Lock()
+	defer coverageMu.Unlock()
+
+	id := coverageID(owner, repo)
+	history := RepoCoverage{Owner: owner, Repo: repo}
+	if err := loadJSON("coverage", id, &history); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	history.Samples = append(history.Samples, sample)
+	if len(history.Samples) > maxCoverageSamples {
+		history.Samples = history.Samples[len(history.Samples)-maxCoverageSamples:]
+	}
+	return saveJSON("coverage", id, history)
+}
+
+// recordRunCoverage measures the static coverage of the context a run was
+// generated from, with and without its generated tests, and adds it to the
+// history of each source repository. Multi-repo contexts are measured as
+// a whole.
+func recordRunCoverage(resp *GeminiResponse, req GeminiRequest) {
+	if resp.Provenance == nil || resp.Provenance.Source == "" {
+		return
+	}
+	files := splitContextFiles(req.CodeContext)
+	check := checkUntestedFiles(files, 100)
+	if check.Total == 0 {
+		return
+	}
+
+	withGenerated := files
+	for _, artifact := range resp.Artifacts {
+		if strings.HasSuffix(artifact.Path, "_test.go") {
+			withGenerated = append(withGenerated, FileContent{Path: artifact.Path, Content: artifact.Content})
+		}
+	}
+	projected := checkUntestedFiles(withGenerated, 100)
+	projectedPercent := coveragePercent(projected.Tested, projected.Total)
+	gapsClosedBy := map[string]int{}
+	for _, generated := range withGenerated[len(files):] {
+		if closed := checkUntestedFiles(append(files[:len(files):len(files)], generated), 100).Tested - check.Tested; closed > 0 {
+			gapsClosedBy[generated.Path] += closed
+		}
+	}
+
+	for _, source := range strings.Split(resp.Provenance.Source, ",") {
+		owner, repo, sha, ok := parseSource(source)
+		if !ok {
+			continue
+		}
+		sample := CoverageSample{
+			MeasuredAt:       time.Now().UTC(),
+			Method:           "static",
+			Commit:           sha,
+			RunID:            resp.RunID,
+			Covered:          check.Tested,
+			Total:            check.Total,
+			Percent:          coveragePercent(check.Tested, check.Total),
+			ProjectedPercent: &projectedPercent,
+			ProjectedCovered: projected.Tested,
+			GapsClosedBy:     gapsClosedBy,
+		}
+		if err := appendCoverage(owner, repo, sample); err != nil {
+			log.Printf("Warning: Could not record coverage of %s/%s: %v", owner, repo, err)
+		}
+	}
+}
+
+// intervalStart returns the start of the day, ISO week or month of t
+func intervalStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "week":
+		// Weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// coverageSeries reduces samples of one method to the last measurement of
+// each interval, coverage being a level rather than a count
+func coverageSeries(samples []CoverageSample, interval string) []CoveragePoint {
+	var points []CoveragePoint
+	for _, sample := range samples {
+		start := intervalStart(sample.MeasuredAt, interval)
+		if len(points) == 0 || !points[len(points)-1].Start.Equal(start) {
+			points = append(points, CoveragePoint{Start: start})
+		}
+		point := &points[len(points)-1]
+		point.Percent = sample.Percent
+		point.ProjectedPercent = sample.ProjectedPercent
+		point.Commit = sample.Commit
+		point.Samples++
+	}
+	return points
+}
+
+// parseTimeQuery reads a time query parameter, a date or an RFC 3339 time
+func parseTimeQuery(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be a date like 2026-01-31 or an RFC 3339 time", name)
+}
+
+// coverageTrend filters the history and groups it by method
+func coverageTrend(history RepoCoverage, method, interval string, since time.Time) CoverageTrend {
+	trend := CoverageTrend{Owner: history.Owner, Repo: history.Repo, Interval: interval, Change: map[string]float64{}}
+
+	byMethod := map[string][]CoverageSample{}
+	var kept []CoverageSample
+	for _, sample := range history.Samples {
+		if (method != "" && sample.Method != method) || sample.MeasuredAt.Before(since) {
+			continue
+		}
+		byMethod[sample.Method] = append(byMethod[sample.Method], sample)
+		kept = append(kept, sample)
+	}
+	for m, samples := range byMethod {
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].MeasuredAt.Before(samples[j].MeasuredAt) })
+		trend.Change[m] = math.Round((samples[len(samples)-1].Percent-samples[0].Percent)*10) / 10
+	}
+
+	if interval == "" {
+		trend.Samples = kept
+		if trend.Samples == nil {
+			trend.Samples = []CoverageSample{}
+		}
+		return trend
+	}
+	trend.Series = map[string][]CoveragePoint{}
+	for m, samples := range byMethod {
+		trend.Series[m] = coverageSeries(samples, interval)
+	}
+	return trend
+}
+
+// coverageHandler serves the coverage history of a repository:
+//
+//	GET    /api/context/{owner}/{repo}/coverage?interval=week&since=2026-01-01&method=static
+//	POST   /api/context/{owner}/{repo}/coverage   record what CI measured
+//	DELETE /api/context/{owner}/{repo}/coverage   clear the history
+func coverageHandler(w http.ResponseWriter, r *http.Request, owner, repo string) {
+	id := coverageID(owner, repo)
+	if _, err := storePath("coverage", id); err != nil {
+		http.Error(w, "Invalid repository", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		var errs fieldErrors
+		if method := query.Get("method"); method != "" {
+			errs.oneOf("method", method, coverageMethods...)
+		}
+		if interval := query.Get("interval"); interval != "" {
+			errs.oneOf("interval", interval, coverageIntervals...)
+		}
+		since, err := parseTimeQuery("since", query.Get("since"))
+		if err != nil {
+			errs.add("since", "format", "%v", err)
+		}
+		if len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+
+		history := RepoCoverage{Owner: owner, Repo: repo}
+		if err := loadJSON("coverage", id, &history); err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Failed to read coverage", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(coverageTrend(history, query.Get("method"), query.Get("interval"), since))
+
+	case "POST":
+		var req coverageReport
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		sample := CoverageSample{
+			MeasuredAt: time.Now().UTC(),
+			Method:     "reported",
+			Commit:     req.Commit,
+			RunID:      req.RunID,
+			Covered:    req.Covered,
+			Total:      req.Total,
+		}
+		if req.Percent != nil {
+			sample.Percent = math.Round(*req.Percent*10) / 10
+		} else {
+			sample.Percent = coveragePercent(req.Covered, req.Total)
+		}
+		if err := appendCoverage(owner, repo, sample); err != nil {
+			log.Printf("Error saving coverage: %v", err)
+			http.Error(w, "Failed to save coverage", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Recorded coverage of %s/%s: %.1f%%", owner, repo, sample.Percent)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sample)
+
+	case "DELETE":
+		coverageMu.Lock()
+		err := deleteJSON("coverage", id)
+		coverageMu.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Failed to delete coverage", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// wantsRawContext reports whether a context request asked for the plain
+// text file instead of the JSON envelope
+func wantsRawContext(r *http.Request) bool {
+	if raw := r.URL.Query().Get("raw"); raw == "1" || raw == "true" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/plain")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRawContext streams a context file as plain text. Range requests are
+// answered from the file, other requests are gzipped when the client
+// accepts it. Neither loads the file into memory.
+func serveRawContext(w http.ResponseWriter, r *http.Request, contextPath string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := os.Open(contextPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Context file not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read context file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read context file", http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if r.Header.Get("Range") != "" || !acceptsGzip(r) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, filepath.Base(contextPath), info.ModTime(), file)
+		return
+	}
+
+	// The compressed representation needs its own validator
+	etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	if r.Method == "HEAD" {
+		return
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, file); err != nil {
+		log.Printf("Error streaming context %s: %v", contextPath, err)
+		return
+	}
+	gz.Close()
+}
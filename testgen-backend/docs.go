@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// Default token budget for the documentation section of the context
+const defaultDocsTokenBudget = 4000
+
+// Documentation files are normally excluded by excludePatterns, these are the
+// patterns that are lifted when docs are explicitly requested
+var docPatterns = map[string]bool{
+	"*.md":          true,
+	"README*":       true,
+	"docs":          true,
+	"documentation": true,
+}
+
+var docExts = []string{".md", ".markdown", ".rst", ".adoc", ".txt"}
+
+func isDocFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, docExt := range docExts {
+		if ext == docExt {
+			return true
+		}
+	}
+	return strings.HasPrefix(strings.ToLower(filepath.Base(path)), "readme")
+}
+
+func shouldExcludeDocFile(filePath string) bool {
+	pathParts := strings.Split(slashPath(filePath), "/")
+
+	for _, pattern := range excludePatterns {
+		if docPatterns[pattern] {
+			continue
+		}
+		for _, part := range pathParts {
+			if matchesExcludePattern(pattern, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func readDocumentationFiles(repo billy.Filesystem, subPath string) ([]FileContent, error) {
+	var docs []FileContent
+
+	err := util.Walk(repo, walkRoot(subPath), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		relPath := slashPath(path)
+
+		if !isDocFile(relPath) || shouldExcludeDocFile(relPath) {
+			return nil
+		}
+
+		// Skip huge docs such as generated API references
+		if info.Size() > 256*1024 {
+			return nil
+		}
+
+		content, err := util.ReadFile(repo, path)
+		if err != nil {
+			return nil
+		}
+
+		text := normalizeLineEndings(string(content))
+		docs = append(docs, FileContent{
+			Path:    relPath,
+			Content: text,
+			Size:    len(text),
+		})
+		return nil
+	})
+
+	return docs, err
+}
+
+// summarizeDoc keeps headings and the first paragraph below each heading,
+// dropping code blocks, images and badges
+func summarizeDoc(content string) string {
+	var summary strings.Builder
+	inCode := false
+	keepParagraph := true
+	paragraphLines := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			summary.WriteString(trimmed + "\n")
+			keepParagraph = true
+			paragraphLines = 0
+			continue
+		}
+
+		if trimmed == "" {
+			if paragraphLines > 0 {
+				keepParagraph = false
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "![") || strings.HasPrefix(trimmed, "[![") || strings.HasPrefix(trimmed, "<") {
+			continue
+		}
+
+		if keepParagraph {
+			summary.WriteString(trimmed + "\n")
+			paragraphLines++
+		}
+	}
+
+	return summary.String()
+}
+
+// prepareDocs summarizes docs if requested and trims them to the token
+// budget. The root README goes first, then shallower files before deeper ones.
+func prepareDocs(docs []FileContent, mode string, budget int) []FileContent {
+	if budget <= 0 {
+		budget = defaultDocsTokenBudget
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		ri := strings.HasPrefix(strings.ToLower(docs[i].Path), "readme")
+		rj := strings.HasPrefix(strings.ToLower(docs[j].Path), "readme")
+		if ri != rj {
+			return ri
+		}
+		di := strings.Count(docs[i].Path, "/")
+		dj := strings.Count(docs[j].Path, "/")
+		if di != dj {
+			return di < dj
+		}
+		return docs[i].Path < docs[j].Path
+	})
+
+	var prepared []FileContent
+	remaining := budget
+	for _, doc := range docs {
+		content := doc.Content
+		if mode == "summary" {
+			content = summarizeDoc(content)
+		}
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+
+		tokens := estimateTokens(content)
+		if tokens > remaining {
+			// Truncate the last doc that partially fits
+			if remaining < 100 {
+				break
+			}
+			// Cut at a character, not inside one
+			n := min(remaining*4, len(content))
+			for n > 0 && n < len(content) && !utf8.RuneStart(content[n]) {
+				n--
+			}
+			content = content[:n] + "\n[... truncated ...]\n"
+			tokens = remaining
+		}
+
+		prepared = append(prepared, FileContent{
+			Path:    doc.Path,
+			Content: content,
+			Size:    len(content),
+		})
+		remaining -= tokens
+		if remaining <= 0 {
+			break
+		}
+	}
+
+	return prepared
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// testFocus is a category of tests requested from the model when the code
+// context matches one of its patterns or its Detect function reports
+// findings. Opt-in focuses are only applied when named in the request's
+// focus list.
+type testFocus struct {
+	Name       string
+	TestType   string
+	Patterns   []*regexp.Regexp
+	Detect     func(codeContext string) []string
+	Findings   []string
+	Guidelines []string
+	Schema     string
+	Section    string
+	Helpers    []GeneratedArtifact
+	Artifacts  func(codeContext string) []GeneratedArtifact
+	OptIn      bool
+}
+
+var testFocuses = []testFocus{
+	{
+		Name:     "binary-protocol",
+		TestType: "round-trip",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"encoding/binary"`),
+			regexp.MustCompile(`google\.golang\.org/protobuf|github\.com/golang/protobuf`),
+			regexp.MustCompile(`func \([^)]+\) (MarshalBinary|UnmarshalBinary|Encode|Decode)\(`),
+			regexp.MustCompile(`struct\.(pack|unpack)\(|new DataView\(|Buffer\.(from|alloc)\(`),
+		},
+		Guidelines: []string{
+			"The code implements a binary encoder/decoder or wire protocol. Generate byte-level test vectors as hex fixtures",
+			"For every encoder/decoder pair, add round-trip tests asserting decode(encode(x)) == x",
+			"Include truncated input, trailing bytes, wrong length prefixes and endianness cases",
+		},
+		Schema: `"testVectors": [{"name": "vector_name", "hex": "0a0b0c", "decoded": "decoded_value"}]`,
+	},
+	{
+		Name:     "determinism",
+		TestType: "deterministic",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`time\.(Now|Since|Until|After|Tick|NewTimer|NewTicker)\(`),
+			regexp.MustCompile(`"math/rand"|"math/rand/v2"|"crypto/rand"`),
+			regexp.MustCompile(`datetime\.(now|utcnow)\(|random\.(random|randint|choice)\(|Date\.now\(|Math\.random\(`),
+		},
+		Guidelines: []string{
+			"The code reads the wall clock or random numbers. Tests must inject a fake clock or a seeded random source instead of depending on real time",
+			"Assert exact timestamps, durations and random-derived values using the injected fakes",
+			"If the code does not already accept a clock or random source, attach a refactor to the test case with kind \"clock\" or \"rand\" describing the minimal injection point",
+		},
+		Schema: `"refactor": {"kind": "clock|rand", "file": "path/to/file", "description": "minimal change to make the dependency injectable", "code": "shim code"}`,
+	},
+	{
+		Name: "testability",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?m)^var \w+ = (map\[|make\(|&|\[\])`),
+			regexp.MustCompile(`sync\.Once|getInstance\(|GetInstance\(`),
+			regexp.MustCompile(`http\.(Get|Post|PostForm|Head)\(|http\.DefaultClient|net\.Dial\(|sql\.Open\(`),
+			regexp.MustCompile(`requests\.(get|post|put|delete)\(|axios\.(get|post)\(`),
+		},
+		Guidelines: []string{
+			"Parts of this code are hard to test (global state, hidden singletons, direct network or database calls)",
+			"For each such file, suggest the minimal refactor (extract an interface, inject the dependency, pass state explicitly) and write the tests against the refactored shape",
+			"List the ids of the tests that assume each refactor",
+		},
+		Section: `"refactorSuggestions": [{"file": "path/to/file", "description": "minimal change, e.g. extract interface or inject dependency", "code": "sketch of the refactored code", "testIds": ["ids of tests assuming this refactor"]}]`,
+	},
+	{
+		Name: "filesystem-fakes",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"io/fs"|"github\.com/spf13/afero"`),
+			regexp.MustCompile(`os\.(Open|OpenFile|Create|ReadFile|WriteFile|ReadDir|MkdirAll|Remove|RemoveAll|Stat)\(|filepath\.Walk`),
+			regexp.MustCompile(`require\(['"]fs['"]\)|from ['"](node:)?fs(/promises)?['"]|\bopen\([^)]*['"][rwa]b?['"]`),
+		},
+		Guidelines: []string{
+			"The code touches the filesystem. Tests must not depend on the real disk layout",
+			"Go: use testing/fstest.MapFS for fs.FS readers, afero.NewMemMapFs when the code accepts an afero.Fs, otherwise t.TempDir()",
+			"Python: use pyfakefs or tmp_path; JavaScript: use memfs or mock-fs",
+			"Cover missing files, permission errors and empty directories",
+		},
+	},
+	{
+		Name: "network-fakes",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"net/http"|"github\.com/h2non/gock"`),
+			regexp.MustCompile(`http\.(Get|Post|NewRequest|NewRequestWithContext)\(|&http\.Client\{`),
+			regexp.MustCompile(`\bfetch\(|axios|requests\.(get|post|put|delete)\(|httpx\.`),
+		},
+		Guidelines: []string{
+			"The code makes HTTP calls. Tests must never hit the real network",
+			"Go: start an httptest.NewServer (or use gock) and point the client at its URL; Python: use responses or respx; JavaScript: use nock or msw",
+			"Cover non-2xx statuses, malformed bodies, slow responses and connection failures",
+		},
+	},
+	{
+		Name:     "configuration",
+		TestType: "configuration",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`os\.(Getenv|LookupEnv|Environ)\(|viper\.|envconfig\.|env:"`),
+			regexp.MustCompile(`process\.env\.|os\.environ|os\.getenv\(|ENV\[`),
+		},
+		Guidelines: []string{
+			"The code reads environment variables or configuration. Generate configuration permutation tests",
+			"Cover missing values, empty strings, malformed values (non-numeric ports, bad durations, invalid URLs) and boundary values",
+			"Go: set variables with t.Setenv; Python: use monkeypatch.setenv/delenv; JavaScript: save and restore process.env",
+			"Assert the documented default when a value is missing and a clear error when it is malformed",
+		},
+	},
+	{
+		Name:     "cli",
+		TestType: "cli",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/spf13/cobra"|"github\.com/urfave/cli(/v\d)?"`),
+			regexp.MustCompile(`&cobra\.Command\{|&cli\.App\{|&cli\.Command\{`),
+			regexp.MustCompile(`import click|@click\.command|argparse\.ArgumentParser|require\(['"]commander['"]\)|from ['"]commander['"]|yargs`),
+		},
+		Guidelines: []string{
+			"The code defines CLI commands. Generate command-level tests that execute the command with arguments",
+			"Capture stdout and stderr (cobra: cmd.SetOut/SetErr/SetArgs then Execute; urfave: app.Writer/ErrWriter then app.Run; click: CliRunner)",
+			"Cover flag permutations: required flags missing, unknown flags, invalid values, defaults and help output",
+			"Assert exit codes or returned errors for each failure case",
+		},
+	},
+	{
+		Name:     "auth",
+		TestType: "auth",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/gin-gonic/gin"|"github\.com/labstack/echo(/v4)?"|"github\.com/go-chi/chi(/v5)?"`),
+			regexp.MustCompile(`\.Use\(|func\(next http\.Handler\) http\.Handler|gin\.HandlerFunc|echo\.MiddlewareFunc`),
+			regexp.MustCompile(`(?i)authoriz|bearer|jwt|RequireAuth|login_required|@permission_classes|passport\.`),
+		},
+		Guidelines: []string{
+			"The code wires middleware or protects routes. Generate tests for every auth-required route",
+			"For each route cover: missing token, malformed token, expired token, valid token with the wrong role, and the happy path",
+			"Go: drive the router with httptest.NewRecorder; Express: supertest; Django: the test client with force_login",
+			"Assert status codes (401 vs 403) and that the protected handler is not reached on failure",
+		},
+	},
+	{
+		Name:     "streaming",
+		TestType: "streaming",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/gorilla/websocket"|"nhooyr\.io/websocket"|"github\.com/coder/websocket"|"golang\.org/x/net/websocket"`),
+			regexp.MustCompile(`text/event-stream|http\.Flusher|\.Flush\(\)`),
+			regexp.MustCompile(`new WebSocket\(|socket\.io|require\(['"]ws['"]\)|from ['"]ws['"]|EventSource|StreamingResponse`),
+		},
+		Guidelines: []string{
+			"The code exposes WebSocket or Server-Sent Events endpoints. Generate tests that act as a real client against an httptest server",
+			"Go: dial with the gorilla or nhooyr websocket client; Node: ws client or supertest with an SSE parser",
+			"Cover connect (including rejected upgrades), message exchange in both directions, ordering, and clean and abrupt disconnects",
+			"Use deadlines on every read so a missing message fails the test instead of hanging it",
+		},
+	},
+	{
+		Name:     "messaging",
+		TestType: "messaging",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/(segmentio/kafka-go|IBM/sarama|Shopify/sarama|confluentinc/confluent-kafka-go[^"]*)"`),
+			regexp.MustCompile(`"github\.com/(rabbitmq/amqp091-go|streadway/amqp)"|"github\.com/aws/aws-sdk-go(-v2)?/service/sqs"`),
+			regexp.MustCompile(`kafkajs|amqplib|@aws-sdk/client-sqs|import pika|from kafka import|boto3\.client\(['"]sqs['"]\)`),
+		},
+		Guidelines: []string{
+			"The code produces or consumes queue messages. Generate producer and consumer tests",
+			"Run against an embedded broker or testcontainers (Kafka, RabbitMQ, LocalStack for SQS) rather than a shared environment",
+			"Cover message serialization and deserialization, poison messages, retries with backoff, and delivery to the dead-letter queue",
+			"Assert acknowledgement behavior: messages are only acked after successful processing",
+			"List the broker each test needs in the services field",
+		},
+		Schema: `"services": ["kafka|rabbitmq|sqs"]`,
+	},
+	{
+		Name:     "caching",
+		TestType: "caching",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/(redis/go-redis|go-redis/redis)(/v\d)?"|"github\.com/gomodule/redigo/redis"`),
+			regexp.MustCompile(`"github\.com/(patrickmn/go-cache|hashicorp/golang-lru[^"]*|dgraph-io/ristretto|allegro/bigcache)"`),
+			regexp.MustCompile(`(?i)\b(ttl|expir\w*|evict\w*|lru)\b`),
+			regexp.MustCompile(`ioredis|node-cache|lru-cache|functools\.lru_cache|import redis`),
+		},
+		Guidelines: []string{
+			"The code implements a cache layer. Generate tests for hit, miss, expiry and eviction semantics",
+			"Use miniredis for Redis-backed code and a fake clock for TTL logic instead of sleeping",
+			"Cover capacity-triggered eviction order, stale reads after expiry, and behavior when the backing cache is unavailable",
+		},
+	},
+	{
+		Name:     "transactions",
+		TestType: "transaction",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"gorm\.io/gorm"|"github\.com/jmoiron/sqlx"|"database/sql"|"github\.com/jackc/pgx(/v\d)?"`),
+			regexp.MustCompile(`\.(Begin|BeginTx|Transaction|Commit|Rollback)\(`),
+			regexp.MustCompile(`sqlalchemy|@prisma/client|prisma\.\$transaction|typeorm|sequelize`),
+		},
+		Guidelines: []string{
+			"The code uses an ORM or database transactions. Generate tests against a real test database provided by the runner, not mocks",
+			"Verify commit persists all writes and rollback (explicit or on error/panic) leaves no partial writes",
+			"Cover unique, foreign key and not-null constraint violations and assert the error surfaced to callers",
+			"Each test must start from a clean schema; list the database it needs in the services field",
+		},
+		Schema: `"services": ["postgres|mysql|sqlite"]`,
+	},
+	{
+		Name:     "pagination",
+		TestType: "pagination",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)["'\s.(](page|pageSize|page_size|per_page|perPage|limit|offset|cursor|sort|sort_by|sortBy|order_by|orderBy)["'\s)=]`),
+			regexp.MustCompile(`(?i)\bLIMIT\s+[\$?:%]|\bOFFSET\s+[\$?:%]|\.(Limit|Offset)\(`),
+		},
+		Guidelines: []string{
+			"The code exposes list endpoints with pagination, filtering or sorting parameters. Generate a systematic suite for each one",
+			"Cover first page, last page, exactly-full last page, out-of-range page, and empty result sets",
+			"Cover limit boundaries: zero, negative, one, the maximum and maximum plus one, and non-numeric values",
+			"Cover invalid sort keys and directions, unknown filters, and stable ordering across pages (no duplicates or gaps)",
+		},
+	},
+	{
+		Name:     "idempotency",
+		TestType: "idempotency",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)idempoten|Idempotency-Key`),
+			regexp.MustCompile(`(?i)\b(payment|charge|refund|transfer|withdraw|invoice|checkout|order)s?\b`),
+			regexp.MustCompile(`http\.Method(Put|Delete)|\.(PUT|DELETE|Put|Delete)\(\s*["']/|methods=\[['"](PUT|DELETE)|router\.(put|delete)\(`),
+		},
+		Guidelines: []string{
+			"Some handlers are idempotency-sensitive (PUT/DELETE or payment-like flows). Generate duplicate-call tests for them",
+			"Call the same operation twice (and concurrently) with identical input and assert there is no double effect: one charge, one row, one event",
+			"When an idempotency key is supported, cover key reuse with a different payload and replays after the original request failed",
+			"Assert the second response matches the first (same status and body) where the contract requires it",
+		},
+	},
+	{
+		Name:     "robustness",
+		TestType: "robustness",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`http\.HandleFunc\(|\.HandleFunc\(|\.(GET|POST|Get|Post)\(\s*["']/|mux\.Handle\(`),
+			regexp.MustCompile(`app\.(get|post|put|delete)\(\s*['"]/|@app\.route\(|@(Get|Post)Mapping|urlpatterns`),
+		},
+		Guidelines: []string{
+			"The code serves HTTP routes. Generate robustness tests that exercise encoding and validation layers",
+			"Hit routes with URL-encoded unicode path segments and query values (e.g. %E2%9C%93, combining characters, right-to-left text) and double-encoded input",
+			"Send oversized headers and bodies, unexpected or missing Content-Type values (text/plain, multipart, application/x-www-form-urlencoded) and invalid UTF-8",
+			"Assert a clean 4xx response, never a 5xx or a panic, and that decoded values round-trip unchanged",
+		},
+	},
+	{
+		Name:     "chaos",
+		TestType: "fault-injection",
+		Guidelines: []string{
+			"Generate fault-injection tests that wrap each external dependency in a failing fake",
+			"Use the faultinject helper package (faultinject.Reader for partial reads and mid-stream errors, faultinject.Conn for connection resets, faultinject.Transport for timeouts and failed HTTP calls)",
+			"Verify errors are returned or wrapped rather than swallowed, retries stop at their limit, and partial results are not committed",
+		},
+		Helpers: []GeneratedArtifact{faultInjectHelper},
+		OptIn:   true,
+	},
+	{
+		Name: "k6",
+		Guidelines: []string{
+			"Also generate a k6 load test script per HTTP endpoint as a separate artifact, not as a test case",
+			"Derive realistic request payloads, headers and query parameters from the handler code and request types",
+			"Use stages for ramp-up, steady state and ramp-down, and thresholds on http_req_failed and p(95) http_req_duration",
+		},
+		Section: `"artifacts": [{"type": "load-test", "path": "loadtest/<endpoint>.js", "language": "javascript", "description": "what the script exercises", "content": "k6 script"}]`,
+		OptIn:   true,
+	},
+	{
+		Name: "vegeta",
+		Guidelines: []string{
+			"Also generate vegeta load test targets per HTTP endpoint as separate artifacts, not as test cases",
+			"Derive realistic request payloads, headers and query parameters from the handler code; use the JSON targets format with base64 bodies",
+			"Add a shell script artifact running vegeta attack with a sensible rate and duration piped to vegeta report",
+		},
+		Section: `"artifacts": [{"type": "load-test", "path": "loadtest/<endpoint>.targets.json", "language": "json", "description": "what the targets exercise", "content": "vegeta targets"}]`,
+		OptIn:   true,
+	},
+	{
+		Name:     "resource-leaks",
+		TestType: "leak",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`\bgo func\(|\bgo \w+\(`),
+			regexp.MustCompile(`os\.(Open|OpenFile|Create)\(|net\.(Dial|Listen)\w*\(|\.Body\.Close\(\)|time\.NewTicker\(`),
+		},
+		Guidelines: []string{
+			"The code acquires goroutines, files, connections or response bodies. Generate leak tests after exercising each such function",
+			"Assert no goroutines are left running with go.uber.org/goleak (goleak.VerifyNone(t), or goleak.VerifyTestMain for the package)",
+			"Compare open file descriptor counts before and after (count entries in /proc/self/fd on Linux) for code that opens files or sockets",
+			"For HTTP clients, use an httptest server that tracks connection state and assert every response body was closed, including on error paths",
+		},
+	},
+	{
+		Name:     "cancellation",
+		TestType: "cancellation",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`\bctx context\.Context\b|\(context\.Context[,)]`),
+		},
+		Guidelines: []string{
+			"Functions accept context.Context. For each of them generate cancellation and deadline tests",
+			"Cancel the context before the call and assert it returns promptly with context.Canceled",
+			"Use context.WithTimeout with a short deadline against a slow fake dependency and assert errors.Is(err, context.DeadlineExceeded)",
+			"Assert work actually stops: no further calls to fakes after cancellation and no goroutines left behind",
+		},
+	},
+	{
+		Name:     "serialization",
+		TestType: "round-trip",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile("`[^`]*\\b(json|yaml|xml|toml|protobuf|msgpack):\"[^`]*`"),
+			regexp.MustCompile(`@dataclass|BaseModel\)|class \w+\(Schema\)|@Serializable|@JsonProperty`),
+		},
+		Guidelines: []string{
+			"Types carry serialization tags. Generate marshal/unmarshal round-trip tests for each tagged struct or class",
+			"Assert unmarshal(marshal(v)) equals v, including zero values, omitempty fields, nested types and pointers",
+			"Cover unknown fields (ignored vs rejected with DisallowUnknownFields), missing required fields, and type mismatches such as a string where a number is expected",
+			"Pin the exact serialized form of one representative value so field renames are caught",
+		},
+	},
+	{
+		Name:     "compatibility",
+		TestType: "compatibility",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`["'/]v[1-9]\d*/`),
+			regexp.MustCompile(`(?m)^package v[1-9]\d*$|\b\w+V[1-9]\d*\b\s+struct\b`),
+		},
+		Guidelines: []string{
+			"The code exposes multiple API versions. Generate backward-compatibility tests between them",
+			"For routes present in several versions, assert an old-version request still succeeds with the old response shape",
+			"For shared or versioned types, assert a payload produced for the older version still decodes into the newer type without losing fields",
+			"Assert removed or renamed fields are handled as the newer version documents (ignored, defaulted or rejected)",
+		},
+	},
+	{
+		Name:     "templates",
+		TestType: "template",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"html/template"|"text/template"|template\.(New|Must|ParseFiles|ParseFS|ParseGlob)\(`),
+			regexp.MustCompile(`jinja2|render_template\(|\bERB\.new|\.erb\b|handlebars|ejs\.render|nunjucks`),
+		},
+		Guidelines: []string{
+			"The code renders templates. Generate rendering tests for each template",
+			"Cover missing keys and nil values (Go: Option(\"missingkey=error\") versus the default <no value>), empty collections and nested data",
+			"Assert contextual escaping: HTML, attribute, URL and JavaScript contexts must escape user-controlled input",
+			"Include injection attempts such as <script>alert(1)</script>, \" onmouseover=, javascript: URLs and template syntax inside data ({{.}}, ${...}) and assert they render inert",
+		},
+	},
+	{
+		Name:     "numeric",
+		TestType: "numeric",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"math"|"math/big"|\bfloat(32|64)\b|math\.(Sqrt|Pow|Log|Exp|Abs|Floor|Ceil|Round)\(`),
+			regexp.MustCompile(`import (numpy|math)|from decimal import|Math\.(sqrt|pow|log|exp|round)\(|parseFloat\(`),
+		},
+		Guidelines: []string{
+			"The code does floating point or numeric computation. Never assert floats with exact equality; compare with an epsilon tolerance (absolute and relative)",
+			"Cover NaN, +Inf, -Inf, -0 vs +0, the smallest subnormal, the largest finite value and overflow to Inf",
+			"Cover integer overflow and underflow at type boundaries, division by zero, and rounding of halves",
+			"Go: use math.IsNaN/math.IsInf/math.Signbit in assertions; Python: math.isclose or pytest.approx; JavaScript: toBeCloseTo and Object.is(x, -0)",
+		},
+	},
+	{
+		Name:     "datetime",
+		TestType: "datetime",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`time\.(Parse|ParseInLocation|LoadLocation|Date)\(|\.Format\(|\.In\(|time\.RFC3339`),
+			regexp.MustCompile(`strptime|strftime|zoneinfo|pytz|dateutil|moment\(|date-fns|luxon|dayjs|toISOString\(`),
+		},
+		Guidelines: []string{
+			"The code parses, formats or converts dates and times. Generate timezone and calendar edge case tests",
+			"Cover DST transitions in a zone that has them (e.g. America/New_York spring-forward gap and fall-back overlap), and zone conversions across midnight and date lines",
+			"Cover leap years (Feb 29 in 2024, not in 2100 or 2023), month-end arithmetic, and leap second representations such as 23:59:60",
+			"Cover RFC3339 parsing failures: missing offset, invalid offsets, out-of-range fields, and fractional seconds precision",
+			"Pin the location explicitly in every test; never depend on the machine's local timezone",
+		},
+	},
+	{
+		Name:     "state-machine",
+		TestType: "state-machine",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)\b\w*(state|status|phase|stage)\w*\s+=\s+iota\b`),
+			regexp.MustCompile(`(?i)\b(transition|canTransition|nextState|setState|fsm)\w*\(`),
+			regexp.MustCompile(`(?i)class \w*(State|Status)\w*\((Enum|IntEnum|str, Enum)\)|enum \w*(State|Status)\w*\s*\{`),
+		},
+		Guidelines: []string{
+			"The code implements enum-based state transitions. Generate one test per valid transition path from the initial state to each terminal state",
+			"Generate a test for every invalid transition (each state crossed with each event it must reject) asserting the error and that the state is unchanged",
+			"Cover repeated events, transitions out of terminal states and unknown enum values",
+		},
+	},
+	{
+		Name:     "state-table",
+		TestType: "state-machine",
+		Guidelines: []string{
+			"Additionally generate one exhaustive table-driven test enumerating every (from state, event or to state) pair with the expected outcome, allowed or rejected",
+		},
+		OptIn: true,
+	},
+	{
+		Name:     "recursion",
+		TestType: "recursion",
+		Detect:   findRecursiveFunctions,
+		Guidelines: []string{
+			"These functions are recursive. Generate tests for every base case and for the smallest inputs that take each recursive branch",
+			"Generate deep-input tests (e.g. 10_000 levels or nodes) asserting the function completes or fails with a clear error rather than overflowing the stack",
+			"For graph and tree algorithms, include cyclic inputs, self-loops and shared subtrees, asserting termination and correct visited-set handling",
+		},
+	},
+	{
+		Name:     "allocations",
+		TestType: "benchmark",
+		Detect:   findHotPathFunctions,
+		Guidelines: []string{
+			"These Go functions are hot paths. Generate a benchmark for each one that calls b.ReportAllocs() and runs the function b.N times on a realistic input",
+			"Also generate a regular test using testing.AllocsPerRun(100, ...) asserting allocations stay at or below the current count, so regressions fail CI",
+			"Reset timers after setup (b.ResetTimer) and keep inputs outside the measured loop",
+		},
+	},
+	{
+		Name:      "api-surface",
+		Detect:    findLibraryPackageDirs,
+		Artifacts: apiSurfaceArtifacts,
+		Guidelines: []string{
+			"These are importable library packages. A golden public API surface test is attached as an artifact; do not generate test cases that only enumerate exported identifiers",
+		},
+	},
+	{
+		Name:     "a11y",
+		TestType: "a11y",
+		Guidelines: []string{
+			"For every React or Vue component, add accessibility tests next to the behavior tests",
+			"React: render with @testing-library/react and assert expect(await axe(container)).toHaveNoViolations() using jest-axe; Vue: mount with @vue/test-utils and run axe-core on the wrapper element",
+			"Cover interactive states too (open dialogs, expanded menus, validation errors) and assert accessible names, roles and keyboard focus order with getByRole queries",
+		},
+		OptIn: true,
+	},
+	{
+		Name:     "graphql",
+		TestType: "graphql",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`"github\.com/(99designs/gqlgen|graph-gophers/graphql-go|graphql-go/graphql)[^"]*"`),
+			regexp.MustCompile(`(?m)^\s*(type (Query|Mutation|Subscription)\s*\{|schema\s*\{)|\.graphqls?\b`),
+			regexp.MustCompile(`apollo-server|@apollo/server|graphql-yoga|type-graphql|import strawberry|import graphene|gql\x60`),
+		},
+		Guidelines: []string{
+			"The code defines a GraphQL schema and resolvers. Generate query and mutation tests executed through the GraphQL server, not by calling resolvers directly",
+			"Cover invalid variables (wrong types, missing non-null, unknown enum values) and assert the errors array and partial data",
+			"Cover auth failures on protected fields and mutations, including field-level authorization inside otherwise allowed queries",
+			"Add N+1-sensitive nested queries (lists of parents with child lists) and assert the number of data-loader or database calls stays bounded",
+		},
+	},
+	{
+		Name:     "race",
+		TestType: "race",
+		Detect:   sharedStateFindingNames,
+		Guidelines: []string{
+			"Shared package-level state is written without synchronization in code that runs concurrently. Generate a targeted stress test for each finding",
+			"Run the writer and its readers from many parallel subtests (t.Run with t.Parallel) or goroutines joined by a sync.WaitGroup, with enough iterations to trip the race detector",
+			"State in the description that the test must run with go test -race, and name the racing function in the code field",
+		},
+	},
+}
+
+func lookupTestFocus(name string) (testFocus, bool) {
+	for _, focus := range testFocuses {
+		if focus.Name == name {
+			return focus, true
+		}
+	}
+	return testFocus{}, false
+}
+
+// detectTestFocuses returns the focuses matching the code context plus any
+// explicitly requested ones
+func detectTestFocuses(codeContext string, requested []string) []testFocus {
+	var focuses []testFocus
+	seen := map[string]bool{}
+
+	for _, name := range requested {
+		focus, ok := lookupTestFocus(strings.TrimSpace(name))
+		if ok && !seen[focus.Name] {
+			focuses = append(focuses, focus)
+			seen[focus.Name] = true
+		}
+	}
+
+	for _, focus := range testFocuses {
+		if focus.OptIn || seen[focus.Name] {
+			continue
+		}
+		if focus.Detect != nil {
+			if findings := focus.Detect(codeContext); len(findings) > 0 {
+				focus.Findings = findings
+				focuses = append(focuses, focus)
+				seen[focus.Name] = true
+			}
+			continue
+		}
+		for _, pattern := range focus.Patterns {
+			if pattern.MatchString(codeContext) {
+				focuses = append(focuses, focus)
+				seen[focus.Name] = true
+				break
+			}
+		}
+	}
+
+	return focuses
+}
+
+// withFindings sets the findings of the named focus, adding it when it was
+// not detected. Used for user-selected targets such as hot paths.
+func withFindings(focuses []testFocus, name string, findings []string) []testFocus {
+	if len(findings) == 0 {
+		return focuses
+	}
+	for i := range focuses {
+		if focuses[i].Name == name {
+			focuses[i].Findings = findings
+			return focuses
+		}
+	}
+	if focus, ok := lookupTestFocus(name); ok {
+		focus.Findings = findings
+		focuses = append(focuses, focus)
+	}
+	return focuses
+}
+
+// focusPromptSection renders the guidelines and extra schema fields of the
+// detected focuses for the generation prompt
+func focusPromptSection(focuses []testFocus) string {
+	if len(focuses) == 0 {
+		return ""
+	}
+
+	var section strings.Builder
+	section.WriteString("\nAdditional focus areas detected in this code:\n")
+	for _, focus := range focuses {
+		section.WriteString(fmt.Sprintf("\n[%s]", focus.Name))
+		if focus.TestType != "" {
+			section.WriteString(fmt.Sprintf(" (use testType \"%s\")", focus.TestType))
+		}
+		section.WriteString("\n")
+		if len(focus.Findings) > 0 {
+			section.WriteString("- Detected: " + strings.Join(focus.Findings, ", ") + "\n")
+		}
+		for _, guideline := range focus.Guidelines {
+			section.WriteString("- " + guideline + "\n")
+		}
+		if focus.Schema != "" {
+			section.WriteString("- Add to each relevant test case: " + focus.Schema + "\n")
+		}
+		if focus.Section != "" {
+			section.WriteString("- Add a top-level field next to testCases: " + focus.Section + "\n")
+		}
+	}
+	return section.String()
+}
+
+func focusTestTypes(focuses []testFocus) string {
+	types := []string{"unit", "integration", "edge-case", "error-handling"}
+	for _, focus := range focuses {
+		if focus.TestType != "" {
+			types = append(types, focus.TestType)
+		}
+	}
+	return strings.Join(types, "|")
+}
+
+func focusNames(focuses []testFocus) []string {
+	var names []string
+	for _, focus := range focuses {
+		names = append(names, focus.Name)
+	}
+	return names
+}
+
+// normalizeTestVectors lowercases hex fixtures and drops the ones that do not decode
+func normalizeTestVectors(testCase *GeminiTestCase) {
+	var vectors []TestVector
+	for _, vector := range testCase.TestVectors {
+		cleaned := strings.ToLower(strings.NewReplacer(" ", "", "0x", "", ":", "").Replace(vector.Hex))
+		if _, err := hex.DecodeString(cleaned); err != nil {
+			continue
+		}
+		vector.Hex = cleaned
+		vectors = append(vectors, vector)
+	}
+	testCase.TestVectors = vectors
+}
+
+// Abstraction shims attached to refactor suggestions that leave the code empty
+var refactorShims = map[string]string{
+	"clock": `// Clock abstracts time.Now so tests can inject a fixed time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// fakeClock returns a fixed time that tests can advance.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+`,
+	"rand": `// RandSource abstracts random number generation so tests can seed it.
+type RandSource interface {
+	Intn(n int) int
+	Float64() float64
+}
+
+// newRandSource returns a deterministic source when seed is non-zero.
+func newRandSource(seed int64) RandSource {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+`,
+}
+
+func fillRefactorShim(testCase *GeminiTestCase) {
+	if testCase.Refactor == nil || strings.TrimSpace(testCase.Refactor.Code) != "" {
+		return
+	}
+	if shim, ok := refactorShims[testCase.Refactor.Kind]; ok {
+		testCase.Refactor.Code = shim
+	}
+}
+
+// collectRefactorSuggestions merges the per test case refactors into the
+// top-level suggestions and groups them by file
+func collectRefactorSuggestions(response *GeminiResponse) {
+	byFile := map[string]int{}
+	var merged []RefactorSuggestion
+
+	add := func(suggestion RefactorSuggestion) {
+		key := suggestion.File + "\x00" + suggestion.Description
+		if i, ok := byFile[key]; ok {
+			merged[i].TestIDs = append(merged[i].TestIDs, suggestion.TestIDs...)
+			return
+		}
+		byFile[key] = len(merged)
+		merged = append(merged, suggestion)
+	}
+
+	for _, suggestion := range response.RefactorSuggestions {
+		add(suggestion)
+	}
+	for _, testCase := range response.TestCases {
+		if testCase.Refactor != nil {
+			suggestion := *testCase.Refactor
+			suggestion.TestIDs = []string{testCase.ID}
+			add(suggestion)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].File < merged[j].File
+	})
+	response.RefactorSuggestions = merged
+}
+
+// countTestTypes counts test cases per testType so categories added by
+// focuses are reported alongside the fixed summary counters
+func countTestTypes(testCases []GeminiTestCase) map[string]int {
+	counts := map[string]int{}
+	for _, testCase := range testCases {
+		counts[testCase.TestType]++
+	}
+	return counts
+}
+
+// focusArtifacts returns the helper and server-generated artifacts of the
+// focuses, once per path
+func focusArtifacts(focuses []testFocus, codeContext string) []GeneratedArtifact {
+	var artifacts []GeneratedArtifact
+	seen := map[string]bool{}
+	for _, focus := range focuses {
+		generated := append([]GeneratedArtifact(nil), focus.Helpers...)
+		if focus.Artifacts != nil {
+			generated = append(generated, focus.Artifacts(codeContext)...)
+		}
+		for _, artifact := range generated {
+			if !seen[artifact.Path] {
+				artifacts = append(artifacts, artifact)
+				seen[artifact.Path] = true
+			}
+		}
+	}
+	return artifacts
+}
+
+// sanitizeArtifacts drops empty artifacts returned by the model and keeps
+// their paths relative to the repository root
+func sanitizeArtifacts(artifacts []GeneratedArtifact) []GeneratedArtifact {
+	var sanitized []GeneratedArtifact
+	for _, artifact := range artifacts {
+		if strings.TrimSpace(artifact.Content) == "" {
+			continue
+		}
+		cleaned := path.Clean("/" + slashPath(artifact.Path))
+		artifact.Path = strings.TrimPrefix(cleaned, "/")
+		artifact.Content = normalizeLineEndings(artifact.Content)
+		if artifact.Path == "" {
+			continue
+		}
+		if artifact.Type == "" {
+			artifact.Type = "file"
+		}
+		sanitized = append(sanitized, artifact)
+	}
+	return sanitized
+}
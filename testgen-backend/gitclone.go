@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// Repositories are cloned in process with go-git, so no git binary is
+// needed and access tokens are set on the requests instead of passing
+// through a command line or environment.
+
+var cloneStorages = []string{"disk", "memory"}
+
+// cloneInMemory keeps clones in memory instead of under the repos
+// directory, for read-only or small container file systems
+var cloneInMemory bool
+
+// loadCloneStorage reads TESTGEN_CLONE_STORAGE, disk (default) or memory
+func loadCloneStorage() error {
+	value := os.Getenv("TESTGEN_CLONE_STORAGE")
+	switch value {
+	case "", "disk":
+		cloneInMemory = false
+	case "memory":
+		cloneInMemory = true
+	default:
+		return fmt.Errorf("TESTGEN_CLONE_STORAGE must be one of %s, got %q", strings.Join(cloneStorages, ", "), value)
+	}
+	return nil
+}
+
+// repoClone is a checked out repository
+type repoClone struct {
+	Files  billy.Filesystem // the worktree, paths relative to the repository root
+	Commit string
+}
+
+// headerAuth sends the Authorization header of a repository provider
+type headerAuth struct {
+	header string
+}
+
+func (a headerAuth) Name() string { return "http-authorization-header" }
+
+// String keeps the header out of anything that prints the auth method
+func (a headerAuth) String() string { return "Authorization: [REDACTED]" }
+
+func (a headerAuth) SetAuth(r *http.Request) { r.Header.Set("Authorization", a.header) }
+
+// cloneTarget returns the object storage and worktree of a clone
+func cloneTarget(clonePath string) (storage.Storer, billy.Filesystem, error) {
+	if cloneInMemory {
+		return memory.NewStorage(), memfs.New(), nil
+	}
+	// Bound file systems resolve paths against an absolute base
+	base, err := filepath.Abs(clonePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, nil, err
+	}
+	// Bound so symlinks in the repository cannot reach outside of the clone
+	worktree := osfs.New(base, osfs.WithBoundOS())
+	dotGit, err := worktree.Chroot(".git")
+	if err != nil {
+		return nil, nil, err
+	}
+	return filesystem.NewStorage(dotGit, cache.NewObjectLRUDefault()), worktree, nil
+}
+
+// remoteRef finds ref among the branches and tags of a remote. A commit
+// is returned as a hash name, abbreviated ones only when a branch or tag
+// points at it.
+func remoteRef(cloneURL string, auth transport.AuthMethod, ref string) (plumbing.ReferenceName, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{cloneURL}})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+	return findRemoteRef(refs, ref), nil
+}
+
+// findRemoteRef finds ref among the listed refs of a remote, like
+// remoteRef
+func findRemoteRef(refs []*plumbing.Reference, ref string) plumbing.ReferenceName {
+	for _, name := range []plumbing.ReferenceName{plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)} {
+		for _, r := range refs {
+			if r.Name() == name {
+				return name
+			}
+		}
+	}
+	if commitSHA.MatchString(ref) {
+		for _, r := range refs {
+			if strings.HasPrefix(r.Hash().String(), ref) {
+				return plumbing.ReferenceName(r.Hash().String())
+			}
+		}
+		if len(ref) == 40 {
+			return plumbing.ReferenceName(ref)
+		}
+	}
+	return ""
+}
+
+// cloneRepository makes a shallow clone of the repository at its ref, a
+// branch, tag or commit, or at the default branch, into clonePath or into
+// memory
+func cloneRepository(loc *RepoLocation, clonePath, accessToken string) (*repoClone, error) {
+	// Remove existing directory if it exists
+	if _, err := os.Stat(clonePath); !os.IsNotExist(err) {
+		os.RemoveAll(clonePath)
+	}
+
+	host, _, err := net.SplitHostPort(loc.Host)
+	if err != nil {
+		host = loc.Host
+	}
+	if err := checkEgress(host); err != nil {
+		return nil, err
+	}
+
+	var auth transport.AuthMethod
+	var header string
+	if accessToken != "" {
+		header = providerFor(loc).AuthHeader(loc, accessToken)
+		auth = headerAuth{header: header}
+	}
+	failed := func(err error) error {
+		return errors.New(redactSecrets(err.Error(), accessToken, header))
+	}
+	notFound := fmt.Errorf("no branch, tag or commit %s in %s/%s", loc.Ref, loc.Owner, loc.Repo)
+	cloneURL := providerFor(loc).CloneURL(loc)
+
+	storer, worktree, err := cloneTarget(clonePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ref plumbing.ReferenceName
+	if loc.Ref != "" {
+		if ref, err = remoteRef(cloneURL, auth, loc.Ref); err != nil {
+			return nil, failed(err)
+		}
+		if ref == "" && !commitSHA.MatchString(loc.Ref) {
+			return nil, notFound
+		}
+	}
+
+	var repo *git.Repository
+	switch {
+	case loc.Ref == "" || ref.IsBranch() || ref.IsTag():
+		// Branches and tags clone directly, with their last commit only
+		repo, err = git.Clone(storer, worktree, &git.CloneOptions{
+			URL:           cloneURL,
+			Auth:          auth,
+			ReferenceName: ref,
+			SingleBranch:  true,
+			Depth:         1,
+			Tags:          git.NoTags,
+		})
+		if err != nil {
+			return nil, failed(err)
+		}
+
+	default:
+		// A commit is fetched on its own where the server allows it, an
+		// abbreviated hash no branch or tag points at needs the whole history
+		if repo, err = git.Init(storer, worktree); err != nil {
+			return nil, failed(err)
+		}
+		remote, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{cloneURL}})
+		if err != nil {
+			return nil, failed(err)
+		}
+		fetched := false
+		if plumbing.IsHash(ref.String()) {
+			err := remote.Fetch(&git.FetchOptions{
+				Auth:     auth,
+				RefSpecs: []config.RefSpec{config.RefSpec(ref.String() + ":refs/heads/testgen")},
+				Depth:    1,
+				Tags:     git.NoTags,
+			})
+			if err != nil && !errors.Is(err, git.ErrExactSHA1NotSupported) {
+				return nil, failed(err)
+			}
+			fetched = err == nil
+		}
+		if !fetched {
+			err := remote.Fetch(&git.FetchOptions{
+				Auth:     auth,
+				RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+				Tags:     git.AllTags,
+			})
+			if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+				return nil, failed(err)
+			}
+		}
+		hash, err := repo.ResolveRevision(plumbing.Revision(loc.Ref))
+		if err != nil {
+			return nil, notFound
+		}
+		files, err := repo.Worktree()
+		if err != nil {
+			return nil, failed(err)
+		}
+		if err := files.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true}); err != nil {
+			return nil, failed(err)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, failed(err)
+	}
+	return &repoClone{Files: worktree, Commit: head.Hash().String()}, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Running as a GitHub App, every generation for a known commit is
+// published as a Check Run on it, with an annotation on each exported
+// function that has no test.
+
+// GitHub accepts at most this many annotations per request
+const maxCheckAnnotations = 50
+
+type githubAppConfig struct {
+	AppID     string
+	Key       *rsa.PrivateKey
+	APIURL    string
+	PublicURL string // where check runs link to, empty leaves links out
+}
+
+// loadGitHubAppConfig reads the GitHub App settings from the environment,
+// returning nil when no app id is configured
+func loadGitHubAppConfig() (*githubAppConfig, error) {
+	appID := os.Getenv("TESTGEN_GITHUB_APP_ID")
+	if appID == "" {
+		return nil, nil
+	}
+	keyPEM := []byte(os.Getenv("TESTGEN_GITHUB_APP_KEY"))
+	if file := os.Getenv("TESTGEN_GITHUB_APP_KEY_FILE"); len(keyPEM) == 0 && file != "" {
+		var err error
+		if keyPEM, err = os.ReadFile(file); err != nil {
+			return nil, fmt.Errorf("reading TESTGEN_GITHUB_APP_KEY_FILE: %v", err)
+		}
+	}
+	if len(keyPEM) == 0 {
+		return nil, errors.New("TESTGEN_GITHUB_APP_KEY or TESTGEN_GITHUB_APP_KEY_FILE is required with TESTGEN_GITHUB_APP_ID")
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub App key: %v", err)
+	}
+	return &githubAppConfig{
+		AppID:     appID,
+		Key:       key,
+		APIURL:    githubAPIURL(),
+		PublicURL: strings.TrimSuffix(os.Getenv("TESTGEN_PUBLIC_URL"), "/"),
+	}, nil
+}
+
+// githubAPIURL returns the GitHub API base. GitHub Enterprise Server
+// serves it under /api/v3.
+func githubAPIURL() string {
+	if apiURL := os.Getenv("TESTGEN_GITHUB_API_URL"); apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/")
+	}
+	return "https://api.github.com"
+}
+
+// parseRSAPrivateKey reads the PKCS#1 key GitHub issues, or a PKCS#8 one
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// githubApp authenticates as the app and its installations, caching the
+// installation tokens until shortly before they expire
+type githubApp struct {
+	cfg    *githubAppConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]installationToken // by owner/repo
+}
+
+// Set in main when a GitHub App is configured
+var githubAppClient *githubApp
+
+func newGitHubApp(cfg *githubAppConfig) *githubApp {
+	return &githubApp{cfg: cfg, client: &http.Client{Timeout: 15 * time.Second}, tokens: map[string]installationToken{}}
+}
+
+// jwt returns the short-lived token that authenticates as the app itself
+func (a *githubApp) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// Backdated against clock drift, GitHub allows at most ten minutes
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.cfg.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.cfg.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// call sends a JSON request to the GitHub API and decodes the response
+func (a *githubApp) call(method, apiPath, token string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.cfg.APIURL+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: status %d: %s", method, apiPath, resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// installationToken returns a token for the installation covering a repo
+func (a *githubApp) installationToken(owner, repo string) (string, error) {
+	key := owner + "/" + repo
+	a.mu.Lock()
+	cached, ok := a.tokens[key]
+	a.mu.Unlock()
+	if ok && time.Until(cached.ExpiresAt) > time.Minute {
+		return cached.Token, nil
+	}
+
+	appToken, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.call("GET", fmt.Sprintf("/repos/%s/%s/installation", owner, repo), appToken, nil, &installation); err != nil {
+		return "", fmt.Errorf("app not installed on %s: %v", key, err)
+	}
+	var token installationToken
+	if err := a.call("POST", fmt.Sprintf("/app/installations/%d/access_tokens", installation.ID), appToken, nil, &token); err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	a.tokens[key] = token
+	a.mu.Unlock()
+	return token.Token, nil
+}
+
+type checkAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title"`
+	Message         string `json:"message"`
+}
+
+type checkOutput struct {
+	Title       string            `json:"title"`
+	Summary     string            `json:"summary"`
+	Text        string            `json:"text,omitempty"`
+	Annotations []checkAnnotation `json:"annotations,omitempty"`
+}
+
+// parseSource splits an owner/repo@sha source
+func parseSource(source string) (owner, repo, sha string, ok bool) {
+	repoRef, sha, ok := strings.Cut(strings.TrimSpace(source), "@")
+	if !ok || sha == "" {
+		return "", "", "", false
+	}
+	owner, repo, ok = strings.Cut(repoRef, "/")
+	return owner, repo, sha, ok && owner != "" && repo != ""
+}
+
+// publishCheckRuns creates a completed Check Run on every source commit of
+// a generation and returns their URLs
+func (a *githubApp) publishCheckRuns(resp *GeminiResponse, req GeminiRequest) ([]string, error) {
+	if resp.Provenance == nil || resp.Provenance.Source == "" {
+		return nil, nil
+	}
+	sources := strings.Split(resp.Provenance.Source, ",")
+	untested := checkUntestedFunctions(req.CodeContext, 100).Untested
+
+	var urls []string
+	for _, source := range sources {
+		owner, repo, sha, ok := parseSource(source)
+		if !ok {
+			continue
+		}
+		// Merged contexts prefix every path with its repository
+		prefix := ""
+		if len(sources) > 1 {
+			prefix = owner + "/" + repo + "/"
+		}
+		url, err := a.publishCheckRun(resp, owner, repo, sha, prefix, untested)
+		if err != nil {
+			return urls, fmt.Errorf("check run on %s/%s@%s: %v", owner, repo, sha, err)
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+func (a *githubApp) publishCheckRun(resp *GeminiResponse, owner, repo, sha, prefix string, untested []UntestedFunction) (string, error) {
+	token, err := a.installationToken(owner, repo)
+	if err != nil {
+		return "", err
+	}
+
+	var annotations []checkAnnotation
+	for _, fn := range untested {
+		if !strings.HasPrefix(fn.Path, prefix) {
+			continue
+		}
+		message := fmt.Sprintf("%s is exported but no test in its package refers to it.", fn.Function)
+		if candidate := candidateArtifact(resp.Artifacts, fn); candidate != "" {
+			message += fmt.Sprintf(" Generated candidate: %s.", strings.TrimPrefix(candidate, prefix))
+		}
+		if link := a.runLink(resp.RunID, "/archive"); link != "" {
+			message += " Download the generated tests: " + link
+		}
+		annotations = append(annotations, checkAnnotation{
+			Path:            strings.TrimPrefix(fn.Path, prefix),
+			StartLine:       fn.Line,
+			EndLine:         fn.EndLine,
+			AnnotationLevel: "warning",
+			Title:           "No test for " + fn.Function,
+			Message:         message,
+		})
+	}
+
+	conclusion := "success"
+	if len(annotations) > 0 {
+		conclusion = "neutral"
+	}
+	output := checkOutput{
+		Title:   fmt.Sprintf("%d test cases generated, %d exported functions without tests", len(resp.TestCases), len(annotations)),
+		Summary: a.checkSummary(resp, len(annotations)),
+		Text:    checkText(resp.Artifacts, prefix),
+	}
+	first := annotations
+	if len(first) > maxCheckAnnotations {
+		first = first[:maxCheckAnnotations]
+	}
+	output.Annotations = first
+
+	run := map[string]interface{}{
+		"name":         "testgen",
+		"head_sha":     sha,
+		"status":       "completed",
+		"conclusion":   conclusion,
+		"completed_at": time.Now().UTC().Format(time.RFC3339),
+		"output":       output,
+	}
+	if resp.RunID != "" {
+		run["external_id"] = resp.RunID
+	}
+	if link := a.runLink(resp.RunID, ""); link != "" {
+		run["details_url"] = link
+	}
+
+	var created struct {
+		ID      int64  `json:"id"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := a.call("POST", fmt.Sprintf("/repos/%s/%s/check-runs", owner, repo), token, run, &created); err != nil {
+		return "", err
+	}
+
+	// Further annotations are appended by updating the run
+	for rest := annotations[len(first):]; len(rest) > 0; {
+		batch := rest
+		if len(batch) > maxCheckAnnotations {
+			batch = batch[:maxCheckAnnotations]
+		}
+		rest = rest[len(batch):]
+		update := map[string]interface{}{
+			"output": checkOutput{Title: output.Title, Summary: output.Summary, Annotations: batch},
+		}
+		if err := a.call("PATCH", fmt.Sprintf("/repos/%s/%s/check-runs/%d", owner, repo, created.ID), token, update, nil); err != nil {
+			return created.HTMLURL, err
+		}
+	}
+	return created.HTMLURL, nil
+}
+
+// runLink returns the public URL of a run, empty without a public URL
+func (a *githubApp) runLink(runID, suffix string) string {
+	if a.cfg.PublicURL == "" || runID == "" {
+		return ""
+	}
+	return a.cfg.PublicURL + "/api/v1/runs/" + runID + suffix
+}
+
+func (a *githubApp) checkSummary(resp *GeminiResponse, untested int) string {
+	var summary strings.Builder
+	if resp.RunID != "" {
+		summary.WriteString(fmt.Sprintf("Run `%s`\n\n", resp.RunID))
+	}
+	summary.WriteString("| | |\n|---|---|\n")
+	summary.WriteString(fmt.Sprintf("| Test cases | %d |\n", resp.Summary.TotalTests))
+	summary.WriteString(fmt.Sprintf("| Unit | %d |\n", resp.Summary.UnitTests))
+	summary.WriteString(fmt.Sprintf("| Integration | %d |\n", resp.Summary.IntegrationTests))
+	summary.WriteString(fmt.Sprintf("| Edge cases | %d |\n", resp.Summary.EdgeCases))
+	summary.WriteString(fmt.Sprintf("| Error handling | %d |\n", resp.Summary.ErrorHandlingTests))
+	summary.WriteString(fmt.Sprintf("| Generated files | %d |\n", len(resp.Artifacts)))
+	summary.WriteString(fmt.Sprintf("| Exported functions without tests | %d |\n", untested))
+	if link := a.runLink(resp.RunID, "/archive"); link != "" {
+		summary.WriteString(fmt.Sprintf("\n[Download the generated tests](%s)\n", link))
+	}
+	return summary.String()
+}
+
+// checkText lists the generated files of the repository
+func checkText(artifacts []GeneratedArtifact, prefix string) string {
+	var text strings.Builder
+	for _, artifact := range artifacts {
+		if !strings.HasPrefix(artifact.Path, prefix) {
+			continue
+		}
+		if text.Len() == 0 {
+			text.WriteString("Generated files:\n\n")
+		}
+		text.WriteString(fmt.Sprintf("- `%s` %s\n", strings.TrimPrefix(artifact.Path, prefix), artifact.Description))
+	}
+	return text.String()
+}
+
+// candidateArtifact returns the generated file in the function's package
+// that most likely tests it
+func candidateArtifact(artifacts []GeneratedArtifact, fn UntestedFunction) string {
+	dir := path.Dir(fn.Path)
+	name := fn.Function
+	if _, method, ok := strings.Cut(name, "."); ok {
+		name = method
+	}
+	fallback := ""
+	for _, artifact := range artifacts {
+		if path.Dir(artifact.Path) != dir || !strings.HasSuffix(artifact.Path, "_test.go") {
+			continue
+		}
+		if strings.Contains(artifact.Content, name) {
+			return artifact.Path
+		}
+		if fallback == "" {
+			fallback = artifact.Path
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Largest glossary accepted, it is included verbatim in every context
+const maxGlossarySize = 64 * 1024
+
+const glossaryHeader = "=== DOMAIN GLOSSARY ==="
+
+// RepoGlossary holds domain terminology and architecture notes for a repo
+type RepoGlossary struct {
+	Owner     string    `json:"owner"`
+	Repo      string    `json:"repo"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func glossaryID(owner, repo string) string {
+	return repoSlug(owner, repo)
+}
+
+// loadGlossary returns the glossary content for a repo, empty if none
+func loadGlossary(owner, repo string) string {
+	var glossary RepoGlossary
+	if err := loadJSON("glossaries", glossaryID(owner, repo), &glossary); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Could not read glossary for %s/%s: %v", owner, repo, err)
+		}
+		return ""
+	}
+	return glossary.Content
+}
+
+// glossarySection renders the glossary for a context or prompt
+func glossarySection(content string) string {
+	if strings.TrimSpace(content) == "" {
+		return ""
+	}
+	return glossaryHeader + "\n\n" +
+		"Use this terminology and these business rules in test names, descriptions and data.\n\n" +
+		strings.TrimSpace(content) + "\n\n"
+}
+
+// attachGlossary adds the repo glossary to a code context that was built
+// before the glossary was uploaded
+func attachGlossary(codeContext, repoRef string) string {
+	if repoRef == "" || contextHasGlossary(codeContext) {
+		return codeContext
+	}
+	owner, repo, ok := strings.Cut(repoRef, "/")
+	if !ok {
+		return codeContext
+	}
+	section := glossarySection(loadGlossary(owner, repo))
+	if section == "" {
+		return codeContext
+	}
+	return section + codeContext
+}
+
+// glossaryHandler serves GET, PUT and DELETE on
+// /api/context/{owner}/{repo}/glossary. PUT takes the raw glossary text
+// (markdown or plain text) as the body.
+func glossaryHandler(w http.ResponseWriter, r *http.Request, owner, repo string) {
+	id := glossaryID(owner, repo)
+	if _, err := storePath("glossaries", id); err != nil {
+		http.Error(w, "Invalid repository", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var glossary RepoGlossary
+		if err := loadJSON("glossaries", id, &glossary); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "Glossary not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to read glossary", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(glossary)
+
+	case "PUT":
+		content, err := io.ReadAll(io.LimitReader(r.Body, maxGlossarySize+1))
+		if isBodyTooLarge(err) {
+			http.Error(w, fmt.Sprintf("Glossary larger than %d bytes", maxGlossarySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read glossary", http.StatusBadRequest)
+			return
+		}
+		if len(content) > maxGlossarySize {
+			http.Error(w, fmt.Sprintf("Glossary larger than %d bytes", maxGlossarySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		glossary := RepoGlossary{
+			Owner:     owner,
+			Repo:      repo,
+			Content:   string(content),
+			UpdatedAt: time.Now().UTC(),
+		}
+		if err := saveJSON("glossaries", id, glossary); err != nil {
+			log.Printf("Error saving glossary: %v", err)
+			http.Error(w, "Failed to save glossary", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Saved glossary for %s/%s: %d bytes", owner, repo, len(content))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(glossary)
+
+	case "DELETE":
+		if err := deleteJSON("glossaries", id); err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Failed to delete glossary", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
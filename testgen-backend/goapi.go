@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path"
+	"strings"
+)
+
+// With goMode "api" Go files are reduced to their API instead of being
+// copied whole: the exported declarations with their doc comments, type
+// definitions in full and the bodies of short functions, which tell the
+// model most of what a test needs for a fraction of the tokens. Package
+// main has no API boundary, all of its declarations are kept. The
+// declarations are also listed in the clone response, for tests aimed at
+// single functions.
+
+// Function bodies up to this many lines are kept, longer ones are left out
+const maxKeptBodyLines = 20
+
+var (
+	goAPIMarker = fmt.Sprintf("// [reduced to its API: exported declarations, bodies up to %d lines]", maxKeptBodyLines)
+	// Aligned like gofmt aligns
+	goAPIPrinter = &printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+)
+
+// GoDeclaration is a declaration of the API of a Go package
+type GoDeclaration struct {
+	File    string `json:"file"`
+	Package string `json:"package"`
+	// func, method, type, const or var
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Receiver  string `json:"receiver,omitempty"` // type of a method's receiver, without *
+	Signature string `json:"signature"`
+}
+
+// extractGoAPI reduces the Go files to their API and returns the bytes
+// saved. Files that do not parse are kept whole.
+func extractGoAPI(files []FileContent) ([]FileContent, int) {
+	saved := 0
+	extracted := make([]FileContent, len(files))
+	for i, file := range files {
+		if path.Ext(file.Path) == ".go" {
+			if content, ok := goFileAPI(file.Path, file.Content); ok {
+				file.Content = content
+				saved += file.Size - len(content)
+				file.Size = len(content)
+			}
+		}
+		extracted[i] = file
+	}
+	return extracted, saved
+}
+
+// goFileAPI renders the API of a Go file: its package clause, imports and
+// kept declarations
+func goFileAPI(filePath, content string) (string, bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return "", false
+	}
+	all := file.Name.Name == "main"
+
+	var out bytes.Buffer
+	out.WriteString(goAPIMarker + "\n")
+	fmt.Fprintf(&out, "package %s\n", file.Name.Name)
+	print := func(node ast.Node, doc *ast.CommentGroup, comments []*ast.CommentGroup) {
+		out.WriteString("\n")
+		if doc != nil {
+			for _, comment := range doc.List {
+				out.WriteString(comment.Text + "\n")
+			}
+		}
+		goAPIPrinter.Fprint(&out, fset, &printer.CommentedNode{Node: node, Comments: comments})
+		out.WriteString("\n")
+	}
+
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				print(decl, nil, commentsWithin(file.Comments, decl.Pos(), decl.End()))
+				continue
+			}
+			kept := *decl
+			kept.Doc, kept.Specs = nil, nil
+			var comments []*ast.CommentGroup
+			for _, spec := range decl.Specs {
+				if all || specExported(spec) {
+					kept.Specs = append(kept.Specs, spec)
+					comments = append(comments, specComments(file.Comments, spec)...)
+				}
+			}
+			if len(kept.Specs) == 0 {
+				continue
+			}
+			print(&kept, decl.Doc, comments)
+		case *ast.FuncDecl:
+			if !all && !funcExported(decl) {
+				continue
+			}
+			if decl.Body == nil || lineSpan(fset, decl.Body) <= maxKeptBodyLines {
+				print(decl, decl.Doc, commentsWithin(file.Comments, decl.Pos(), decl.End()))
+				continue
+			}
+			signature := *decl
+			signature.Doc, signature.Body = nil, nil
+			print(&signature, decl.Doc, nil)
+			out.Truncate(out.Len() - 1)
+			fmt.Fprintf(&out, " // body of %d lines left out\n", lineSpan(fset, decl.Body))
+		}
+	}
+	return out.String(), true
+}
+
+// goDeclarations lists the declarations of the Go files of a context
+func goDeclarations(files []FileContent) []GoDeclaration {
+	var declarations []GoDeclaration
+	for _, file := range files {
+		if path.Ext(file.Path) != ".go" {
+			continue
+		}
+		fset := token.NewFileSet()
+		parsed, err := parser.ParseFile(fset, file.Path, file.Content, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		all := parsed.Name.Name == "main"
+		add := func(kind, name, receiver string, node ast.Node) {
+			var signature bytes.Buffer
+			printer.Fprint(&signature, fset, node)
+			declarations = append(declarations, GoDeclaration{
+				File:     file.Path,
+				Package:  parsed.Name.Name,
+				Kind:     kind,
+				Name:     name,
+				Receiver: receiver,
+				// On one line, struct and interface types without their body
+				Signature: strings.TrimSuffix(strings.Join(strings.Fields(signature.String()), " "), " { }"),
+			})
+		}
+		for _, decl := range parsed.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if !all && !specExported(spec) {
+						continue
+					}
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						// Only the kind of a struct or interface, not its fields
+						shown := *spec
+						switch spec.Type.(type) {
+						case *ast.StructType:
+							shown.Type = &ast.StructType{Fields: &ast.FieldList{}}
+						case *ast.InterfaceType:
+							shown.Type = &ast.InterfaceType{Methods: &ast.FieldList{}}
+						}
+						add("type", spec.Name.Name, "", &ast.GenDecl{Tok: token.TYPE, Specs: []ast.Spec{&shown}})
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							if all || name.IsExported() {
+								value := &ast.ValueSpec{Names: []*ast.Ident{name}, Type: spec.Type}
+								add(decl.Tok.String(), name.Name, "", &ast.GenDecl{Tok: decl.Tok, Specs: []ast.Spec{value}})
+							}
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				if !all && !funcExported(decl) {
+					continue
+				}
+				signature := *decl
+				signature.Doc, signature.Body = nil, nil
+				if receiver := receiverType(decl); receiver != "" {
+					add("method", decl.Name.Name, receiver, &signature)
+				} else {
+					add("func", decl.Name.Name, "", &signature)
+				}
+			}
+		}
+	}
+	return declarations
+}
+
+// specExported reports whether a type, const or var spec declares an
+// exported name
+func specExported(spec ast.Spec) bool {
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		return spec.Name.IsExported()
+	case *ast.ValueSpec:
+		for _, name := range spec.Names {
+			if name.IsExported() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// funcExported reports whether a function is exported, for methods on an
+// exported type
+func funcExported(decl *ast.FuncDecl) bool {
+	if !decl.Name.IsExported() {
+		return false
+	}
+	receiver := receiverType(decl)
+	return receiver == "" || ast.IsExported(receiver)
+}
+
+// receiverType is the name of the type of a method's receiver, empty for
+// functions
+func receiverType(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return ""
+	}
+	expr := decl.Recv.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch expr := expr.(type) {
+	case *ast.IndexExpr:
+		if ident, ok := expr.X.(*ast.Ident); ok {
+			return ident.Name
+		}
+	case *ast.IndexListExpr:
+		if ident, ok := expr.X.(*ast.Ident); ok {
+			return ident.Name
+		}
+	case *ast.Ident:
+		return expr.Name
+	}
+	return ""
+}
+
+// commentsWithin are the comment groups between two positions
+func commentsWithin(comments []*ast.CommentGroup, from, to token.Pos) []*ast.CommentGroup {
+	var within []*ast.CommentGroup
+	for _, group := range comments {
+		if group.Pos() >= from && group.End() <= to {
+			within = append(within, group)
+		}
+	}
+	return within
+}
+
+// specComments are the comment groups of a spec, its doc and line comment
+// included
+func specComments(comments []*ast.CommentGroup, spec ast.Spec) []*ast.CommentGroup {
+	from, to := spec.Pos(), spec.End()
+	var doc, line *ast.CommentGroup
+	switch spec := spec.(type) {
+	case *ast.TypeSpec:
+		doc, line = spec.Doc, spec.Comment
+	case *ast.ValueSpec:
+		doc, line = spec.Doc, spec.Comment
+	}
+	if doc != nil {
+		from = doc.Pos()
+	}
+	if line != nil {
+		to = line.End()
+	}
+	return commentsWithin(comments, from, to)
+}
+
+// lineSpan counts the lines a node spans
+func lineSpan(fset *token.FileSet, node ast.Node) int {
+	return fset.Position(node.End()).Line - fset.Position(node.Pos()).Line + 1
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Generated Go test files are fixed up the way goimports would before they
+// are handed out: imports nothing refers to are dropped, the packages the
+// code refers to are imported and the file is gofmt'ed. Packages resolve to
+// the repository's own packages and the shared helpers first, then the
+// standard library and the common test libraries. Test libraries the
+// repository does not require yet are added to its go.mod, emitted as an
+// artifact to replace the file with.
+
+// goImport is a package a qualifier may refer to. Members, when set, are
+// the only selectors the package has, to tell apart packages of one name.
+type goImport struct {
+	Path    string
+	Module  string // empty for the standard library
+	Version string
+	Members []string
+}
+
+var stdlibPackages = []string{
+	"bufio", "bytes", "context", "crypto/rand", "crypto/sha256", "encoding/base64", "encoding/hex",
+	"encoding/json", "encoding/xml", "errors", "flag", "fmt", "io", "io/fs", "log", "maps", "math",
+	"math/big", "net", "net/http", "net/http/httptest", "net/url", "os", "os/exec", "path",
+	"path/filepath", "reflect", "regexp", "runtime", "slices", "sort", "strconv", "strings", "sync",
+	"sync/atomic", "testing", "testing/fstest", "testing/iotest", "testing/quick", "time",
+	"unicode", "unicode/utf8",
+}
+
+var goCmpMembers = []string{"AllowUnexported", "Comparer", "Diff", "Equal", "Exporter", "FilterPath",
+	"FilterValues", "Ignore", "Option", "Options", "Path", "Reporter", "Transformer"}
+
+// knownImports lists the candidates of each qualifier, the first one that
+// has every selector used wins
+var knownImports = func() map[string][]goImport {
+	imports := map[string][]goImport{
+		"assert":  {{Path: "github.com/stretchr/testify/assert", Module: "github.com/stretchr/testify", Version: "v1.10.0"}},
+		"require": {{Path: "github.com/stretchr/testify/require", Module: "github.com/stretchr/testify", Version: "v1.10.0"}},
+		"mock":    {{Path: "github.com/stretchr/testify/mock", Module: "github.com/stretchr/testify", Version: "v1.10.0"}},
+		"suite":   {{Path: "github.com/stretchr/testify/suite", Module: "github.com/stretchr/testify", Version: "v1.10.0"}},
+		"cmp": {
+			{Path: "github.com/google/go-cmp/cmp", Module: "github.com/google/go-cmp", Version: "v0.7.0", Members: goCmpMembers},
+			{Path: "cmp"},
+		},
+		"cmpopts": {{Path: "github.com/google/go-cmp/cmp/cmpopts", Module: "github.com/google/go-cmp", Version: "v0.7.0"}},
+		"gomock":  {{Path: "go.uber.org/mock/gomock", Module: "go.uber.org/mock", Version: "v0.5.2"}},
+	}
+	for _, pkg := range stdlibPackages {
+		name := path.Base(pkg)
+		// math/rand is meant far more often than crypto/rand
+		if name == "rand" {
+			imports[name] = append(imports[name], goImport{Path: "math/rand"})
+		}
+		imports[name] = append(imports[name], goImport{Path: pkg})
+	}
+	return imports
+}()
+
+// goModFile is what the imports need of a go.mod in the context
+type goModFile struct {
+	Path     string
+	Content  string
+	Module   string
+	Requires map[string]bool
+	Added    map[string]string // requirements of the generated tests
+}
+
+func parseGoMod(filePath, content string) *goModFile {
+	mod := &goModFile{Path: filePath, Content: content, Requires: map[string]bool{}, Added: map[string]string{}}
+	inRequire := false
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "//"); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case inRequire:
+			if fields[0] == ")" {
+				inRequire = false
+			} else {
+				mod.Requires[fields[0]] = true
+			}
+		case fields[0] == "module" && len(fields) > 1:
+			mod.Module, _ = strconv.Unquote(fields[1])
+			if mod.Module == "" {
+				mod.Module = fields[1]
+			}
+		case fields[0] == "require" && len(fields) > 1:
+			if fields[1] == "(" {
+				inRequire = true
+			} else {
+				mod.Requires[fields[1]] = true
+			}
+		}
+	}
+	return mod
+}
+
+// goPackage is a package of the repository
+type goPackage struct {
+	Dir  string
+	Path string
+}
+
+// goImportIndex resolves qualifiers against the Go packages of a context
+type goImportIndex struct {
+	mods     []*goModFile
+	packages map[string][]goPackage     // repository packages by name
+	names    map[string]string          // package names by import path
+	declared map[string]map[string]bool // package-level names by directory
+}
+
+func newGoImportIndex(files []FileContent) *goImportIndex {
+	index := &goImportIndex{packages: map[string][]goPackage{}, names: map[string]string{}, declared: map[string]map[string]bool{}}
+	for _, file := range files {
+		if path.Base(slashPath(file.Path)) == "go.mod" {
+			index.mods = append(index.mods, parseGoMod(slashPath(file.Path), file.Content))
+		}
+	}
+	// Nested modules first, they own the directories below them
+	sort.Slice(index.mods, func(i, j int) bool { return len(index.mods[i].Path) > len(index.mods[j].Path) })
+
+	for name, candidates := range knownImports {
+		for _, candidate := range candidates {
+			index.names[candidate.Path] = name
+		}
+	}
+
+	_, goFiles := parseGoFiles(files)
+	for _, goFile := range goFiles {
+		dir := path.Dir(slashPath(goFile.Path))
+		if index.declared[dir] == nil {
+			index.declared[dir] = map[string]bool{}
+		}
+		for _, decl := range goFile.File.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					index.declared[dir][decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							index.declared[dir][name.Name] = true
+						}
+					case *ast.TypeSpec:
+						index.declared[dir][spec.Name.Name] = true
+					}
+				}
+			}
+		}
+
+		name := goFile.File.Name.Name
+		if name == "main" || strings.HasSuffix(name, "_test") || strings.HasSuffix(goFile.Path, "_test.go") {
+			continue
+		}
+		mod := index.modOf(dir)
+		if mod == nil {
+			continue
+		}
+		importPath := mod.Module
+		switch modDir := path.Dir(mod.Path); {
+		case modDir == "." && dir != ".":
+			importPath += "/" + dir
+		case modDir != "." && dir != modDir:
+			importPath += "/" + strings.TrimPrefix(dir, modDir+"/")
+		}
+		if _, ok := index.names[importPath]; !ok {
+			index.names[importPath] = name
+			index.packages[name] = append(index.packages[name], goPackage{Dir: dir, Path: importPath})
+		}
+	}
+	return index
+}
+
+// modOf is the go.mod governing a directory
+func (index *goImportIndex) modOf(dir string) *goModFile {
+	for _, mod := range index.mods {
+		modDir := path.Dir(mod.Path)
+		if modDir == "." || dir == modDir || strings.HasPrefix(dir, modDir+"/") {
+			return mod
+		}
+	}
+	return nil
+}
+
+// sharedDirs counts the leading directories two paths have in common
+func sharedDirs(a, b string) int {
+	aParts, bParts := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(aParts) && n < len(bParts) && aParts[n] == bParts[n] {
+		n++
+	}
+	return n
+}
+
+// resolve picks the import of a qualifier with the selectors used on it, in
+// a file of dir. External test packages import the package they test.
+func (index *goImportIndex) resolve(qualifier, dir string, external bool, selectors []string) (goImport, bool) {
+	// Repository packages of the name, the nearest wins
+	var best *goPackage
+	for i, pkg := range index.packages[qualifier] {
+		if pkg.Dir == dir && !external {
+			continue
+		}
+		if best == nil || sharedDirs(pkg.Dir, dir) > sharedDirs(best.Dir, dir) {
+			best = &index.packages[qualifier][i]
+		}
+	}
+	if best != nil {
+		return goImport{Path: best.Path}, true
+	}
+
+	for _, candidate := range knownImports[qualifier] {
+		if candidate.Members == nil {
+			return candidate, true
+		}
+		members := map[string]bool{}
+		for _, member := range candidate.Members {
+			members[member] = true
+		}
+		ok := true
+		for _, selector := range selectors {
+			ok = ok && members[selector]
+		}
+		if ok {
+			return candidate, true
+		}
+	}
+	return goImport{}, false
+}
+
+// fixGoImports runs the import fixes over the Go files of the artifacts and
+// returns them with the go.mod files that need new requirements
+func fixGoImports(artifacts []GeneratedArtifact, codeContext string) ([]GeneratedArtifact, []AnalysisWarning) {
+	var index *goImportIndex
+	var warnings []AnalysisWarning
+	for i, artifact := range artifacts {
+		if !strings.HasSuffix(artifact.Path, ".go") {
+			continue
+		}
+		if index == nil {
+			index = newGoImportIndex(append(splitContextFiles(codeContext), helperFiles(artifacts)...))
+		}
+		content, fileWarnings := index.fixFile(artifact.Path, artifact.Content)
+		artifacts[i].Content = content
+		warnings = append(warnings, fileWarnings...)
+	}
+	if index == nil {
+		return artifacts, warnings
+	}
+
+	for _, mod := range index.mods {
+		if len(mod.Added) == 0 {
+			continue
+		}
+		var modules []string
+		for module := range mod.Added {
+			modules = append(modules, module)
+		}
+		sort.Strings(modules)
+		var require strings.Builder
+		require.WriteString("\nrequire (\n")
+		for _, module := range modules {
+			fmt.Fprintf(&require, "\t%s %s\n", module, mod.Added[module])
+		}
+		require.WriteString(")\n")
+
+		// A go.mod among the artifacts already is the one to extend
+		updated := false
+		for i, artifact := range artifacts {
+			if artifact.Path == mod.Path {
+				artifacts[i].Content = strings.TrimRight(artifact.Content, "\n") + "\n" + require.String()
+				updated = true
+			}
+		}
+		if !updated {
+			artifacts = append(artifacts, GeneratedArtifact{
+				Type:        "go-mod",
+				Path:        mod.Path,
+				Description: fmt.Sprintf("%s requiring %s for the generated tests; run go mod tidy to update go.sum", mod.Path, strings.Join(modules, ", ")),
+				Content:     strings.TrimRight(mod.Content, "\n") + "\n" + require.String(),
+			})
+		}
+	}
+	return artifacts, warnings
+}
+
+// helperFiles are the Go helpers among the artifacts, the tests resolve
+// their packages like the repository's own
+func helperFiles(artifacts []GeneratedArtifact) []FileContent {
+	var files []FileContent
+	for _, artifact := range artifacts {
+		if artifact.Type == "helper" && strings.HasSuffix(artifact.Path, ".go") {
+			files = append(files, FileContent{Path: artifact.Path, Content: artifact.Content, Size: len(artifact.Content)})
+		}
+	}
+	return files
+}
+
+// fixFile fixes the imports of one Go file. Files that do not parse or use
+// cgo are returned as they are.
+func (index *goImportIndex) fixFile(filePath, content string) (string, []AnalysisWarning) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, content, parser.ParseComments)
+	if err != nil {
+		return content, nil
+	}
+	dir := path.Dir(slashPath(filePath))
+	external := strings.HasSuffix(file.Name.Name, "_test")
+
+	// Qualifiers the parser could not resolve to a declaration of the file
+	selectors := map[string][]string{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Obj == nil {
+				selectors[ident.Name] = append(selectors[ident.Name], sel.Sel.Name)
+			}
+		}
+		return true
+	})
+
+	type importLine struct {
+		name, path string
+	}
+	var lines []importLine
+	imported := map[string]bool{}
+	changed := false
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		if importPath == "C" {
+			return content, nil
+		}
+		name := ""
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		used := name
+		if used == "" {
+			used = index.names[importPath]
+		}
+		// Only imports whose package name is known can be told unused
+		if used != "" && used != "_" && used != "." && selectors[used] == nil {
+			changed = true
+			continue
+		}
+		if used == "" {
+			used = importName(spec)
+		}
+		imported[used] = true
+		lines = append(lines, importLine{name, importPath})
+	}
+
+	var warnings []AnalysisWarning
+	var qualifiers []string
+	for qualifier := range selectors {
+		qualifiers = append(qualifiers, qualifier)
+	}
+	sort.Strings(qualifiers)
+	for _, qualifier := range qualifiers {
+		if imported[qualifier] || !external && index.declared[dir][qualifier] {
+			continue
+		}
+		imp, ok := index.resolve(qualifier, dir, external, selectors[qualifier])
+		if !ok {
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "imports",
+				File:    filePath,
+				Symbol:  qualifier,
+				Message: fmt.Sprintf("%s refers to package %s, which is neither in the context nor a known library, add its import", filePath, qualifier),
+			})
+			continue
+		}
+		name := ""
+		if path.Base(imp.Path) != qualifier {
+			name = qualifier
+		}
+		lines = append(lines, importLine{name, imp.Path})
+		imported[qualifier] = true
+		changed = true
+
+		if imp.Module == "" {
+			continue
+		}
+		mod := index.modOf(dir)
+		switch {
+		case mod == nil:
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "imports",
+				File:    filePath,
+				Symbol:  qualifier,
+				Message: fmt.Sprintf("%s imports %s, the context has no go.mod to require %s %s in", filePath, imp.Path, imp.Module, imp.Version),
+			})
+		case !mod.Requires[imp.Module] && !strings.HasPrefix(imp.Path, mod.Module+"/"):
+			mod.Added[imp.Module] = imp.Version
+		}
+	}
+
+	src := content
+	if changed {
+		// Replace every import declaration by one block after the package clause
+		var std, other []string
+		for _, line := range lines {
+			spec := strconv.Quote(line.path)
+			if line.name != "" {
+				spec = line.name + " " + spec
+			}
+			if strings.Contains(strings.SplitN(line.path, "/", 2)[0], ".") {
+				other = append(other, spec)
+			} else {
+				std = append(std, spec)
+			}
+		}
+		sort.Strings(std)
+		sort.Strings(other)
+		var block strings.Builder
+		if len(std)+len(other) > 0 {
+			block.WriteString("\n\nimport (\n")
+			for _, spec := range std {
+				block.WriteString("\t" + spec + "\n")
+			}
+			if len(std) > 0 && len(other) > 0 {
+				block.WriteString("\n")
+			}
+			for _, spec := range other {
+				block.WriteString("\t" + spec + "\n")
+			}
+			block.WriteString(")\n")
+		}
+
+		var b strings.Builder
+		last := fset.Position(file.Name.End()).Offset
+		b.WriteString(content[:last])
+		b.WriteString(block.String())
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.IMPORT {
+				continue
+			}
+			start := fset.Position(gen.Pos()).Offset
+			if gen.Doc != nil {
+				start = fset.Position(gen.Doc.Pos()).Offset
+			}
+			b.WriteString(content[last:start])
+			last = fset.Position(gen.End()).Offset
+		}
+		b.WriteString(content[last:])
+		src = b.String()
+	}
+
+	formatted, err := format.Source([]byte(src))
+	if err != nil {
+		return content, warnings
+	}
+	return string(formatted), warnings
+}
@@ -0,0 +1,857 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With output "go-files" the test cases are also written as Go test files:
+// one table-driven test per function under test, in the package of the
+// function and shaped like the skeletons, with a row per test case. The
+// input and expected value of a case are converted to Go literals of the
+// function's parameter and result types. The files then go through the
+// conflict and import fixes like any generated Go file. Cases whose
+// function is not found, or whose values do not fit its types, are left
+// out and reported.
+
+// Test cases of the output are rows of their table
+var skeletonCasesLine = regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(skeletonCasesMarker) + `\n`)
+
+// goTypeDecls are the types a package declares, by name
+type goTypeDecls map[string]ast.Expr
+
+// goTestTable is the test of one function and its rows
+type goTestTable struct {
+	fn   skeletonFunc
+	rows []string
+}
+
+// goTestFile is a test file of the output
+type goTestFile struct {
+	path    string
+	pkg     string
+	imports map[string]string
+	sources []string
+	tables  []*goTestTable
+	cases   int
+}
+
+// goTestArtifacts writes the test cases that are not in a generated Go
+// file yet as table-driven Go test files, and points them at those files
+func goTestArtifacts(testResponse *GeminiResponse, codeContext string) ([]GeneratedArtifact, []AnalysisWarning) {
+	files := splitContextFiles(codeContext)
+	fset, goFiles := parseGoFiles(files)
+	if len(goFiles) == 0 {
+		return nil, nil
+	}
+	layout := detectTestLayout(files)
+
+	parsed := map[string]parsedGoFile{}
+	types := map[string]goTypeDecls{}
+	for _, goFile := range goFiles {
+		filePath := slashPath(goFile.Path)
+		parsed[filePath] = goFile
+		dir := path.Dir(filePath)
+		if types[dir] == nil {
+			types[dir] = goTypeDecls{}
+		}
+		for _, decl := range goFile.File.Decls {
+			if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.TYPE {
+				for _, spec := range decl.Specs {
+					spec := spec.(*ast.TypeSpec)
+					if spec.TypeParams == nil {
+						types[dir][spec.Name.Name] = spec.Type
+					}
+				}
+			}
+		}
+	}
+	existing := map[string]bool{}
+	for _, file := range files {
+		existing[slashPath(file.Path)] = true
+	}
+	carried := map[string]bool{}
+	for _, artifact := range testResponse.Artifacts {
+		carried[artifact.Path] = true
+	}
+
+	// Functions of each source file, with the imports of their signatures
+	type sourceFuncs struct {
+		funcs   []skeletonFunc
+		imports map[string]string
+	}
+	sources := map[string]*sourceFuncs{}
+	funcsOf := func(sourcePath string) *sourceFuncs {
+		if funcs, ok := sources[sourcePath]; ok {
+			return funcs
+		}
+		funcs := &sourceFuncs{}
+		if goFile, ok := parsed[sourcePath]; ok && !strings.HasSuffix(sourcePath, "_test.go") {
+			funcs.funcs, funcs.imports = skeletonFuncs(fset, goFile)
+		}
+		sources[sourcePath] = funcs
+		return funcs
+	}
+
+	var testFiles []*goTestFile
+	byPath := map[string]*goTestFile{}
+	tables := map[string]*goTestTable{} // by test file and function
+	testNames := map[string]map[string]bool{}
+	var warnings []AnalysisWarning
+	skip := func(testCase GeminiTestCase, reason string) {
+		warnings = append(warnings, AnalysisWarning{
+			Kind:    "go-files",
+			File:    testCase.SuggestedPath,
+			Message: fmt.Sprintf("%s is not written to a Go test file: %s", testCase.Name, reason),
+			TestIDs: []string{testCase.ID},
+		})
+	}
+
+	for i := range testResponse.TestCases {
+		testCase := &testResponse.TestCases[i]
+		if !strings.HasSuffix(testCase.SuggestedPath, ".go") || carried[testCase.SuggestedPath] {
+			continue
+		}
+		sourcePath := layout.sourceOf(*testCase)
+		source := funcsOf(sourcePath)
+		fn, ok := goTestedFunc(*testCase, source.funcs)
+		if !ok {
+			skip(*testCase, "the function it tests is not found in the context")
+			continue
+		}
+		dir := path.Dir(sourcePath)
+		row, err := goTableRow(*testCase, fn, types[dir])
+		if err != nil {
+			skip(*testCase, err.Error())
+			continue
+		}
+
+		testPath := testCase.SuggestedPath
+		if path.Dir(testPath) != dir || !strings.HasSuffix(testPath, "_test.go") {
+			testPath = skeletonTestPath(sourcePath, existing)
+		}
+		file, ok := byPath[testPath]
+		if !ok {
+			file = &goTestFile{path: testPath, pkg: parsed[sourcePath].File.Name.Name, imports: map[string]string{}}
+			byPath[testPath] = file
+			testFiles = append(testFiles, file)
+		}
+		if !containsString(file.sources, sourcePath) {
+			file.sources = append(file.sources, sourcePath)
+		}
+		for name, line := range source.imports {
+			file.imports[name] = line
+		}
+
+		key := testPath + "\x00" + fn.File + "\x00" + fn.Receiver + "." + fn.Name
+		table, ok := tables[key]
+		if !ok {
+			// Test names must be unique per package, e.g. for foo and Foo
+			if testNames[dir] == nil {
+				testNames[dir] = map[string]bool{}
+			}
+			name := fn.TestName
+			for n := 2; testNames[dir][name]; n++ {
+				name = fmt.Sprintf("%s%d", fn.TestName, n)
+			}
+			testNames[dir][name] = true
+			fn.TestName = name
+			table = &goTestTable{fn: fn}
+			tables[key] = table
+			file.tables = append(file.tables, table)
+		}
+		table.rows = append(table.rows, row)
+		file.cases++
+		testCase.SuggestedPath = testPath
+	}
+
+	var artifacts []GeneratedArtifact
+	for _, file := range testFiles {
+		content, err := file.render()
+		if err != nil {
+			warnings = append(warnings, AnalysisWarning{
+				Kind:    "go-files",
+				File:    file.path,
+				Message: fmt.Sprintf("%s could not be written: %v", file.path, err),
+			})
+			continue
+		}
+		existing[file.path] = true
+		artifacts = append(artifacts, GeneratedArtifact{
+			Type:        "go-test",
+			Path:        file.path,
+			Language:    "go",
+			Description: fmt.Sprintf("Table-driven tests of %d test cases for %s", file.cases, strings.Join(file.sources, ", ")),
+			Content:     content,
+		})
+	}
+	return artifacts, warnings
+}
+
+// render writes the file with the skeleton of each function's test and
+// its rows in the table
+func (file *goTestFile) render() (string, error) {
+	var body bytes.Buffer
+	usesReflect := false
+	for _, table := range file.tables {
+		if renderSkeletonTest(&body, table.fn) {
+			usesReflect = true
+		}
+	}
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "package %s\n\nimport (\n", file.pkg)
+	if usesReflect {
+		src.WriteString("\t\"reflect\"\n")
+	}
+	src.WriteString("\t\"testing\"\n")
+	var pkgs []string
+	for pkg := range file.imports {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		fmt.Fprintf(&src, "\t%s\n", file.imports[pkg])
+	}
+	src.WriteString(")\n\n")
+	src.Write(body.Bytes())
+
+	content := src.String()
+	for _, table := range file.tables {
+		for _, row := range table.rows {
+			content, _ = insertTableRow(content, table.fn.TestName, row)
+		}
+	}
+	content = skeletonCasesLine.ReplaceAllString(content, "")
+	// Imports of signatures the file has no test of are dropped later
+	formatted, err := format.Source([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	return string(formatted), nil
+}
+
+// goTestedFunc finds the function a test case tests among the functions of
+// its source file, by the names called in its code and then in its name.
+// Of methods of one name the one whose receiver type is mentioned wins.
+func goTestedFunc(testCase GeminiTestCase, funcs []skeletonFunc) (skeletonFunc, bool) {
+	pick := func(name string) (skeletonFunc, bool) {
+		var found []skeletonFunc
+		for _, fn := range funcs {
+			if fn.Name == name {
+				found = append(found, fn)
+			}
+		}
+		if len(found) == 0 {
+			return skeletonFunc{}, false
+		}
+		for _, fn := range found {
+			receiver := strings.TrimPrefix(fn.Receiver, "*")
+			if receiver != "" && (strings.Contains(testCase.Code, receiver) || strings.Contains(testCase.Name, receiver)) {
+				return fn, true
+			}
+		}
+		return found[0], true
+	}
+	for _, text := range []string{testCase.Code, testCase.Name} {
+		for _, match := range calledName.FindAllStringSubmatch(text, -1) {
+			if fn, ok := pick(match[1]); ok {
+				return fn, true
+			}
+		}
+	}
+	for _, word := range strings.FieldsFunc(testCase.Name, func(r rune) bool { return r == '_' || r == ' ' || r == '.' || r == '/' }) {
+		word = strings.TrimSuffix(strings.TrimPrefix(word, "Test"), "Test")
+		if fn, ok := pick(word); ok {
+			return fn, true
+		}
+	}
+	return skeletonFunc{}, false
+}
+
+// goTableRow writes a test case as a row of the table of its function's
+// test, with its description as a comment
+func goTableRow(testCase GeminiTestCase, fn skeletonFunc, types goTypeDecls) (string, error) {
+	fields := []string{"name: " + strconv.Quote(testCase.Name)}
+
+	input := testCase.Input
+	if fn.Receiver != "" {
+		receiverType, err := parser.ParseExpr(fn.Receiver)
+		if err != nil {
+			return "", err
+		}
+		value, given := inputReceiver(input)
+		receiver, ok := goZeroLiteral(receiverType, types)
+		if given {
+			receiver, ok = goLiteral(value, receiverType, types)
+		}
+		if !ok {
+			return "", fmt.Errorf("its receiver does not fit %s", fn.Receiver)
+		}
+		fields = append(fields, "receiver: "+receiver)
+	}
+
+	if len(fn.Params) > 0 {
+		args, ok := goArgs(input, fn.Params, types)
+		if !ok {
+			return "", fmt.Errorf("its input does not fit the parameters of %s", fn.Name)
+		}
+		var named []string
+		for i, param := range fn.Params {
+			named = append(named, param.Name+": "+args[i])
+		}
+		fields = append(fields, "args: args{"+strings.Join(named, ", ")+"}")
+	}
+
+	wants, wantErr, err := goWants(testCase.Expected, fn, types)
+	if err != nil {
+		return "", err
+	}
+	for i, want := range wants {
+		suffix := ""
+		if i > 0 {
+			suffix = strconv.Itoa(i)
+		}
+		fields = append(fields, fmt.Sprintf("want%s: %s", suffix, want))
+	}
+	if wantErr {
+		fields = append(fields, "wantErr: true")
+	}
+
+	row := "{" + strings.Join(fields, ", ") + "}"
+	if description := strings.TrimSpace(strings.SplitN(testCase.Description, "\n", 2)[0]); description != "" {
+		row = "// " + description + "\n" + row
+	}
+	return row, nil
+}
+
+// inputReceiver is the receiver given with the input of a method's test
+func inputReceiver(input interface{}) (interface{}, bool) {
+	object, ok := input.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for key, value := range object {
+		if strings.EqualFold(key, "receiver") {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// goArgs converts the input of a test case to the arguments of a function:
+// an object by parameter name, an array by position, a string of Go
+// literals separated by commas, or the value of the only parameter
+func goArgs(input interface{}, params []skeletonParam, types goTypeDecls) ([]string, bool) {
+	paramTypes := make([]ast.Expr, len(params))
+	for i, param := range params {
+		paramType, err := parser.ParseExpr(param.Type)
+		if err != nil {
+			return nil, false
+		}
+		paramTypes[i] = paramType
+	}
+	convert := func(values []interface{}) ([]string, bool) {
+		args := make([]string, len(values))
+		for i, value := range values {
+			arg, ok := goLiteral(value, paramTypes[i], types)
+			if !ok {
+				return nil, false
+			}
+			args[i] = arg
+		}
+		return args, true
+	}
+
+	if object, ok := input.(map[string]interface{}); ok {
+		values := make([]interface{}, len(params))
+		found := 0
+		for i, param := range params {
+			for key, value := range object {
+				if strings.EqualFold(key, param.Name) {
+					values[i] = value
+					found++
+					break
+				}
+			}
+		}
+		if found == len(params) {
+			if args, ok := convert(values); ok {
+				return args, true
+			}
+		}
+	}
+	if len(params) == 1 {
+		if args, ok := convert([]interface{}{input}); ok {
+			return args, true
+		}
+	}
+	if array, ok := input.([]interface{}); ok && len(array) == len(params) {
+		return convert(array)
+	}
+	if text, ok := input.(string); ok {
+		return literalArgs(text, len(params))
+	}
+	return nil, false
+}
+
+// literalArgs takes the arguments from a string of Go literals such as
+// `2, "b", -1.5`, anything else does not fit
+func literalArgs(text string, count int) ([]string, bool) {
+	text = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(text), "("), ")")
+	expr, err := parser.ParseExpr("f(" + text + ")")
+	if err != nil {
+		return nil, false
+	}
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != count || call.Ellipsis.IsValid() {
+		return nil, false
+	}
+	var args []string
+	for _, arg := range call.Args {
+		literal := arg
+		if unary, ok := arg.(*ast.UnaryExpr); ok && unary.Op == token.SUB {
+			literal = unary.X
+		}
+		switch literal := literal.(type) {
+		case *ast.BasicLit:
+		case *ast.Ident:
+			if literal.Name != "true" && literal.Name != "false" && literal.Name != "nil" {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+		// Positions count from 1, after the "f(" around the text
+		args = append(args, text[int(arg.Pos())-3:int(arg.End())-3])
+	}
+	return args, true
+}
+
+// goWants converts the expected value of a test case to the results of a
+// function. Expectations of an error set wantErr for functions returning
+// one, a single result may be wrapped in an object such as
+// {"result": 3}.
+func goWants(expected interface{}, fn skeletonFunc, types goTypeDecls) ([]string, bool, error) {
+	if expectsError(expected) {
+		if !fn.ReturnErr {
+			return nil, false, fmt.Errorf("it expects an error %s does not return", fn.Name)
+		}
+		return nil, true, nil
+	}
+	resultTypes := make([]ast.Expr, len(fn.Results))
+	for i, result := range fn.Results {
+		resultType, err := parser.ParseExpr(result)
+		if err != nil {
+			return nil, false, err
+		}
+		resultTypes[i] = resultType
+	}
+
+	switch len(resultTypes) {
+	case 0:
+		return nil, false, nil
+	case 1:
+		if want, ok := goLiteral(expected, resultTypes[0], types); ok {
+			return []string{want}, false, nil
+		}
+		if object, ok := expected.(map[string]interface{}); ok && len(object) == 1 {
+			for key, value := range object {
+				switch strings.ToLower(key) {
+				case "result", "value", "return", "returns", "output", "want", "expected":
+					if want, ok := goLiteral(value, resultTypes[0], types); ok {
+						return []string{want}, false, nil
+					}
+				}
+			}
+		}
+	default:
+		if array, ok := expected.([]interface{}); ok && len(array) == len(resultTypes) {
+			wants := make([]string, len(array))
+			for i, value := range array {
+				want, ok := goLiteral(value, resultTypes[i], types)
+				if !ok {
+					return nil, false, fmt.Errorf("its expected value does not fit the results of %s", fn.Name)
+				}
+				wants[i] = want
+			}
+			return wants, false, nil
+		}
+	}
+	return nil, false, fmt.Errorf("its expected value does not fit the results of %s", fn.Name)
+}
+
+// expectsError reports whether an expected value describes an error, as
+// an object with an error key or text mentioning one
+func expectsError(expected interface{}) bool {
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		for key, value := range expected {
+			switch strings.ToLower(key) {
+			case "error", "err", "wanterr", "exception", "panic", "throws":
+				return value != nil && value != false && value != ""
+			}
+		}
+	case string:
+		text := strings.ToLower(expected)
+		for _, negation := range []string{"no error", "nil error", "without error", "without an error", "without errors"} {
+			if strings.Contains(text, negation) {
+				return false
+			}
+		}
+		return strings.HasPrefix(text, "error") || strings.Contains(text, "returns an error") || strings.Contains(text, "an error is returned") || strings.Contains(text, "fails with")
+	}
+	return false
+}
+
+// goLiteral writes a JSON value as a Go literal of a type, basic types,
+// slices, maps, pointers and structs of the package, and any
+func goLiteral(value interface{}, typ ast.Expr, types goTypeDecls) (string, bool) {
+	switch typ := typ.(type) {
+	case *ast.ParenExpr:
+		return goLiteral(value, typ.X, types)
+	case *ast.Ident:
+		switch typ.Name {
+		case "any":
+			return anyLiteral(value)
+		case "error":
+			return "nil", value == nil
+		}
+		if literal, ok, basic := basicLiteral(value, typ.Name); basic {
+			return literal, ok
+		}
+		decl, ok := types[typ.Name]
+		if !ok {
+			return "", false
+		}
+		if structType, ok := decl.(*ast.StructType); ok {
+			return structLiteral(value, typ.Name, structType, types)
+		}
+		// Untyped constants and composite literals of the underlying
+		// type are assignable to the named one
+		if _, ok := decl.(*ast.Ident); ok {
+			return goLiteral(value, decl, types)
+		}
+		if literal, ok := goLiteral(value, decl, types); ok {
+			if literal == "nil" {
+				return literal, true
+			}
+			return typ.Name + "(" + literal + ")", true
+		}
+		return "", false
+	case *ast.InterfaceType:
+		if len(typ.Methods.List) == 0 {
+			return anyLiteral(value)
+		}
+		return "nil", value == nil
+	case *ast.StarExpr:
+		if value == nil {
+			return "nil", true
+		}
+		if ident, ok := typ.X.(*ast.Ident); ok {
+			if structType, ok := types[ident.Name].(*ast.StructType); ok {
+				literal, ok := structLiteral(value, ident.Name, structType, types)
+				return "&" + literal, ok
+			}
+		}
+		return "", false
+	case *ast.ArrayType:
+		if typ.Len != nil {
+			return "", false
+		}
+		if value == nil {
+			return "nil", true
+		}
+		if text, ok := value.(string); ok {
+			if ident, ok := typ.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+				return "[]byte(" + strconv.Quote(text) + ")", true
+			}
+		}
+		array, ok := value.([]interface{})
+		if !ok {
+			return "", false
+		}
+		elements := make([]string, len(array))
+		for i, element := range array {
+			if elements[i], ok = goLiteral(element, typ.Elt, types); !ok {
+				return "", false
+			}
+		}
+		return typeString(typ) + "{" + strings.Join(elements, ", ") + "}", true
+	case *ast.MapType:
+		if value == nil {
+			return "nil", true
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		var keys []string
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entries := make([]string, len(keys))
+		for i, key := range keys {
+			keyLiteral, ok := goLiteral(key, typ.Key, types)
+			if !ok {
+				// JSON object keys are strings, numeric keys are parsed
+				number, err := strconv.ParseFloat(key, 64)
+				if err != nil {
+					return "", false
+				}
+				if keyLiteral, ok = goLiteral(number, typ.Key, types); !ok {
+					return "", false
+				}
+			}
+			valueLiteral, ok := goLiteral(object[key], typ.Value, types)
+			if !ok {
+				return "", false
+			}
+			entries[i] = keyLiteral + ": " + valueLiteral
+		}
+		return typeString(typ) + "{" + strings.Join(entries, ", ") + "}", true
+	case *ast.SelectorExpr:
+		// Durations as nanoseconds or as text such as "1.5s"
+		if pkg, ok := typ.X.(*ast.Ident); ok && pkg.Name == "time" && typ.Sel.Name == "Duration" {
+			switch value := value.(type) {
+			case float64:
+				if value == math.Trunc(value) {
+					return durationLiteral(time.Duration(value)), true
+				}
+			case string:
+				if d, err := time.ParseDuration(value); err == nil {
+					return durationLiteral(d), true
+				}
+			}
+		}
+		return "", false
+	case *ast.FuncType, *ast.ChanType:
+		return "nil", value == nil
+	}
+	return "", false
+}
+
+// basicLiteral writes a value as a literal of a predeclared type. basic
+// is false for other types.
+func basicLiteral(value interface{}, name string) (literal string, ok bool, basic bool) {
+	switch name {
+	case "string":
+		text, ok := value.(string)
+		return strconv.Quote(text), ok, true
+	case "bool":
+		b, ok := value.(bool)
+		return strconv.FormatBool(b), ok, true
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "byte":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) || strings.HasPrefix(name, "u") && number < 0 || name == "byte" && number < 0 {
+			return "", false, true
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), true, true
+	case "rune":
+		if text, ok := value.(string); ok && len([]rune(text)) == 1 {
+			return strconv.QuoteRune([]rune(text)[0]), true, true
+		}
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return "", false, true
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), true, true
+	case "float32", "float64":
+		number, ok := value.(float64)
+		return strconv.FormatFloat(number, 'g', -1, 64), ok, true
+	case "complex64", "complex128":
+		return "", false, true
+	}
+	return "", false, false
+}
+
+// anyLiteral writes a JSON value as it decodes into an any, whole numbers
+// as ints
+func anyLiteral(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "nil", true
+	case bool:
+		return strconv.FormatBool(value), true
+	case string:
+		return strconv.Quote(value), true
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return strconv.FormatFloat(value, 'f', -1, 64), true
+		}
+		return "float64(" + strconv.FormatFloat(value, 'g', -1, 64) + ")", true
+	case []interface{}:
+		elements := make([]string, len(value))
+		for i, element := range value {
+			elements[i], _ = anyLiteral(element)
+		}
+		return "[]any{" + strings.Join(elements, ", ") + "}", true
+	case map[string]interface{}:
+		var keys []string
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entries := make([]string, len(keys))
+		for i, key := range keys {
+			element, _ := anyLiteral(value[key])
+			entries[i] = strconv.Quote(key) + ": " + element
+		}
+		return "map[string]any{" + strings.Join(entries, ", ") + "}", true
+	}
+	return "", false
+}
+
+// structLiteral writes a JSON object as a literal of a struct type of the
+// package. Keys match field names regardless of case, or their json tags.
+func structLiteral(value interface{}, name string, structType *ast.StructType, types goTypeDecls) (string, bool) {
+	if value == nil {
+		return name + "{}", true
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	// In the order of the fields
+	literals := map[int]string{}
+	for key, fieldValue := range object {
+		index, field, fieldType, ok := structField(structType, key)
+		if !ok {
+			return "", false
+		}
+		literal, ok := goLiteral(fieldValue, fieldType, types)
+		if !ok {
+			return "", false
+		}
+		literals[index] = field + ": " + literal
+	}
+	var indexes []int
+	for index := range literals {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	fields := make([]string, len(indexes))
+	for i, index := range indexes {
+		fields[i] = literals[index]
+	}
+	return name + "{" + strings.Join(fields, ", ") + "}", true
+}
+
+// structField finds the field of a struct a JSON key names, with its
+// index among the fields
+func structField(structType *ast.StructType, key string) (int, string, ast.Expr, bool) {
+	index := 0
+	for _, field := range structType.Fields.List {
+		tagName := ""
+		if field.Tag != nil {
+			tag, _ := strconv.Unquote(field.Tag.Value)
+			if jsonTag, ok := lookupStructTag(tag, "json"); ok {
+				tagName, _, _ = strings.Cut(jsonTag, ",")
+			}
+		}
+		for _, name := range field.Names {
+			if tagName == key || tagName == "" && strings.EqualFold(name.Name, key) {
+				return index, name.Name, field.Type, true
+			}
+			index++
+		}
+	}
+	return 0, "", nil, false
+}
+
+// lookupStructTag is reflect.StructTag.Lookup for tags of the source
+func lookupStructTag(tag, key string) (string, bool) {
+	for tag != "" {
+		tag = strings.TrimLeft(tag, " ")
+		name, rest, ok := strings.Cut(tag, ":\"")
+		if !ok {
+			return "", false
+		}
+		end := strings.Index(rest, "\"")
+		for end > 0 && rest[end-1] == '\\' {
+			next := strings.Index(rest[end+1:], "\"")
+			if next == -1 {
+				return "", false
+			}
+			end += next + 1
+		}
+		if end == -1 {
+			return "", false
+		}
+		if name == key {
+			value, err := strconv.Unquote(rest[:end+1])
+			return value, err == nil
+		}
+		tag = rest[end+1:]
+	}
+	return "", false
+}
+
+// goZeroLiteral is the zero value of a method's receiver, a struct of the
+// package takes a composite literal
+func goZeroLiteral(typ ast.Expr, types goTypeDecls) (string, bool) {
+	pointer := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ, pointer = star.X, true
+	}
+	ident, ok := typ.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	_, isStruct := types[ident.Name].(*ast.StructType)
+	switch {
+	case isStruct && pointer:
+		return "&" + ident.Name + "{}", true
+	case isStruct:
+		return ident.Name + "{}", true
+	case pointer:
+		return "new(" + ident.Name + ")", true
+	}
+	return "*new(" + ident.Name + ")", true
+}
+
+// durationLiteral writes a duration in the largest unit it is a whole
+// number of, such as 1500 * time.Millisecond
+func durationLiteral(d time.Duration) string {
+	units := []struct {
+		name string
+		unit time.Duration
+	}{{"Hour", time.Hour}, {"Minute", time.Minute}, {"Second", time.Second}, {"Millisecond", time.Millisecond}, {"Microsecond", time.Microsecond}}
+	for _, u := range units {
+		if d != 0 && d%u.unit == 0 {
+			return fmt.Sprintf("%d * time.%s", d/u.unit, u.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
+
+// typeString prints a type expression
+func typeString(typ ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, token.NewFileSet(), typ)
+	return buf.String()
+}
+
+// goTestFileMap lists the Go test files among the artifacts by path
+func goTestFileMap(artifacts []GeneratedArtifact) map[string]string {
+	files := map[string]string{}
+	for _, artifact := range artifacts {
+		if strings.HasSuffix(artifact.Path, "_test.go") {
+			files[artifact.Path] = artifact.Content
+		}
+	}
+	return files
+}
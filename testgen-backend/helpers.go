@@ -0,0 +1,837 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Helper libraries emitted as artifacts next to the tests that use them.
+//
+// The shared helpers cover the boilerplate most test files repeat:
+// temporary directories, HTTP test servers and database fixtures. The
+// prompt lists those of the context's languages, tests that refer to one
+// get it emitted once per run instead of a copy of its code in every file.
+// Helpers the repository already has are referred to but not emitted.
+
+// testHelper is a snippet of the shared helper library
+type testHelper struct {
+	Name     string // tempdir, httpserver or dbfixture
+	Language string // go, python or javascript
+	// How tests refer to the helper, told to the model
+	Usage string
+	// Matches test code that refers to the helper
+	Uses  *regexp.Regexp
+	Files []GeneratedArtifact
+}
+
+// Go helpers live in this package below the module root
+const goHelperDir = "internal/testutil"
+
+var testHelpers = []testHelper{
+	{
+		Name:     "tempdir",
+		Language: "go",
+		Usage:    `testutil.TempDir(t, map[string]string{"config/app.yaml": "..."}) creates a directory with the files, removed after the test, and returns its path`,
+		Uses:     regexp.MustCompile(`\btestutil\.TempDir\(`),
+		Files:    []GeneratedArtifact{goTempDirHelper},
+	},
+	{
+		Name:     "httpserver",
+		Language: "go",
+		Usage:    `testutil.NewServer(t, map[string]testutil.Route{"GET /users/1": {Body: "{...}"}, "/health": {Status: 503}}) starts an httptest server answering with the routes, 404 otherwise; srv.URL is its address and srv.Requests() the requests it received`,
+		Uses:     regexp.MustCompile(`\btestutil\.(NewServer|Route)\b`),
+		Files:    []GeneratedArtifact{goHTTPServerHelper},
+	},
+	{
+		Name:     "dbfixture",
+		Language: "go",
+		Usage:    `testutil.LoadFixtures(t, db, testutil.Fixtures{Tables: map[string][]map[string]any{"users": {{"id": 1, "name": "ada"}}}, Order: []string{"users"}, Dollar: true}) inserts rows into a *sql.DB in one transaction and empties the tables after the test; Dollar for $1 placeholders`,
+		Uses:     regexp.MustCompile(`\btestutil\.(LoadFixtures|Fixtures)\b`),
+		Files:    []GeneratedArtifact{goDBFixtureHelper},
+	},
+	{
+		Name:     "tempdir",
+		Language: "python",
+		Usage:    `from tests.helpers.tempdir import temp_tree; with temp_tree({"config/app.yaml": "..."}) as root: yields a pathlib.Path to a directory with the files, removed afterwards`,
+		Uses:     regexp.MustCompile(`tests\.helpers\.tempdir\b|\btemp_tree\(`),
+		Files:    []GeneratedArtifact{pythonHelpersPackage, pythonTempDirHelper},
+	},
+	{
+		Name:     "httpserver",
+		Language: "python",
+		Usage:    `from tests.helpers.httpserver import serve; with serve({"GET /users/1": (200, {"id": 1}), "/health": 503}) as server: server.url is its address and server.requests the (method, path, headers, body) it received, unknown routes answer 404`,
+		Uses:     regexp.MustCompile(`tests\.helpers\.httpserver\b`),
+		Files:    []GeneratedArtifact{pythonHelpersPackage, pythonHTTPServerHelper},
+	},
+	{
+		Name:     "dbfixture",
+		Language: "python",
+		Usage:    `from tests.helpers.dbfixture import fixtures; with fixtures(conn, {"users": [{"id": 1, "name": "ada"}]}, placeholder="%s"): inserts rows through a DB-API connection, tables in the order given, and empties them afterwards; placeholder defaults to ?`,
+		Uses:     regexp.MustCompile(`tests\.helpers\.dbfixture\b`),
+		Files:    []GeneratedArtifact{pythonHelpersPackage, pythonDBFixtureHelper},
+	},
+	{
+		Name:     "tempdir",
+		Language: "javascript",
+		Usage:    `const { tempDir } = require('<relative path>/test/helpers/tempdir'); const tmp = tempDir({ 'config/app.json': '...' }) creates a directory with the files, tmp.dir is its path and tmp.cleanup() removes it`,
+		Uses:     regexp.MustCompile(`helpers/tempdir['"]`),
+		Files:    []GeneratedArtifact{jsTempDirHelper},
+	},
+	{
+		Name:     "httpserver",
+		Language: "javascript",
+		Usage:    `const { startServer } = require('<relative path>/test/helpers/httpserver'); const server = await startServer({ 'GET /users/1': { body: { id: 1 } }, '/health': { status: 503 } }) answers with the routes, 404 otherwise; server.url is its address, server.requests what it received, await server.close() stops it`,
+		Uses:     regexp.MustCompile(`helpers/httpserver['"]`),
+		Files:    []GeneratedArtifact{jsHTTPServerHelper},
+	},
+	{
+		Name:     "dbfixture",
+		Language: "javascript",
+		Usage:    `const { loadFixtures } = require('<relative path>/test/helpers/dbfixture'); const cleanup = await loadFixtures((sql, params) => pool.query(sql, params), { users: [{ id: 1, name: 'ada' }] }, { placeholder: '$' }) inserts rows through any driver's query function, tables in the order given; await cleanup() empties them`,
+		Uses:     regexp.MustCompile(`helpers/dbfixture['"]`),
+		Files:    []GeneratedArtifact{jsDBFixtureHelper},
+	},
+}
+
+// helperLanguage is the helper library language of a file, "" when it has
+// no helpers
+func helperLanguage(filePath string) string {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".go":
+		return "go"
+	case ".py":
+		return "python"
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs", ".cjs":
+		return "javascript"
+	}
+	return ""
+}
+
+// helperRoot is the directory the Go helpers go below and their import
+// path, the module of the outermost go.mod of the context. Both are empty
+// without a go.mod.
+func helperRoot(files []FileContent) (string, string) {
+	var root *goModFile
+	for _, file := range files {
+		if path.Base(slashPath(file.Path)) != "go.mod" {
+			continue
+		}
+		mod := parseGoMod(slashPath(file.Path), file.Content)
+		if mod.Module != "" && (root == nil || len(mod.Path) < len(root.Path)) {
+			root = mod
+		}
+	}
+	if root == nil {
+		return "", ""
+	}
+	return path.Dir(root.Path), root.Module + "/" + goHelperDir
+}
+
+// contextHelpers are the helpers of the languages of the context files
+func contextHelpers(files []FileContent) []testHelper {
+	languages := map[string]bool{}
+	for _, file := range files {
+		languages[helperLanguage(file.Path)] = true
+	}
+	var helpers []testHelper
+	for _, helper := range testHelpers {
+		if languages[helper.Language] {
+			helpers = append(helpers, helper)
+		}
+	}
+	return helpers
+}
+
+// helperPromptSection tells the model the shared helpers its tests should
+// use
+func helperPromptSection(codeContext string) string {
+	files := splitContextFiles(codeContext)
+	helpers := contextHelpers(files)
+	if len(helpers) == 0 {
+		return ""
+	}
+
+	var section strings.Builder
+	section.WriteString("\nShared test helpers:\n")
+	section.WriteString("- The following helpers are added to the repository with the tests that use them. Use them instead of writing temporary directories, HTTP test servers or database fixtures by hand, and do not repeat their code in the tests\n")
+	if _, importPath := helperRoot(files); importPath != "" {
+		section.WriteString(fmt.Sprintf("- Go tests import the helpers as \"%s\"\n", importPath))
+	}
+	for _, helper := range helpers {
+		section.WriteString(fmt.Sprintf("- [%s %s] %s\n", helper.Language, helper.Name, helper.Usage))
+	}
+	return section.String()
+}
+
+// helperArtifacts returns the files of the helpers the test cases and
+// artifacts refer to, leaving out the ones the context has or the
+// artifacts carry already
+func helperArtifacts(testResponse *GeminiResponse, codeContext string) []GeneratedArtifact {
+	files := splitContextFiles(codeContext)
+	helpers := contextHelpers(files)
+	if len(helpers) == 0 {
+		return nil
+	}
+	goRoot, _ := helperRoot(files)
+
+	existing := map[string]bool{}
+	for _, file := range files {
+		existing[slashPath(file.Path)] = true
+	}
+	for _, artifact := range testResponse.Artifacts {
+		existing[artifact.Path] = true
+	}
+
+	// Test code by language, helpers only count where their language uses them
+	code := map[string]string{}
+	for _, testCase := range testResponse.TestCases {
+		language := helperLanguage(testCase.SuggestedPath)
+		code[language] += testCase.Code + "\n"
+	}
+	for _, artifact := range testResponse.Artifacts {
+		language := helperLanguage(artifact.Path)
+		code[language] += artifact.Content + "\n"
+	}
+
+	var artifacts []GeneratedArtifact
+	var used []string
+	for _, helper := range helpers {
+		// Test cases without a path are matched in any language
+		if !helper.Uses.MatchString(code[helper.Language]) && !helper.Uses.MatchString(code[""]) {
+			continue
+		}
+		used = append(used, helper.Language+" "+helper.Name)
+		for _, file := range helper.Files {
+			if file.Language == "go" {
+				file.Path = path.Join(goRoot, file.Path)
+			}
+			if !existing[file.Path] {
+				artifacts = append(artifacts, file)
+				existing[file.Path] = true
+			}
+		}
+	}
+	if len(used) > 0 {
+		sort.Strings(used)
+		log.Printf("Tests use the shared helpers %s", strings.Join(used, ", "))
+	}
+	return artifacts
+}
+
+var faultInjectHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "internal/testutil/faultinject/faultinject.go",
+	Language:    "go",
+	Description: "Fault-injecting wrappers for readers, connections and HTTP transports",
+	Content: `// Package faultinject wraps dependencies with fakes that fail on purpose so
+// tests can verify error handling and retry logic.
+package faultinject
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrInjected is returned by wrappers configured without a specific error.
+var ErrInjected = errors.New("faultinject: injected failure")
+
+// Reader returns at most Chunk bytes per Read and fails with Err once
+// FailAfter bytes have been read. A zero FailAfter never fails.
+type Reader struct {
+	R         io.Reader
+	Chunk     int
+	FailAfter int
+	Err       error
+
+	read int
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.FailAfter > 0 && r.read >= r.FailAfter {
+		return 0, r.err()
+	}
+	if r.Chunk > 0 && len(p) > r.Chunk {
+		p = p[:r.Chunk]
+	}
+	if r.FailAfter > 0 && len(p) > r.FailAfter-r.read {
+		p = p[:r.FailAfter-r.read]
+	}
+	n, err := r.R.Read(p)
+	r.read += n
+	return n, err
+}
+
+func (r *Reader) err() error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return ErrInjected
+}
+
+// Conn resets the connection once ResetAfter bytes have been written or read.
+type Conn struct {
+	net.Conn
+	ResetAfter int
+
+	mu    sync.Mutex
+	bytes int
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.account(len(p)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.account(len(p)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *Conn) account(n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ResetAfter > 0 && c.bytes >= c.ResetAfter {
+		return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	c.bytes += n
+	return nil
+}
+
+// Transport fails the calls listed in FailCalls (1-based) with Err, or delays
+// them by Delay so client timeouts trigger. Other calls go to Base.
+type Transport struct {
+	Base      http.RoundTripper
+	FailCalls map[int]bool
+	Delay     time.Duration
+	Err       error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.calls++
+	call := t.calls
+	t.mu.Unlock()
+
+	if t.FailCalls[call] {
+		if t.Delay > 0 {
+			select {
+			case <-time.After(t.Delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+		if t.Err != nil {
+			return nil, t.Err
+		}
+		return nil, context.DeadlineExceeded
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// Calls reports how many requests went through the transport.
+func (t *Transport) Calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+`,
+}
+
+var goTempDirHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        goHelperDir + "/tempdir.go",
+	Language:    "go",
+	Description: "Temporary directories with files for tests",
+	Content: `// Package testutil holds helpers shared by the tests of the repository.
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TempDir creates a directory holding the files, keyed by their slash
+// separated path below it, and returns its path. It is removed when the
+// test ends.
+func TempDir(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("testutil: creating the directory of %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("testutil: writing %s: %v", name, err)
+		}
+	}
+	return dir
+}
+`,
+}
+
+var goHTTPServerHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        goHelperDir + "/httpserver.go",
+	Language:    "go",
+	Description: "HTTP test server answering with canned routes and recording its requests",
+	Content: `package testutil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Route is the canned response of a test server to a route.
+type Route struct {
+	Status int // 200 when zero
+	Header http.Header
+	Body   string
+}
+
+// Request is a request a test server received.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// Server is an httptest server answering with canned routes.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// NewServer starts a server answering the routes, keyed by "METHOD /path"
+// or by "/path" for any method, and 404 for any other request. It is
+// closed when the test ends.
+func NewServer(t testing.TB, routes map[string]Route) *Server {
+	t.Helper()
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Header: r.Header.Clone(), Body: string(body)})
+		s.mu.Unlock()
+
+		route, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			route, ok = routes[r.URL.Path]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for name, values := range route.Header {
+			w.Header()[name] = values
+		}
+		content := strings.TrimSpace(route.Body)
+		if w.Header().Get("Content-Type") == "" && (strings.HasPrefix(content, "{") || strings.HasPrefix(content, "[")) {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if route.Status != 0 {
+			w.WriteHeader(route.Status)
+		}
+		io.WriteString(w, route.Body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the requests the server received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+`,
+}
+
+var goDBFixtureHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        goHelperDir + "/dbfixture.go",
+	Language:    "go",
+	Description: "Database fixtures inserted before a test and removed after it",
+	Content: `package testutil
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Fixtures are rows to insert into a test database.
+type Fixtures struct {
+	// Rows by table, each row by column
+	Tables map[string][]map[string]any
+	// Tables to fill first, for foreign keys; the others follow by name
+	Order []string
+	// PostgreSQL placeholders $1, $2 instead of ?
+	Dollar bool
+}
+
+// LoadFixtures inserts the rows in one transaction and empties their
+// tables when the test ends, in reverse order. Meant for test databases
+// only.
+func LoadFixtures(t testing.TB, db *sql.DB, fixtures Fixtures) {
+	t.Helper()
+	tables := fixtures.tables()
+	t.Cleanup(func() {
+		for i := len(tables) - 1; i >= 0; i-- {
+			if _, err := db.Exec("DELETE FROM " + tables[i]); err != nil {
+				t.Errorf("testutil: emptying %s: %v", tables[i], err)
+			}
+		}
+	})
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("testutil: starting the fixture transaction: %v", err)
+	}
+	for _, table := range tables {
+		for _, row := range fixtures.Tables[table] {
+			columns := make([]string, 0, len(row))
+			for column := range row {
+				columns = append(columns, column)
+			}
+			sort.Strings(columns)
+			placeholders := make([]string, len(columns))
+			values := make([]any, len(columns))
+			for i, column := range columns {
+				placeholders[i] = "?"
+				if fixtures.Dollar {
+					placeholders[i] = fmt.Sprintf("$%d", i+1)
+				}
+				values[i] = row[column]
+			}
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+			if _, err := tx.Exec(query, values...); err != nil {
+				tx.Rollback()
+				t.Fatalf("testutil: inserting into %s: %v", table, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("testutil: committing the fixtures: %v", err)
+	}
+}
+
+// tables lists the tables in the order they are filled
+func (f Fixtures) tables() []string {
+	seen := map[string]bool{}
+	var tables []string
+	for _, table := range f.Order {
+		if _, ok := f.Tables[table]; ok && !seen[table] {
+			tables = append(tables, table)
+			seen[table] = true
+		}
+	}
+	var rest []string
+	for table := range f.Tables {
+		if !seen[table] {
+			rest = append(rest, table)
+		}
+	}
+	sort.Strings(rest)
+	return append(tables, rest...)
+}
+`,
+}
+
+var pythonHelpersPackage = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "tests/helpers/__init__.py",
+	Language:    "python",
+	Description: "Package of the shared test helpers",
+	Content:     "\"\"\"Helpers shared by the tests of the repository.\"\"\"\n",
+}
+
+var pythonTempDirHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "tests/helpers/tempdir.py",
+	Language:    "python",
+	Description: "Temporary directories with files for tests",
+	Content: `"""Temporary directories with files for tests."""
+
+import contextlib
+import pathlib
+import tempfile
+
+
+@contextlib.contextmanager
+def temp_tree(files=None):
+    """Yield a directory holding the files, keyed by their slash separated
+    path below it. It is removed afterwards."""
+    with tempfile.TemporaryDirectory() as tmp:
+        root = pathlib.Path(tmp)
+        for name, content in (files or {}).items():
+            path = root / name
+            path.parent.mkdir(parents=True, exist_ok=True)
+            if isinstance(content, bytes):
+                path.write_bytes(content)
+            else:
+                path.write_text(content)
+        yield root
+`,
+}
+
+var pythonHTTPServerHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "tests/helpers/httpserver.py",
+	Language:    "python",
+	Description: "HTTP test server answering with canned routes and recording its requests",
+	Content: `"""HTTP test server answering with canned routes."""
+
+import contextlib
+import http.server
+import json
+import threading
+
+
+@contextlib.contextmanager
+def serve(routes):
+    """Serve the routes, keyed by "METHOD /path" or by "/path" for any
+    method, on a free local port. A route is a status, a body or a
+    (status, body) or (status, body, headers) tuple; dicts and lists are
+    sent as JSON. Other requests get 404. Yields the server with its url
+    and the (method, path, headers, body) of the requests it received."""
+    requests = []
+
+    class Handler(http.server.BaseHTTPRequestHandler):
+        def do_request(self):
+            length = int(self.headers.get("Content-Length") or 0)
+            body = self.rfile.read(length) if length else b""
+            path = self.path.split("?", 1)[0]
+            requests.append((self.command, self.path, dict(self.headers), body))
+            route = routes.get(self.command + " " + path, routes.get(path))
+            if route is None:
+                self.send_error(404)
+                return
+            status, content, headers = _response(route)
+            self.send_response(status)
+            if isinstance(content, (dict, list)):
+                content = json.dumps(content)
+                headers.setdefault("Content-Type", "application/json")
+            if isinstance(content, str):
+                content = content.encode()
+            for name, value in headers.items():
+                self.send_header(name, value)
+            self.send_header("Content-Length", str(len(content)))
+            self.end_headers()
+            self.wfile.write(content)
+
+        do_GET = do_POST = do_PUT = do_PATCH = do_DELETE = do_HEAD = do_request
+
+        def log_message(self, format, *args):
+            pass
+
+    server = http.server.ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+    server.url = "http://127.0.0.1:%d" % server.server_address[1]
+    server.requests = requests
+    thread = threading.Thread(target=server.serve_forever, daemon=True)
+    thread.start()
+    try:
+        yield server
+    finally:
+        server.shutdown()
+        server.server_close()
+
+
+def _response(route):
+    if isinstance(route, int):
+        return route, b"", {}
+    if isinstance(route, tuple):
+        status, content = route[0], route[1]
+        headers = dict(route[2]) if len(route) > 2 else {}
+        return status, content, headers
+    return 200, route, {}
+`,
+}
+
+var pythonDBFixtureHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "tests/helpers/dbfixture.py",
+	Language:    "python",
+	Description: "Database fixtures inserted before a test and removed after it",
+	Content: `"""Database fixtures for tests, through any DB-API connection."""
+
+import contextlib
+
+
+@contextlib.contextmanager
+def fixtures(conn, tables, placeholder="?"):
+    """Insert the rows of the tables, each row a dict of columns, in the
+    order given and commit. The tables are emptied afterwards, in reverse
+    order. Meant for test databases only; placeholder is "%s" for psycopg
+    and MySQL drivers."""
+    cursor = conn.cursor()
+    try:
+        for table, rows in tables.items():
+            for row in rows:
+                columns = sorted(row)
+                cursor.execute(
+                    "INSERT INTO %s (%s) VALUES (%s)"
+                    % (table, ", ".join(columns), ", ".join([placeholder] * len(columns))),
+                    [row[column] for column in columns],
+                )
+        conn.commit()
+        yield conn
+    finally:
+        conn.rollback()
+        for table in reversed(list(tables)):
+            cursor.execute("DELETE FROM %s" % table)
+        conn.commit()
+        cursor.close()
+`,
+}
+
+var jsTempDirHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "test/helpers/tempdir.js",
+	Language:    "javascript",
+	Description: "Temporary directories with files for tests",
+	Content: `'use strict';
+
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+
+// tempDir creates a directory holding the files, keyed by their slash
+// separated path below it. cleanup removes it.
+function tempDir(files = {}) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'test-'));
+  for (const [name, content] of Object.entries(files)) {
+    const file = path.join(dir, ...name.split('/'));
+    fs.mkdirSync(path.dirname(file), { recursive: true });
+    fs.writeFileSync(file, content);
+  }
+  return {
+    dir,
+    cleanup() {
+      fs.rmSync(dir, { recursive: true, force: true });
+    },
+  };
+}
+
+module.exports = { tempDir };
+`,
+}
+
+var jsHTTPServerHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "test/helpers/httpserver.js",
+	Language:    "javascript",
+	Description: "HTTP test server answering with canned routes and recording its requests",
+	Content: `'use strict';
+
+const http = require('http');
+
+// startServer serves the routes, keyed by 'METHOD /path' or by '/path' for
+// any method, on a free local port. A route is { status, headers, body },
+// objects in body are sent as JSON. Other requests get 404.
+function startServer(routes) {
+  const requests = [];
+  const server = http.createServer((req, res) => {
+    const chunks = [];
+    req.on('data', (chunk) => chunks.push(chunk));
+    req.on('end', () => {
+      const urlPath = req.url.split('?')[0];
+      requests.push({ method: req.method, url: req.url, headers: req.headers, body: Buffer.concat(chunks).toString() });
+      const route = routes[req.method + ' ' + urlPath] || routes[urlPath];
+      if (!route) {
+        res.writeHead(404);
+        res.end();
+        return;
+      }
+      const headers = Object.assign({}, route.headers);
+      let body = route.body === undefined ? '' : route.body;
+      if (typeof body === 'object' && !Buffer.isBuffer(body)) {
+        body = JSON.stringify(body);
+        headers['Content-Type'] = headers['Content-Type'] || 'application/json';
+      }
+      res.writeHead(route.status || 200, headers);
+      res.end(body);
+    });
+  });
+  return new Promise((resolve, reject) => {
+    server.once('error', reject);
+    server.listen(0, '127.0.0.1', () => {
+      resolve({
+        url: 'http://127.0.0.1:' + server.address().port,
+        requests,
+        close: () => new Promise((done) => server.close(done)),
+      });
+    });
+  });
+}
+
+module.exports = { startServer };
+`,
+}
+
+var jsDBFixtureHelper = GeneratedArtifact{
+	Type:        "helper",
+	Path:        "test/helpers/dbfixture.js",
+	Language:    "javascript",
+	Description: "Database fixtures inserted before a test and removed after it",
+	Content: `'use strict';
+
+// loadFixtures inserts the rows of the tables, each row an object of
+// columns, in the order given through query(sql, params) of any driver.
+// placeholder '$' numbers them $1, $2 as PostgreSQL expects, '?' is the
+// default. The returned cleanup empties the tables in reverse order. Meant
+// for test databases only.
+async function loadFixtures(query, tables, { placeholder = '?' } = {}) {
+  for (const [table, rows] of Object.entries(tables)) {
+    for (const row of rows) {
+      const columns = Object.keys(row).sort();
+      const marks = columns.map((_, i) => (placeholder === '$' ? '$' + (i + 1) : placeholder));
+      await query(
+        'INSERT INTO ' + table + ' (' + columns.join(', ') + ') VALUES (' + marks.join(', ') + ')',
+        columns.map((column) => row[column]),
+      );
+    }
+  }
+  return async function cleanup() {
+    for (const table of Object.keys(tables).reverse()) {
+      await query('DELETE FROM ' + table, []);
+    }
+  };
+}
+
+module.exports = { loadFixtures };
+`,
+}
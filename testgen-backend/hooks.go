@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Git hooks that block commits or pushes adding exported Go functions
+// without tests. The hook sends the changed files and the tests of their
+// packages to /api/hooks/check, which does the analysis.
+
+var hookTypes = map[string]bool{"pre-commit": true, "pre-push": true}
+
+// Percentage of exported functions in the changed files that need tests
+const defaultHookThreshold = 100
+
+// UntestedFunction is an exported function no test in its package refers to
+type UntestedFunction struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line"`
+	EndLine  int    `json:"endLine"`
+	Function string `json:"function"`
+}
+
+// HookCheck is the result of checking changed files for untested functions
+type HookCheck struct {
+	Pass      bool               `json:"pass"`
+	Threshold int                `json:"threshold"`
+	Total     int                `json:"total"`
+	Tested    int                `json:"tested"`
+	Untested  []UntestedFunction `json:"untested"`
+}
+
+// checkUntestedFunctions finds the exported functions and methods of the
+// non-test Go files in the context that none of the test files of the same
+// package mention
+func checkUntestedFunctions(codeContext string, threshold int) HookCheck {
+	return checkUntestedFiles(splitContextFiles(codeContext), threshold)
+}
+
+func checkUntestedFiles(files []FileContent, threshold int) HookCheck {
+	fset, goFiles := parseGoFiles(files)
+
+	// Identifiers used by the tests of each package directory
+	used := map[string]map[string]bool{}
+	for _, goFile := range goFiles {
+		if !strings.HasSuffix(goFile.Path, "_test.go") {
+			continue
+		}
+		dir := path.Dir(slashPath(goFile.Path))
+		if used[dir] == nil {
+			used[dir] = map[string]bool{}
+		}
+		ast.Inspect(goFile.File, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok {
+				used[dir][ident.Name] = true
+			}
+			return true
+		})
+	}
+
+	check := HookCheck{Threshold: threshold, Untested: []UntestedFunction{}}
+	for _, goFile := range goFiles {
+		// Exported names of a main package are not importable
+		if strings.HasSuffix(goFile.Path, "_test.go") || goFile.File.Name.Name == "main" {
+			continue
+		}
+		dir := path.Dir(slashPath(goFile.Path))
+		for _, decl := range goFile.File.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || !fn.Name.IsExported() {
+				continue
+			}
+			name := funcDisplayName(fn)
+			// Methods of unexported types are not part of the package API
+			if recv, _, isMethod := strings.Cut(name, "."); isMethod && !ast.IsExported(recv) {
+				continue
+			}
+			check.Total++
+			if used[dir][fn.Name.Name] {
+				check.Tested++
+				continue
+			}
+			check.Untested = append(check.Untested, UntestedFunction{
+				Path:     goFile.Path,
+				Line:     fset.Position(fn.Pos()).Line,
+				EndLine:  fset.Position(fn.End()).Line,
+				Function: name,
+			})
+		}
+	}
+	sort.Slice(check.Untested, func(i, j int) bool {
+		if check.Untested[i].Path != check.Untested[j].Path {
+			return check.Untested[i].Path < check.Untested[j].Path
+		}
+		return check.Untested[i].Line < check.Untested[j].Line
+	})
+	check.Pass = check.Total == 0 || check.Tested*100 >= threshold*check.Total
+	return check
+}
+
+// hookThreshold reads the threshold query parameter, a percentage
+func hookThreshold(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("threshold")
+	if value == "" {
+		return defaultHookThreshold, nil
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 || threshold > 100 {
+		return 0, fmt.Errorf("threshold must be a percentage between 0 and 100")
+	}
+	return threshold, nil
+}
+
+// hookServerURL returns the URL the hook calls back, the server query
+// parameter or the address the script was downloaded from
+func hookServerURL(r *http.Request) (string, error) {
+	server := r.URL.Query().Get("server")
+	if server == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		server = scheme + "://" + r.Host
+	}
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("server must be an http or https URL")
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// shellQuote quotes a value for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+var hookScript = template.Must(template.New("hook").Parse(`#!/bin/sh
+# testgen {{.Hook}} hook, generated by testgen {{.Version}}
+#
+# Blocks {{if eq .Hook "pre-push"}}pushes{{else}}commits{{end}} of Go changes whose exported functions are not
+# referenced by the tests of their package. Install it with
+#
+#   cp {{.Hook}} .git/hooks/{{.Hook}} && chmod +x .git/hooks/{{.Hook}}
+#
+# and bypass it once with --no-verify. TESTGEN_URL, TESTGEN_THRESHOLD and
+# TESTGEN_TOKEN override the defaults below. The check is skipped when the
+# service cannot be reached, unless TESTGEN_STRICT=1.
+
+DEFAULT_URL={{.Server}}
+DEFAULT_THRESHOLD={{.Threshold}}
+TESTGEN_URL="${TESTGEN_URL:-$DEFAULT_URL}"
+TESTGEN_THRESHOLD="${TESTGEN_THRESHOLD:-$DEFAULT_THRESHOLD}"
+
+# show_file prints a file from the revision being checked, the index when empty
+show_file() {
+	if [ -z "$rev" ]; then git show ":$1"; else git show "$rev:$1"; fi
+}
+
+list_tests() {
+	if [ -z "$rev" ]; then
+		git ls-files -- ":(glob)$1*_test.go"
+	else
+		git ls-tree --name-only "$rev" -- ${1:+"$1"} | grep '_test\.go$'
+	fi
+}
+
+# check_files sends the changed Go files and the tests of their packages
+check_files() {
+	body=$(mktemp) || return 1
+	dirs=$(mktemp) || return 1
+	sources=0
+	while IFS= read -r file; do
+		case "$file" in
+		*_test.go | vendor/* | */vendor/*) continue ;;
+		*.go) ;;
+		*) continue ;;
+		esac
+		printf '// File: %s\n' "$file" >>"$body"
+		show_file "$file" >>"$body" 2>/dev/null
+		printf '\n\n---\n' >>"$body"
+		dir=$(dirname "$file")
+		if [ "$dir" = "." ]; then echo "" >>"$dirs"; else echo "$dir/" >>"$dirs"; fi
+		sources=$((sources + 1))
+	done
+	if [ "$sources" -eq 0 ]; then
+		rm -f "$body" "$dirs"
+		return 0
+	fi
+	sort -u "$dirs" | while IFS= read -r dir; do
+		list_tests "$dir" | while IFS= read -r test; do
+			printf '// File: %s\n' "$test"
+			show_file "$test" 2>/dev/null
+			printf '\n\n---\n'
+		done
+	done >>"$body"
+
+	set --
+	if [ -n "$TESTGEN_TOKEN" ]; then
+		set -- -H "Authorization: Bearer $TESTGEN_TOKEN"
+	fi
+	report=$(curl -sS -X POST "$@" -H 'Content-Type: text/plain' -H 'Accept: text/plain' \
+		--data-binary @"$body" "$TESTGEN_URL/api/v1/hooks/check?threshold=$TESTGEN_THRESHOLD")
+	status=$?
+	rm -f "$body" "$dirs"
+
+	case "$report" in
+	PASS*)
+		return 0
+		;;
+	FAIL*)
+		echo "$report" >&2
+		return 1
+		;;
+	esac
+	echo "testgen: could not check for untested functions at $TESTGEN_URL (curl exit $status)" >&2
+	[ -n "$report" ] && echo "$report" >&2
+	[ "$TESTGEN_STRICT" = "1" ] && return 1
+	return 0
+}
+{{if eq .Hook "pre-push"}}
+# An all zero id stands for a ref that does not exist on one side
+is_zero() {
+	case "$1" in
+	*[!0]*) return 1 ;;
+	esac
+	return 0
+}
+
+while read -r local_ref local_sha remote_ref remote_sha; do
+	if is_zero "$local_sha"; then
+		continue
+	fi
+	rev="$local_sha"
+	if is_zero "$remote_sha"; then
+		# New branch, check the commits no remote has yet
+		git log --name-only --diff-filter=ACMR --format= "$local_sha" --not --remotes | sort -u | check_files || exit 1
+	else
+		git diff --name-only --diff-filter=ACMR "$remote_sha" "$local_sha" | check_files || exit 1
+	fi
+done
+exit 0
+{{else}}
+rev=""
+git diff --cached --name-only --diff-filter=ACMR | check_files || exit 1
+exit 0
+{{end}}`))
+
+// hooksHandler serves the hook scripts and the check they call:
+//
+//	GET  /api/hooks/pre-commit?threshold=90  download a pre-commit hook
+//	GET  /api/hooks/pre-push?threshold=90    download a pre-push hook
+//	POST /api/hooks/check?threshold=90       check changed files, the body
+//	                                         is a context in any format
+func hooksHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/hooks/"), "/")
+	threshold, err := hookThreshold(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case name == "check":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			var maxErr *http.MaxBytesError
+			errors.As(err, &maxErr)
+			writeBodyTooLarge(w, maxErr.Limit)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		check := checkUntestedFunctions(string(body), threshold)
+		log.Printf("Hook check: %d of %d exported functions tested, threshold %d%%", check.Tested, check.Total, threshold)
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, check.report())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(check)
+
+	case hookTypes[name]:
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		server, err := hookServerURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		hookScript.Execute(w, map[string]interface{}{
+			"Hook":      name,
+			"Version":   toolVersion,
+			"Server":    shellQuote(server),
+			"Threshold": threshold,
+		})
+
+	default:
+		http.Error(w, "Hook not found", http.StatusNotFound)
+	}
+}
+
+// report renders the check for the hook, the first word is PASS or FAIL
+func (c HookCheck) report() string {
+	var report strings.Builder
+	verdict := "PASS"
+	if !c.Pass {
+		verdict = "FAIL"
+	}
+	report.WriteString(fmt.Sprintf("%s testgen: %d of %d exported functions in the changed files have tests, %d%% required\n", verdict, c.Tested, c.Total, c.Threshold))
+	for _, fn := range c.Untested {
+		report.WriteString(fmt.Sprintf("  untested: %s:%d %s\n", fn.Path, fn.Line, fn.Function))
+	}
+	return report.String()
+}
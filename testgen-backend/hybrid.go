@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"strings"
+)
+
+// Hybrid mode generates the test skeletons deterministically and only asks
+// the model for table rows, which are checked before being spliced in
+
+const skeletonCasesMarker = "// TODO: add test cases."
+
+type hybridFill struct {
+	Test  string `json:"test"`
+	Cases []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Literal     string `json:"literal"`
+		TestType    string `json:"testType"`
+		Priority    string `json:"priority"`
+	} `json:"cases"`
+}
+
+func buildHybridPrompt(req GeminiRequest, skeletons []GeneratedArtifact) string {
+	var tests strings.Builder
+	for _, skeleton := range skeletons {
+		tests.WriteString(fmt.Sprintf("// Test file: %s\n%s\n", skeleton.Path, skeleton.Content))
+	}
+
+	return fmt.Sprintf(`
+You are an expert software testing engineer. The Go test functions below were generated from the exact signatures in the code.
+Do not change them. Only provide the rows of each table (the entries of the tests slice).
+
+Code Context:
+%s
+
+Test Skeletons:
+%s
+
+%s
+
+Return JSON in the following format:
+{
+  "fills": [
+    {
+      "test": "TestFunctionName",
+      "cases": [
+        {
+          "name": "descriptive_case_name",
+          "description": "what this case verifies",
+          "literal": "{name: \"descriptive_case_name\", args: args{...}, want: ...}",
+          "testType": "unit|edge-case|error-handling",
+          "priority": "high|medium|low"
+        }
+      ]
+    }
+  ]
+}
+
+Guidelines:
+1. Each literal must be a valid Go composite literal for that test's anonymous struct, using only the fields it declares
+2. Use realistic inputs and exact expected values derived from the code
+3. Cover normal cases, edge cases and error cases (wantErr: true)
+4. Skip a test entirely if its inputs cannot be constructed from the code shown
+
+Return only valid JSON, no additional text or markdown formatting.`, req.CodeContext, tests.String(), req.AdditionalPrompt)
+}
+
+func parseHybridFills(generatedText string) ([]hybridFill, error) {
+	jsonStart := strings.Index(generatedText, "{")
+	jsonEnd := strings.LastIndex(generatedText, "}")
+	if jsonStart == -1 || jsonEnd == -1 || jsonStart >= jsonEnd {
+		return nil, errors.New("No valid JSON found in model response")
+	}
+
+	var parsed struct {
+		Fills []hybridFill `json:"fills"`
+	}
+	if err := json.Unmarshal([]byte(generatedText[jsonStart:jsonEnd+1]), &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse table rows from model response: %v", err)
+	}
+	return parsed.Fills, nil
+}
+
+// insertTableRow adds a row before the TODO marker of the named test function
+func insertTableRow(src, testName, literal string) (string, bool) {
+	start := strings.Index(src, "func "+testName+"(t *testing.T) {")
+	if start == -1 {
+		return src, false
+	}
+	marker := strings.Index(src[start:], skeletonCasesMarker)
+	if marker == -1 {
+		return src, false
+	}
+	at := start + marker
+	row := strings.TrimSuffix(strings.TrimSpace(literal), ",") + ",\n\t\t"
+	return src[:at] + row + src[at:], true
+}
+
+// applyHybridFills splices the model's rows into the skeletons. Rows that do
+// not keep the file parseable are dropped so the output still compiles.
+func applyHybridFills(response *GeminiResponse, fills []hybridFill) int {
+	signatures := map[string]string{}
+	for _, testCase := range response.TestCases {
+		signatures[testCase.Name] = testCase.Code
+	}
+
+	var testCases []GeminiTestCase
+	rejected := 0
+
+	for i, artifact := range response.Artifacts {
+		if artifact.Type != "test-skeleton" {
+			continue
+		}
+		src := artifact.Content
+		for _, fill := range fills {
+			for _, c := range fill.Cases {
+				updated, ok := insertTableRow(src, fill.Test, c.Literal)
+				if !ok {
+					continue
+				}
+				// A row must be exactly one composite literal
+				if expr, err := parser.ParseExpr(strings.TrimSuffix(strings.TrimSpace(c.Literal), ",")); err != nil {
+					rejected++
+					continue
+				} else if _, ok := expr.(*ast.CompositeLit); !ok {
+					rejected++
+					continue
+				}
+				if _, err := parser.ParseFile(token.NewFileSet(), artifact.Path, updated, 0); err != nil {
+					rejected++
+					continue
+				}
+				src = updated
+
+				testType := c.TestType
+				if testType == "" {
+					testType = "unit"
+				}
+				priority := c.Priority
+				if priority == "" {
+					priority = "medium"
+				}
+				testCases = append(testCases, GeminiTestCase{
+					ID:            fmt.Sprintf("test_%d", len(testCases)+1),
+					Name:          fill.Test + "/" + c.Name,
+					Description:   c.Description,
+					Input:         c.Literal,
+					Code:          signatures[fill.Test],
+					TestType:      testType,
+					Priority:      priority,
+					SuggestedPath: artifact.Path,
+				})
+			}
+		}
+		if formatted, err := format.Source([]byte(src)); err == nil {
+			src = string(formatted)
+		}
+		response.Artifacts[i].Content = src
+		response.Artifacts[i].Description = strings.Replace(artifact.Description, "Table-driven test stubs", "Table-driven tests", 1)
+	}
+
+	if rejected > 0 {
+		log.Printf("Dropped %d table rows that did not parse", rejected)
+	}
+	if len(testCases) == 0 {
+		// Nothing usable, keep the skeleton test cases
+		return rejected
+	}
+	response.TestCases = testCases
+	response.Summary.TotalTests = len(testCases)
+	response.Summary.UnitTests = 0
+	response.Summary.EdgeCases = 0
+	response.Summary.ErrorHandlingTests = 0
+	for _, testCase := range testCases {
+		switch testCase.TestType {
+		case "edge-case":
+			response.Summary.EdgeCases++
+		case "error-handling":
+			response.Summary.ErrorHandlingTests++
+		default:
+			response.Summary.UnitTests++
+		}
+	}
+	return rejected
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job progress is streamed as Server-Sent Events so the frontend can show
+// the step, percentage and current file instead of a spinner. Events live
+// in memory: a subscriber gets the latest step when it connects and every
+// step published after, the job file has the rest.
+
+const (
+	// Steps within a stage are sent at most this often per subscriber
+	jobEventInterval = 100 * time.Millisecond
+	// Comment lines keep proxies from closing an idle stream
+	jobEventHeartbeat = 15 * time.Second
+)
+
+// JobEvent is a step of a job as streamed to its subscribers
+type JobEvent struct {
+	JobID  string `json:"jobId"`
+	Status string `json:"status"`
+	JobProgress
+	// Set once the job finished
+	Result string `json:"result,omitempty"` // where the response is fetched
+	Error  string `json:"error,omitempty"`
+}
+
+var jobEvents = struct {
+	sync.Mutex
+	latest      map[string]JobEvent
+	subscribers map[string]map[chan JobEvent]bool
+}{latest: map[string]JobEvent{}, subscribers: map[string]map[chan JobEvent]bool{}}
+
+// publishJobEvent sends a step to the subscribers of a job. Subscribers
+// that fall behind miss steps rather than slow the job down.
+func publishJobEvent(event JobEvent) {
+	jobEvents.Lock()
+	defer jobEvents.Unlock()
+	jobEvents.latest[event.JobID] = event
+	for ch := range jobEvents.subscribers[event.JobID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// finishJobEvents ends the streams of a finished job, each subscriber
+// sends the final event from the job itself
+func finishJobEvents(job *Job) {
+	jobEvents.Lock()
+	defer jobEvents.Unlock()
+	delete(jobEvents.latest, job.ID)
+	for ch := range jobEvents.subscribers[job.ID] {
+		close(ch)
+	}
+	delete(jobEvents.subscribers, job.ID)
+}
+
+// subscribeJobEvents registers for the steps of a job
+func subscribeJobEvents(id string) (chan JobEvent, func()) {
+	ch := make(chan JobEvent, 16)
+	jobEvents.Lock()
+	if jobEvents.subscribers[id] == nil {
+		jobEvents.subscribers[id] = map[chan JobEvent]bool{}
+	}
+	jobEvents.subscribers[id][ch] = true
+	jobEvents.Unlock()
+	return ch, func() {
+		jobEvents.Lock()
+		// Already closed and removed when the job finished
+		if jobEvents.subscribers[id][ch] {
+			delete(jobEvents.subscribers[id], ch)
+			if len(jobEvents.subscribers[id]) == 0 {
+				delete(jobEvents.subscribers, id)
+			}
+		}
+		jobEvents.Unlock()
+	}
+}
+
+// jobEventFor is the event describing a stored job
+func jobEventFor(job *Job) JobEvent {
+	event := JobEvent{JobID: job.ID, Status: job.Status, JobProgress: job.Progress}
+	switch job.Status {
+	case "done":
+		event.Result = "/api/v1/jobs/" + job.ID + "/result"
+	case "failed":
+		event.Error = job.Error
+	}
+	return event
+}
+
+// streamJobEvents serves GET /api/jobs/{id}/events. The stream starts with
+// the current step, sends progress events as the job advances and ends
+// with a done or failed event.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	// Subscribed before the job is read, so a job finishing in between
+	// still closes the stream
+	ch, unsubscribe := subscribeJobEvents(id)
+	defer unsubscribe()
+
+	var job Job
+	if err := loadJSON("jobs", id, &job); err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Buffering proxies such as nginx would hold the events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	seq := 0
+	send := func(event JobEvent) bool {
+		name := "progress"
+		if event.Status == "done" || event.Status == "failed" {
+			name = event.Status
+		}
+		data, _ := json.Marshal(event)
+		seq++
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, name, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	final := func() {
+		var finished Job
+		if err := loadJSON("jobs", id, &finished); err == nil {
+			send(jobEventFor(&finished))
+		}
+	}
+
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	if job.FinishedAt != nil {
+		send(jobEventFor(&job))
+		return
+	}
+	current := jobEventFor(&job)
+	jobEvents.Lock()
+	if latest, ok := jobEvents.latest[id]; ok {
+		current = latest
+	}
+	jobEvents.Unlock()
+	if !send(current) {
+		return
+	}
+
+	heartbeat := time.NewTicker(jobEventHeartbeat)
+	defer heartbeat.Stop()
+	lastStage, lastSent := current.Stage, time.Now()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				final()
+				return
+			}
+			// Every stage is sent, the files read within one are thinned out
+			if event.Stage == lastStage && time.Since(lastSent) < jobEventInterval {
+				continue
+			}
+			if !send(event) {
+				return
+			}
+			lastStage, lastSent = event.Stage, time.Now()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Context builds of big repositories and generations over large contexts
+// take longer than clients and proxies keep a request open, so they can run
+// as jobs: the request is queued and answered at once, workers run it in
+// the background and the client polls the job, or follows its events, for
+// its progress and result.
+
+const (
+	defaultJobWorkers = 2
+	// Finished jobs and their results are kept this long
+	jobRetention = 24 * time.Hour
+	// Progress is written to the job at most this often, events carry
+	// every step
+	jobSaveInterval = time.Second
+)
+
+// Job is a queued context build or generation
+type Job struct {
+	ID        string      `json:"id"`
+	Kind      string      `json:"kind"` // clone or generate
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	Status    string      `json:"status"` // queued, running, done or failed
+	Progress  JobProgress `json:"progress"`
+	// The clone request without its access token. Generation requests are
+	// stored aside, their code context can be large.
+	Request *RepoRequest `json:"request,omitempty"`
+	Tenant  string       `json:"tenant,omitempty"`
+	// The request carried an access token or API key, kept in memory only
+	Credentials bool   `json:"credentials,omitempty"`
+	ContextID   string `json:"contextId,omitempty"`
+	FilesCount  int    `json:"filesCount,omitempty"`
+	RunID       string `json:"runId,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Status the request would have answered the error with
+	ErrorStatus int        `json:"errorStatus,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// JobProgress is the step a job is at. Clones go through cloning,
+// files-read and context-built for their repositories, generations through
+// context-built, model-called and parsing; both end done.
+type JobProgress struct {
+	Stage   string `json:"stage"`
+	Percent int    `json:"percent"`
+	Repo    string `json:"repo,omitempty"`
+	// File read last and the files read of the repository
+	File      string `json:"file,omitempty"`
+	FilesRead int    `json:"filesRead,omitempty"`
+	// Repositories of a clone and those read completely
+	Cloned       int `json:"cloned,omitempty"`
+	Repositories int `json:"repositories,omitempty"`
+}
+
+var (
+	jobsMu   sync.Mutex
+	jobQueue = make(chan string, 256)
+	// Access tokens and API keys of queued jobs, kept in memory only. Jobs
+	// needing one that are interrupted by a restart fail instead of
+	// resuming.
+	jobSecrets = map[string]string{}
+)
+
+// jobWorkers reads TESTGEN_JOB_WORKERS, the jobs run at once
+func jobWorkers() (int, error) {
+	value := os.Getenv("TESTGEN_JOB_WORKERS")
+	if value == "" {
+		return defaultJobWorkers, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("TESTGEN_JOB_WORKERS must be a positive number, got %q", value)
+	}
+	return n, nil
+}
+
+// newJob stores a queued job of a kind
+func newJob(kind string, progress JobProgress, update func(*Job)) (*Job, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	progress.Stage = "queued"
+	job := &Job{ID: id, Kind: kind, CreatedAt: now, UpdatedAt: now, Status: "queued", Progress: progress}
+	update(job)
+	if err := saveJSON("jobs", id, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// enqueueJob hands a stored job to the workers, removing it when the
+// queue is full
+func enqueueJob(job *Job, secret string) bool {
+	if secret != "" {
+		jobsMu.Lock()
+		jobSecrets[job.ID] = secret
+		jobsMu.Unlock()
+	}
+	select {
+	case jobQueue <- job.ID:
+		return true
+	default:
+		jobsMu.Lock()
+		delete(jobSecrets, job.ID)
+		jobsMu.Unlock()
+		deleteJSON("job-requests", job.ID)
+		deleteJSON("jobs", job.ID)
+		return false
+	}
+}
+
+// updateJob applies a change to a stored job
+func updateJob(id string, update func(*Job)) (*Job, error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	var job Job
+	if err := loadJSON("jobs", id, &job); err != nil {
+		return nil, err
+	}
+	update(&job)
+	job.UpdatedAt = time.Now().UTC()
+	return &job, saveJSON("jobs", id, job)
+}
+
+// jobSecret takes the secret of a job out of memory
+func jobSecret(id string) string {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	secret := jobSecrets[id]
+	delete(jobSecrets, id)
+	return secret
+}
+
+// runJobs runs queued jobs, one per worker
+func runJobs() {
+	for id := range jobQueue {
+		job, err := updateJob(id, func(j *Job) { j.Status = "running" })
+		if err != nil {
+			// Deleted while it was queued
+			continue
+		}
+
+		// Every step is published, the job file is only rewritten when the
+		// stage changes or jobSaveInterval passed
+		var saved JobProgress
+		var savedAt time.Time
+		progress := func(p JobProgress) {
+			publishJobEvent(JobEvent{JobID: id, Status: "running", JobProgress: p})
+			if p.Stage != saved.Stage || time.Since(savedAt) >= jobSaveInterval {
+				saved, savedAt = p, time.Now()
+				updateJob(id, func(j *Job) { j.Progress = p })
+			}
+		}
+
+		var result interface{}
+		var update func(*Job)
+		switch job.Kind {
+		case "generate":
+			var req GeminiRequest
+			if err = loadJSON("job-requests", id, &req); err == nil {
+				req.APIKey = jobSecret(id)
+				req.progress = progress
+				var response GeminiResponse
+				if response, err = generateTests(req, job.Tenant); err == nil {
+					result = response
+					update = func(j *Job) { j.RunID = response.RunID }
+				}
+			}
+			deleteJSON("job-requests", id)
+		default:
+			req := *job.Request
+			req.AccessToken = jobSecret(id)
+			var response *RepoResponse
+			if response, err = buildRepoContext(req, progress); err == nil {
+				result = response
+				update = func(j *Job) {
+					j.ContextID = response.ContextID
+					j.FilesCount = response.FilesCount
+				}
+			}
+		}
+		if err == nil {
+			if err = saveJSON("job-results", id, result); err != nil {
+				log.Printf("Error saving result of job %s: %v", id, err)
+				err = errors.New("Failed to save job result")
+			}
+		}
+
+		job, _ = updateJob(id, func(j *Job) {
+			now := time.Now().UTC()
+			j.FinishedAt = &now
+			if err != nil {
+				var reqErr *requestError
+				j.Status = "failed"
+				j.Error = err.Error()
+				j.ErrorStatus = http.StatusInternalServerError
+				if errors.As(err, &reqErr) {
+					j.Error = reqErr.message
+					j.ErrorStatus = reqErr.status
+				}
+				return
+			}
+			j.Status = "done"
+			j.Progress = JobProgress{Stage: "done", Percent: 100, Cloned: j.Progress.Repositories, Repositories: j.Progress.Repositories}
+			update(j)
+		})
+		if job != nil {
+			finishJobEvents(job)
+		}
+		if err != nil {
+			log.Printf("Job %s failed: %v", id, err)
+			continue
+		}
+		log.Printf("Job %s finished", id)
+	}
+}
+
+// resumeJobs queues the jobs left unfinished by a restart. Jobs needing a
+// secret lost it with the restart and fail.
+func resumeJobs() {
+	ids, err := listJSON("jobs")
+	if err != nil {
+		log.Printf("Warning: Could not list jobs: %v", err)
+		return
+	}
+	for _, id := range ids {
+		job, err := updateJob(id, func(j *Job) {
+			if j.Status != "queued" && j.Status != "running" {
+				return
+			}
+			if j.Credentials {
+				now := time.Now().UTC()
+				j.Status = "failed"
+				j.Error = "The server restarted before the job finished, submit it again"
+				j.ErrorStatus = http.StatusServiceUnavailable
+				j.FinishedAt = &now
+				deleteJSON("job-requests", j.ID)
+				return
+			}
+			j.Status = "queued"
+			j.Progress = JobProgress{Stage: "queued", Repositories: j.Progress.Repositories}
+		})
+		if err != nil || job.Status != "queued" {
+			continue
+		}
+		select {
+		case jobQueue <- id:
+		default:
+			log.Printf("Warning: Job queue full, %s not resumed", id)
+		}
+	}
+}
+
+// expireJobs removes finished jobs and their results after jobRetention
+func expireJobs(interval time.Duration) {
+	for range time.Tick(interval) {
+		ids, err := listJSON("jobs")
+		if err != nil {
+			log.Printf("Warning: Could not list jobs: %v", err)
+			continue
+		}
+		jobsMu.Lock()
+		for _, id := range ids {
+			var job Job
+			if err := loadJSON("jobs", id, &job); err == nil && job.FinishedAt != nil && time.Since(*job.FinishedAt) > jobRetention {
+				deleteJSON("job-results", id)
+				deleteJSON("jobs", id)
+				log.Printf("Expired job %s", id)
+			}
+		}
+		jobsMu.Unlock()
+	}
+}
+
+// writeJobAccepted answers a queued job with 202 Accepted
+func writeJobAccepted(w http.ResponseWriter, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// queueRepoJob queues a decoded clone request as a job
+func queueRepoJob(w http.ResponseWriter, req RepoRequest) {
+	repositories := len(req.RepoURLs)
+	if req.RepoURL != "" {
+		repositories++
+	}
+	job, err := newJob("clone", JobProgress{Repositories: repositories}, func(j *Job) {
+		stored := req
+		stored.AccessToken = ""
+		j.Request = &stored
+		j.Credentials = req.AccessToken != ""
+	})
+	if err != nil {
+		log.Printf("Error saving job: %v", err)
+		http.Error(w, "Failed to save job", http.StatusInternalServerError)
+		return
+	}
+	if !enqueueJob(job, req.AccessToken) {
+		http.Error(w, "Job queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Queued clone job %s: %d repositories", job.ID, repositories)
+	writeJobAccepted(w, job)
+}
+
+// queueGenerationJob queues a decoded generation request as a job
+func queueGenerationJob(w http.ResponseWriter, req GeminiRequest, tenant string) {
+	if !req.hasAPIKey() && req.needsAPIKey() {
+		http.Error(w, "API Key is required", http.StatusBadRequest)
+		return
+	}
+	job, err := newJob("generate", JobProgress{}, func(j *Job) {
+		j.Tenant = tenant
+		j.Credentials = req.APIKey != ""
+	})
+	if err == nil {
+		stored := req
+		stored.APIKey = ""
+		if err = saveJSON("job-requests", job.ID, stored); err != nil {
+			deleteJSON("jobs", job.ID)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving job: %v", err)
+		http.Error(w, "Failed to save job", http.StatusInternalServerError)
+		return
+	}
+	if !enqueueJob(job, req.APIKey) {
+		http.Error(w, "Job queue is full, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Queued generation job %s", job.ID)
+	writeJobAccepted(w, job)
+}
+
+// prefersAsync reports whether a request asked to be answered with a job,
+// with Prefer: respond-async
+func prefersAsync(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Prefer"), "respond-async")
+}
+
+// jobsHandler serves:
+//
+//	POST   /api/jobs              queue a clone-repo request, 202 Accepted
+//	GET    /api/jobs/{id}         status and progress of a job
+//	GET    /api/jobs/{id}/events  the progress as Server-Sent Events
+//	GET    /api/jobs/{id}/result  the response of a finished job
+//	DELETE /api/jobs/{id}         remove a finished job and its result
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, DELETE, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/")
+	if path == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RepoRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		queueRepoJob(w, req)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "result" && parts[1] != "events") {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var job Job
+	if err := loadJSON("jobs", parts[0], &job); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read job", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		if job.FinishedAt == nil {
+			http.Error(w, "Job has not finished", http.StatusConflict)
+			return
+		}
+		jobsMu.Lock()
+		deleteJSON("job-results", job.ID)
+		err := deleteJSON("jobs", job.ID)
+		jobsMu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to delete job", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "events" && r.Method == "GET":
+		streamJobEvents(w, r, job.ID)
+
+	case len(parts) == 2 && r.Method == "GET":
+		switch job.Status {
+		case "done":
+			var response json.RawMessage
+			if err := loadJSON("job-results", job.ID, &response); err != nil {
+				http.Error(w, "Failed to read job result", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(response)
+		case "failed":
+			http.Error(w, job.Error, job.ErrorStatus)
+		default:
+			// Not there yet, the job tells how far it got
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider keys are kept on the server, so browsers never hold them and
+// they stay out of request logs. A generation names a key by its keyAlias.
+// Keys come from TESTGEN_<PROVIDER>_API_KEY, which is the provider's
+// default key and takes the provider's name as alias, from the secret file
+// named by TESTGEN_API_KEYS_FILE, or from PUT /api/keys/{alias}. Keys put
+// through the API are stored encrypted with TESTGEN_KEY_ENCRYPTION_KEY or
+// a key generated in the data directory. No endpoint returns a key.
+
+// configuredAPIKey is a key of the secret file
+type configuredAPIKey struct {
+	Alias    string `json:"alias"`
+	Provider string `json:"provider"`
+	Key      string `json:"key"`
+}
+
+// storedAPIKey is a key put through the API, encrypted at rest
+type storedAPIKey struct {
+	Alias       string    `json:"alias"`
+	Provider    string    `json:"provider"`
+	Nonce       string    `json:"nonce"`
+	Ciphertext  string    `json:"ciphertext"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedBy   string    `json:"createdBy,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// APIKeyInfo describes a key without revealing it
+type APIKeyInfo struct {
+	Alias       string     `json:"alias"`
+	Provider    string     `json:"provider"`
+	Source      string     `json:"source"` // env, file or api
+	Fingerprint string     `json:"fingerprint"`
+	CreatedBy   string     `json:"createdBy,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+}
+
+type apiKeyPutRequest struct {
+	Provider string `json:"provider"`
+	Key      string `json:"key"`
+}
+
+func (req *apiKeyPutRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.required("provider", req.Provider)
+	errs.oneOf("provider", req.Provider, llmProviderNames()...)
+	errs.required("key", req.Key)
+	errs.maxLen("key", req.Key, 4096)
+	return errs
+}
+
+var (
+	// Keys of the environment and the secret file by alias, read at startup
+	configuredKeys = map[string]configuredAPIKey{}
+	keySources     = map[string]string{}
+
+	// TESTGEN_DISABLE_REQUEST_KEYS rejects apiKey in requests
+	requestKeysDisabled bool
+
+	keyCipherOnce sync.Once
+	keyCipher     cipher.AEAD
+	keyCipherErr  error
+)
+
+// providerKeyEnv is the variable of a provider's default key
+func providerKeyEnv(provider string) string {
+	return "TESTGEN_" + strings.ToUpper(provider) + "_API_KEY"
+}
+
+func loadAPIKeys() error {
+	requestKeysDisabled = os.Getenv("TESTGEN_DISABLE_REQUEST_KEYS") == "true"
+	for _, provider := range llmProviderNames() {
+		if key := os.Getenv(providerKeyEnv(provider)); key != "" {
+			configuredKeys[provider] = configuredAPIKey{Alias: provider, Provider: provider, Key: key}
+			keySources[provider] = "env"
+		}
+	}
+
+	path := os.Getenv("TESTGEN_API_KEYS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Keys []configuredAPIKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid API keys file %s: %v", path, err)
+	}
+	for _, key := range file.Keys {
+		if !validStoreID.MatchString(key.Alias) {
+			return fmt.Errorf("invalid key alias %q in %s", key.Alias, path)
+		}
+		if _, ok := lookupLLMProvider(key.Provider); !ok || key.Provider == "" {
+			return fmt.Errorf("unknown provider %q for key %s", key.Provider, key.Alias)
+		}
+		if key.Key == "" {
+			return fmt.Errorf("key %s has no key", key.Alias)
+		}
+		if _, ok := configuredKeys[key.Alias]; ok {
+			return fmt.Errorf("key alias %s is configured twice", key.Alias)
+		}
+		configuredKeys[key.Alias] = key
+		keySources[key.Alias] = "file"
+	}
+	return nil
+}
+
+// apiKeyCipher is the AES-GCM cipher stored keys are encrypted with
+func apiKeyCipher() (cipher.AEAD, error) {
+	keyCipherOnce.Do(func() {
+		var key []byte
+		if encoded := os.Getenv("TESTGEN_KEY_ENCRYPTION_KEY"); encoded != "" {
+			key, keyCipherErr = base64.StdEncoding.DecodeString(encoded)
+			if keyCipherErr == nil && len(key) != 32 {
+				keyCipherErr = errors.New("TESTGEN_KEY_ENCRYPTION_KEY must be a 32 byte key")
+			}
+		} else {
+			key, keyCipherErr = loadOrCreateKeySeed(filepath.Join(dataDir, "keys", "api-keys.key"))
+		}
+		if keyCipherErr != nil {
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			keyCipherErr = err
+			return
+		}
+		keyCipher, keyCipherErr = cipher.NewGCM(block)
+	})
+	return keyCipher, keyCipherErr
+}
+
+// keyFingerprint identifies a key in listings and logs
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// lookupAPIKey returns the provider and key of an alias, configured keys
+// first
+func lookupAPIKey(alias string) (provider, key string, err error) {
+	if configured, ok := configuredKeys[alias]; ok {
+		return configured.Provider, configured.Key, nil
+	}
+	var stored storedAPIKey
+	if err := loadJSON("api-keys", alias, &stored); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			return "", "", &requestError{http.StatusUnprocessableEntity, "Unknown key alias " + alias}
+		}
+		return "", "", err
+	}
+	aead, err := apiKeyCipher()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, _ := base64.StdEncoding.DecodeString(stored.Nonce)
+	ciphertext, _ := base64.StdEncoding.DecodeString(stored.Ciphertext)
+	if len(nonce) != aead.NonceSize() {
+		return "", "", fmt.Errorf("Stored key %s is corrupt", alias)
+	}
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(alias))
+	if err != nil {
+		return "", "", fmt.Errorf("Stored key %s cannot be decrypted, was the encryption key changed?", alias)
+	}
+	return stored.Provider, string(plain), nil
+}
+
+// hasAPIKey reports whether the request carries a key, names one or can
+// use the provider's default key
+func (req GeminiRequest) hasAPIKey() bool {
+	if req.APIKey != "" || req.KeyAlias != "" {
+		return true
+	}
+	return req.usesDefaultKey()
+}
+
+// usesDefaultKey reports whether the request falls back to the provider's
+// default key. Keys kept on the server only go to the endpoint the server
+// configures, a request naming its own endpoint brings its own key.
+func (req GeminiRequest) usesDefaultKey() bool {
+	if req.Endpoint != "" {
+		return false
+	}
+	_, ok := configuredKeys[req.provider().Name()]
+	return ok
+}
+
+// resolveAPIKey replaces the request's key alias, or the absence of a key,
+// by the key itself
+func (req *GeminiRequest) resolveAPIKey() error {
+	if req.APIKey != "" || req.Mode == "skeleton" {
+		return nil
+	}
+	alias := req.KeyAlias
+	if alias != "" && req.Endpoint != "" {
+		return &requestError{http.StatusUnprocessableEntity, "Keys kept on the server are not sent to a request's endpoint, send apiKey or leave endpoint out"}
+	}
+	if alias == "" {
+		if !req.usesDefaultKey() {
+			return nil
+		}
+		alias = req.provider().Name()
+	}
+	provider, key, err := lookupAPIKey(alias)
+	if err != nil {
+		return err
+	}
+	if provider != req.provider().Name() {
+		return &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("Key %s is a %s key, the request uses %s", alias, provider, req.provider().Name())}
+	}
+	req.APIKey = key
+	return nil
+}
+
+func validateAPIKey(errs *fieldErrors, req *GeminiRequest) {
+	if req.KeyAlias != "" && !validStoreID.MatchString(req.KeyAlias) {
+		errs.add("keyAlias", "id", "keyAlias may only contain letters, digits, '.', '_' and '-'")
+	}
+	switch {
+	case req.APIKey != "" && req.KeyAlias != "":
+		errs.add("keyAlias", "excluded_with", "keyAlias and apiKey are exclusive")
+	case req.KeyAlias != "" && req.Endpoint != "":
+		errs.add("keyAlias", "excluded_with", "keys kept on the server are only sent to the server's endpoint, send apiKey with endpoint")
+	case req.APIKey != "" && requestKeysDisabled:
+		errs.add("apiKey", "disabled", "this server does not accept keys in requests, name one with keyAlias")
+	case req.needsAPIKey() && !req.hasAPIKey():
+		errs.required("apiKey", req.APIKey)
+	}
+}
+
+// listAPIKeys describes the configured and stored keys, sorted by alias
+func listAPIKeys() ([]APIKeyInfo, error) {
+	var keys []APIKeyInfo
+	for alias, key := range configuredKeys {
+		keys = append(keys, APIKeyInfo{Alias: alias, Provider: key.Provider, Source: keySources[alias], Fingerprint: keyFingerprint(key.Key)})
+	}
+	ids, err := listJSON("api-keys")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		var stored storedAPIKey
+		if _, ok := configuredKeys[id]; ok || loadJSON("api-keys", id, &stored) != nil {
+			continue
+		}
+		createdAt := stored.CreatedAt
+		keys = append(keys, APIKeyInfo{
+			Alias:       stored.Alias,
+			Provider:    stored.Provider,
+			Source:      "api",
+			Fingerprint: stored.Fingerprint,
+			CreatedBy:   stored.CreatedBy,
+			CreatedAt:   &createdAt,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Alias < keys[j].Alias })
+	return keys, nil
+}
+
+// apiKeysHandler serves GET /api/keys and PUT and DELETE on
+// /api/keys/{alias}
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, PUT, DELETE, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	alias := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/keys"), "/")
+	if alias == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys, err := listAPIKeys()
+		if err != nil {
+			http.Error(w, "Failed to list keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+		return
+	}
+	if _, err := storePath("api-keys", alias); err != nil {
+		http.Error(w, "Invalid key alias", http.StatusBadRequest)
+		return
+	}
+	if _, ok := configuredKeys[alias]; ok && (r.Method == "PUT" || r.Method == "DELETE") {
+		http.Error(w, "Key "+alias+" is configured on the server and cannot be changed through the API", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var req apiKeyPutRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		aead, err := apiKeyCipher()
+		if err != nil {
+			log.Printf("Error loading key encryption key: %v", err)
+			http.Error(w, "Failed to store key", http.StatusInternalServerError)
+			return
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			http.Error(w, "Failed to store key", http.StatusInternalServerError)
+			return
+		}
+		stored := storedAPIKey{
+			Alias:       alias,
+			Provider:    req.Provider,
+			Nonce:       base64.StdEncoding.EncodeToString(nonce),
+			Ciphertext:  base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, []byte(req.Key), []byte(alias))),
+			Fingerprint: keyFingerprint(req.Key),
+			CreatedAt:   time.Now().UTC(),
+		}
+		if principal, ok := requestPrincipal(r); ok {
+			stored.CreatedBy = principal.Name
+		}
+		if err := saveJSON("api-keys", alias, stored); err != nil {
+			log.Printf("Error saving key %s: %v", alias, err)
+			http.Error(w, "Failed to store key", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Stored %s key %s (%s)", stored.Provider, alias, stored.Fingerprint)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(APIKeyInfo{
+			Alias:       alias,
+			Provider:    stored.Provider,
+			Source:      "api",
+			Fingerprint: stored.Fingerprint,
+			CreatedBy:   stored.CreatedBy,
+			CreatedAt:   &stored.CreatedAt,
+		})
+
+	case "DELETE":
+		if err := deleteJSON("api-keys", alias); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "Key not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to delete key", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted key %s", alias)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useKeyEncryptionKey sets TESTGEN_KEY_ENCRYPTION_KEY to a new key and
+// makes the cipher read it again
+func useKeyEncryptionKey(t *testing.T) {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TESTGEN_KEY_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	keyCipherOnce, keyCipher, keyCipherErr = sync.Once{}, nil, nil
+	t.Cleanup(func() { keyCipherOnce, keyCipher, keyCipherErr = sync.Once{}, nil, nil })
+}
+
+// TestStoredAPIKeyEncryption stores a key through the API and reads it
+// back. The alias is authenticated with the key, so a stored key copied to
+// another alias or read with another encryption key does not decrypt.
+func TestStoredAPIKeyEncryption(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useKeyEncryptionKey(t)
+
+	const secret = "sk-test-0123456789"
+	w := httptest.NewRecorder()
+	apiKeysHandler(w, httptest.NewRequest("PUT", "/api/keys/payments", strings.NewReader(`{"provider":"openai","key":"`+secret+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /api/keys/payments = %d: %s", w.Code, w.Body)
+	}
+	data, err := os.ReadFile(filepath.Join(dataDir, "api-keys", "payments.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), secret) {
+		t.Fatalf("stored key is not encrypted: %s", data)
+	}
+
+	tests := []struct {
+		name    string
+		alias   string
+		setup   func(t *testing.T)
+		wantKey string
+		wantErr string
+	}{
+		{"stored alias", "payments", nil, secret, ""},
+		{"copied to another alias", "billing", func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dataDir, "api-keys", "billing.json"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "", "cannot be decrypted"},
+		{"unknown alias", "missing", nil, "", "Unknown key alias"},
+		{"other encryption key", "payments", useKeyEncryptionKey, "", "cannot be decrypted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			provider, key, err := lookupAPIKey(tt.alias)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("lookupAPIKey(%q) error = %v, want %q", tt.alias, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupAPIKey(%q) error = %v", tt.alias, err)
+			}
+			if provider != "openai" || key != tt.wantKey {
+				t.Errorf("lookupAPIKey(%q) = %q, %q, want openai, %q", tt.alias, provider, key, tt.wantKey)
+			}
+		})
+	}
+}
+
+// TestUsesDefaultKey checks that the provider's default key is only used
+// for the endpoint the server configures
+func TestUsesDefaultKey(t *testing.T) {
+	saved := configuredKeys
+	configuredKeys = map[string]configuredAPIKey{"openai": {Alias: "openai", Provider: "openai", Key: "sk-default"}}
+	t.Cleanup(func() { configuredKeys = saved })
+
+	tests := []struct {
+		name    string
+		req     GeminiRequest
+		want    bool
+		wantKey string
+	}{
+		{"provider with a default key", GeminiRequest{Provider: "openai"}, true, "sk-default"},
+		{"provider without one", GeminiRequest{Provider: "claude"}, false, ""},
+		{"request endpoint", GeminiRequest{Provider: "openai", Endpoint: "https://llm.example.com"}, false, ""},
+		{"own key", GeminiRequest{Provider: "openai", APIKey: "sk-own"}, true, "sk-own"},
+		{"own key and endpoint", GeminiRequest{Provider: "openai", APIKey: "sk-own", Endpoint: "https://llm.example.com"}, false, "sk-own"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.usesDefaultKey(); got != tt.want {
+				t.Errorf("usesDefaultKey() = %v, want %v", got, tt.want)
+			}
+			req := tt.req
+			if err := req.resolveAPIKey(); err != nil {
+				t.Fatalf("resolveAPIKey() error = %v", err)
+			}
+			if req.APIKey != tt.wantKey {
+				t.Errorf("resolveAPIKey() key = %q, want %q", req.APIKey, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Output languages. Teams can have test names and descriptions written in
+// one language and the comments of generated code in another, such as
+// Japanese descriptions for reviewers and English comments for the code
+// base. The prompt asks for both, and after generation every field the
+// model got wrong is translated in one more model call or reported.
+
+// outputLanguage describes a language well enough to tell it from the
+// others: by script, or by its most common words when it is written in
+// Latin script
+type outputLanguage struct {
+	name      string
+	scripts   []*unicode.RangeTable
+	stopwords []string
+}
+
+var outputLanguages = map[string]outputLanguage{
+	"en": {name: "English", stopwords: strings.Fields("the and is are should when with returns that it of to for an not be if empty given")},
+	"es": {name: "Spanish", stopwords: strings.Fields("el la los las que y debe cuando con para una es del se no por devuelve si vacío")},
+	"fr": {name: "French", stopwords: strings.Fields("le la les des que et doit quand avec pour une est du ne pas renvoie si vide")},
+	"de": {name: "German", stopwords: strings.Fields("der die das und ist soll wenn mit für ein eine nicht zu den gibt sollte leer")},
+	"pt": {name: "Portuguese", stopwords: strings.Fields("o os as que e deve quando com para uma é do da não retorna se vazio")},
+	"it": {name: "Italian", stopwords: strings.Fields("il lo gli che e deve quando con per una è del della non restituisce se vuoto")},
+	"nl": {name: "Dutch", stopwords: strings.Fields("de het een en is moet wanneer met voor niet van dat geeft als leeg")},
+	"ja": {name: "Japanese", scripts: []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana, unicode.Han}},
+	"zh": {name: "Chinese", scripts: []*unicode.RangeTable{unicode.Han}},
+	"ko": {name: "Korean", scripts: []*unicode.RangeTable{unicode.Hangul}},
+	"ru": {name: "Russian", scripts: []*unicode.RangeTable{unicode.Cyrillic}},
+	"ar": {name: "Arabic", scripts: []*unicode.RangeTable{unicode.Arabic}},
+	"hi": {name: "Hindi", scripts: []*unicode.RangeTable{unicode.Devanagari}},
+}
+
+// Language tags such as es, ja or pt-BR
+var languageTag = regexp.MustCompile(`^([a-z]{2})(-[A-Za-z0-9]{2,8})?$`)
+
+// lookupOutputLanguage returns the language of a tag, ignoring its region
+func lookupOutputLanguage(tag string) (outputLanguage, bool) {
+	match := languageTag.FindStringSubmatch(tag)
+	if match == nil {
+		return outputLanguage{}, false
+	}
+	language, ok := outputLanguages[match[1]]
+	return language, ok
+}
+
+func languageLabel(tag string) string {
+	language, _ := lookupOutputLanguage(tag)
+	return fmt.Sprintf("%s (%s)", language.name, tag)
+}
+
+func supportedLanguages() []string {
+	var codes []string
+	for code := range outputLanguages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// validateLanguage checks a language tag field of a generation request
+func validateLanguage(errs *fieldErrors, field, tag string) {
+	if tag == "" {
+		return
+	}
+	if _, ok := lookupOutputLanguage(tag); !ok {
+		errs.add(field, "language", "%s must be a language tag with one of the languages %s", field, strings.Join(supportedLanguages(), ", "))
+	}
+}
+
+// languagePromptSection tells the model which languages to write in
+func languagePromptSection(req GeminiRequest) string {
+	if req.DescriptionLanguage == "" && req.CommentLanguage == "" {
+		return ""
+	}
+	var section strings.Builder
+	section.WriteString("Output languages (always follow these):\n")
+	if req.DescriptionLanguage != "" {
+		section.WriteString("- Write every test name, test description and refactor suggestion description in " + languageLabel(req.DescriptionLanguage) + ".\n")
+	}
+	if req.CommentLanguage != "" {
+		section.WriteString("- Write every comment inside generated code in " + languageLabel(req.CommentLanguage) + ".\n")
+	}
+	section.WriteString("- Never translate identifiers, string literals or log messages.\n")
+	return section.String() + "\n"
+}
+
+// languageWords splits text into lower case words, breaking identifiers
+// such as returns_error_when_empty apart
+func languageWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+}
+
+// inLanguage reports whether text is plausibly written in the language.
+// Text too short to tell, such as a single word, always is.
+func inLanguage(text string, language outputLanguage) bool {
+	latin, target, other := 0, 0, 0
+	for _, r := range text {
+		switch {
+		case !unicode.IsLetter(r):
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		case unicode.In(r, language.scripts...):
+			target++
+		default:
+			other++
+		}
+	}
+
+	if len(language.scripts) > 0 {
+		if target > 0 {
+			return true
+		}
+		// Identifiers are Latin, so it takes two words of prose to be wrong
+		return other == 0 && len(languageWords(text)) < 2
+	}
+
+	if other > latin {
+		return false
+	}
+	words := languageWords(text)
+	if len(words) < 3 {
+		return true
+	}
+	own := stopwordCount(words, language.stopwords)
+	for _, candidate := range outputLanguages {
+		if score := stopwordCount(words, candidate.stopwords); score >= 2 && score > own {
+			return false
+		}
+	}
+	return true
+}
+
+func stopwordCount(words, stopwords []string) int {
+	count := 0
+	for _, word := range words {
+		for _, stopword := range stopwords {
+			if word == stopword {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// commentSpan is the text of a comment without its markers
+type commentSpan struct {
+	start, end int
+	line       bool // a line comment, which cannot hold a line break
+}
+
+// commentSpans finds the comments of a source file, leaving out build
+// directives and shebangs
+func commentSpans(src string, syntax *sourceSyntax) []commentSpan {
+	var spans []commentSpan
+	for i := 0; i < len(src); {
+		tok := scanToken(src, i, syntax)
+		i = tok.end
+		text := src[tok.start:tok.end]
+		span := commentSpan{start: tok.start, end: tok.end}
+		switch tok.kind {
+		case tokenLineComment:
+			if isDirectiveComment(text) || (tok.start == 0 && strings.HasPrefix(src, "#!")) {
+				continue
+			}
+			span.start += len(lineCommentAt(src, tok.start, syntax))
+			span.line = true
+		case tokenBlockComment:
+			span.start += len(syntax.blockStart)
+			if strings.HasSuffix(text, syntax.blockEnd) && len(text) >= len(syntax.blockStart)+len(syntax.blockEnd) {
+				span.end -= len(syntax.blockEnd)
+			}
+		default:
+			continue
+		}
+		// Trim blanks and the stars of doc comments so translations keep the layout
+		body := src[span.start:span.end]
+		span.start += len(body) - len(strings.TrimLeft(body, " \t\r\n*/#-"))
+		span.end -= len(body) - len(strings.TrimRight(body, " \t\r\n*"))
+		if span.start < span.end && strings.IndexFunc(src[span.start:span.end], unicode.IsLetter) != -1 {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// languageField is generated text in the wrong language
+type languageField struct {
+	text string
+	set  func(string)
+	// Test case or artifact the text belongs to, for warnings
+	testID string
+	file   string
+}
+
+type commentEdit struct {
+	span commentSpan
+	text string
+}
+
+// enforceLanguages translates the names, descriptions and code comments
+// the model wrote in the wrong language, and warns about the ones it could
+// not translate. Without a meter, as for skeletons, it only warns.
+func enforceLanguages(testResponse *GeminiResponse, req GeminiRequest, meter *tokenMeter) {
+	if language, ok := lookupOutputLanguage(req.DescriptionLanguage); ok {
+		var fields []languageField
+		check := func(text *string, testID string) {
+			if *text != "" && !inLanguage(*text, language) {
+				fields = append(fields, languageField{text: *text, set: func(s string) { *text = s }, testID: testID})
+			}
+		}
+		for i := range testResponse.TestCases {
+			tc := &testResponse.TestCases[i]
+			check(&tc.Name, tc.ID)
+			check(&tc.Description, tc.ID)
+			if tc.Refactor != nil {
+				check(&tc.Refactor.Description, tc.ID)
+			}
+		}
+		for i := range testResponse.RefactorSuggestions {
+			check(&testResponse.RefactorSuggestions[i].Description, "")
+		}
+		for i := range testResponse.Artifacts {
+			check(&testResponse.Artifacts[i].Description, "")
+		}
+
+		remaining := repairLanguage(fields, req, language, meter)
+		if len(remaining) > 0 {
+			var ids []string
+			for _, field := range remaining {
+				if field.testID != "" && (len(ids) == 0 || ids[len(ids)-1] != field.testID) {
+					ids = append(ids, field.testID)
+				}
+			}
+			testResponse.Warnings = append(testResponse.Warnings, AnalysisWarning{
+				Kind:    "language",
+				Message: fmt.Sprintf("%d names and descriptions are not in %s", len(remaining), languageLabel(req.DescriptionLanguage)),
+				TestIDs: ids,
+			})
+		}
+	}
+
+	if language, ok := lookupOutputLanguage(req.CommentLanguage); ok {
+		var fields []languageField
+		edits := map[int][]commentEdit{}
+		for i := range testResponse.Artifacts {
+			artifact := &testResponse.Artifacts[i]
+			syntax := syntaxFor(artifact.Path)
+			if syntax == nil {
+				continue
+			}
+			for _, span := range commentSpans(artifact.Content, syntax) {
+				text := artifact.Content[span.start:span.end]
+				if inLanguage(text, language) {
+					continue
+				}
+				i, span := i, span
+				fields = append(fields, languageField{text: text, file: artifact.Path, set: func(s string) {
+					edits[i] = append(edits[i], commentEdit{span: span, text: s})
+				}})
+			}
+		}
+
+		remaining := repairLanguage(fields, req, language, meter)
+		for i, artifactEdits := range edits {
+			testResponse.Artifacts[i].Content = applyCommentEdits(testResponse.Artifacts[i].Content, syntaxFor(testResponse.Artifacts[i].Path), artifactEdits)
+		}
+		perFile := map[string]int{}
+		var files []string
+		for _, field := range remaining {
+			if perFile[field.file] == 0 {
+				files = append(files, field.file)
+			}
+			perFile[field.file]++
+		}
+		for _, file := range files {
+			testResponse.Warnings = append(testResponse.Warnings, AnalysisWarning{
+				Kind:    "language",
+				File:    file,
+				Message: fmt.Sprintf("%d code comments are not in %s", perFile[file], languageLabel(req.CommentLanguage)),
+			})
+		}
+	}
+}
+
+// repairLanguage asks the model to translate the fields in one call and
+// returns the ones still in the wrong language
+func repairLanguage(fields []languageField, req GeminiRequest, language outputLanguage, meter *tokenMeter) []languageField {
+	if len(fields) == 0 || meter == nil || (req.APIKey == "" && req.needsAPIKey()) {
+		return fields
+	}
+	texts := make([]string, len(fields))
+	for i, field := range fields {
+		texts[i] = field.text
+	}
+	translations, err := translateTexts(texts, language, req, meter)
+	if err != nil {
+		log.Printf("Warning: Could not translate %d fields to %s: %v", len(fields), language.name, err)
+		return fields
+	}
+
+	var remaining []languageField
+	for i, field := range fields {
+		if translation := strings.TrimSpace(translations[i]); translation != "" && inLanguage(translation, language) {
+			field.set(translation)
+		} else {
+			remaining = append(remaining, field)
+		}
+	}
+	log.Printf("Translated %d of %d fields to %s", len(fields)-len(remaining), len(fields), language.name)
+	return remaining
+}
+
+// translateTexts translates texts in one model call, keeping their order
+func translateTexts(texts []string, language outputLanguage, req GeminiRequest, meter *tokenMeter) ([]string, error) {
+	encoded, err := json.Marshal(texts)
+	if err != nil {
+		return nil, err
+	}
+	prompt := fmt.Sprintf(`Translate each string of the JSON array below into %s. Keep identifiers, function names, literals, placeholders, markdown and line breaks unchanged and keep the meaning exact.
+
+Return only JSON of the form {"translations": ["..."]} with exactly one translation per string, in the same order.
+
+%s`, language.name, encoded)
+
+	generatedText, err := generateText(req, prompt, meter)
+	if err != nil {
+		return nil, err
+	}
+	jsonStart := strings.Index(generatedText, "{")
+	jsonEnd := strings.LastIndex(generatedText, "}")
+	if jsonStart == -1 || jsonEnd == -1 || jsonStart >= jsonEnd {
+		return nil, errors.New("No valid JSON found in model response")
+	}
+	var parsed struct {
+		Translations []string `json:"translations"`
+	}
+	if err := json.Unmarshal([]byte(generatedText[jsonStart:jsonEnd+1]), &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse translations from model response: %v", err)
+	}
+	if len(parsed.Translations) != len(texts) {
+		return nil, fmt.Errorf("expected %d translations, got %d", len(texts), len(parsed.Translations))
+	}
+	return parsed.Translations, nil
+}
+
+// applyCommentEdits replaces comment texts, keeping each comment closed
+func applyCommentEdits(src string, syntax *sourceSyntax, edits []commentEdit) string {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].span.start > edits[j].span.start })
+	for _, edit := range edits {
+		text := edit.text
+		if edit.span.line {
+			text = strings.Join(strings.Fields(text), " ")
+		} else if syntax.blockEnd != "" && strings.Contains(text, syntax.blockEnd) {
+			continue
+		}
+		src = src[:edit.span.start] + text + src[edit.span.end:]
+	}
+	return src
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Request bodies are capped before they are read so a large or endless
+// upload cannot exhaust the server's memory. Limits are in bytes and can be
+// raised with the environment variables below.
+type bodyLimits struct {
+	Default  int64 // TESTGEN_MAX_BODY_BYTES
+	Generate int64 // TESTGEN_MAX_CONTEXT_BYTES, generation requests carrying a code context
+	Upload   int64 // TESTGEN_MAX_UPLOAD_BYTES, session files and snippets
+}
+
+var defaultBodyLimits = bodyLimits{
+	Default:  1 << 20,
+	Generate: 16 << 20,
+	Upload:   4 << 20,
+}
+
+func loadBodyLimits() (bodyLimits, error) {
+	limits := defaultBodyLimits
+	for name, limit := range map[string]*int64{
+		"TESTGEN_MAX_BODY_BYTES":    &limits.Default,
+		"TESTGEN_MAX_CONTEXT_BYTES": &limits.Generate,
+		"TESTGEN_MAX_UPLOAD_BYTES":  &limits.Upload,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("%s must be a positive number of bytes", name)
+		}
+		*limit = n
+	}
+	return limits, nil
+}
+
+// limitFor returns the body limit of an API request
+func (l bodyLimits) limitFor(r *http.Request) int64 {
+	switch path := r.URL.Path; {
+	case path == "/api/generate-tests":
+		return l.Generate
+	case strings.HasPrefix(path, "/api/sessions"), path == "/api/hooks/check":
+		return l.Upload
+	}
+	return l.Default
+}
+
+// isBodyTooLarge reports whether err came from reading past the body limit
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// withBodyLimits caps the body of every request, refusing bodies that
+// declare a larger size up front
+func withBodyLimits(next http.Handler, limits bodyLimits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := limits.limitFor(r)
+		if r.ContentLength > limit {
+			log.Printf("Refused %s %s: body of %d bytes exceeds %d", r.Method, r.URL.Path, r.ContentLength, limit)
+			enableCORS(w, "GET, POST, PUT, DELETE, OPTIONS")
+			writeBodyTooLarge(w, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Teams triage a large run together over a WebSocket per reviewer. Each
+// gets the review state when it connects, then every change any reviewer
+// makes, through the socket or POST /api/runs/{id}/review, with the
+// cases it changed and the new version of the review. Changes sent with
+// the versions the reviewer saw are refused when another reviewer changed
+// one of the cases first, the sender gets the cases as they are now.
+
+const (
+	// Largest message a reviewer may send
+	maxReviewMessageBytes = 64 << 10
+	// Events queued for a reviewer before it counts as gone
+	reviewEventBuffer = 64
+)
+
+// ReviewEvent is a message to live reviewers of a run
+type ReviewEvent struct {
+	// snapshot, reviewed, presence, applied, conflict, error or keep-alive
+	Type  string `json:"type"`
+	RunID string `json:"runId,omitempty"`
+	// Version of the review the event brings a reviewer to
+	Version int `json:"version,omitempty"`
+	// Reviewer whose change it is
+	By string `json:"by,omitempty"`
+	// requestId of the message the event answers
+	RequestID string `json:"requestId,omitempty"`
+	// The whole review in a snapshot, the changed cases otherwise
+	Review    *RunReviewResponse `json:"review,omitempty"`
+	TestCases []TestCaseReview   `json:"testCases,omitempty"`
+	Counts    map[string]int     `json:"counts,omitempty"`
+	Status    string             `json:"status,omitempty"`
+	// Reviewers connected to the run
+	Reviewers []string    `json:"reviewers,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Fields    fieldErrors `json:"fields,omitempty"`
+}
+
+// reviewMessage is a review request sent by a live reviewer, its answer
+// carries the requestId
+type reviewMessage struct {
+	RequestID string `json:"requestId,omitempty"`
+	runReviewRequest
+}
+
+// reviewPeer is a reviewer connected to a run
+type reviewPeer struct {
+	name   string
+	events chan ReviewEvent
+}
+
+var liveReviews = struct {
+	sync.Mutex
+	peers map[string]map[*reviewPeer]bool
+}{peers: map[string]map[*reviewPeer]bool{}}
+
+// send queues an event for the peer. A peer whose queue is full has
+// stopped reading and is disconnected, it gets a fresh snapshot when it
+// connects again. The caller holds liveReviews.
+func (peer *reviewPeer) send(runID string, event ReviewEvent) {
+	if !liveReviews.peers[runID][peer] {
+		return
+	}
+	select {
+	case peer.events <- event:
+	default:
+		log.Printf("Disconnecting reviewer %s of run %s, it fell behind", peer.name, runID)
+		delete(liveReviews.peers[runID], peer)
+		close(peer.events)
+	}
+}
+
+// publishReviewEvent tells the live reviewers of a run the changed test
+// cases. The caller holds runReviews, so events leave in version order.
+func publishReviewEvent(run *Run, ids []string, reviewer string) {
+	liveReviews.Lock()
+	defer liveReviews.Unlock()
+	if len(liveReviews.peers[run.ID]) == 0 {
+		return
+	}
+	review := reviewResponse(run)
+	event := ReviewEvent{Type: "reviewed", RunID: run.ID, Version: review.Version, By: reviewer, Counts: review.Counts, Status: review.Status}
+	for _, item := range review.TestCases {
+		if containsString(ids, item.ID) {
+			event.TestCases = append(event.TestCases, item)
+		}
+	}
+	for peer := range liveReviews.peers[run.ID] {
+		peer.send(run.ID, event)
+	}
+}
+
+// joinReview connects a reviewer to a run and queues its snapshot
+// before any change made after it
+func joinReview(runID, name string) (*reviewPeer, error) {
+	runReviews.Lock()
+	defer runReviews.Unlock()
+	run, err := loadReviewedRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	review := reviewResponse(run)
+
+	peer := &reviewPeer{name: name, events: make(chan ReviewEvent, reviewEventBuffer)}
+	liveReviews.Lock()
+	defer liveReviews.Unlock()
+	if liveReviews.peers[runID] == nil {
+		liveReviews.peers[runID] = map[*reviewPeer]bool{}
+	}
+	liveReviews.peers[runID][peer] = true
+	reviewers := reviewerNames(runID)
+	peer.send(runID, ReviewEvent{Type: "snapshot", RunID: runID, Version: review.Version, Review: &review, Reviewers: reviewers})
+	for other := range liveReviews.peers[runID] {
+		if other != peer {
+			other.send(runID, ReviewEvent{Type: "presence", RunID: runID, Reviewers: reviewers})
+		}
+	}
+	return peer, nil
+}
+
+// leaveReview disconnects a reviewer and tells the others
+func leaveReview(runID string, peer *reviewPeer) {
+	liveReviews.Lock()
+	defer liveReviews.Unlock()
+	// Already removed when it fell behind
+	if liveReviews.peers[runID][peer] {
+		delete(liveReviews.peers[runID], peer)
+		close(peer.events)
+	}
+	if len(liveReviews.peers[runID]) == 0 {
+		delete(liveReviews.peers, runID)
+		return
+	}
+	reviewers := reviewerNames(runID)
+	for other := range liveReviews.peers[runID] {
+		other.send(runID, ReviewEvent{Type: "presence", RunID: runID, Reviewers: reviewers})
+	}
+}
+
+// reviewerNames lists the reviewers connected to a run. The caller holds
+// liveReviews.
+func reviewerNames(runID string) []string {
+	var names []string
+	for peer := range liveReviews.peers[runID] {
+		names = append(names, peer.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkReviewOrigin accepts browsers on the frontend or on the server
+// itself, and clients that send no origin. Sessions are cookies, any other
+// site could otherwise review in the name of a signed-in user.
+func checkReviewOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == frontendOrigin {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return nil
+	}
+	return fmt.Errorf("origin %s may not review", origin)
+}
+
+// liveReviewHandler serves the WebSocket GET /api/runs/{id}/review/live
+func liveReviewHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "Live reviews are WebSocket connections", http.StatusUpgradeRequired)
+		return
+	}
+	if err := checkReviewOrigin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	reviewer := requestReviewer(r)
+	name := reviewer
+	if name == "" {
+		name = "anonymous"
+	}
+	// Refused before the upgrade, so the client sees the status
+	peer, err := joinReview(runID, name)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	defer leaveReview(runID, peer)
+
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = maxReviewMessageBytes
+		go writeReviewEvents(ws, peer)
+		readReviewMessages(ws, runID, peer, reviewer)
+	}}
+	server.ServeHTTP(w, r)
+}
+
+// writeReviewEvents sends a reviewer its events until it is disconnected
+func writeReviewEvents(ws *websocket.Conn, peer *reviewPeer) {
+	defer ws.Close()
+	heartbeat := time.NewTicker(jobEventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-peer.events:
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := websocket.JSON.Send(ws, ReviewEvent{Type: "keep-alive"}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readReviewMessages applies the review requests of a reviewer until it
+// disconnects. Changes reach it with everyone else, refusals only it.
+func readReviewMessages(ws *websocket.Conn, runID string, peer *reviewPeer, reviewer string) {
+	reply := func(event ReviewEvent) {
+		event.RunID = runID
+		liveReviews.Lock()
+		peer.send(runID, event)
+		liveReviews.Unlock()
+	}
+	for {
+		var msg reviewMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				reply(ReviewEvent{Type: "error", Error: fmt.Sprintf("Invalid JSON: %v", err)})
+				continue
+			}
+			return
+		}
+		if errs := msg.validate(); len(errs) > 0 {
+			reply(ReviewEvent{Type: "error", RequestID: msg.RequestID, Error: "Validation failed", Fields: errs})
+			continue
+		}
+
+		run, errs, err := updateReview(runID, msg.runReviewRequest, reviewer)
+		var reqErr *requestError
+		switch {
+		case len(errs) > 0:
+			reply(ReviewEvent{Type: "error", RequestID: msg.RequestID, Error: "Validation failed", Fields: errs})
+		case errors.As(err, &reqErr) && reqErr.status == http.StatusConflict:
+			// The named cases as they are now, to decide again on
+			review := reviewResponse(run)
+			event := ReviewEvent{Type: "conflict", RequestID: msg.RequestID, Version: review.Version, Error: reqErr.message}
+			for _, item := range review.TestCases {
+				if containsString(msg.TestIDs, item.ID) || (len(msg.TestIDs) == 0 && item.Confidence == msg.Confidence) {
+					event.TestCases = append(event.TestCases, item)
+				}
+			}
+			reply(event)
+		case err != nil:
+			reply(ReviewEvent{Type: "error", RequestID: msg.RequestID, Error: err.Error()})
+		default:
+			// The change itself reaches the sender in the reviewed event
+			// of every reviewer
+			reply(ReviewEvent{Type: "applied", RequestID: msg.RequestID, Version: run.Review.Version})
+		}
+	}
+}
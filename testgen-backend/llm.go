@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Tests can be generated by Gemini, OpenAI, Azure OpenAI, Claude or a
+// self-hosted Ollama, picked by the provider field of a generation
+// request, so users bring whichever API key or model server they have.
+// Each provider knows its REST shape, the HTTP call, metering and error
+// reporting are shared.
+
+// LLMProvider generates text from a prompt with one model API
+type LLMProvider interface {
+	Name() string
+	// Tiers are the models picked by context size and depth
+	Tiers() ModelTiers
+	GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error)
+}
+
+// GenerateOptions are the settings of one model call
+type GenerateOptions struct {
+	APIKey          string
+	Model           string
+	MaxOutputTokens int
+	// Base URL of a self-hosted provider, empty for its default
+	Endpoint string
+	// Azure OpenAI deployment and api-version, empty for the defaults
+	Deployment string
+	APIVersion string
+	// Counts the response against the request's output budget
+	Meter *tokenMeter
+	// Ask for the log probability of each output token, recorded on the
+	// meter by providers that report them
+	Logprobs bool
+}
+
+// endpointProvider is implemented by providers the request can point at
+// its own server
+type endpointProvider interface {
+	// DefaultEndpoint is the base URL called when the request names none
+	DefaultEndpoint() string
+}
+
+// streamingProvider is implemented by providers that can hand out the
+// generated text as the model writes it
+type streamingProvider interface {
+	StreamTests(ctx context.Context, prompt string, opts GenerateOptions, onText func(string)) (string, error)
+}
+
+// keylessProvider is implemented by providers callable without an API key
+type keylessProvider interface {
+	KeyOptional() bool
+}
+
+const defaultLLMProvider = "gemini"
+
+var llmProviders = []LLMProvider{geminiProvider{}, openAIProvider{}, azureProvider{}, claudeProvider{}, ollamaProvider{}}
+
+// llmProviderNames lists the providers a request may name
+func llmProviderNames() []string {
+	names := make([]string, len(llmProviders))
+	for i, provider := range llmProviders {
+		names[i] = provider.Name()
+	}
+	return names
+}
+
+// lookupLLMProvider finds a provider by name, empty names Gemini
+func lookupLLMProvider(name string) (LLMProvider, bool) {
+	if name == "" {
+		name = defaultLLMProvider
+	}
+	for _, provider := range llmProviders {
+		if provider.Name() == name {
+			return provider, true
+		}
+	}
+	return nil, false
+}
+
+// provider is the model API a generation request calls
+func (req GeminiRequest) provider() LLMProvider {
+	provider, ok := lookupLLMProvider(req.Provider)
+	if !ok {
+		// Requests are validated before they get here
+		provider, _ = lookupLLMProvider(defaultLLMProvider)
+	}
+	return provider
+}
+
+// needsAPIKey reports whether the request has to carry an apiKey
+func (req GeminiRequest) needsAPIKey() bool {
+	if req.Mode == "skeleton" {
+		return false
+	}
+	keyless, ok := req.provider().(keylessProvider)
+	return !ok || !keyless.KeyOptional()
+}
+
+// validateEndpoint checks the base URL of a self-hosted provider. Calls to
+// it go through the egress allowlist as to any provider. Without one,
+// requests may not point the server at its own network, only the default
+// endpoint the server configures may be internal.
+func validateEndpoint(errs *fieldErrors, req *GeminiRequest) {
+	provider, ok := req.provider().(endpointProvider)
+	switch {
+	case !ok && req.Endpoint != "":
+		errs.add("endpoint", "unsupported", "endpoint is only used by self-hosted providers such as ollama and azure")
+		return
+	case !ok:
+		return
+	case req.Endpoint == "":
+		if provider.DefaultEndpoint() == "" && req.Mode != "skeleton" {
+			errs.add("endpoint", "required", "endpoint is required for %s, the server sets no default", req.provider().Name())
+		}
+		return
+	}
+	errs.maxLen("endpoint", req.Endpoint, 2048)
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		errs.add("endpoint", "url", "endpoint must be an http or https base URL like https://ollama.example.com")
+		return
+	}
+	if egressAllowlist == nil && req.Endpoint != provider.DefaultEndpoint() && internalHost(u.Hostname()) {
+		errs.add("endpoint", "internal", "endpoint may not be a loopback or private address unless TESTGEN_EGRESS_HOSTS allows it")
+	}
+}
+
+// generateText sends the prompt to the request's provider and returns the
+// generated text, metering the response against the output budget. The
+// request's model is called, or the tier the prompt needs.
+func generateText(req GeminiRequest, prompt string, meter *tokenMeter) (string, error) {
+	opts, err := req.generateOptions(prompt, meter)
+	if err != nil {
+		return "", err
+	}
+	return req.provider().GenerateTests(context.Background(), prompt, opts)
+}
+
+// generateOptions are the settings of a model call for the request
+func (req GeminiRequest) generateOptions(prompt string, meter *tokenMeter) (GenerateOptions, error) {
+	maxOutputTokens := meter.remaining(8192)
+	if maxOutputTokens <= 0 {
+		return GenerateOptions{}, errOutputBudgetExceeded
+	}
+	return GenerateOptions{
+		APIKey:          req.APIKey,
+		Model:           req.selectModel(prompt),
+		MaxOutputTokens: maxOutputTokens,
+		Endpoint:        req.Endpoint,
+		Deployment:      req.Deployment,
+		APIVersion:      req.APIVersion,
+		Meter:           meter,
+		// Under an output budget they would count as streamed output
+		Logprobs: meter != nil && meter.budget == 0,
+	}, nil
+}
+
+// postProvider sends a JSON request to a model API and returns the body of
+// a successful response. label names the API in errors, such as "OpenAI".
+func postProvider(ctx context.Context, label, endpoint string, header http.Header, requestBody interface{}, meter *tokenMeter) ([]byte, error) {
+	resp, err := callProvider(ctx, label, endpoint, header, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(&meteredBody{ReadCloser: resp.Body, meter: meter})
+	if errors.Is(err, errOutputBudgetExceeded) {
+		log.Printf("Aborted %s response: %v", label, err)
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Error reading %s response: %v", label, err)
+		if isTimeout(err) {
+			return nil, fmt.Errorf("%s API did not answer in time", label)
+		}
+		return nil, fmt.Errorf("Failed to read %s response", label)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// The body stays in the log, endpoints may be picked by the caller
+		log.Printf("%s API error: %s", label, string(body))
+		return nil, fmt.Errorf("%s API answered %s", label, resp.Status)
+	}
+	return body, nil
+}
+
+// callProvider sends a JSON request to a model API and returns the response
+// of any status, for the caller to read and close. Rate limited and
+// overloaded answers and failed connections are retried with backoff, a
+// provider still busy after the last attempt is a providerBusyError.
+func callProvider(ctx context.Context, label, endpoint string, header http.Header, requestBody interface{}) (*http.Response, error) {
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, errors.New("Failed to marshal request")
+	}
+
+	for attempt := 1; ; attempt++ {
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s request", label)
+		}
+		for name, values := range header {
+			httpReq.Header[name] = values
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		resp, err := providerClient.Do(httpReq)
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			log.Printf("Error calling %s API: %v", label, err)
+			// A provider that did not answer in time is not waited for again
+			if isTimeout(err) {
+				return nil, fmt.Errorf("%s API did not answer in time", label)
+			}
+			if ctx.Err() != nil || attempt >= providerRetry.MaxAttempts {
+				return nil, fmt.Errorf("Failed to call %s API", label)
+			}
+		case !retryableStatus(resp.StatusCode):
+			return resp, nil
+		default:
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			log.Printf("%s API answered %d on attempt %d: %s", label, resp.StatusCode, attempt, string(body))
+			if attempt >= providerRetry.MaxAttempts {
+				return nil, &providerBusyError{label: label, status: resp.StatusCode, retryAfter: retryAfter}
+			}
+		}
+
+		delay, ok := providerRetry.delay(attempt, retryAfter)
+		if !ok {
+			return nil, &providerBusyError{label: label, status: resp.StatusCode, retryAfter: retryAfter}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("Failed to call %s API", label)
+		}
+	}
+}
+
+const (
+	geminiModel    = "gemini-1.5-flash-latest"
+	geminiProModel = "gemini-1.5-pro-latest"
+)
+
+// geminiProvider calls Google's Gemini generateContent API
+type geminiProvider struct{}
+
+func (geminiProvider) Name() string { return "gemini" }
+func (geminiProvider) Tiers() ModelTiers {
+	return ModelTiers{Standard: geminiModel, LongContext: geminiProModel}
+}
+
+// geminiRequestBody is the generateContent request for a prompt
+func geminiRequestBody(prompt string, opts GenerateOptions) map[string]interface{} {
+	return map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]interface{}{
+					{
+						"text": prompt,
+					},
+				},
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":     0.7,
+			"topK":            40,
+			"topP":            0.95,
+			"maxOutputTokens": opts.MaxOutputTokens,
+		},
+	}
+}
+
+func (geminiProvider) GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error) {
+	geminiURL := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent", url.PathEscape(opts.Model))
+	requestBody := geminiRequestBody(prompt, opts)
+
+	// In a header the key stays out of URLs quoted by errors and logs
+	header := http.Header{}
+	header.Set("x-goog-api-key", opts.APIKey)
+	body, err := postProvider(ctx, "Gemini", geminiURL, header, requestBody, opts.Meter)
+	if err != nil {
+		return "", err
+	}
+
+	var geminiResp map[string]interface{}
+	if err := json.Unmarshal(body, &geminiResp); err != nil {
+		return "", errors.New("Failed to parse Gemini response")
+	}
+
+	// Record token usage, falling back to the streamed estimate
+	promptTokens, outputTokens := 0, 0
+	if usage, ok := geminiResp["usageMetadata"].(map[string]interface{}); ok {
+		if count, ok := usage["promptTokenCount"].(float64); ok {
+			promptTokens = int(count)
+		}
+		if count, ok := usage["candidatesTokenCount"].(float64); ok {
+			outputTokens = int(count)
+		}
+	}
+	opts.Meter.record(promptTokens, outputTokens)
+
+	// Extract the generated text
+	candidates, ok := geminiResp["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return "", errors.New("Invalid Gemini response format")
+	}
+
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return "", errors.New("Invalid candidate format")
+	}
+
+	content, ok := candidate["content"].(map[string]interface{})
+	if !ok {
+		return "", errors.New("Invalid content format")
+	}
+
+	parts, ok := content["parts"].([]interface{})
+	if !ok || len(parts) == 0 {
+		return "", errors.New("Invalid parts format")
+	}
+
+	part, ok := parts[0].(map[string]interface{})
+	if !ok {
+		return "", errors.New("Invalid part format")
+	}
+
+	generatedText, ok := part["text"].(string)
+	if !ok {
+		return "", errors.New("Invalid text format")
+	}
+
+	return generatedText, nil
+}
+
+// StreamTests calls streamGenerateContent, which sends the response as
+// Server-Sent Events of partial generateContent responses
+func (geminiProvider) StreamTests(ctx context.Context, prompt string, opts GenerateOptions, onText func(string)) (string, error) {
+	geminiURL := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:streamGenerateContent?alt=sse", url.PathEscape(opts.Model))
+
+	header := http.Header{}
+	header.Set("x-goog-api-key", opts.APIKey)
+	resp, err := callProvider(ctx, "Gemini", geminiURL, header, geminiRequestBody(prompt, opts))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body := &meteredBody{ReadCloser: resp.Body, meter: opts.Meter}
+
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(body)
+		log.Printf("Gemini API error: %s", string(errBody))
+		return "", fmt.Errorf("Gemini API answered %s", resp.Status)
+	}
+
+	var generated strings.Builder
+	promptTokens, outputTokens := 0, 0
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"content"`
+			} `json:"candidates"`
+			UsageMetadata struct {
+				PromptTokenCount     int `json:"promptTokenCount"`
+				CandidatesTokenCount int `json:"candidatesTokenCount"`
+			} `json:"usageMetadata"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &chunk); err != nil {
+			return "", errors.New("Failed to parse Gemini response")
+		}
+		// Every chunk carries the usage so far, the last one the total
+		if chunk.UsageMetadata.PromptTokenCount > 0 {
+			promptTokens = chunk.UsageMetadata.PromptTokenCount
+		}
+		if chunk.UsageMetadata.CandidatesTokenCount > 0 {
+			outputTokens = chunk.UsageMetadata.CandidatesTokenCount
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if part.Text != "" {
+				generated.WriteString(part.Text)
+				onText(part.Text)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, errOutputBudgetExceeded) {
+			log.Printf("Aborted Gemini response: %v", err)
+			return "", err
+		}
+		log.Printf("Error reading Gemini response: %v", err)
+		if isTimeout(err) {
+			return "", errors.New("Gemini API did not answer in time")
+		}
+		return "", errors.New("Failed to read Gemini response")
+	}
+	opts.Meter.record(promptTokens, outputTokens)
+
+	if generated.Len() == 0 {
+		return "", errors.New("Invalid Gemini response format")
+	}
+	return generated.String(), nil
+}
+
+const (
+	openAIModel            = "gpt-4o"
+	openAILongContextModel = "gpt-4.1"
+)
+
+// openAIProvider calls OpenAI's chat completions API
+type openAIProvider struct{}
+
+func (openAIProvider) Name() string { return "openai" }
+func (openAIProvider) Tiers() ModelTiers {
+	return ModelTiers{Standard: openAIModel, LongContext: openAILongContextModel}
+}
+
+func (openAIProvider) GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error) {
+	requestBody := map[string]interface{}{
+		"model": opts.Model,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+		"temperature": 0.7,
+		"max_tokens":  opts.MaxOutputTokens,
+	}
+	if opts.Logprobs && chatLogprobs(opts.Model) {
+		requestBody["logprobs"] = true
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+opts.APIKey)
+	body, err := postProvider(ctx, "OpenAI", "https://api.openai.com/v1/chat/completions", header, requestBody, opts.Meter)
+	if err != nil {
+		return "", err
+	}
+	return parseChatCompletion(body, "OpenAI", opts.Meter)
+}
+
+// chatLogprobs reports whether a chat completions model returns log
+// probabilities, reasoning models answer asking for them with a 400
+func chatLogprobs(model string) bool {
+	return !(len(model) > 1 && model[0] == 'o' && isASCIIDigit(model[1]))
+}
+
+// parseChatCompletion reads the text, token usage and log probabilities of
+// a chat completion
+func parseChatCompletion(body []byte, label string, meter *tokenMeter) (string, error) {
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Logprobs *struct {
+				Content []struct {
+					Token   string  `json:"token"`
+					Logprob float64 `json:"logprob"`
+				} `json:"content"`
+			} `json:"logprobs"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return "", fmt.Errorf("Failed to parse %s response", label)
+	}
+
+	// Record token usage, falling back to the streamed estimate
+	meter.record(completion.Usage.PromptTokens, completion.Usage.CompletionTokens)
+
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("Invalid %s response format", label)
+	}
+	choice := completion.Choices[0]
+	if choice.FinishReason == "content_filter" {
+		return "", fmt.Errorf("%s withheld the response for its content", label)
+	}
+	if choice.Logprobs != nil {
+		tokens := make([]tokenLogprob, len(choice.Logprobs.Content))
+		for i, token := range choice.Logprobs.Content {
+			tokens[i] = tokenLogprob{Token: token.Token, Logprob: token.Logprob}
+		}
+		meter.recordLogprobs(tokens)
+	}
+	return choice.Message.Content, nil
+}
@@ -1,21 +1,51 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
 type RepoRequest struct {
-	RepoURL string `json:"repoUrl"`
+	RepoURL     string   `json:"repoUrl"`
+	RepoURLs    []string `json:"repoUrls,omitempty"` // further repos merged into one namespaced context
+	IncludeDocs bool     `json:"includeDocs,omitempty"`
+	DocsMode    string   `json:"docsMode,omitempty"`   // "raw" (default) or "summary"
+	DocsBudget  int      `json:"docsBudget,omitempty"` // token budget for the docs section
+	// Token budget for the source files, the least important files are left out first
+	ContextBudget int `json:"contextBudget,omitempty"`
+	// Keep vendored, generated, mock and minified files in the context
+	IncludeGenerated bool `json:"includeGenerated,omitempty"`
+	// Context serialization: "text" (default), "json", "jsonl" or "xml"
+	Format string `json:"format,omitempty"`
+	// Comment, whitespace, license header and string literal reduction
+	Normalize *NormalizeOptions `json:"normalize,omitempty"`
+	// "source" (default) keeps Go files whole, "api" reduces them to their
+	// exported declarations and short function bodies
+	GoMode string `json:"goMode,omitempty"`
+	// Token for cloning private repositories over HTTPS, never stored or logged
+	AccessToken string `json:"accessToken,omitempty"`
+	// Branch, tag or commit of repoUrl to clone, overrides a branch in the URL
+	Ref string `json:"ref,omitempty"`
+	// Directory of repoUrl to build the context from, such as one service
+	// of a monorepo
+	SubPath string `json:"subPath,omitempty"`
+	// Leave the project summary out of the context
+	SkipSummary bool `json:"skipSummary,omitempty"`
 }
 
 type FileContent struct {
@@ -29,35 +59,170 @@ type RepoResponse struct {
 	Message     string        `json:"message"`
 	FilesCount  int           `json:"filesCount"`
 	ContextPath string        `json:"contextPath"`
+	ContextID   string        `json:"contextId,omitempty"`
+	Version     string        `json:"version,omitempty"` // context version, the commit SHA for a single repository
+	Repos       []string      `json:"repos,omitempty"`   // owner/repo namespaces of a multi-repo context
 	Files       []FileContent `json:"files"`
+	DocsCount   int           `json:"docsCount,omitempty"`
+	// Files left out of the context to stay within the context budget
+	DroppedFiles []string `json:"droppedFiles,omitempty"`
+	// Vendored and generated files left out of the context
+	ExcludedFiles []string `json:"excludedFiles,omitempty"`
+	// Entrypoints, routing and public API at the top of the context
+	Summary *ProjectSummary `json:"summary,omitempty"`
+	// Declarations of the Go files with goMode "api"
+	GoAPI []GoDeclaration `json:"goApi,omitempty"`
 }
 
 type GeminiTestCase struct {
-	ID          string      `json:"id"`
-	Name        string      `json:"name"`
-	Description string      `json:"description"`
-	Input       interface{} `json:"input"`
-	Expected    interface{} `json:"expected"`
-	Code        string      `json:"code"`
-	TestType    string      `json:"testType"`
-	Priority    string      `json:"priority"`
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Input       interface{}         `json:"input"`
+	Expected    interface{}         `json:"expected"`
+	Code        string              `json:"code"`
+	TestType    string              `json:"testType"`
+	Priority    string              `json:"priority"`
+	TestVectors []TestVector        `json:"testVectors,omitempty"`
+	Refactor    *RefactorSuggestion `json:"refactor,omitempty"`
+	Services    []string            `json:"services,omitempty"` // infrastructure the runner must provide
+	// Test file the case belongs in, checked against the repository layout
+	SuggestedPath string            `json:"suggestedPath,omitempty"`
+	Verification  *TestVerification `json:"verification,omitempty"`
+	Confidence    *TestConfidence   `json:"confidence,omitempty"`
+	// Geometric mean probability of the case's tokens, 0 when unknown
+	tokenProb float64
+}
+
+// RefactorSuggestion describes a minimal change a test assumes has been made
+type RefactorSuggestion struct {
+	Kind        string   `json:"kind,omitempty"`
+	File        string   `json:"file,omitempty"`
+	Description string   `json:"description"`
+	Code        string   `json:"code,omitempty"`
+	TestIDs     []string `json:"testIds,omitempty"`
+}
+
+// TestVector is a byte-level fixture for encoder/decoder tests
+type TestVector struct {
+	Name    string      `json:"name"`
+	Hex     string      `json:"hex"`
+	Decoded interface{} `json:"decoded,omitempty"`
 }
 
 type GeminiResponse struct {
 	TestCases []GeminiTestCase `json:"testCases"`
 	Summary   struct {
-		TotalTests         int `json:"totalTests"`
-		UnitTests          int `json:"unitTests"`
-		IntegrationTests   int `json:"integrationTests"`
-		EdgeCases          int `json:"edgeCases"`
-		ErrorHandlingTests int `json:"errorHandlingTests"`
+		TotalTests         int            `json:"totalTests"`
+		UnitTests          int            `json:"unitTests"`
+		IntegrationTests   int            `json:"integrationTests"`
+		EdgeCases          int            `json:"edgeCases"`
+		ErrorHandlingTests int            `json:"errorHandlingTests"`
+		Categories         map[string]int `json:"categories,omitempty"`
 	} `json:"summary"`
+	RefactorSuggestions []RefactorSuggestion `json:"refactorSuggestions,omitempty"`
+	Artifacts           []GeneratedArtifact  `json:"artifacts,omitempty"`
+	Warnings            []AnalysisWarning    `json:"warnings,omitempty"`
+	Focuses             []string             `json:"focuses,omitempty"`
+	Usage               *TokenUsage          `json:"usage,omitempty"`
+	RunID               string               `json:"runId,omitempty"`
+	Manifest            *SignedManifest      `json:"manifest,omitempty"`
+	Provenance          *Provenance          `json:"provenance,omitempty"`
+	CheckRuns           []string             `json:"checkRuns,omitempty"` // GitHub Check Runs published for the run
+	Redaction           *RedactionSummary    `json:"redaction,omitempty"`
+	Checklist           []ReviewItem         `json:"checklist,omitempty"` // what reviewers should check by hand
+	// Go test files of the run by path, with output "go-files"
+	GoTestFiles map[string]string `json:"goTestFiles,omitempty"`
+}
+
+// AnalysisWarning is a problem found by static analysis of the code context
+type AnalysisWarning struct {
+	Kind    string   `json:"kind"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+	Symbol  string   `json:"symbol,omitempty"`
+	Message string   `json:"message"`
+	TestIDs []string `json:"testIds,omitempty"`
+}
+
+// GeneratedArtifact is a file produced alongside the test cases, such as a
+// helper library or a load test script
+type GeneratedArtifact struct {
+	Type        string `json:"type"`
+	Path        string `json:"path"`
+	Language    string `json:"language,omitempty"`
+	Description string `json:"description,omitempty"`
+	Content     string `json:"content"`
 }
 
 type GeminiRequest struct {
-	APIKey           string `json:"apiKey"`
-	CodeContext      string `json:"codeContext"`
-	AdditionalPrompt string `json:"additionalPrompt,omitempty"`
+	APIKey           string   `json:"apiKey"`
+	CodeContext      string   `json:"codeContext"`
+	AdditionalPrompt string   `json:"additionalPrompt,omitempty"`
+	Focus            []string `json:"focus,omitempty"`
+	HotPaths         []string `json:"hotPaths,omitempty"` // functions to benchmark, overrides name heuristics
+	Mode             string   `json:"mode,omitempty"`     // "llm" (default), "skeleton" or "hybrid"
+	// Return deterministic skeletons instead of an error when the model call fails
+	FallbackToSkeleton bool `json:"fallbackToSkeleton,omitempty"`
+	// Output token budget across all model calls of the request, 0 is unlimited
+	MaxOutputTokens int `json:"maxOutputTokens,omitempty"`
+	// Prompt token budget the context is fitted to, 0 takes what the
+	// model's context window leaves
+	ContextBudget int `json:"contextBudget,omitempty"`
+	// "auto" (default) generates contexts above the budget in chunks of
+	// directories, "off" shortens them to one prompt
+	Chunking string `json:"chunking,omitempty"`
+	// Run the code under test with the input of each test case in the
+	// sandbox and compare the result with the expected value
+	Verify bool `json:"verify,omitempty"`
+	// Tenant whose standing instructions apply, defaults to the X-Tenant-ID header
+	Tenant string `json:"tenant,omitempty"`
+	// Repository as owner/repo, attaches its glossary if the context lacks it
+	Repo string `json:"repo,omitempty"`
+	// Source as owner/repo@sha recorded in the provenance, read from the context by default
+	Source string `json:"source,omitempty"`
+	// Cost attribution such as team, project or ticket, kept with the run
+	Tags map[string]string `json:"tags,omitempty"`
+	// Language tags such as es or ja for test names and descriptions, and
+	// for comments in generated code
+	DescriptionLanguage string `json:"descriptionLanguage,omitempty"`
+	CommentLanguage     string `json:"commentLanguage,omitempty"`
+	// Secrets and proprietary identifiers kept from the model
+	Redact *RedactOptions `json:"redact,omitempty"`
+	// Model API the tests are generated with, "gemini" (default), "openai",
+	// "azure", "claude" or "ollama"
+	Provider string `json:"provider,omitempty"`
+	// Base URL of a self-hosted provider, such as http://gpu-box:11434 or
+	// https://contoso.openai.azure.com
+	Endpoint string `json:"endpoint,omitempty"`
+	// Azure OpenAI deployment and api-version such as 2024-10-21
+	Deployment string `json:"deployment,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Model called instead of the tier picked by context size and depth
+	Model string `json:"model,omitempty"`
+	Depth string `json:"depth,omitempty"` // "standard" (default) or "deep", which takes the stronger model
+	// Context built by the clone endpoint, used instead of codeContext
+	ContextID string `json:"contextId,omitempty"`
+	// Files replacing their entries in the context or added to it, such as
+	// unsaved editor buffers
+	Overrides []FileContent `json:"overrides,omitempty"`
+	// Key stored on the server, used instead of apiKey
+	KeyAlias string `json:"keyAlias,omitempty"`
+	// "cases" (default) or "go-files", which also writes the test cases as
+	// table-driven Go test files
+	Output string `json:"output,omitempty"`
+
+	// Told the steps of a generation running as a job
+	progress func(JobProgress)
+	// Told the test cases of a streamed generation as the model writes them
+	onTestCase func(GeminiTestCase)
+}
+
+// report tells a job's subscribers the step a generation is at
+func (req GeminiRequest) report(stage string, percent int) {
+	if req.progress != nil {
+		req.progress(JobProgress{Stage: stage, Percent: percent})
+	}
 }
 
 // Files and directories to exclude when processing repository
@@ -73,17 +238,11 @@ var excludePatterns = []string{
 }
 
 func shouldExcludeFile(filePath string) bool {
-	pathParts := strings.Split(filePath, "/")
+	pathParts := strings.Split(slashPath(filePath), "/")
 
 	for _, pattern := range excludePatterns {
 		for _, part := range pathParts {
-			if strings.Contains(pattern, "*") {
-				regexPattern := strings.ReplaceAll(pattern, "*", ".*")
-				matched, _ := regexp.MatchString(regexPattern, part)
-				if matched {
-					return true
-				}
-			} else if part == pattern || strings.HasPrefix(part, pattern) {
+			if matchesExcludePattern(pattern, part) {
 				return true
 			}
 		}
@@ -91,79 +250,97 @@ func shouldExcludeFile(filePath string) bool {
 	return false
 }
 
-func parseGitHubURL(url string) (string, string, error) {
-	// Clean the URL to remove any file paths, branches, or specific files
-	cleanURL := url
-
-	// Remove /blob/ and everything after it
-	if strings.Contains(cleanURL, "/blob/") {
-		cleanURL = strings.Split(cleanURL, "/blob/")[0]
-	}
-
-	// Remove /tree/ and everything after it
-	if strings.Contains(cleanURL, "/tree/") {
-		cleanURL = strings.Split(cleanURL, "/tree/")[0]
+// isContextFile reports whether a file is source code or an important
+// config file, by its extension or name
+func isContextFile(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	sourceExts := []string{".js", ".jsx", ".ts", ".tsx", ".py", ".java", ".cpp", ".c", ".cs", ".php", ".rb", ".go", ".rs", ".swift", ".kt", ".vue", ".svelte", ".html", ".css", ".scss", ".sass", ".less", ".json", ".yaml", ".yml", ".toml", ".ini", ".env", ".sql", ".sh", ".bat", ".ps1"}
+	for _, sourceExt := range sourceExts {
+		if ext == sourceExt {
+			return true
+		}
 	}
 
-	// Remove trailing slash
-	cleanURL = strings.TrimSuffix(cleanURL, "/")
-
-	// Remove .git if present
-	cleanURL = strings.TrimSuffix(cleanURL, ".git")
-
-	// Extract owner and repo using regex
-	re := regexp.MustCompile(`github\.com/([^/]+)/([^/]+)$`)
-	matches := re.FindStringSubmatch(cleanURL)
-	if len(matches) != 3 {
-		return "", "", fmt.Errorf("invalid GitHub URL: %s", url)
+	// Also include files without extensions that might be important
+	baseName := strings.ToLower(filepath.Base(filePath))
+	importantFiles := []string{"dockerfile", "makefile", "readme", "license", "changelog", "contributing", "docker-compose", "package", "composer", "requirements", "pom", "gradle", "gemfile", "cargo", "go.mod", "go.sum"}
+	for _, importantFile := range importantFiles {
+		if strings.Contains(baseName, importantFile) {
+			return true
+		}
 	}
+	return false
+}
 
-	owner := strings.TrimSpace(matches[1])
-	repo := strings.TrimSpace(matches[2])
-
-	// Validate that we have valid owner and repo
-	if owner == "" || repo == "" {
-		return "", "", fmt.Errorf("invalid GitHub URL: %s", url)
+func matchesExcludePattern(pattern, part string) bool {
+	if strings.Contains(pattern, "*") {
+		regexPattern := strings.ReplaceAll(pattern, "*", ".*")
+		matched, _ := regexp.MatchString(regexPattern, part)
+		return matched
 	}
-
-	return owner, repo, nil
+	return part == pattern || strings.HasPrefix(part, pattern)
 }
 
-func cloneRepository(owner, repo, clonePath string) error {
-	// Remove existing directory if it exists
-	if _, err := os.Stat(clonePath); !os.IsNotExist(err) {
-		os.RemoveAll(clonePath)
+// redactSecrets masks every occurrence of the secrets in text, including
+// the encoded credentials of an Authorization header
+func redactSecrets(text string, secrets ...string) string {
+	for _, secret := range secrets {
+		if _, credentials, ok := strings.Cut(secret, " "); ok {
+			secret = credentials
+		}
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "[REDACTED]")
+		}
 	}
+	return text
+}
 
-	// Construct the proper GitHub clone URL
-	repoURL := fmt.Sprintf("https://github.com/%s/%s.git", owner, repo)
-
-	// Clone the repository
-	cmd := exec.Command("git", "clone", "--depth", "1", repoURL, clonePath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to clone repository: %s, output: %s", err.Error(), string(output))
+// walkRoot is where to walk a clone for subPath, the root when empty
+func walkRoot(subPath string) string {
+	if subPath == "" {
+		return "."
 	}
-	return nil
+	return filepath.FromSlash(subPath)
 }
 
-func readRepositoryFiles(repoPath string) ([]FileContent, error) {
+// readRepositoryFiles reads the source files under subPath, or the whole
+// repository when empty. Paths stay relative to the repository root.
+// onRead, when set, is told about each file read, with the files read and
+// walked so far and the files in total.
+func readRepositoryFiles(repo billy.Filesystem, subPath string, onRead func(path string, read, walked, total int)) ([]FileContent, error) {
 	var files []FileContent
 
-	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
+	walked, total := 0, 0
+	if onRead != nil {
+		// Counted first so progress can be reported as a share
+		util.Walk(repo, walkRoot(subPath), func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if err == nil && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+				total++
+			}
+			return nil
+		})
+	}
+
+	err := util.Walk(repo, walkRoot(subPath), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		// The object store of a clone on disk
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
 
-		if info.IsDir() {
+		// Symlinks may point out of the repository
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
 			return nil
 		}
+		walked++
 
-		// Get relative path
-		relPath, err := filepath.Rel(repoPath, path)
-		if err != nil {
-			return err
-		}
+		// Relative to the repository root, always with forward slashes
+		relPath := slashPath(path)
 
 		// Check if file should be excluded
 		if shouldExcludeFile(relPath) {
@@ -176,42 +353,27 @@ func readRepositoryFiles(repoPath string) ([]FileContent, error) {
 		}
 
 		// Check if it's a source code file or important config file
-		ext := strings.ToLower(filepath.Ext(path))
-		sourceExts := []string{".js", ".jsx", ".ts", ".tsx", ".py", ".java", ".cpp", ".c", ".cs", ".php", ".rb", ".go", ".rs", ".swift", ".kt", ".vue", ".svelte", ".html", ".css", ".scss", ".sass", ".less", ".json", ".yaml", ".yml", ".toml", ".ini", ".env", ".sql", ".sh", ".bat", ".ps1"}
-		isSourceFile := false
-		for _, sourceExt := range sourceExts {
-			if ext == sourceExt {
-				isSourceFile = true
-				break
-			}
-		}
-
-		// Also include files without extensions that might be important
-		baseName := strings.ToLower(filepath.Base(path))
-		importantFiles := []string{"dockerfile", "makefile", "readme", "license", "changelog", "contributing", "docker-compose", "package", "composer", "requirements", "pom", "gradle", "gemfile", "cargo", "go.mod", "go.sum"}
-		for _, importantFile := range importantFiles {
-			if strings.Contains(baseName, importantFile) {
-				isSourceFile = true
-				break
-			}
-		}
-
-		if !isSourceFile {
+		if !isContextFile(relPath) {
 			return nil
 		}
 
 		// Read file content
-		content, err := os.ReadFile(path)
+		content, err := util.ReadFile(repo, path)
 		if err != nil {
 			log.Printf("Warning: Could not read file %s: %v", path, err)
 			return nil
 		}
 
+		// CRLF checkouts would otherwise differ from LF ones in every line
+		text := normalizeLineEndings(string(content))
 		files = append(files, FileContent{
 			Path:    relPath,
-			Content: string(content),
-			Size:    len(content),
+			Content: text,
+			Size:    len(text),
 		})
+		if onRead != nil {
+			onRead(relPath, len(files), walked, total)
+		}
 
 		return nil
 	})
@@ -219,13 +381,44 @@ func readRepositoryFiles(repoPath string) ([]FileContent, error) {
 	return files, err
 }
 
-func generatePromptContext(files []FileContent) string {
+// contextExtras are the sections of a context besides the source files
+type contextExtras struct {
+	Docs     []FileContent
+	Glossary string
+	Summary  string   // rendered project summary
+	Repos    []string // owner/repo namespaces when several repositories are merged
+	Sources  []string // owner/repo@sha of each repository
+}
+
+func generatePromptContext(files []FileContent, extras contextExtras) string {
 	var context strings.Builder
 
 	// Add header
 	context.WriteString("=== REPOSITORY CODE CONTEXT FOR TEST GENERATION ===\n\n")
 	context.WriteString("This context contains all source code files from the cloned repository.\n")
 	context.WriteString("Generate comprehensive test cases based on the functions, methods, and logic found in these files.\n\n")
+	for _, source := range extras.Sources {
+		context.WriteString("Source: " + source + "\n")
+	}
+	if len(extras.Sources) > 0 {
+		context.WriteString("\n")
+	}
+
+	context.WriteString(summarySection(extras.Summary))
+	context.WriteString(repositoriesSection(extras.Repos))
+
+	// Add the domain glossary uploaded for the repository
+	context.WriteString(glossarySection(extras.Glossary))
+
+	// Add project documentation, it describes the intended behavior
+	if len(extras.Docs) > 0 {
+		context.WriteString("=== PROJECT DOCUMENTATION ===\n\n")
+		context.WriteString("The following documentation describes the intended behavior. Use it to derive expected values.\n\n")
+		for _, doc := range extras.Docs {
+			context.WriteString(fmt.Sprintf("// Doc: %s\n%s\n\n---\n", doc.Path, doc.Content))
+		}
+	}
+
 	context.WriteString("=== FILES ===\n\n")
 
 	// Group files by type for better organization
@@ -274,12 +467,20 @@ func generatePromptContext(files []FileContent) string {
 	return context.String()
 }
 
-func cloneRepoHandler(w http.ResponseWriter, r *http.Request) {
-	// Enable CORS for frontend on port 8080
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// Origin of the frontend, the only one browsers may call from
+const frontendOrigin = "http://localhost:8080"
+
+// enableCORS allows the frontend on port 8080 to call the API
+func enableCORS(w http.ResponseWriter, methods string) {
+	w.Header().Set("Access-Control-Allow-Origin", frontendOrigin)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Tenant-ID")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "API-Version, Deprecation, Sunset, Link")
+}
+
+func cloneRepoHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "POST, OPTIONS")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -292,86 +493,165 @@ func cloneRepoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req RepoRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	if req.RepoURL == "" {
-		http.Error(w, "Repository URL is required", http.StatusBadRequest)
+	// Prefer: respond-async queues the clone as a job, see jobs.go
+	if prefersAsync(r) {
+		queueRepoJob(w, req)
 		return
 	}
 
-	// Parse GitHub URL
-	owner, repo, err := parseGitHubURL(req.RepoURL)
+	response, err := buildRepoContext(req, nil)
 	if err != nil {
-		http.Error(w, "Invalid GitHub URL", http.StatusBadRequest)
+		writeRequestError(w, err)
 		return
 	}
 
-	log.Printf("Cloning repository: %s/%s", owner, repo)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// repoURLs lists the repositories of a request, repoUrl first
+func (req RepoRequest) repoURLs() []string {
+	repoURLs := req.RepoURLs
+	if req.RepoURL != "" {
+		repoURLs = append([]string{req.RepoURL}, repoURLs...)
+	}
+	return repoURLs
+}
+
+// buildRepoContext clones the requested repositories and saves their
+// context, as a new version when the context existed before. progress,
+// when set, is told about each step.
+func buildRepoContext(req RepoRequest, progress func(JobProgress)) (*RepoResponse, error) {
+	repoURLs := req.repoURLs()
+	// Each repository takes an equal share of the first 90 percent, a
+	// fifth of it for the clone and the rest for reading its files
+	report := func(p JobProgress) {
+		if progress != nil {
+			p.Repositories = len(repoURLs)
+			progress(p)
+		}
+	}
+	repoPercent := func(i, perMille int) int {
+		return (i*1000 + perMille) * 90 / (1000 * len(repoURLs))
+	}
 
 	// Create repos directory if it doesn't exist
 	reposDir := "repos"
 	if err := os.MkdirAll(reposDir, 0755); err != nil {
-		http.Error(w, "Failed to create repos directory", http.StatusInternalServerError)
-		return
+		return nil, errors.New("Failed to create repos directory")
 	}
 
-	// Clone repository
-	clonePath := filepath.Join(reposDir, fmt.Sprintf("%s-%s", owner, repo))
-	if err := cloneRepository(owner, repo, clonePath); err != nil {
-		log.Printf("Error cloning repository: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to clone repository: %v", err), http.StatusInternalServerError)
-		return
+	var snapshots []*repoSnapshot
+	for i, repoURL := range repoURLs {
+		ref, subPath := "", ""
+		if i == 0 && req.RepoURL != "" {
+			ref = req.Ref
+			subPath, _ = cleanSubPath(req.SubPath)
+		}
+		report(JobProgress{Stage: "cloning", Repo: repoURL, Cloned: i, Percent: repoPercent(i, 0)})
+		var onRead func(string, int, int, int)
+		if progress != nil {
+			onRead = func(path string, read, walked, total int) {
+				report(JobProgress{Stage: "files-read", Repo: repoURL, File: path, FilesRead: read, Cloned: i, Percent: repoPercent(i, 200+800*walked/max(total, 1))})
+			}
+		}
+		snapshot, err := snapshotRepository(reposDir, repoURL, ref, subPath, req, onRead)
+		if err != nil {
+			if errors.Is(err, errInvalidRepoURL) {
+				return nil, &requestError{http.StatusBadRequest, "Invalid repository URL"}
+			}
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
 	}
 
-	// Read repository files
-	files, err := readRepositoryFiles(clonePath)
-	if err != nil {
-		log.Printf("Error reading repository files: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to read repository files: %v", err), http.StatusInternalServerError)
-		return
+	contextID, files, extras := mergeSnapshots(snapshots)
+
+	// Summarize the whole project, before the budget leaves files out
+	var summary *ProjectSummary
+	if !req.SkipSummary {
+		summary = summarizeProject(files)
+		extras.Summary = renderSummary(summary)
+	}
+
+	// The summary needs the bodies for the routes, the budget only the API
+	if req.GoMode == "api" {
+		var saved int
+		files, saved = extractGoAPI(files)
+		log.Printf("Reducing Go files to their API saved %d bytes", saved)
+	}
+
+	// Order files by importance and apply the context budget
+	files, dropped := prioritizeFiles(files, req.ContextBudget)
+	if len(dropped) > 0 {
+		log.Printf("Dropped %d low priority files to fit the context budget of %d tokens", len(dropped), req.ContextBudget)
 	}
 
 	// Generate comprehensive prompt context
-	context := generatePromptContext(files)
+	context := buildContext(files, extras, req.Format)
 
 	// Save context to file
-	contextPath := filepath.Join(reposDir, fmt.Sprintf("%s-%s-context.txt", owner, repo))
+	report(JobProgress{Stage: "context-built", Cloned: len(snapshots), Percent: 95})
+	contextPath := filepath.Join(reposDir, contextID+"-context.txt")
 	if err := os.WriteFile(contextPath, []byte(context), 0644); err != nil {
 		log.Printf("Error saving context file: %v", err)
-		http.Error(w, "Failed to save context file", http.StatusInternalServerError)
-		return
+		return nil, errors.New("Failed to save context file")
+	}
+
+	// Record the files of this build so later builds can be diffed against it
+	version, err := saveContextVersion(contextID, snapshots, files)
+	if err != nil {
+		log.Printf("Warning: Could not save context version: %v", err)
+	}
+	// Kept for refreshing single files later, see refresh.go
+	if err := saveContextBuild(contextID, req, extras, version); err != nil {
+		log.Printf("Warning: Could not save context build: %v", err)
 	}
 
 	log.Printf("Context saved to: %s", contextPath)
 	log.Printf("Context size: %d characters", len(context))
 
-	// Clean up cloned directory
-	os.RemoveAll(clonePath)
-
 	// Prepare response
-	response := RepoResponse{
+	response := &RepoResponse{
 		Success:     true,
 		Message:     "Repository cloned successfully",
 		FilesCount:  len(files),
 		ContextPath: contextPath,
+		ContextID:   contextID,
+		Version:     version,
 		Files:       files,
+		DocsCount:   len(extras.Docs),
+		Summary:     summary,
+	}
+	if req.GoMode == "api" {
+		response.GoAPI = goDeclarations(files)
+	}
+	for _, file := range dropped {
+		response.DroppedFiles = append(response.DroppedFiles, file.Path)
+	}
+	for _, s := range snapshots {
+		for _, path := range s.Excluded {
+			if len(snapshots) > 1 {
+				path = s.Owner + "/" + s.Repo + "/" + path
+			}
+			response.ExcludedFiles = append(response.ExcludedFiles, path)
+		}
+	}
+	if len(snapshots) > 1 {
+		response.Message = fmt.Sprintf("%d repositories cloned successfully", len(snapshots))
+		response.Repos = extras.Repos
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-
-	log.Printf("Successfully processed repository %s/%s: %d files", owner, repo, len(files))
+	log.Printf("Successfully processed context %s: %d files", contextID, len(files))
+	return response, nil
 }
 
 func getContextHandler(w http.ResponseWriter, r *http.Request) {
-	// Enable CORS for frontend on port 8080
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	enableCORS(w, "GET, POST, PUT, DELETE, OPTIONS")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -381,13 +661,47 @@ func getContextHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract owner and repo from URL path
 	path := strings.TrimPrefix(r.URL.Path, "/api/context/")
 	parts := strings.Split(path, "/")
-	if len(parts) != 2 {
+	if len(parts) == 3 && parts[1] == "diff" {
+		contextDiffHandler(w, r, parts[0], parts[2])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "glossary" {
+		glossaryHandler(w, r, parts[0], parts[1])
+		return
+	}
+	if len(parts) == 3 && parts[2] == "coverage" {
+		coverageHandler(w, r, parts[0], parts[1])
+		return
+	}
+	// A repository named refresh keeps its context readable with GET
+	if r.Method == "POST" && len(parts) == 2 && parts[1] == "refresh" {
+		contextRefreshHandler(w, r, parts[0])
+		return
+	}
+	// Owner and repository name a github.com repository
+	if len(parts) == 3 && parts[2] == "refresh" {
+		contextRefreshHandler(w, r, githubContextID(parts[0], parts[1]))
+		return
+	}
+	var contextID string
+	switch {
+	case len(parts) == 2:
+		contextID = githubContextID(parts[0], parts[1])
+	case len(parts) == 1 && validContextID.MatchString(parts[0]):
+		// Context ids as returned by the clone endpoint, e.g. for multi-repo contexts
+		contextID = parts[0]
+	default:
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
 
-	owner, repo := parts[0], parts[1]
-	contextPath := filepath.Join("repos", fmt.Sprintf("%s-%s-context.txt", owner, repo))
+	contextPath := filepath.Join("repos", contextID+"-context.txt")
+
+	// Large contexts download best as a stream
+	if wantsRawContext(r) {
+		serveRawContext(w, r, contextPath)
+		return
+	}
 
 	// Check if context file exists
 	if _, err := os.Stat(contextPath); os.IsNotExist(err) {
@@ -410,12 +724,23 @@ func getContextHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// githubContextID is the context id of a github.com repository. Contexts
+// built before ids carried a host hash are kept as owner-repo and found
+// under that id until they are built again.
+func githubContextID(owner, repo string) string {
+	contextID := contextSlug("github.com", owner, repo, "")
+	if _, err := os.Stat(filepath.Join("repos", contextID+"-context.txt")); err == nil {
+		return contextID
+	}
+	legacyID := repoSlug(owner, repo)
+	if _, err := os.Stat(filepath.Join("repos", legacyID+"-context.txt")); err == nil {
+		return legacyID
+	}
+	return contextID
+}
+
 func generateTestsHandler(w http.ResponseWriter, r *http.Request) {
-	// Enable CORS for frontend on port 8080
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8080")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	enableCORS(w, "POST, OPTIONS")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -428,23 +753,323 @@ func generateTestsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req GeminiRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.resolveCodeContext(); err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
-	if req.APIKey == "" {
-		http.Error(w, "API Key is required", http.StatusBadRequest)
+	if prefersAsync(r) {
+		queueGenerationJob(w, req, requestTenant(r, req.Tenant))
+		return
+	}
+	format, ok := streamFormat(w, r)
+	if !ok {
 		return
 	}
+	if format != "" {
+		streamGeneration(w, req, requestTenant(r, req.Tenant), format)
+		return
+	}
+
+	testResponse, err := generateTests(req, requestTenant(r, req.Tenant))
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(testResponse)
+}
+
+// requestError is an error answered with a specific HTTP status
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
 
-	if req.CodeContext == "" {
-		http.Error(w, "Code context is required", http.StatusBadRequest)
+// writeRequestError answers with the status of a requestError, or 500
+func writeRequestError(w http.ResponseWriter, err error) {
+	var busy *providerBusyError
+	if errors.As(err, &busy) && busy.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(busy.retryAfterSeconds()))
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		http.Error(w, reqErr.message, reqErr.status)
 		return
 	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
 
-	// Generate prompt for Gemini
-	prompt := fmt.Sprintf(`
+// generateTests runs a generation request and records it as a signed run
+func generateTests(req GeminiRequest, tenant string) (GeminiResponse, error) {
+	req.Tenant = tenant
+	req.CodeContext = attachGlossary(normalizeLineEndings(req.CodeContext), req.Repo)
+
+	// The model sees placeholders, the run records the restored output
+	modelReq := req
+	redaction := redactRequest(&modelReq)
+	if req.onTestCase != nil {
+		modelReq.onTestCase = func(testCase GeminiTestCase) {
+			req.onTestCase(redaction.restoreTestCase(testCase))
+		}
+	}
+	testResponse, err := runGeneration(modelReq, tenant)
+	if err != nil {
+		return testResponse, err
+	}
+	redaction.restore(&testResponse)
+	recordGeneration(&testResponse, req)
+	return testResponse, nil
+}
+
+// recordGeneration prices and scores a finished generation, records it as
+// a run with its coverage and publishes its check runs
+func recordGeneration(testResponse *GeminiResponse, req GeminiRequest) {
+	if testResponse.Usage != nil && testResponse.Provenance != nil {
+		testResponse.Usage.CostUSD = usageCost(testResponse.Usage, testResponse.Provenance.Model)
+	}
+	scoreTestCases(testResponse, req)
+	testResponse.Checklist = buildReviewChecklist(testResponse)
+	if err := recordRun(testResponse, req); err != nil {
+		log.Printf("Warning: Could not record run: %v", err)
+	}
+	recordRunCoverage(testResponse, req)
+	if githubAppClient != nil {
+		checkRuns, err := githubAppClient.publishCheckRuns(testResponse, req)
+		if err != nil {
+			log.Printf("Warning: Could not publish check run: %v", err)
+		}
+		testResponse.CheckRuns = checkRuns
+	}
+}
+
+// standingInstructions loads the tenant's standing instructions, prepended
+// to every prompt
+func standingInstructions(tenant string) (string, error) {
+	instructions, err := loadTenantInstructions(tenant)
+	if err != nil {
+		log.Printf("Error loading tenant instructions: %v", err)
+		return "", errors.New("Failed to load tenant instructions")
+	}
+	return tenantPromptSection(instructions), nil
+}
+
+// generationPrompt builds the prompt of an llm or hybrid generation. Hybrid
+// mode only asks the model to fill the tables of the skeletons it returns.
+func generationPrompt(req GeminiRequest, standing string) (string, []testFocus, GeminiResponse) {
+	if req.Mode == "hybrid" {
+		testResponse := skeletonResponse(req.CodeContext)
+		return standing + languagePromptSection(req) + buildHybridPrompt(req, testResponse.Artifacts), nil, testResponse
+	}
+	focuses := detectTestFocuses(req.CodeContext, req.Focus)
+	focuses = withFindings(focuses, "allocations", req.HotPaths)
+	return standing + languagePromptSection(req) + buildTestPrompt(req, focuses), focuses, GeminiResponse{}
+}
+
+// fillSkeletons adds the table rows the model generated to hybrid
+// skeletons and returns how many rows did not parse
+func fillSkeletons(testResponse *GeminiResponse, generatedText string) (int, error) {
+	fills, err := parseHybridFills(generatedText)
+	if err != nil {
+		return 0, err
+	}
+	return applyHybridFills(testResponse, fills), nil
+}
+
+func rejectedRowsWarning(rejected int) AnalysisWarning {
+	return AnalysisWarning{
+		Kind:    "rejected-rows",
+		Message: fmt.Sprintf("%d table rows from the model did not parse and were dropped", rejected),
+	}
+}
+
+// runGeneration generates tests in the requested mode
+func runGeneration(req GeminiRequest, tenant string) (GeminiResponse, error) {
+	// Skeleton mode needs no model and no API key
+	if req.Mode == "skeleton" {
+		testResponse := skeletonResponse(req.CodeContext)
+		finalizeTestResponse(&testResponse, req, nil)
+		enforceLanguages(&testResponse, req, nil)
+		testResponse.Provenance = newProvenance("", "")
+		return testResponse, nil
+	}
+
+	if err := req.resolveAPIKey(); err != nil {
+		return GeminiResponse{}, err
+	}
+	if req.APIKey == "" && req.needsAPIKey() {
+		return GeminiResponse{}, &requestError{http.StatusBadRequest, "API Key is required"}
+	}
+
+	meter := newTokenMeter(req.MaxOutputTokens)
+
+	standing, err := standingInstructions(tenant)
+	if err != nil {
+		return GeminiResponse{}, err
+	}
+	prompt, focuses, testResponse := generationPrompt(req, standing)
+	// Translations of the response go to the same model
+	req.Model = req.selectModel(prompt)
+	budget := req.promptBudget(meter)
+	chunks := req.contextChunks(prompt, standing, budget)
+	var budgetWarnings []AnalysisWarning
+	if chunks == nil {
+		prompt, focuses, testResponse, budgetWarnings, err = fitPromptContext(req, standing, budget)
+		if err != nil {
+			return GeminiResponse{}, err
+		}
+		meter.recordContext(estimateTokens(prompt), budget)
+	}
+	req.report("context-built", 10)
+
+	if req.Mode == "hybrid" {
+		req.report("model-called", 20)
+		generatedText, err := generateText(req, prompt, meter)
+		rejected := 0
+		if err == nil {
+			req.report("parsing", 80)
+			rejected, err = fillSkeletons(&testResponse, generatedText)
+		}
+		finalizeTestResponse(&testResponse, req, nil)
+		enforceLanguages(&testResponse, req, meter)
+		testResponse.Provenance = newProvenance(req.Model, prompt)
+		if err != nil {
+			testResponse.Provenance = newProvenance("", "")
+			log.Printf("Returning unfilled test skeletons: %v", err)
+			testResponse.Warnings = append(testResponse.Warnings, AnalysisWarning{
+				Kind:    "fallback",
+				Message: fmt.Sprintf("model call failed, returning unfilled test skeletons: %v", err),
+			})
+		} else if rejected > 0 {
+			testResponse.Warnings = append(testResponse.Warnings, rejectedRowsWarning(rejected))
+		}
+		testResponse.Warnings = append(testResponse.Warnings, budgetWarnings...)
+
+		testResponse.Usage = meter.usage()
+		return testResponse, nil
+	}
+
+	// Call the model API, once per chunk for contexts too large for one call
+	req.report("model-called", 20)
+	if chunks != nil {
+		testResponse, prompt, budgetWarnings, err = generateChunked(req, standing, chunks, budget, meter)
+	} else {
+		var generatedText string
+		generatedText, err = generateTestCases(req, prompt, meter)
+		if err == nil {
+			req.report("parsing", 80)
+			testResponse, err = parseTestResponse(generatedText)
+		}
+		if err == nil {
+			attachTokenProbabilities(&testResponse, generatedText, meter.lastLogprobs())
+		}
+	}
+	if err != nil {
+		if !req.FallbackToSkeleton {
+			return GeminiResponse{}, err
+		}
+		log.Printf("Falling back to test skeletons: %v", err)
+		testResponse = skeletonResponse(req.CodeContext)
+		finalizeTestResponse(&testResponse, req, nil)
+		enforceLanguages(&testResponse, req, nil)
+		testResponse.Warnings = append(testResponse.Warnings, AnalysisWarning{
+			Kind:    "fallback",
+			Message: fmt.Sprintf("model call failed, returning test skeletons: %v", err),
+		})
+		testResponse.Provenance = newProvenance("", "")
+
+		testResponse.Usage = meter.usage()
+		return testResponse, nil
+	}
+
+	finalizeTestResponse(&testResponse, req, focuses)
+	enforceLanguages(&testResponse, req, meter)
+	testResponse.Warnings = append(testResponse.Warnings, budgetWarnings...)
+	testResponse.Provenance = newProvenance(req.Model, prompt)
+
+	testResponse.Usage = meter.usage()
+	return testResponse, nil
+}
+
+// parseTestResponse extracts the test cases JSON from the generated text
+func parseTestResponse(generatedText string) (GeminiResponse, error) {
+	var testResponse GeminiResponse
+
+	// Extract JSON from the response
+	jsonStart := strings.Index(generatedText, "{")
+	jsonEnd := strings.LastIndex(generatedText, "}")
+	if jsonStart == -1 || jsonEnd == -1 || jsonStart >= jsonEnd {
+		log.Printf("No valid JSON found in model response: %s", generatedText)
+		return testResponse, errors.New("No valid JSON found in model response")
+	}
+
+	jsonStr := generatedText[jsonStart : jsonEnd+1]
+	log.Printf("Extracted JSON: %s", jsonStr)
+
+	if err := json.Unmarshal([]byte(jsonStr), &testResponse); err != nil {
+		log.Printf("Error parsing test response: %v", err)
+		log.Printf("JSON string: %s", jsonStr)
+		return testResponse, fmt.Errorf("Failed to parse test cases from model response: %v", err)
+	}
+
+	return testResponse, nil
+}
+
+// finalizeTestResponse fills defaults and attaches the server-side analysis
+func finalizeTestResponse(testResponse *GeminiResponse, req GeminiRequest, focuses []testFocus) {
+	for i := range testResponse.TestCases {
+		normalizeTestVectors(&testResponse.TestCases[i])
+		fillRefactorShim(&testResponse.TestCases[i])
+		fillTestCaseDefaults(&testResponse.TestCases[i], i)
+	}
+
+	placeTestCases(testResponse.TestCases, req.CodeContext)
+	collectRefactorSuggestions(testResponse)
+	testResponse.Summary.Categories = countTestTypes(testResponse.TestCases)
+	testResponse.Artifacts = append(sanitizeArtifacts(testResponse.Artifacts), focusArtifacts(focuses, req.CodeContext)...)
+	testResponse.Artifacts = append(testResponse.Artifacts, helperArtifacts(testResponse, req.CodeContext)...)
+	var goFileWarnings []AnalysisWarning
+	if req.Output == "go-files" {
+		var goTests []GeneratedArtifact
+		goTests, goFileWarnings = goTestArtifacts(testResponse, req.CodeContext)
+		testResponse.Artifacts = append(testResponse.Artifacts, goTests...)
+	}
+	testResponse.Warnings = sharedStateWarnings(req.CodeContext, testResponse.TestCases)
+	testResponse.Warnings = append(testResponse.Warnings, goFileWarnings...)
+	testResponse.Warnings = append(testResponse.Warnings, resolveTestConflicts(testResponse, req.CodeContext)...)
+	var importWarnings []AnalysisWarning
+	testResponse.Artifacts, importWarnings = fixGoImports(testResponse.Artifacts, req.CodeContext)
+	testResponse.Warnings = append(testResponse.Warnings, importWarnings...)
+	testResponse.Focuses = focusNames(focuses)
+	if req.Output == "go-files" {
+		testResponse.GoTestFiles = goTestFileMap(testResponse.Artifacts)
+	}
+}
+
+// fillTestCaseDefaults adds a unique ID, the type and the priority to the
+// i-th test case where the model left them out
+func fillTestCaseDefaults(testCase *GeminiTestCase, i int) {
+	if testCase.ID == "" {
+		testCase.ID = fmt.Sprintf("test_%d", i+1)
+	}
+	if testCase.TestType == "" {
+		testCase.TestType = "unit"
+	}
+	if testCase.Priority == "" {
+		testCase.Priority = "medium"
+	}
+}
+
+func buildTestPrompt(req GeminiRequest, focuses []testFocus) string {
+	return fmt.Sprintf(`
 You are an expert software testing engineer. Analyze the provided code and generate comprehensive test cases.
 
 Code Context:
@@ -462,8 +1087,9 @@ Please generate test cases in the following JSON format:
       "input": "input_data_for_the_test",
       "expected": "expected_output_or_result",
       "code": "the_function_or_code_being_tested",
-      "testType": "unit|integration|edge-case|error-handling",
-      "priority": "high|medium|low"
+      "testType": "%s",
+      "priority": "high|medium|low",
+      "suggestedPath": "repository_path_of_the_test_file"
     }
   ],
   "summary": {
@@ -484,150 +1110,163 @@ Guidelines:
 6. Ensure test inputs are realistic and meaningful
 7. Focus on the main functionality of the code
 8. Generate at least 5-10 test cases for good coverage
+9. Set suggestedPath to the test file each test belongs in, following the repository's test layout; Go tests go next to the file they test
+%s%s
 
-Return only valid JSON, no additional text or markdown formatting.`, req.CodeContext, req.AdditionalPrompt)
-
-	// Call Gemini API
-	geminiURL := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-flash-latest:generateContent?key=%s", req.APIKey)
-
-	requestBody := map[string]interface{}{
-		"contents": []map[string]interface{}{
-			{
-				"parts": []map[string]interface{}{
-					{
-						"text": prompt,
-					},
-				},
-			},
-		},
-		"generationConfig": map[string]interface{}{
-			"temperature":     0.7,
-			"topK":            40,
-			"topP":            0.95,
-			"maxOutputTokens": 8192,
-		},
-	}
-
-	jsonBody, err := json.Marshal(requestBody)
-	if err != nil {
-		http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
-		return
+Return only valid JSON, no additional text or markdown formatting.`, req.CodeContext, req.AdditionalPrompt, focusTestTypes(focuses), focusPromptSection(focuses), helperPromptSection(req.CodeContext))
+}
+
+func main() {
+	validateConfig := flag.Bool("validate-config", false, "check the configuration and environment, print the result and exit")
+	flag.Parse()
+
+	// Create repos directory
+	if err := os.MkdirAll("repos", 0755); err != nil {
+		log.Fatal("Failed to create repos directory:", err)
 	}
 
-	resp, err := http.Post(geminiURL, "application/json", bytes.NewBuffer(jsonBody))
+	// Set up routes
+	http.HandleFunc("/api/clone-repo", cloneRepoHandler)
+	http.HandleFunc("/api/context/", getContextHandler)
+	http.HandleFunc("/api/generate-tests", generateTestsHandler)
+	http.HandleFunc("/api/generate-tests/diff", diffTestsHandler)
+	http.HandleFunc("/api/tenants/", tenantInstructionsHandler)
+	http.HandleFunc("/api/sessions", sessionsHandler)
+	http.HandleFunc("/api/sessions/", sessionsHandler)
+	http.HandleFunc("/api/me", meHandler)
+	http.HandleFunc("/api/runs/", runsHandler)
+	http.HandleFunc("/api/signing-key", signingKeyHandler)
+	http.HandleFunc("/api/versions", apiVersionsHandler)
+	http.HandleFunc("/api/keys", apiKeysHandler)
+	http.HandleFunc("/api/keys/", apiKeysHandler)
+	http.HandleFunc("/api/hooks/", hooksHandler)
+	http.HandleFunc("/api/ci/", ciTemplateHandler)
+	http.HandleFunc("/api/orgs/", orgsHandler)
+	http.HandleFunc("/api/analytics/", analyticsHandler)
+	http.HandleFunc("/api/usage", usageHandler)
+	http.HandleFunc("/api/offline/bundles", offlineHandler)
+	http.HandleFunc("/api/offline/bundles/", offlineHandler)
+	http.HandleFunc("/api/sandbox", sandboxHandler)
+	http.HandleFunc("/api/sandbox/", sandboxHandler)
+	http.HandleFunc("/api/jobs", jobsHandler)
+	http.HandleFunc("/api/jobs/", jobsHandler)
+
+	// Serve static files from the frontend
+	http.Handle("/", http.FileServer(http.Dir("../dist")))
+
+	// Roles for team deployments, off unless an access file is configured
+	ac, err := loadAccessControl(os.Getenv("TESTGEN_ACCESS_FILE"))
 	if err != nil {
-		log.Printf("Error calling Gemini API: %v", err)
-		http.Error(w, "Failed to call Gemini API", http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to load access control:", err)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	oidcCfg, err := loadOIDCConfig()
 	if err != nil {
-		http.Error(w, "Failed to read Gemini response", http.StatusInternalServerError)
-		return
+		log.Fatal("Invalid OIDC configuration:", err)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Gemini API error: %s", string(body))
-		http.Error(w, fmt.Sprintf("Gemini API error: %s", string(body)), http.StatusInternalServerError)
-		return
+	if oidcCfg != nil {
+		if ac == nil {
+			ac = &accessControl{users: map[string]Principal{}}
+		}
+		ac.oidc = newOIDCProvider(oidcCfg)
+		http.HandleFunc("/api/auth/", ac.oidc.authHandler)
+		log.Printf("Single sign-on enabled with %s", oidcCfg.Issuer)
 	}
-
-	var geminiResp map[string]interface{}
-	if err := json.Unmarshal(body, &geminiResp); err != nil {
-		http.Error(w, "Failed to parse Gemini response", http.StatusInternalServerError)
-		return
+	if ac != nil {
+		log.Printf("Access control enabled for %d users", len(ac.users))
 	}
 
-	// Extract the generated text
-	candidates, ok := geminiResp["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		http.Error(w, "Invalid Gemini response format", http.StatusInternalServerError)
-		return
+	appCfg, err := loadGitHubAppConfig()
+	if err != nil {
+		log.Fatal("Invalid GitHub App configuration:", err)
 	}
-
-	candidate, ok := candidates[0].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Invalid candidate format", http.StatusInternalServerError)
-		return
+	if appCfg != nil {
+		githubAppClient = newGitHubApp(appCfg)
+		log.Printf("Publishing check runs as GitHub App %s", appCfg.AppID)
 	}
 
-	content, ok := candidate["content"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Invalid content format", http.StatusInternalServerError)
-		return
+	if err := loadModelPricing(); err != nil {
+		log.Fatal("Invalid model pricing:", err)
 	}
-
-	parts, ok := content["parts"].([]interface{})
-	if !ok || len(parts) == 0 {
-		http.Error(w, "Invalid parts format", http.StatusInternalServerError)
-		return
+	if err := loadModelTiers(); err != nil {
+		log.Fatal("Invalid model tiers:", err)
 	}
-
-	part, ok := parts[0].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Invalid part format", http.StatusInternalServerError)
-		return
+	if err := loadAPIKeys(); err != nil {
+		log.Fatal("Invalid API keys:", err)
 	}
 
-	generatedText, ok := part["text"].(string)
-	if !ok {
-		http.Error(w, "Invalid text format", http.StatusInternalServerError)
-		return
+	if err := loadCloneStorage(); err != nil {
+		log.Fatal("Invalid clone storage:", err)
 	}
 
-	// Extract JSON from the response
-	jsonStart := strings.Index(generatedText, "{")
-	jsonEnd := strings.LastIndex(generatedText, "}")
-	if jsonStart == -1 || jsonEnd == -1 || jsonStart >= jsonEnd {
-		log.Printf("No valid JSON found in Gemini response: %s", generatedText)
-		http.Error(w, "No valid JSON found in Gemini response", http.StatusInternalServerError)
-		return
+	ingress, egress, err := loadNetworkPolicy()
+	if err != nil {
+		log.Fatal("Invalid network policy:", err)
+	}
+	if egress != nil {
+		// Clients made with their own transport must wrap it the same way
+		egressAllowlist = egress
+		http.DefaultTransport = &egressTransport{base: http.DefaultTransport}
+		// go-git made its client before, with the unwrapped transport
+		client.InstallProtocol("https", githttp.NewClient(&http.Client{Transport: http.DefaultTransport}))
+		log.Printf("Outbound connections restricted to %s", strings.Join(egress, ", "))
 	}
 
-	jsonStr := generatedText[jsonStart : jsonEnd+1]
-	log.Printf("Extracted JSON: %s", jsonStr)
+	// After the egress allowlist, which the provider client wraps its own
+	// transport with
+	providerCfg, err := loadProviderClientConfig()
+	if err != nil {
+		log.Fatal("Invalid provider client configuration:", err)
+	}
+	providerClient = newProviderClient(providerCfg)
+	providerRetry = providerCfg.Retry
 
-	var testResponse GeminiResponse
-	if err := json.Unmarshal([]byte(jsonStr), &testResponse); err != nil {
-		log.Printf("Error parsing test response: %v", err)
-		log.Printf("JSON string: %s", jsonStr)
-		http.Error(w, fmt.Sprintf("Failed to parse test cases from Gemini response: %v", err), http.StatusInternalServerError)
-		return
+	limits, err := loadBodyLimits()
+	if err != nil {
+		log.Fatal("Invalid body limits:", err)
 	}
 
-	// Add unique IDs if missing
-	for i, testCase := range testResponse.TestCases {
-		if testCase.ID == "" {
-			testResponse.TestCases[i].ID = fmt.Sprintf("test_%d", i+1)
-		}
-		if testCase.TestType == "" {
-			testResponse.TestCases[i].TestType = "unit"
+	skipped, err := loadSkippedChecks()
+	if err != nil {
+		log.Fatal("Invalid startup checks:", err)
+	}
+	results := runStartupChecks(skipped)
+	if *validateConfig {
+		printCheckResults(os.Stdout, results)
+		if checksFailed(results) {
+			os.Exit(1)
 		}
-		if testCase.Priority == "" {
-			testResponse.TestCases[i].Priority = "medium"
+		return
+	}
+	for _, result := range results {
+		if result.Status != "ok" {
+			log.Printf("Startup check %s %s: %s", result.Check, result.Status, result.Message)
 		}
 	}
+	if checksFailed(results) {
+		log.Fatal("Startup checks failed, fix the above or run with -validate-config for the full report")
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(testResponse)
-}
+	go expireSessions(time.Hour)
 
-func main() {
-	// Create repos directory
-	if err := os.MkdirAll("repos", 0755); err != nil {
-		log.Fatal("Failed to create repos directory:", err)
+	// Jobs and onboardings start once the clone storage and network policy
+	// are in place
+	go runOnboardings()
+	resumeOnboardings()
+	workers, err := jobWorkers()
+	if err != nil {
+		log.Fatal("Invalid job workers:", err)
 	}
+	for i := 0; i < workers; i++ {
+		go runJobs()
+	}
+	go expireJobs(time.Hour)
+	resumeJobs()
 
-	// Set up routes
-	http.HandleFunc("/api/clone-repo", cloneRepoHandler)
-	http.HandleFunc("/api/context/", getContextHandler)
-	http.HandleFunc("/api/generate-tests", generateTestsHandler)
-
-	// Serve static files from the frontend
-	http.Handle("/", http.FileServer(http.Dir("../dist")))
+	handler := withAccessControl(http.DefaultServeMux, ac)
+	handler = withBodyLimits(handler, limits)
+	handler = withAPIVersions(handler)
+	handler = withIPAllowlist(handler, ingress)
 
 	log.Println("Server starting on :3001")
-	log.Fatal(http.ListenAndServe(":3001", nil))
+	log.Fatal(http.ListenAndServe(":3001", handler))
 }
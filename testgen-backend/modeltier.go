@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Each provider has a fast model for small contexts and a stronger one
+// with a long context window. The prompt's size and the requested depth
+// pick between them, a request naming its model skips the choice. The
+// model called is recorded in the run's provenance and priced by it.
+
+// ModelTiers are the models of a provider by the size of the work
+type ModelTiers struct {
+	Standard    string // small contexts
+	LongContext string // large contexts and deep requests
+}
+
+// Prompts above this many estimated tokens go to the long-context tier,
+// TESTGEN_LONG_CONTEXT_TOKENS overrides it
+var longContextTokens = 100000
+
+// Model names end up in request paths, as Gemini's does. Ollama names
+// may have a namespace and a tag, as in library/codellama:7b.
+var validModelName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]*$`)
+
+func loadModelTiers() error {
+	value := os.Getenv("TESTGEN_LONG_CONTEXT_TOKENS")
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("TESTGEN_LONG_CONTEXT_TOKENS must be a positive number of tokens, got %q", value)
+	}
+	longContextTokens = n
+	return nil
+}
+
+// selectModel is the model a prompt of the request is sent to
+func (req GeminiRequest) selectModel(prompt string) string {
+	if req.Model != "" {
+		return req.Model
+	}
+	tiers := req.provider().Tiers()
+	if req.Depth == "deep" || estimateTokens(prompt) > longContextTokens {
+		return tiers.LongContext
+	}
+	return tiers.Standard
+}
+
+func validateModel(errs *fieldErrors, req *GeminiRequest) {
+	errs.oneOf("depth", req.Depth, "standard", "deep")
+	errs.maxLen("model", req.Model, 128)
+	if req.Model != "" && !validModelName.MatchString(req.Model) {
+		errs.add("model", "model", "model may only contain letters, digits, '.', '_', ':', '/' and '-'")
+	}
+}
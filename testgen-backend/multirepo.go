@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+var errInvalidRepoURL = errors.New("invalid repository URL")
+
+// Context ids are owner-repo and a hash of the location, joined with +
+// for multi-repo contexts
+var validContextID = regexp.MustCompile(`^[A-Za-z0-9_.+-]{1,256}$`)
+
+// repoSnapshot is what a context is built from for one repository
+type repoSnapshot struct {
+	Host     string
+	Owner    string
+	Repo     string
+	Files    []FileContent
+	Docs     []FileContent
+	Glossary string
+	Commit   string
+	Excluded []string // vendored and generated files left out
+	SubPath  string   // directory the files were read from, empty for all
+}
+
+// snapshotID names the context of a snapshot. A subtree gets its own
+// context, so it never replaces the context or versions of the whole
+// repository.
+func snapshotID(s *repoSnapshot) string {
+	return contextSlug(s.Host, s.Owner, s.Repo, s.SubPath)
+}
+
+// contextSlug names the context of a repository, or of its directory
+// subPath. The slug keeps it readable, the hash of the whole location
+// tells apart repositories of different hosts and owners and repositories
+// whose names join to the same slug.
+func contextSlug(host, owner, repo, subPath string) string {
+	id := repoSlug(owner, repo)
+	if subPath != "" {
+		id += "." + strings.ReplaceAll(subPath, "/", ".")
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{strings.ToLower(host), owner, repo, subPath}, "\x00")))
+	return id + "-" + hex.EncodeToString(sum[:6])
+}
+
+// cleanSubPath normalizes a directory inside a repository to a relative
+// slash separated path, reporting false for paths leaving the repository
+func cleanSubPath(subPath string) (string, bool) {
+	if strings.ContainsAny(subPath, "\\\x00") || strings.HasPrefix(subPath, "/") {
+		return "", false
+	}
+	cleaned := path.Clean(strings.TrimSuffix(subPath, "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") || !validContextID.MatchString(strings.ReplaceAll(cleaned, "/", ".")) {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// snapshotRepository clones a repository into reposDir at ref, or at the
+// ref of its URL when empty, or downloads it when public on GitHub. It
+// reads the files and documentation under subPath, or of the whole
+// repository when empty, and removes the clone again.
+func snapshotRepository(reposDir, repoURL, ref, subPath string, req RepoRequest, onRead func(string, int, int, int)) (*repoSnapshot, error) {
+	loc, err := parseRepoURL(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidRepoURL, repoURL)
+	}
+	if ref != "" {
+		loc.Ref = ref
+	}
+	owner, repo := loc.Owner, loc.Repo
+
+	if loc.Ref != "" {
+		log.Printf("Cloning repository: %s/%s at %s from %s", owner, repo, loc.Ref, loc.Host)
+	} else {
+		log.Printf("Cloning repository: %s/%s from %s", owner, repo, loc.Host)
+	}
+
+	// Each clone gets its own directory, jobs may clone a repository at
+	// the same time as a request does
+	clonePath, err := os.MkdirTemp(reposDir, repoSlug(owner, repo)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create clone directory: %v", err)
+	}
+	defer os.RemoveAll(clonePath)
+
+	var clone *repoClone
+	if tarballEligible(loc, req.AccessToken) {
+		if clone, err = downloadTarball(loc, subPath, req.IncludeDocs); err != nil {
+			log.Printf("Tarball download of %s/%s failed, cloning instead: %v", owner, repo, err)
+			clone = nil
+		}
+	}
+	if clone == nil {
+		if clone, err = cloneRepository(loc, clonePath, req.AccessToken); err != nil {
+			log.Printf("Error cloning repository: %v", err)
+			return nil, fmt.Errorf("Failed to clone repository: %v", err)
+		}
+	}
+
+	if subPath != "" {
+		if !isSubdirectory(clone.Files, subPath) {
+			return nil, &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("No directory %s in %s/%s", subPath, owner, repo)}
+		}
+		log.Printf("Reading %s of %s/%s", subPath, owner, repo)
+	}
+
+	files, err := readRepositoryFiles(clone.Files, subPath, onRead)
+	if err != nil {
+		log.Printf("Error reading repository files: %v", err)
+		return nil, fmt.Errorf("Failed to read repository files: %v", err)
+	}
+
+	// Vendored and generated code only wastes tokens unless asked for
+	var excluded []string
+	if !req.IncludeGenerated {
+		files, excluded = excludeNonAuthoredFiles(files)
+		if len(excluded) > 0 {
+			log.Printf("Excluded %d vendored or generated files from %s/%s", len(excluded), owner, repo)
+		}
+	}
+
+	if req.Normalize.enabled() {
+		var saved int
+		files, saved = normalizeFiles(files, req.Normalize)
+		log.Printf("Normalization saved %d bytes in %s/%s", saved, owner, repo)
+	}
+
+	// Read documentation files if requested
+	var docs []FileContent
+	if req.IncludeDocs {
+		allDocs, err := readDocumentationFiles(clone.Files, subPath)
+		if err != nil {
+			log.Printf("Warning: Could not read documentation files: %v", err)
+		}
+		docs = prepareDocs(allDocs, req.DocsMode, req.DocsBudget)
+	}
+
+	return &repoSnapshot{
+		Host:     loc.Host,
+		Owner:    owner,
+		Repo:     repo,
+		Files:    files,
+		Docs:     docs,
+		Glossary: loadGlossary(owner, repo),
+		Commit:   clone.Commit,
+		Excluded: excluded,
+		SubPath:  subPath,
+	}, nil
+}
+
+// isSubdirectory reports whether subPath is a directory of the clone.
+// Symlinks are refused, they may lead outside of it.
+func isSubdirectory(repo billy.Filesystem, subPath string) bool {
+	dir := ""
+	for _, name := range strings.Split(subPath, "/") {
+		dir = repo.Join(dir, name)
+		info, err := repo.Lstat(dir)
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSnapshots combines the snapshots into one context. A single
+// repository keeps its paths as they are, with several every path is
+// prefixed with owner/repo so files from different repositories never clash.
+func mergeSnapshots(snapshots []*repoSnapshot) (string, []FileContent, contextExtras) {
+	if len(snapshots) == 1 {
+		s := snapshots[0]
+		return snapshotID(s), s.Files, contextExtras{
+			Docs:     s.Docs,
+			Glossary: s.Glossary,
+			Sources:  snapshotSources(snapshots),
+		}
+	}
+
+	var ids []string
+	var files []FileContent
+	var extras contextExtras
+	var glossaries []string
+	for _, s := range snapshots {
+		namespace := s.Owner + "/" + s.Repo
+		ids = append(ids, snapshotID(s))
+		extras.Repos = append(extras.Repos, namespace)
+
+		for _, file := range s.Files {
+			file.Path = namespace + "/" + file.Path
+			files = append(files, file)
+		}
+		for _, doc := range s.Docs {
+			doc.Path = namespace + "/" + doc.Path
+			extras.Docs = append(extras.Docs, doc)
+		}
+		if strings.TrimSpace(s.Glossary) != "" {
+			glossaries = append(glossaries, fmt.Sprintf("## %s\n\n%s", namespace, strings.TrimSpace(s.Glossary)))
+		}
+	}
+	extras.Glossary = strings.Join(glossaries, "\n\n")
+	extras.Sources = snapshotSources(snapshots)
+
+	return strings.Join(ids, "+"), files, extras
+}
+
+func snapshotSources(snapshots []*repoSnapshot) []string {
+	var sources []string
+	for _, s := range snapshots {
+		if s.Commit != "" {
+			sources = append(sources, fmt.Sprintf("%s/%s@%s", s.Owner, s.Repo, s.Commit))
+		}
+	}
+	return sources
+}
+
+// repositoriesSection lists the repositories of a multi-repo context
+func repositoriesSection(repos []string) string {
+	if len(repos) < 2 {
+		return ""
+	}
+	var section strings.Builder
+	section.WriteString("=== REPOSITORIES ===\n\n")
+	section.WriteString("This context combines several repositories. Every file path starts with the repository it belongs to:\n")
+	for _, repo := range repos {
+		section.WriteString("- " + repo + "/\n")
+	}
+	section.WriteString("Include integration tests for the interactions between them, e.g. a client calling the service it targets.\n\n")
+	return section.String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Network policy for locked down deployments. Inbound API access can be
+// restricted to CIDR ranges and outbound connections to a list of hosts.
+// Both are unrestricted when not configured.
+
+var errEgressDenied = errors.New("egress denied by network policy")
+
+// Hosts the server may contact, nil allows all. Entries are host names,
+// "*.example.com" also matches every subdomain.
+var egressAllowlist []string
+
+type ingressPolicy struct {
+	allowed        []*net.IPNet
+	trustedProxies []*net.IPNet
+}
+
+// parseCIDRs parses a comma separated list of CIDR ranges and addresses
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadNetworkPolicy reads TESTGEN_ALLOWED_CIDRS, TESTGEN_TRUSTED_PROXIES
+// and TESTGEN_EGRESS_HOSTS. The ingress policy is nil when unrestricted.
+func loadNetworkPolicy() (*ingressPolicy, []string, error) {
+	var policy *ingressPolicy
+	if list := os.Getenv("TESTGEN_ALLOWED_CIDRS"); list != "" {
+		allowed, err := parseCIDRs(list)
+		if err != nil {
+			return nil, nil, fmt.Errorf("TESTGEN_ALLOWED_CIDRS: %v", err)
+		}
+		proxies, err := parseCIDRs(os.Getenv("TESTGEN_TRUSTED_PROXIES"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("TESTGEN_TRUSTED_PROXIES: %v", err)
+		}
+		policy = &ingressPolicy{allowed: allowed, trustedProxies: proxies}
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("TESTGEN_EGRESS_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return policy, hosts, nil
+}
+
+// clientIP returns the address of the caller. Behind trusted proxies it is
+// the rightmost X-Forwarded-For entry that is not itself a trusted proxy.
+func (p *ingressPolicy) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(p.trustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(p.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// withIPAllowlist refuses requests from addresses outside the policy
+func withIPAllowlist(next http.Handler, policy *ingressPolicy) http.Handler {
+	if policy == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := policy.clientIP(r); ip == nil || !containsIP(policy.allowed, ip) {
+			log.Printf("Refused %s %s from %s: not in allowed CIDR ranges", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkEgress reports whether the server may connect to host
+func checkEgress(host string) error {
+	if egressAllowlist == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range egressAllowlist {
+		if host == allowed {
+			return nil
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errEgressDenied, host)
+}
+
+// internalHost reports whether host is, or resolves to, a loopback,
+// private or link-local address, such as internal services and cloud
+// metadata endpoints
+func internalHost(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		ips = resolved
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// egressTransport refuses requests to hosts outside the egress allowlist.
+// It sees every hop of a redirect, so redirects cannot leave the list.
+type egressTransport struct {
+	base http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkEgress(req.URL.Hostname()); err != nil {
+		log.Printf("Blocked outbound request to %s", req.URL.Host)
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClientIP checks which address the ingress policy attributes a
+// request to. X-Forwarded-For is only read when the request comes from a
+// trusted proxy, and only up to the first hop that is not one.
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &ingressPolicy{trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4711", nil, "203.0.113.7"},
+		{"direct ignores forwarded", "203.0.113.7:4711", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"no port", "203.0.113.7", nil, "203.0.113.7"},
+		{"ipv6", "[2001:db8::1]:4711", nil, "2001:db8::1"},
+		{"trusted proxy", "10.1.2.3:4711", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"single trusted address", "192.168.1.5:4711", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"rightmost untrusted hop", "10.1.2.3:4711", []string{"198.51.100.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"several headers", "10.1.2.3:4711", []string{"198.51.100.9", "198.51.100.1"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:4711", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"spoofed hop stops the walk", "10.1.2.3:4711", []string{"198.51.100.1, not-an-ip"}, "10.1.2.3"},
+		{"trusted proxy without header", "10.1.2.3:4711", nil, "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/versions", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := policy.clientIP(r); got.String() != tt.want {
+				t.Errorf("clientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCheckEgress checks host names against the egress allowlist, where a
+// "*." entry matches subdomains but not the domain itself
+func TestCheckEgress(t *testing.T) {
+	saved := egressAllowlist
+	t.Cleanup(func() { egressAllowlist = saved })
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		host      string
+		allowed   bool
+	}{
+		{"unrestricted", nil, "anything.example.org", true},
+		{"listed", []string{"github.com"}, "github.com", true},
+		{"case and trailing dot", []string{"github.com"}, "GitHub.com.", true},
+		{"not listed", []string{"github.com"}, "gitlab.com", false},
+		{"subdomain of plain entry", []string{"github.com"}, "api.github.com", false},
+		{"suffix without dot", []string{"github.com"}, "evilgithub.com", false},
+		{"wildcard subdomain", []string{"*.example.com"}, "llm.example.com", true},
+		{"wildcard nested subdomain", []string{"*.example.com"}, "a.b.example.com", true},
+		{"wildcard domain itself", []string{"*.example.com"}, "example.com", false},
+		{"wildcard lookalike", []string{"*.example.com"}, "badexample.com", false},
+		{"empty allowlist", []string{}, "github.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			egressAllowlist = tt.allowlist
+			err := checkEgress(tt.host)
+			if tt.allowed && err != nil {
+				t.Errorf("checkEgress(%q) error = %v, want allowed", tt.host, err)
+			}
+			if !tt.allowed && !errors.Is(err, errEgressDenied) {
+				t.Errorf("checkEgress(%q) error = %v, want errEgressDenied", tt.host, err)
+			}
+		})
+	}
+}
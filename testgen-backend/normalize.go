@@ -0,0 +1,357 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Normalization squeezes more signal into the token budget by dropping
+// what the model does not need to write tests: comments, license headers,
+// runs of blank lines and the tail of very long string literals.
+
+// NormalizeOptions select the normalizations applied to file contents
+type NormalizeOptions struct {
+	StripComments       bool `json:"stripComments,omitempty"`
+	CollapseWhitespace  bool `json:"collapseWhitespace,omitempty"`
+	StripLicenseHeaders bool `json:"stripLicenseHeaders,omitempty"`
+	// Truncate string literals longer than this many bytes, 0 keeps them
+	MaxStringLength int `json:"maxStringLength,omitempty"`
+}
+
+// Shortest useful string literal, shorter limits would mangle ordinary code
+const minStringLength = 16
+
+const truncatedMarker = "..."
+
+// sourceSyntax describes the comments and string literals of a language
+// well enough to find them without a full parser
+type sourceSyntax struct {
+	lineComments []string
+	blockStart   string
+	blockEnd     string
+	quotes       string // single line string delimiters
+	rawQuote     byte   // multi-line string without escapes, such as Go's `
+	tripleQuotes bool   // Python style """ and ''' strings
+	hashComments bool   // # only starts a comment at line start or after a space
+}
+
+var (
+	cSyntax      = &sourceSyntax{lineComments: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`}
+	goSyntax     = &sourceSyntax{lineComments: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, rawQuote: '`'}
+	jsSyntax     = &sourceSyntax{lineComments: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, rawQuote: '`'}
+	rustSyntax   = &sourceSyntax{lineComments: []string{"//"}, blockStart: "/*", blockEnd: "*/", quotes: `"`}
+	phpSyntax    = &sourceSyntax{lineComments: []string{"//", "#"}, blockStart: "/*", blockEnd: "*/", quotes: `"'`, hashComments: true}
+	pythonSyntax = &sourceSyntax{lineComments: []string{"#"}, quotes: `"'`, tripleQuotes: true, hashComments: true}
+	hashSyntax   = &sourceSyntax{lineComments: []string{"#"}, quotes: `"'`, hashComments: true}
+	sqlSyntax    = &sourceSyntax{lineComments: []string{"--"}, blockStart: "/*", blockEnd: "*/", quotes: `'"`}
+	cssSyntax    = &sourceSyntax{blockStart: "/*", blockEnd: "*/", quotes: `"'`}
+)
+
+func syntaxFor(path string) *sourceSyntax {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".go":
+		return goSyntax
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs":
+		return jsSyntax
+	case ".java", ".kt", ".c", ".cpp", ".cs", ".swift":
+		return cSyntax
+	case ".rs":
+		return rustSyntax
+	case ".php":
+		return phpSyntax
+	case ".py":
+		return pythonSyntax
+	case ".rb", ".sh", ".yaml", ".yml", ".toml":
+		return hashSyntax
+	case ".sql":
+		return sqlSyntax
+	case ".css", ".scss", ".sass", ".less":
+		return cssSyntax
+	}
+	return nil
+}
+
+func (o *NormalizeOptions) enabled() bool {
+	return o != nil && (o.StripComments || o.CollapseWhitespace || o.StripLicenseHeaders || o.MaxStringLength > 0)
+}
+
+// normalizeFiles applies the options to every file and returns the bytes saved
+func normalizeFiles(files []FileContent, opts *NormalizeOptions) ([]FileContent, int) {
+	if !opts.enabled() {
+		return files, 0
+	}
+	saved := 0
+	normalized := make([]FileContent, len(files))
+	for i, file := range files {
+		file.Content = normalizeContent(file.Path, file.Content, opts)
+		saved += file.Size - len(file.Content)
+		file.Size = len(file.Content)
+		normalized[i] = file
+	}
+	return normalized, saved
+}
+
+func normalizeContent(path, content string, opts *NormalizeOptions) string {
+	syntax := syntaxFor(path)
+	if syntax != nil {
+		if opts.StripLicenseHeaders && !opts.StripComments {
+			content = stripLicenseHeader(content, syntax)
+		}
+		if opts.StripComments || opts.MaxStringLength > 0 {
+			content = rewriteSource(content, syntax, opts.StripComments, opts.MaxStringLength)
+		}
+	}
+	if opts.CollapseWhitespace {
+		content = collapseWhitespace(content)
+	}
+	return content
+}
+
+// leadingShebang splits off a #! line, which has to stay first
+func leadingShebang(content string) (string, string) {
+	if !strings.HasPrefix(content, "#!") {
+		return "", content
+	}
+	end := strings.IndexByte(content, '\n')
+	if end == -1 {
+		return content, ""
+	}
+	return content[:end+1], content[end+1:]
+}
+
+var licenseKeywords = []string{"copyright", "license", "licence", "spdx-license-identifier", "all rights reserved"}
+
+// stripLicenseHeader removes the first comment block of a file when it is
+// a license or copyright notice
+func stripLicenseHeader(content string, syntax *sourceSyntax) string {
+	shebang, body := leadingShebang(content)
+	rest := strings.TrimLeft(body, " \t\r\n")
+
+	end := -1
+	if syntax.blockStart != "" && strings.HasPrefix(rest, syntax.blockStart) {
+		if i := strings.Index(rest[len(syntax.blockStart):], syntax.blockEnd); i != -1 {
+			end = len(syntax.blockStart) + i + len(syntax.blockEnd)
+		}
+	} else {
+		for _, prefix := range syntax.lineComments {
+			if !strings.HasPrefix(rest, prefix) {
+				continue
+			}
+			end = 0
+			for end < len(rest) {
+				line := rest[end:]
+				if !strings.HasPrefix(strings.TrimLeft(line, " \t"), prefix) {
+					break
+				}
+				next := strings.IndexByte(line, '\n')
+				if next == -1 {
+					end = len(rest)
+					break
+				}
+				end += next + 1
+			}
+			break
+		}
+	}
+	if end <= 0 {
+		return content
+	}
+
+	block := strings.ToLower(rest[:end])
+	for _, keyword := range licenseKeywords {
+		if strings.Contains(block, keyword) {
+			return shebang + strings.TrimLeft(rest[end:], " \t\r\n")
+		}
+	}
+	return content
+}
+
+// isDirectiveComment reports comments that change how code builds, which
+// are kept when stripping comments
+func isDirectiveComment(comment string) bool {
+	return strings.HasPrefix(comment, "//go:") || strings.HasPrefix(comment, "// +build") ||
+		strings.HasPrefix(comment, "#!") || strings.HasPrefix(comment, "# -*-")
+}
+
+type tokenKind int
+
+const (
+	tokenText tokenKind = iota
+	tokenBlockComment
+	tokenLineComment
+	tokenString
+)
+
+// sourceToken is a span of source: a comment, a string literal with its
+// delimiters, or a single byte of anything else
+type sourceToken struct {
+	kind       tokenKind
+	start, end int
+	// Delimiters of a string, the literal is src[start+len(quote):end-len(quote)]
+	quote string
+}
+
+// scanToken reads the token starting at i
+func scanToken(src string, i int, syntax *sourceSyntax) sourceToken {
+	c := src[i]
+
+	if syntax.blockStart != "" && strings.HasPrefix(src[i:], syntax.blockStart) {
+		end := strings.Index(src[i+len(syntax.blockStart):], syntax.blockEnd)
+		if end == -1 {
+			end = len(src)
+		} else {
+			end = i + len(syntax.blockStart) + end + len(syntax.blockEnd)
+		}
+		return sourceToken{kind: tokenBlockComment, start: i, end: end}
+	}
+
+	if prefix := lineCommentAt(src, i, syntax); prefix != "" {
+		end := strings.IndexByte(src[i:], '\n')
+		if end == -1 {
+			end = len(src)
+		} else {
+			end += i
+		}
+		return sourceToken{kind: tokenLineComment, start: i, end: end}
+	}
+
+	if syntax.tripleQuotes && (strings.HasPrefix(src[i:], `"""`) || strings.HasPrefix(src[i:], `'''`)) {
+		quote := src[i : i+3]
+		end := strings.Index(src[i+3:], quote)
+		if end == -1 {
+			return sourceToken{kind: tokenText, start: i, end: len(src)}
+		}
+		return sourceToken{kind: tokenString, start: i, end: i + 3 + end + 3, quote: quote}
+	}
+
+	if syntax.rawQuote != 0 && c == syntax.rawQuote {
+		end := strings.IndexByte(src[i+1:], c)
+		if end == -1 {
+			return sourceToken{kind: tokenText, start: i, end: len(src)}
+		}
+		return sourceToken{kind: tokenString, start: i, end: i + end + 2, quote: string(c)}
+	}
+
+	if strings.IndexByte(syntax.quotes, c) != -1 {
+		end := i + 1
+		for end < len(src) && src[end] != c && src[end] != '\n' {
+			if src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end < len(src) && src[end] == c {
+			return sourceToken{kind: tokenString, start: i, end: end + 1, quote: string(c)}
+		}
+		// Unterminated, such as an apostrophe in prose
+	}
+
+	return sourceToken{kind: tokenText, start: i, end: i + 1}
+}
+
+// rewriteSource removes comments and shortens long string literals in one
+// pass, so comment markers inside strings and quotes inside comments are
+// left alone
+func rewriteSource(src string, syntax *sourceSyntax, stripComments bool, maxString int) string {
+	if maxString > 0 && maxString < minStringLength {
+		maxString = minStringLength
+	}
+
+	out := make([]byte, 0, len(src))
+	// Trailing blanks left in front of a removed comment
+	trimLine := func() {
+		for len(out) > 0 && (out[len(out)-1] == ' ' || out[len(out)-1] == '\t') {
+			out = out[:len(out)-1]
+		}
+	}
+
+	for i := 0; i < len(src); {
+		tok := scanToken(src, i, syntax)
+		text := src[tok.start:tok.end]
+		switch tok.kind {
+		case tokenBlockComment:
+			if !stripComments {
+				out = append(out, text...)
+			} else if strings.Contains(text, "\n") {
+				trimLine()
+				out = append(out, '\n')
+			} else {
+				out = append(out, ' ')
+			}
+		case tokenLineComment:
+			if !stripComments || isDirectiveComment(text) || (tok.start == 0 && strings.HasPrefix(src, "#!")) {
+				out = append(out, text...)
+			} else {
+				trimLine()
+			}
+		case tokenString:
+			body := text[len(tok.quote) : len(text)-len(tok.quote)]
+			out = append(out, tok.quote...)
+			out = append(out, truncateLiteral(body, maxString)...)
+			out = append(out, tok.quote...)
+		default:
+			out = append(out, text...)
+		}
+		i = tok.end
+	}
+	return string(out)
+}
+
+// lineCommentAt returns the line comment marker starting at i, if any
+func lineCommentAt(src string, i int, syntax *sourceSyntax) string {
+	for _, prefix := range syntax.lineComments {
+		if !strings.HasPrefix(src[i:], prefix) {
+			continue
+		}
+		if prefix == "#" && syntax.hashComments && i > 0 && src[i-1] != ' ' && src[i-1] != '\t' && src[i-1] != '\n' {
+			continue
+		}
+		return prefix
+	}
+	return ""
+}
+
+// truncateLiteral shortens a string literal body to max bytes, never
+// cutting an escape sequence or a UTF-8 character in half
+func truncateLiteral(body string, max int) string {
+	if max <= 0 || len(body) <= max {
+		return body
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	kept := body[:cut]
+	// An odd number of trailing backslashes would escape the marker
+	backslashes := len(kept) - len(strings.TrimRight(kept, `\`))
+	if backslashes%2 == 1 {
+		kept = kept[:len(kept)-1]
+	}
+	return kept + truncatedMarker
+}
+
+// collapseWhitespace trims trailing blanks and folds runs of blank lines
+// into one. Indentation is kept, it is significant in Python and YAML.
+func collapseWhitespace(content string) string {
+	lines := strings.Split(content, "\n")
+	var out []string
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			if blank || len(out) == 0 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		out = append(out, line)
+	}
+	collapsed := strings.TrimRight(strings.Join(out, "\n"), "\n")
+	if collapsed == "" {
+		return ""
+	}
+	return collapsed + "\n"
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Offline bundles serve air-gapped networks. The server packs everything a
+// generation would send to the model, the context, its symbol index and
+// the prompt, into a tarball that is carried to a machine running a local
+// model. The model's answers are imported back and go through the same
+// parsing, analysis and signing as a live generation, so the resulting run
+// can be downloaded, published and executed like any other.
+
+const bundleDirName = "testgen-bundle"
+
+// OfflineBundle is a stored export, kept until its responses are imported
+type OfflineBundle struct {
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Mode      string         `json:"mode"`
+	Request   GeminiRequest  `json:"request"` // without API key
+	Prompts   []BundlePrompt `json:"prompts"`
+	Runs      []string       `json:"runs,omitempty"` // runs imported from the bundle
+}
+
+// BundlePrompt is one prompt of a bundle, answered by one model call
+type BundlePrompt struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Text   string `json:"text,omitempty"`
+}
+
+// BundleManifest is the bundle.json of the tarball, telling the offline
+// side what to answer and where to send it
+type BundleManifest struct {
+	ID             string         `json:"id"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	Mode           string         `json:"mode"`
+	ContextSHA256  string         `json:"contextSha256"`
+	Prompts        []BundlePrompt `json:"prompts"`
+	Symbols        int            `json:"symbols"`
+	ImportURL      string         `json:"importUrl"`
+	ResponseFormat string         `json:"responseFormat"`
+}
+
+// Symbol is a declaration in the symbol index of a bundle
+type Symbol struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"` // func, method, type or function
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Exported bool   `json:"exported"`
+}
+
+// offlineBundleRequest is a generation request exported instead of sent,
+// optionally for a context built by the clone endpoint
+type offlineBundleRequest struct {
+	GeminiRequest
+}
+
+func (req *offlineBundleRequest) validate() fieldErrors {
+	generation := req.GeminiRequest
+	// A local model answers, no API key is involved
+	generation.APIKey, generation.KeyAlias = "", "offline"
+	errs := generation.validateGeneration()
+	if req.Mode == "skeleton" {
+		errs.add("mode", "oneof", "mode must be llm or hybrid, skeletons need no model")
+	}
+	if req.ContextID != "" {
+		if !validContextID.MatchString(req.ContextID) {
+			errs.add("contextId", "id", "contextId must be a context id returned by the clone endpoint")
+		}
+	} else {
+		errs.required("codeContext", req.CodeContext)
+	}
+	return errs
+}
+
+// bundleResponsesRequest carries what the local model answered
+type bundleResponsesRequest struct {
+	// Local model that answered, recorded in the provenance
+	Model     string           `json:"model"`
+	Responses []bundleResponse `json:"responses"`
+}
+
+type bundleResponse struct {
+	Prompt string `json:"prompt"` // name of the prompt, as in bundle.json
+	Text   string `json:"text"`   // raw model output
+}
+
+func (req *bundleResponsesRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.required("model", req.Model)
+	errs.maxLen("model", req.Model, 128)
+	if len(req.Responses) == 0 {
+		errs.add("responses", "required", "responses is required")
+	}
+	for i, response := range req.Responses {
+		errs.required(fmt.Sprintf("responses[%d].prompt", i), response.Prompt)
+		errs.required(fmt.Sprintf("responses[%d].text", i), response.Text)
+	}
+	return errs
+}
+
+var bundlesMu sync.Mutex
+
+// symbolIndex lists the declarations of the context, from the AST for Go
+// and by definition keywords for scripts
+func symbolIndex(codeContext string) []Symbol {
+	files := splitContextFiles(codeContext)
+	symbols := []Symbol{}
+
+	fset, goFiles := parseGoFiles(files)
+	for _, goFile := range goFiles {
+		for _, decl := range goFile.File.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				kind := "func"
+				if decl.Recv != nil {
+					kind = "method"
+				}
+				symbols = append(symbols, Symbol{
+					Name:     funcDisplayName(decl),
+					Kind:     kind,
+					File:     goFile.Path,
+					Line:     fset.Position(decl.Pos()).Line,
+					Exported: decl.Name.IsExported(),
+				})
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if typeSpec, ok := spec.(*ast.TypeSpec); ok {
+						symbols = append(symbols, Symbol{
+							Name:     typeSpec.Name.Name,
+							Kind:     "type",
+							File:     goFile.Path,
+							Line:     fset.Position(typeSpec.Pos()).Line,
+							Exported: typeSpec.Name.IsExported(),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	for _, file := range files {
+		switch strings.ToLower(filepath.Ext(file.Path)) {
+		case ".py", ".js", ".jsx", ".ts", ".tsx", ".mjs":
+		default:
+			continue
+		}
+		for i, line := range strings.Split(file.Content, "\n") {
+			if match := scriptFuncDecl.FindStringSubmatch(line); match != nil {
+				symbols = append(symbols, Symbol{
+					Name:     match[1],
+					Kind:     "function",
+					File:     file.Path,
+					Line:     i + 1,
+					Exported: !strings.HasPrefix(match[1], "_"),
+				})
+			}
+		}
+	}
+	return symbols
+}
+
+// bundleReadme explains the offline side of the round trip
+func bundleReadme(manifest BundleManifest) string {
+	var readme strings.Builder
+	fmt.Fprintf(&readme, "Test generation bundle %s\n\n", manifest.ID)
+	readme.WriteString("Files:\n")
+	readme.WriteString("  bundle.json    what to answer and where to send it\n")
+	readme.WriteString("  context.txt    the code context the prompts were built from\n")
+	readme.WriteString("  symbols.json   the declarations of the context\n")
+	readme.WriteString("  prompts/       one prompt per model call\n\n")
+	readme.WriteString("Send each prompt to the local model unchanged, for example:\n\n")
+	for _, prompt := range manifest.Prompts {
+		fmt.Fprintf(&readme, "  ollama run llama3.1 < prompts/%s > responses/%s\n", prompt.Name, prompt.Name)
+	}
+	readme.WriteString("\nThen import the answers on the server:\n\n")
+	fmt.Fprintf(&readme, "  POST %s\n  %s\n", manifest.ImportURL, manifest.ResponseFormat)
+	return readme.String()
+}
+
+// buildBundleArchive packs a bundle for the offline machine
+func buildBundleArchive(bundle *OfflineBundle) ([]byte, error) {
+	modelReq := bundle.Request
+	redactRequest(&modelReq)
+	symbols := symbolIndex(modelReq.CodeContext)
+
+	manifest := BundleManifest{
+		ID:             bundle.ID,
+		CreatedAt:      bundle.CreatedAt,
+		Mode:           bundle.Mode,
+		ContextSHA256:  sha256Hex([]byte(modelReq.CodeContext)),
+		Symbols:        len(symbols),
+		ImportURL:      "/api/v1/offline/bundles/" + bundle.ID + "/responses",
+		ResponseFormat: `{"model": "<local model>", "responses": [{"prompt": "<prompt name>", "text": "<raw model output>"}]}`,
+	}
+	for _, prompt := range bundle.Prompts {
+		manifest.Prompts = append(manifest.Prompts, BundlePrompt{Name: prompt.Name, SHA256: prompt.SHA256})
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    bundleDirName + "/" + name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: bundle.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	// The response format is shown as written, not with escaped angle brackets
+	var manifestJSON bytes.Buffer
+	encoder := json.NewEncoder(&manifestJSON)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+	symbolsJSON, err := json.MarshalIndent(symbols, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"bundle.json", manifestJSON.Bytes()},
+		{"README.txt", []byte(bundleReadme(manifest))},
+		{"context.txt", []byte(modelReq.CodeContext)},
+		{"symbols.json", symbolsJSON},
+	}
+	for _, prompt := range bundle.Prompts {
+		files = append(files, struct {
+			name    string
+			content []byte
+		}{"prompts/" + prompt.Name, []byte(prompt.Text)})
+	}
+	for _, file := range files {
+		if err := add(file.name, file.content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newOfflineBundle builds the prompt a generation would send and stores it
+// with the request
+func newOfflineBundle(req GeminiRequest, tenant string) (*OfflineBundle, error) {
+	req.APIKey = ""
+	req.Tenant = tenant
+	req.CodeContext = attachGlossary(normalizeLineEndings(req.CodeContext), req.Repo)
+	if req.Mode == "" {
+		req.Mode = "llm"
+	}
+
+	standing, err := standingInstructions(tenant)
+	if err != nil {
+		return nil, err
+	}
+	modelReq := req
+	redactRequest(&modelReq)
+	prompt, _, _ := generationPrompt(modelReq, standing)
+
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	bundle := &OfflineBundle{
+		ID:        id,
+		CreatedAt: time.Now().UTC(),
+		Mode:      req.Mode,
+		Request:   req,
+		Prompts:   []BundlePrompt{{Name: "prompt-001.txt", SHA256: sha256Hex([]byte(prompt)), Text: prompt}},
+	}
+	if err := saveJSON("bundles", id, bundle); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// importBundleResponses turns the answers of the local model into a run
+func importBundleResponses(bundle *OfflineBundle, body bundleResponsesRequest) (GeminiResponse, error) {
+	answers := map[string]string{}
+	for _, response := range body.Responses {
+		answers[response.Prompt] = response.Text
+	}
+	for name := range answers {
+		found := false
+		for _, prompt := range bundle.Prompts {
+			found = found || prompt.Name == name
+		}
+		if !found {
+			return GeminiResponse{}, &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("Bundle has no prompt %s", name)}
+		}
+	}
+	prompt := bundle.Prompts[0]
+	generatedText, ok := answers[prompt.Name]
+	if !ok {
+		return GeminiResponse{}, &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("Missing response to %s", prompt.Name)}
+	}
+
+	req := bundle.Request
+	modelReq := req
+	redaction := redactRequest(&modelReq)
+	_, focuses, testResponse := generationPrompt(modelReq, "")
+
+	if bundle.Mode == "hybrid" {
+		rejected, err := fillSkeletons(&testResponse, generatedText)
+		if err != nil {
+			return GeminiResponse{}, &requestError{http.StatusUnprocessableEntity, err.Error()}
+		}
+		if rejected > 0 {
+			testResponse.Warnings = append(testResponse.Warnings, rejectedRowsWarning(rejected))
+		}
+	} else {
+		var err error
+		if testResponse, err = parseTestResponse(generatedText); err != nil {
+			return GeminiResponse{}, &requestError{http.StatusUnprocessableEntity, err.Error()}
+		}
+	}
+	finalizeTestResponse(&testResponse, modelReq, focuses)
+	enforceLanguages(&testResponse, modelReq, nil)
+	testResponse.Provenance = newProvenance(body.Model, prompt.Text)
+
+	redaction.restore(&testResponse)
+	recordGeneration(&testResponse, req)
+	return testResponse, nil
+}
+
+// writeBundleArchive sends a bundle tarball signed like a run archive
+func writeBundleArchive(w http.ResponseWriter, bundle *OfflineBundle, status int) {
+	key, err := loadSigningKey()
+	if err != nil {
+		log.Printf("Error loading signing key: %v", err)
+		http.Error(w, "Failed to sign bundle", http.StatusInternalServerError)
+		return
+	}
+	archive, err := buildBundleArchive(bundle)
+	if err != nil {
+		log.Printf("Error building bundle %s: %v", bundle.ID, err)
+		http.Error(w, "Failed to build bundle", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"testgen-bundle-%s.tar.gz\"", bundle.ID))
+	w.Header().Set("Location", "/api/v1/offline/bundles/"+bundle.ID)
+	w.Header().Set("X-Testgen-Bundle-Id", bundle.ID)
+	w.Header().Set("X-Testgen-Key-Id", key.id)
+	w.Header().Set("X-Testgen-Archive-Sha256", sha256Hex(archive))
+	w.Header().Set("X-Testgen-Archive-Signature", key.sign(archive))
+	w.WriteHeader(status)
+	w.Write(archive)
+}
+
+// offlineHandler serves the offline bundles:
+//
+//	POST   /api/offline/bundles                   export a generation as a tarball
+//	GET    /api/offline/bundles/{id}               bundle and its imported runs
+//	GET    /api/offline/bundles/{id}/archive       download the tarball again
+//	POST   /api/offline/bundles/{id}/responses     import the local model's answers
+//	DELETE /api/offline/bundles/{id}
+func offlineHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, DELETE, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/offline/bundles"), "/")
+	if path == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req offlineBundleRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		if err := req.resolveCodeContext(); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		bundle, err := newOfflineBundle(req.GeminiRequest, requestTenant(r, req.Tenant))
+		if err != nil {
+			log.Printf("Error creating offline bundle: %v", err)
+			http.Error(w, "Failed to create bundle", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Exported offline bundle %s", bundle.ID)
+		writeBundleArchive(w, bundle, http.StatusCreated)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	id := parts[0]
+
+	if r.Method == "DELETE" && len(parts) == 1 {
+		bundlesMu.Lock()
+		err := deleteJSON("bundles", id)
+		bundlesMu.Unlock()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+				http.Error(w, "Bundle not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to delete bundle", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var bundle OfflineBundle
+	if err := loadJSON("bundles", id, &bundle); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Bundle not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read bundle", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		// The context and prompts stay on the server, the archive has them
+		info := bundle
+		info.Request.CodeContext = ""
+		info.Request.AdditionalPrompt = ""
+		info.Prompts = nil
+		for _, prompt := range bundle.Prompts {
+			info.Prompts = append(info.Prompts, BundlePrompt{Name: prompt.Name, SHA256: prompt.SHA256})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+
+	case len(parts) == 2 && parts[1] == "archive" && r.Method == "GET":
+		writeBundleArchive(w, &bundle, http.StatusOK)
+
+	case len(parts) == 2 && parts[1] == "responses" && r.Method == "POST":
+		var body bundleResponsesRequest
+		if !decodeRequest(w, r, &body) {
+			return
+		}
+		testResponse, err := importBundleResponses(&bundle, body)
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		bundlesMu.Lock()
+		if err := loadJSON("bundles", id, &bundle); err == nil {
+			bundle.Runs = append(bundle.Runs, testResponse.RunID)
+			err = saveJSON("bundles", id, bundle)
+		}
+		bundlesMu.Unlock()
+		log.Printf("Imported offline bundle %s as run %s", id, testResponse.RunID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(testResponse)
+
+	case len(parts) == 2 && parts[1] != "archive" && parts[1] != "responses":
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single sign-on through an OpenID Connect provider. Users log in with the
+// authorization code flow (with PKCE), their groups are mapped to a role
+// and they get a server-side login session kept in a cookie. ID tokens are
+// also accepted as bearer tokens for API clients.
+
+const (
+	authSessionCookie   = "testgen_session"
+	authSessionLifetime = 12 * time.Hour
+	pendingLoginTTL     = 10 * time.Minute
+	// Logins started and not completed, beyond it new ones are refused
+	maxPendingLogins    = 10000
+	jwksRefetchInterval = time.Minute
+)
+
+var errInvalidIDToken = errors.New("invalid ID token")
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	GroupsClaim  string
+	RoleMap      map[string]role // group -> role
+	DefaultRole  role            // role for users in no mapped group, "" denies them
+}
+
+// loadOIDCConfig reads the OIDC settings from the environment, returning
+// nil when no issuer is configured
+func loadOIDCConfig() (*oidcConfig, error) {
+	issuer := os.Getenv("TESTGEN_OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &oidcConfig{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("TESTGEN_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("TESTGEN_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("TESTGEN_OIDC_REDIRECT_URL"),
+		Scopes:       []string{"openid", "profile", "email", "offline_access"},
+		GroupsClaim:  "groups",
+		RoleMap:      map[string]role{},
+		DefaultRole:  role(os.Getenv("TESTGEN_OIDC_DEFAULT_ROLE")),
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("TESTGEN_OIDC_CLIENT_ID and TESTGEN_OIDC_REDIRECT_URL are required with TESTGEN_OIDC_ISSUER")
+	}
+	if scopes := os.Getenv("TESTGEN_OIDC_SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+	if claim := os.Getenv("TESTGEN_OIDC_GROUPS_CLAIM"); claim != "" {
+		cfg.GroupsClaim = claim
+	}
+	// Mapping in the form "platform-admins=admin,developers=maintainer"
+	for _, pair := range strings.Split(os.Getenv("TESTGEN_OIDC_ROLE_MAP"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, r, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TESTGEN_OIDC_ROLE_MAP entry %q", pair)
+		}
+		if _, known := rolePermissions[role(r)]; !known {
+			return nil, fmt.Errorf("unknown role %q in TESTGEN_OIDC_ROLE_MAP", r)
+		}
+		cfg.RoleMap[strings.TrimSpace(group)] = role(r)
+	}
+	if _, known := rolePermissions[cfg.DefaultRole]; cfg.DefaultRole != "" && !known {
+		return nil, fmt.Errorf("unknown role %q in TESTGEN_OIDC_DEFAULT_ROLE", cfg.DefaultRole)
+	}
+	return cfg, nil
+}
+
+// oidcProvider talks to the identity provider. Discovery and keys are
+// fetched on first use so the server starts while the provider is down.
+type oidcProvider struct {
+	cfg    *oidcConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+	keys          map[string]crypto.PublicKey
+	keysFetched   time.Time
+
+	// Started logins by state. They live for minutes and anyone can start
+	// one, so they are kept in memory rather than stored.
+	loginsMu sync.Mutex
+	logins   map[string]pendingLogin
+}
+
+func newOIDCProvider(cfg *oidcConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, logins: map[string]pendingLogin{}}
+}
+
+func (p *oidcProvider) getJSON(rawURL string, v interface{}) error {
+	resp, err := p.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokenEndpoint != "" {
+		return nil
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.cfg.Issuer {
+		return fmt.Errorf("OIDC discovery returned issuer %q, expected %q", doc.Issuer, p.cfg.Issuer)
+	}
+	p.authEndpoint, p.tokenEndpoint, p.jwksURI = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	return nil
+}
+
+// key returns the signing key with the given id, refetching the key set
+// when the id is unknown, at most once per jwksRefetchInterval
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefetchInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+	}
+	p.keysFetched = time.Now()
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC keys: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, kid)
+}
+
+// idClaims are the ID token claims used for sign-in
+type idClaims struct {
+	Subject  string
+	Name     string
+	Groups   []string
+	Nonce    string
+	Expiry   time.Time
+	Audience []string
+}
+
+// verifyIDToken checks the signature, issuer, audience and expiry of an ID
+// token and returns its claims
+func (p *oidcProvider) verifyIDToken(raw string) (*idClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("%w: bad signature", errInvalidIDToken)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("%w: bad signature", errInvalidIDToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported key", errInvalidIDToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	result := &idClaims{
+		Subject:  stringClaim(claims, "sub"),
+		Nonce:    stringClaim(claims, "nonce"),
+		Groups:   stringsClaim(claims, p.cfg.GroupsClaim),
+		Audience: stringsClaim(claims, "aud"),
+	}
+	for _, name := range []string{"email", "preferred_username", "name", "sub"} {
+		if result.Name = stringClaim(claims, name); result.Name != "" {
+			break
+		}
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		result.Expiry = time.Unix(int64(exp), 0)
+	}
+
+	if strings.TrimSuffix(stringClaim(claims, "iss"), "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", errInvalidIDToken)
+	}
+	audienceOK := false
+	for _, aud := range result.Audience {
+		audienceOK = audienceOK || aud == p.cfg.ClientID
+	}
+	if !audienceOK {
+		return nil, fmt.Errorf("%w: wrong audience", errInvalidIDToken)
+	}
+	// Allow a minute of clock skew
+	if result.Expiry.IsZero() || time.Now().After(result.Expiry.Add(time.Minute)) {
+		return nil, fmt.Errorf("%w: expired", errInvalidIDToken)
+	}
+	return result, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidIDToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidIDToken
+	}
+	return nil
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// stringsClaim reads a claim that may be a single string or a list
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// roleForGroups picks the most privileged role mapped from the user's
+// groups, falling back to the default role
+func (cfg *oidcConfig) roleForGroups(groups []string) role {
+	best := cfg.DefaultRole
+	for _, group := range groups {
+		if r, ok := cfg.RoleMap[group]; ok && len(rolePermissions[r]) > len(rolePermissions[best]) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (p *oidcProvider) principal(claims *idClaims) (Principal, bool) {
+	r := p.cfg.roleForGroups(claims.Groups)
+	if r == "" {
+		return Principal{}, false
+	}
+	return Principal{Name: claims.Name, Role: r}, true
+}
+
+type tokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (p *oidcProvider) exchange(form url.Values) (*tokenResponse, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+	// Public clients identify themselves in the form, confidential ones
+	// with client_secret_basic
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request failed: %s %s", tokens.Error, tokens.Description)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &tokens, nil
+}
+
+// pendingLogin ties an authorization callback to the login that started it
+type pendingLogin struct {
+	Nonce     string
+	Verifier  string
+	ReturnTo  string
+	ExpiresAt time.Time
+}
+
+// startLogin keeps a pending login until its callback, dropping the
+// expired ones. It reports false when too many logins are in progress.
+func (p *oidcProvider) startLogin(state string, login pendingLogin) bool {
+	p.loginsMu.Lock()
+	defer p.loginsMu.Unlock()
+	if len(p.logins) >= maxPendingLogins {
+		now := time.Now()
+		for s, pending := range p.logins {
+			if now.After(pending.ExpiresAt) {
+				delete(p.logins, s)
+			}
+		}
+		if len(p.logins) >= maxPendingLogins {
+			return false
+		}
+	}
+	p.logins[state] = login
+	return true
+}
+
+// completeLogin takes the pending login of a callback, a login can only
+// be completed once
+func (p *oidcProvider) completeLogin(state string) (pendingLogin, bool) {
+	p.loginsMu.Lock()
+	defer p.loginsMu.Unlock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	return login, ok && time.Now().Before(login.ExpiresAt)
+}
+
+// authSession is a signed-in user, stored under the hash of its cookie
+type authSession struct {
+	Name           string    `json:"name"`
+	Role           role      `json:"role"`
+	Groups         []string  `json:"groups,omitempty"`
+	RefreshToken   string    `json:"refreshToken,omitempty"`
+	TokenExpiresAt time.Time `json:"tokenExpiresAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func sessionKey(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionPrincipal resolves the login session cookie of a request,
+// refreshing the ID token when it expired
+func (p *oidcProvider) sessionPrincipal(r *http.Request) (Principal, bool) {
+	cookie, err := r.Cookie(authSessionCookie)
+	if err != nil {
+		return Principal{}, false
+	}
+	key := sessionKey(cookie.Value)
+	var session authSession
+	if err := loadJSON("auth-sessions", key, &session); err != nil {
+		return Principal{}, false
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		deleteJSON("auth-sessions", key)
+		return Principal{}, false
+	}
+	if now.After(session.TokenExpiresAt) {
+		if err := p.refreshSession(key, &session); err != nil {
+			log.Printf("Could not refresh login session of %s: %v", session.Name, err)
+			deleteJSON("auth-sessions", key)
+			return Principal{}, false
+		}
+	}
+	return Principal{Name: session.Name, Role: session.Role}, true
+}
+
+// refreshSession renews the ID token with the refresh token and re-applies
+// the role mapping, so group changes take effect without a new login
+func (p *oidcProvider) refreshSession(key string, session *authSession) error {
+	if session.RefreshToken == "" {
+		return errors.New("no refresh token")
+	}
+	tokens, err := p.exchange(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	claims, err := p.verifyIDToken(tokens.IDToken)
+	if err != nil {
+		return err
+	}
+	principal, ok := p.principal(claims)
+	if !ok {
+		return errors.New("user no longer has a role")
+	}
+	session.Role = principal.Role
+	session.Groups = claims.Groups
+	session.TokenExpiresAt = claims.Expiry
+	if tokens.RefreshToken != "" {
+		session.RefreshToken = tokens.RefreshToken
+	}
+	return saveJSON("auth-sessions", key, session)
+}
+
+func (p *oidcProvider) secureCookies() bool {
+	return strings.HasPrefix(p.cfg.RedirectURL, "https://")
+}
+
+// authHandler serves the login flow:
+//
+//	GET  /api/auth/login?returnTo=/path  redirect to the identity provider
+//	GET  /api/auth/callback              finish the login and set the cookie
+//	POST /api/auth/refresh               renew the session's ID token
+//	POST /api/auth/logout                end the session
+func (p *oidcProvider) authHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/api/auth/") {
+	case "login":
+		p.loginHandler(w, r)
+	case "callback":
+		p.callbackHandler(w, r)
+	case "refresh":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cookie, err := r.Cookie(authSessionCookie)
+		if err != nil {
+			http.Error(w, "Not signed in", http.StatusUnauthorized)
+			return
+		}
+		key := sessionKey(cookie.Value)
+		var session authSession
+		if err := loadJSON("auth-sessions", key, &session); err != nil || time.Now().After(session.ExpiresAt) {
+			http.Error(w, "Not signed in", http.StatusUnauthorized)
+			return
+		}
+		if err := p.refreshSession(key, &session); err != nil {
+			log.Printf("Could not refresh login session of %s: %v", session.Name, err)
+			http.Error(w, "Failed to refresh session", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":           session.Name,
+			"role":           session.Role,
+			"tokenExpiresAt": session.TokenExpiresAt,
+			"expiresAt":      session.ExpiresAt,
+		})
+	case "logout":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := r.Cookie(authSessionCookie); err == nil {
+			deleteJSON("auth-sessions", sessionKey(cookie.Value))
+		}
+		http.SetCookie(w, &http.Cookie{Name: authSessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: p.secureCookies()})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (p *oidcProvider) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if err := p.discover(); err != nil {
+		log.Printf("Error starting login: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// Only local paths, never another host
+	returnTo := r.URL.Query().Get("returnTo")
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = "/"
+	}
+
+	state, err1 := randomToken(24)
+	nonce, err2 := randomToken(24)
+	verifier, err3 := randomToken(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	login := pendingLogin{Nonce: nonce, Verifier: verifier, ReturnTo: returnTo, ExpiresAt: time.Now().Add(pendingLoginTTL)}
+	if !p.startLogin(state, login) {
+		log.Printf("Refused login, %d logins are in progress", maxPendingLogins)
+		http.Error(w, "Too many logins in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authEndpoint+sep+query.Encode(), http.StatusFound)
+}
+
+func (p *oidcProvider) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, fmt.Sprintf("Login failed: %s %s", errCode, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+
+	login, ok := p.completeLogin(query.Get("state"))
+	if !ok {
+		http.Error(w, "Unknown or expired login", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := p.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		log.Printf("Error exchanging authorization code: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := p.verifyIDToken(tokens.IDToken)
+	if err != nil || claims.Nonce != login.Nonce {
+		log.Printf("Rejected ID token at login: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	principal, ok := p.principal(claims)
+	if !ok {
+		log.Printf("Denied login of %s: no role for groups %v", claims.Name, claims.Groups)
+		http.Error(w, "Your account has no access to this server", http.StatusForbidden)
+		return
+	}
+
+	cookieValue, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	session := authSession{
+		Name:           principal.Name,
+		Role:           principal.Role,
+		Groups:         claims.Groups,
+		RefreshToken:   tokens.RefreshToken,
+		TokenExpiresAt: claims.Expiry,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(authSessionLifetime),
+	}
+	if err := saveJSON("auth-sessions", sessionKey(cookieValue), session); err != nil {
+		log.Printf("Error saving login session: %v", err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     authSessionCookie,
+		Value:    cookieValue,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   p.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("Signed in %s as %s", principal.Name, principal.Role)
+	http.Redirect(w, r, login.ReturnTo, http.StatusFound)
+}
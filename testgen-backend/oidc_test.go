@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerifyIDToken signs ID tokens with a key the provider already holds,
+// so neither discovery nor the key set is fetched. The nonce is not
+// checked by verifyIDToken, the login callback compares the one returned.
+func TestVerifyIDToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newOIDCProvider(&oidcConfig{Issuer: "https://idp.example.com", ClientID: "testgen", GroupsClaim: "groups"})
+	p.tokenEndpoint = "https://idp.example.com/token"
+	p.keys = map[string]crypto.PublicKey{"k1": &key.PublicKey}
+	p.keysFetched = time.Now()
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    "testgen",
+			"sub":    "u-1",
+			"email":  "dev@example.com",
+			"nonce":  "n-1",
+			"groups": []string{"devs"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	tests := []struct {
+		name    string
+		kid     string
+		signer  *ecdsa.PrivateKey
+		change  func(claims map[string]interface{})
+		wantErr string
+	}{
+		{"valid", "k1", key, nil, ""},
+		{"issuer with trailing slash", "k1", key, func(c map[string]interface{}) { c["iss"] = "https://idp.example.com/" }, ""},
+		{"audience list", "k1", key, func(c map[string]interface{}) { c["aud"] = []string{"other", "testgen"} }, ""},
+		{"within clock skew", "k1", key, func(c map[string]interface{}) { c["exp"] = time.Now().Add(-30 * time.Second).Unix() }, ""},
+		{"wrong issuer", "k1", key, func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, "wrong issuer"},
+		{"wrong audience", "k1", key, func(c map[string]interface{}) { c["aud"] = "other" }, "wrong audience"},
+		{"no audience", "k1", key, func(c map[string]interface{}) { delete(c, "aud") }, "wrong audience"},
+		{"expired", "k1", key, func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() }, "expired"},
+		{"no expiry", "k1", key, func(c map[string]interface{}) { delete(c, "exp") }, "expired"},
+		{"signed by another key", "k1", other, nil, "bad signature"},
+		{"unknown key", "k2", key, nil, `unknown key "k2"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			if tt.change != nil {
+				tt.change(claims)
+			}
+			got, err := p.verifyIDToken(signES256(t, tt.signer, tt.kid, claims))
+			if tt.wantErr != "" {
+				if !errors.Is(err, errInvalidIDToken) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyIDToken() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyIDToken() error = %v", err)
+			}
+			if got.Subject != "u-1" || got.Name != "dev@example.com" || got.Nonce != "n-1" || len(got.Groups) != 1 || got.Groups[0] != "devs" {
+				t.Errorf("verifyIDToken() = %+v", got)
+			}
+		})
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, raw := range []string{"", "a.b", "a.b.c.d", "!.!.!"} {
+			if _, err := p.verifyIDToken(raw); !errors.Is(err, errInvalidIDToken) {
+				t.Errorf("verifyIDToken(%q) error = %v, want errInvalidIDToken", raw, err)
+			}
+		}
+	})
+}
+
+// signES256 encodes the claims as a JWT signed with the key
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": "ES256", "kid": kid}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Ollama serves codellama, qwen and other open models on the team's own
+// machines, for networks without access to the hosted APIs. The base URL
+// comes from the request's endpoint, TESTGEN_OLLAMA_URL or the local
+// default, and no API key is needed.
+
+const (
+	ollamaModel            = "codellama"
+	ollamaLongContextModel = "qwen2.5-coder:32b"
+	defaultOllamaURL       = "http://localhost:11434"
+)
+
+// ollamaProvider calls Ollama's chat API
+type ollamaProvider struct{}
+
+func (ollamaProvider) Name() string { return "ollama" }
+func (ollamaProvider) Tiers() ModelTiers {
+	return ModelTiers{Standard: ollamaModel, LongContext: ollamaLongContextModel}
+}
+
+func (ollamaProvider) DefaultEndpoint() string {
+	if endpoint := os.Getenv("TESTGEN_OLLAMA_URL"); endpoint != "" {
+		return endpoint
+	}
+	return defaultOllamaURL
+}
+
+func (ollamaProvider) KeyOptional() bool { return true }
+
+func (p ollamaProvider) GenerateTests(ctx context.Context, prompt string, opts GenerateOptions) (string, error) {
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = p.DefaultEndpoint()
+	}
+	requestBody := map[string]interface{}{
+		"model": opts.Model,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+		"stream": false,
+		"options": map[string]interface{}{
+			"temperature": 0.7,
+			"num_predict": opts.MaxOutputTokens,
+			// Ollama cuts prompts to a 2048 token window by default
+			"num_ctx": estimateTokens(prompt) + opts.MaxOutputTokens,
+		},
+	}
+
+	// Servers behind an authenticating proxy take the key as a bearer token
+	header := http.Header{}
+	if opts.APIKey != "" {
+		header.Set("Authorization", "Bearer "+opts.APIKey)
+	}
+	body, err := postProvider(ctx, "Ollama", strings.TrimSuffix(endpoint, "/")+"/api/chat", header, requestBody, opts.Meter)
+	if err != nil {
+		return "", err
+	}
+
+	var chat struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		DoneReason      string `json:"done_reason"`
+		PromptEvalCount int    `json:"prompt_eval_count"`
+		EvalCount       int    `json:"eval_count"`
+	}
+	if err := json.Unmarshal(body, &chat); err != nil {
+		return "", errors.New("Failed to parse Ollama response")
+	}
+
+	// Record token usage, falling back to the streamed estimate
+	opts.Meter.record(chat.PromptEvalCount, chat.EvalCount)
+
+	if chat.Message.Content == "" {
+		return "", errors.New("Invalid Ollama response format")
+	}
+	if chat.DoneReason == "length" {
+		return "", fmt.Errorf("Ollama stopped at the limit of %d output tokens", opts.MaxOutputTokens)
+	}
+	return chat.Message.Content, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Onboarding a whole organization: its repositories are listed through the
+// GitHub API, filtered by language and recent activity, and the selected
+// ones are queued to have their contexts built one after the other.
+
+// Pages of 100 repositories fetched at most, GitHub caps listings anyway
+const maxDiscoveryPages = 50
+
+var validOrgName = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,38})$`)
+
+// DiscoveredRepo is a repository found in an organization
+type DiscoveredRepo struct {
+	Name          string    `json:"name"`
+	FullName      string    `json:"fullName"`
+	URL           string    `json:"url"`
+	Language      string    `json:"language,omitempty"`
+	PushedAt      time.Time `json:"pushedAt"`
+	Stars         int       `json:"stars"`
+	SizeKB        int       `json:"sizeKb"`
+	Private       bool      `json:"private"`
+	Fork          bool      `json:"fork"`
+	Archived      bool      `json:"archived"`
+	DefaultBranch string    `json:"defaultBranch"`
+}
+
+// discoverRequest filters the repositories of an organization
+type discoverRequest struct {
+	// Defaults to TESTGEN_GITHUB_TOKEN, public repositories only without one
+	Token string `json:"token,omitempty"`
+	// Primary languages to keep, matched case-insensitively
+	Languages []string `json:"languages,omitempty"`
+	// Keep repositories pushed to within this many days, 0 keeps all
+	ActiveWithinDays int  `json:"activeWithinDays,omitempty"`
+	IncludeForks     bool `json:"includeForks,omitempty"`
+	IncludeArchived  bool `json:"includeArchived,omitempty"`
+}
+
+func (req *discoverRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.min("activeWithinDays", req.ActiveWithinDays, 0)
+	return errs
+}
+
+// onboardRequest queues context builds for repositories of an organization
+type onboardRequest struct {
+	discoverRequest
+	// Repository names to onboard, all repositories matching the filters
+	// when empty
+	Repos []string `json:"repos,omitempty"`
+	// Context build options applied to every repository
+	Options RepoRequest `json:"options"`
+}
+
+func (req *onboardRequest) validate() fieldErrors {
+	errs := req.discoverRequest.validate()
+	// The options are checked as a clone request for a placeholder repository
+	options := req.Options
+	options.RepoURL = "https://github.com/org/repo"
+	options.RepoURLs = nil
+	for _, e := range options.validate() {
+		e.Field = "options." + e.Field
+		errs = append(errs, e)
+	}
+	if req.Options.AccessToken != "" {
+		errs.add("options.accessToken", "unsupported", "options.accessToken is not kept for queued clones, private repositories are cloned with token")
+	}
+	return errs
+}
+
+// Onboarding tracks the context builds queued for an organization
+type Onboarding struct {
+	ID        string           `json:"id"`
+	Org       string           `json:"org"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	Status    string           `json:"status"` // queued, running or done
+	Options   RepoRequest      `json:"options"`
+	Repos     []OnboardingRepo `json:"repos"`
+}
+
+// OnboardingRepo is the state of one repository of an onboarding
+type OnboardingRepo struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Status     string     `json:"status"` // queued, running, done or failed
+	ContextID  string     `json:"contextId,omitempty"`
+	FilesCount int        `json:"filesCount,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+var (
+	onboardingsMu   sync.Mutex
+	onboardingQueue = make(chan string, 64)
+	// Discovery tokens of queued onboardings, kept in memory only. After a
+	// restart clones fall back to TESTGEN_GITHUB_TOKEN.
+	onboardingTokens = map[string]string{}
+)
+
+// onboardingToken returns the token to clone the repositories of an
+// onboarding with
+func onboardingToken(id string) string {
+	onboardingsMu.Lock()
+	token := onboardingTokens[id]
+	onboardingsMu.Unlock()
+	if token == "" {
+		token = os.Getenv("TESTGEN_GITHUB_TOKEN")
+	}
+	return token
+}
+
+// discoverRepositories lists the repositories of an organization, or of a
+// user when no organization has the name, and applies the filters
+func discoverRepositories(org string, req discoverRequest) ([]DiscoveredRepo, error) {
+	token := req.Token
+	if token == "" {
+		token = os.Getenv("TESTGEN_GITHUB_TOKEN")
+	}
+
+	listURL := fmt.Sprintf("%s/orgs/%s/repos?type=all&per_page=100", githubAPIURL(), url.PathEscape(org))
+	repos, err := listGitHubRepos(listURL, token)
+	var notFound *githubNotFoundError
+	if errors.As(err, &notFound) {
+		repos, err = listGitHubRepos(fmt.Sprintf("%s/users/%s/repos?type=owner&per_page=100", githubAPIURL(), url.PathEscape(org)), token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	languages := map[string]bool{}
+	for _, language := range req.Languages {
+		languages[strings.ToLower(language)] = true
+	}
+	var since time.Time
+	if req.ActiveWithinDays > 0 {
+		since = time.Now().AddDate(0, 0, -req.ActiveWithinDays)
+	}
+
+	var kept []DiscoveredRepo
+	for _, repo := range repos {
+		switch {
+		case repo.Fork && !req.IncludeForks,
+			repo.Archived && !req.IncludeArchived,
+			len(languages) > 0 && !languages[strings.ToLower(repo.Language)],
+			repo.PushedAt.Before(since):
+			continue
+		}
+		kept = append(kept, repo)
+	}
+	return kept, nil
+}
+
+type githubNotFoundError struct{ url string }
+
+func (e *githubNotFoundError) Error() string { return "not found: " + e.url }
+
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// listGitHubRepos follows the pages of a GitHub repository listing
+func listGitHubRepos(listURL, token string) ([]DiscoveredRepo, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var repos []DiscoveredRepo
+
+	for page := 0; listURL != "" && page < maxDiscoveryPages; page++ {
+		req, err := http.NewRequest("GET", listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, &githubNotFoundError{listURL}
+		}
+		if resp.StatusCode != http.StatusOK {
+			detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return nil, fmt.Errorf("GitHub API: status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+		}
+
+		var listed []struct {
+			Name          string    `json:"name"`
+			FullName      string    `json:"full_name"`
+			HTMLURL       string    `json:"html_url"`
+			Language      string    `json:"language"`
+			PushedAt      time.Time `json:"pushed_at"`
+			Stars         int       `json:"stargazers_count"`
+			Size          int       `json:"size"`
+			Private       bool      `json:"private"`
+			Fork          bool      `json:"fork"`
+			Archived      bool      `json:"archived"`
+			DefaultBranch string    `json:"default_branch"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&listed)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("GitHub API: %v", err)
+		}
+		for _, r := range listed {
+			repos = append(repos, DiscoveredRepo{
+				Name:          r.Name,
+				FullName:      r.FullName,
+				URL:           r.HTMLURL,
+				Language:      r.Language,
+				PushedAt:      r.PushedAt,
+				Stars:         r.Stars,
+				SizeKB:        r.Size,
+				Private:       r.Private,
+				Fork:          r.Fork,
+				Archived:      r.Archived,
+				DefaultBranch: r.DefaultBranch,
+			})
+		}
+
+		listURL = ""
+		if match := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			listURL = match[1]
+		}
+	}
+	return repos, nil
+}
+
+// updateOnboarding applies a change to a stored onboarding
+func updateOnboarding(id string, update func(*Onboarding)) (*Onboarding, error) {
+	onboardingsMu.Lock()
+	defer onboardingsMu.Unlock()
+	var onboarding Onboarding
+	if err := loadJSON("onboardings", id, &onboarding); err != nil {
+		return nil, err
+	}
+	update(&onboarding)
+	onboarding.UpdatedAt = time.Now().UTC()
+	return &onboarding, saveJSON("onboardings", id, onboarding)
+}
+
+// runOnboardings builds the queued contexts, one repository at a time so
+// an organization does not crowd out interactive clones
+func runOnboardings() {
+	for id := range onboardingQueue {
+		var onboarding Onboarding
+		if err := loadJSON("onboardings", id, &onboarding); err != nil {
+			log.Printf("Warning: Could not load onboarding %s: %v", id, err)
+			continue
+		}
+		updateOnboarding(id, func(o *Onboarding) { o.Status = "running" })
+
+		for i, repo := range onboarding.Repos {
+			if repo.Status != "queued" {
+				continue
+			}
+			updateOnboarding(id, func(o *Onboarding) { o.Repos[i].Status = "running" })
+
+			req := onboarding.Options
+			req.RepoURL = repo.URL
+			req.RepoURLs = nil
+			req.AccessToken = onboardingToken(id)
+			response, err := buildRepoContext(req, nil)
+
+			updateOnboarding(id, func(o *Onboarding) {
+				now := time.Now().UTC()
+				o.Repos[i].FinishedAt = &now
+				if err != nil {
+					o.Repos[i].Status = "failed"
+					o.Repos[i].Error = err.Error()
+					return
+				}
+				o.Repos[i].Status = "done"
+				o.Repos[i].ContextID = response.ContextID
+				o.Repos[i].FilesCount = response.FilesCount
+			})
+			if err != nil {
+				log.Printf("Onboarding %s: %s failed: %v", onboarding.Org, repo.Name, err)
+			}
+		}
+
+		updateOnboarding(id, func(o *Onboarding) { o.Status = "done" })
+		onboardingsMu.Lock()
+		delete(onboardingTokens, id)
+		onboardingsMu.Unlock()
+		log.Printf("Onboarding %s of %s finished", id, onboarding.Org)
+	}
+}
+
+// resumeOnboardings queues the onboardings left unfinished by a restart
+func resumeOnboardings() {
+	ids, err := listJSON("onboardings")
+	if err != nil {
+		log.Printf("Warning: Could not list onboardings: %v", err)
+		return
+	}
+	for _, id := range ids {
+		onboarding, err := updateOnboarding(id, func(o *Onboarding) {
+			for i := range o.Repos {
+				if o.Repos[i].Status == "running" {
+					o.Repos[i].Status = "queued"
+				}
+			}
+		})
+		if err != nil || onboarding.Status == "done" {
+			continue
+		}
+		select {
+		case onboardingQueue <- id:
+		default:
+			log.Printf("Warning: Onboarding queue full, %s not resumed", id)
+		}
+	}
+}
+
+// orgsHandler serves:
+//
+//	POST /api/orgs/{org}/discover           list and filter the repositories
+//	POST /api/orgs/{org}/onboard            queue context builds, 202 Accepted
+//	GET  /api/orgs/{org}/onboardings/{id}   progress of an onboarding
+func orgsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/orgs/"), "/"), "/")
+	if len(parts) < 2 || !validOrgName.MatchString(parts[0]) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	org := parts[0]
+
+	switch {
+	case len(parts) == 2 && parts[1] == "discover":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req discoverRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		repos, err := discoverRepositories(org, req)
+		if err != nil {
+			log.Printf("Error discovering repositories of %s: %v", org, err)
+			http.Error(w, fmt.Sprintf("Failed to list repositories: %v", err), http.StatusBadGateway)
+			return
+		}
+		if repos == nil {
+			repos = []DiscoveredRepo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"org": org, "total": len(repos), "repos": repos})
+
+	case len(parts) == 2 && parts[1] == "onboard":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req onboardRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		repos, err := discoverRepositories(org, req.discoverRequest)
+		if err != nil {
+			log.Printf("Error discovering repositories of %s: %v", org, err)
+			http.Error(w, fmt.Sprintf("Failed to list repositories: %v", err), http.StatusBadGateway)
+			return
+		}
+		onboarding, errs := newOnboarding(org, req, repos)
+		if len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+		if err := saveJSON("onboardings", onboarding.ID, onboarding); err != nil {
+			http.Error(w, "Failed to save onboarding", http.StatusInternalServerError)
+			return
+		}
+		if req.Token != "" {
+			onboardingsMu.Lock()
+			onboardingTokens[onboarding.ID] = req.Token
+			onboardingsMu.Unlock()
+		}
+		select {
+		case onboardingQueue <- onboarding.ID:
+		default:
+			onboardingsMu.Lock()
+			delete(onboardingTokens, onboarding.ID)
+			onboardingsMu.Unlock()
+			deleteJSON("onboardings", onboarding.ID)
+			http.Error(w, "Onboarding queue is full, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Queued onboarding %s of %s: %d repositories", onboarding.ID, org, len(onboarding.Repos))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/v1/orgs/"+org+"/onboardings/"+onboarding.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(onboarding)
+
+	case len(parts) == 3 && parts[1] == "onboardings":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var onboarding Onboarding
+		if err := loadJSON("onboardings", parts[2], &onboarding); err != nil || onboarding.Org != org {
+			if err == nil || errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+				http.Error(w, "Onboarding not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to read onboarding", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(onboarding)
+
+	default:
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+	}
+}
+
+// newOnboarding selects the repositories to onboard
+func newOnboarding(org string, req onboardRequest, discovered []DiscoveredRepo) (*Onboarding, fieldErrors) {
+	byName := map[string]DiscoveredRepo{}
+	for _, repo := range discovered {
+		byName[strings.ToLower(repo.Name)] = repo
+	}
+
+	selected := discovered
+	var errs fieldErrors
+	if len(req.Repos) > 0 {
+		selected = nil
+		for i, name := range req.Repos {
+			repo, ok := byName[strings.ToLower(name)]
+			if !ok {
+				errs.add(fmt.Sprintf("repos[%d]", i), "discovered", "%s is not a repository of %s matching the filters", name, org)
+				continue
+			}
+			selected = append(selected, repo)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(selected) == 0 {
+		errs.add("repos", "required", "no repositories of %s match the filters", org)
+		return nil, errs
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		errs.add("id", "internal", "could not create onboarding id")
+		return nil, errs
+	}
+	now := time.Now().UTC()
+	onboarding := &Onboarding{ID: id, Org: org, CreatedAt: now, UpdatedAt: now, Status: "queued", Options: req.Options}
+	for _, repo := range selected {
+		onboarding.Repos = append(onboarding.Repos, OnboardingRepo{Name: repo.Name, URL: repo.URL, Status: "queued"})
+	}
+	return onboarding, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IDE integrations generate tests for code that is not committed yet. A
+// generation request names a stored context, or carries one, and
+// overrides the files open in unsaved editor buffers. Each override
+// replaces the file's entry in place, in whichever format the context was
+// built, and files the context lacks are added after its last file.
+
+// contextEdit replaces s[start:end] of a context with text
+type contextEdit struct {
+	start, end int
+	text       string
+}
+
+func applyContextEdits(s string, edits []contextEdit) string {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var b strings.Builder
+	last := 0
+	for _, edit := range edits {
+		b.WriteString(s[last:edit.start])
+		b.WriteString(edit.text)
+		last = edit.end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// resolveCodeContext reads the stored context a request names and applies
+// the request's overrides to its code context
+func (req *GeminiRequest) resolveCodeContext() error {
+	if req.ContextID != "" {
+		content, err := os.ReadFile(filepath.Join("repos", req.ContextID+"-context.txt"))
+		if err != nil {
+			return &requestError{http.StatusNotFound, "Context file not found"}
+		}
+		req.CodeContext = string(content)
+	}
+	if len(req.Overrides) > 0 {
+		req.CodeContext = overrideContextFiles(req.CodeContext, req.Overrides)
+	}
+	return nil
+}
+
+// overrideContextFiles replaces or adds the files in a context
+func overrideContextFiles(codeContext string, overrides []FileContent) string {
+	codeContext = normalizeLineEndings(codeContext)
+	pending := map[string]string{}
+	var order []string
+	for _, file := range overrides {
+		filePath, _ := cleanSessionFilePath(file.Path)
+		if _, ok := pending[filePath]; !ok {
+			order = append(order, filePath)
+		}
+		pending[filePath] = normalizeLineEndings(file.Content)
+	}
+	// added lists the overrides without an entry, in request order
+	added := func() []FileContent {
+		var files []FileContent
+		for _, filePath := range order {
+			if content, ok := pending[filePath]; ok {
+				files = append(files, FileContent{Path: filePath, Content: content, Size: len(content)})
+			}
+		}
+		return files
+	}
+
+	if i := strings.Index(codeContext, `{"format":"`+contextJSONFormat+`"`); i != -1 {
+		var doc contextDocument
+		dec := json.NewDecoder(strings.NewReader(codeContext[i:]))
+		if err := dec.Decode(&doc); err == nil {
+			for j, record := range doc.Files {
+				if content, ok := pending[record.Path]; ok {
+					doc.Files[j].Content = content
+					delete(pending, record.Path)
+				}
+			}
+			for _, file := range added() {
+				doc.Files = append(doc.Files, contextRecord{Type: "file", Path: file.Path, Content: file.Content})
+			}
+			return codeContext[:i] + marshalContextJSON(doc) + codeContext[i+int(dec.InputOffset()):]
+		}
+	}
+
+	var edits []contextEdit
+	switch {
+	case strings.Contains(codeContext, jsonlFileRecordStart):
+		insertAt := len(codeContext)
+		offset := 0
+		for _, line := range strings.SplitAfter(codeContext, "\n") {
+			start := offset
+			offset += len(line)
+			if !strings.HasPrefix(line, jsonlFileRecordStart) {
+				continue
+			}
+			insertAt = offset
+			var record contextRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				continue
+			}
+			if content, ok := pending[record.Path]; ok {
+				record.Content = content
+				edits = append(edits, contextEdit{start, start + len(strings.TrimSuffix(line, "\n")), marshalContextJSON(record)})
+				delete(pending, record.Path)
+			}
+		}
+		var text strings.Builder
+		if insertAt == len(codeContext) && !strings.HasSuffix(codeContext, "\n") {
+			text.WriteString("\n")
+		}
+		for _, file := range added() {
+			text.WriteString(marshalContextJSON(contextRecord{Type: "file", Path: file.Path, Content: file.Content}) + "\n")
+		}
+		edits = append(edits, contextEdit{insertAt, insertAt, text.String()})
+
+	case xmlFileOpen.MatchString(codeContext):
+		insertAt := strings.LastIndex(codeContext, "</context>")
+		if insertAt == -1 {
+			insertAt = len(codeContext)
+		}
+		for _, match := range xmlFileOpen.FindAllStringSubmatchIndex(codeContext, -1) {
+			end := strings.Index(codeContext[match[1]:], "\n"+xmlFileClose)
+			if end == -1 {
+				continue
+			}
+			filePath := html.UnescapeString(codeContext[match[2]:match[3]])
+			if content, ok := pending[filePath]; ok {
+				edits = append(edits, contextEdit{match[1], match[1] + end, strings.ReplaceAll(content, xmlFileClose, xmlEscapedFileClose)})
+				delete(pending, filePath)
+			}
+		}
+		var text strings.Builder
+		for _, file := range added() {
+			content := strings.ReplaceAll(file.Content, xmlFileClose, xmlEscapedFileClose)
+			text.WriteString(fmt.Sprintf("<file path=\"%s\">\n%s\n%s\n", html.EscapeString(file.Path), content, xmlFileClose))
+		}
+		edits = append(edits, contextEdit{insertAt, insertAt, text.String()})
+
+	default:
+		// Text contexts, or contexts written by hand without file headers
+		insertAt := len(codeContext)
+		matches := contextFileHeader.FindAllStringSubmatchIndex(codeContext, -1)
+		for i, match := range matches {
+			start := min(match[1]+1, len(codeContext))
+			end := len(codeContext)
+			if i+1 < len(matches) {
+				end = matches[i+1][0]
+			}
+			if start > end {
+				start = end
+			}
+			contentEnd := end
+			if sep := strings.LastIndex(codeContext[start:end], "\n\n---\n"); sep != -1 {
+				contentEnd = start + sep
+				insertAt = contentEnd + len("\n\n---\n")
+			}
+			filePath := strings.TrimSpace(codeContext[match[2]:match[3]])
+			if content, ok := pending[filePath]; ok {
+				edits = append(edits, contextEdit{start, contentEnd, content})
+				delete(pending, filePath)
+			}
+		}
+		var text strings.Builder
+		if insertAt == len(codeContext) && insertAt > 0 && !strings.HasSuffix(codeContext, "\n") {
+			text.WriteString("\n")
+		}
+		for _, file := range added() {
+			text.WriteString(fmt.Sprintf("// File: %s\n%s\n\n---\n", file.Path, file.Content))
+		}
+		edits = append(edits, contextEdit{insertAt, insertAt, text.String()})
+	}
+	return applyContextEdits(codeContext, edits)
+}
+
+func validateOverrides(errs *fieldErrors, overrides []FileContent) {
+	for i, file := range overrides {
+		if _, ok := cleanSessionFilePath(file.Path); !ok {
+			field := fmt.Sprintf("overrides[%d].path", i)
+			errs.add(field, "path", "%s must be a relative path like pkg/handler.go", field)
+		}
+	}
+}
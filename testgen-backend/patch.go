@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A run can be downloaded as a unified diff against the repository, which
+// git apply and CI bots take as it is. New files are added in full, files
+// the generation merged into, such as existing tests or a go.mod, are
+// diffed against their content in the context.
+
+const (
+	patchContextLines = 3
+	// Above this many line pairs the changed middle of a file is replaced
+	// as a whole instead of diffed line by line
+	maxPatchDiffCells = 4 << 20
+)
+
+// diffLine is a line of a file diff, ' ' kept, '-' removed or '+' added.
+// Lines keep their newline, the last line of a file may have none.
+type diffLine struct {
+	op      byte
+	text    string
+	oldLine int // 0-based line numbers, before and after the line
+	newLine int
+}
+
+// patchLines splits file content into lines ending in their newline
+func patchLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffFileLines lines up two versions of a file. Common leading and
+// trailing lines are cut off first, generated changes are mostly appended.
+func diffFileLines(oldContent, newContent string) []diffLine {
+	oldLines, newLines := patchLines(oldContent), patchLines(newContent)
+
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix &&
+		oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	var ops []byte
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, ' ')
+	}
+	ops = append(ops, diffMiddle(oldLines[prefix:len(oldLines)-suffix], newLines[prefix:len(newLines)-suffix])...)
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, ' ')
+	}
+
+	var lines []diffLine
+	oldIndex, newIndex := 0, 0
+	for _, op := range ops {
+		line := diffLine{op: op, oldLine: oldIndex, newLine: newIndex}
+		switch op {
+		case ' ':
+			line.text = oldLines[oldIndex]
+			oldIndex++
+			newIndex++
+		case '-':
+			line.text = oldLines[oldIndex]
+			oldIndex++
+		case '+':
+			line.text = newLines[newIndex]
+			newIndex++
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// diffMiddle is the edit script of the longest common subsequence of two
+// line lists, or a removal and addition of all of them when they are large
+func diffMiddle(oldLines, newLines []string) []byte {
+	n, m := len(oldLines), len(newLines)
+	var ops []byte
+	if n*m > maxPatchDiffCells {
+		for i := 0; i < n; i++ {
+			ops = append(ops, '-')
+		}
+		for j := 0; j < m; j++ {
+			ops = append(ops, '+')
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the common length of oldLines[i:] and newLines[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && oldLines[i] == newLines[j]:
+			ops = append(ops, ' ')
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, '-')
+			i++
+		default:
+			ops = append(ops, '+')
+			j++
+		}
+	}
+	return ops
+}
+
+// writeHunks writes the changed lines of a file diff with their context
+func writeHunks(b *strings.Builder, lines []diffLine) {
+	for start := 0; start < len(lines); {
+		// The next change, with its leading context
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			return
+		}
+		from := max(first-patchContextLines, start)
+
+		// Changes closer than twice the context share a hunk
+		to := first
+		for i := first; i < len(lines); i++ {
+			if lines[i].op != ' ' {
+				to = i + 1
+				continue
+			}
+			if i-to >= 2*patchContextLines {
+				break
+			}
+		}
+		to = min(to+patchContextLines, len(lines))
+
+		oldCount, newCount := 0, 0
+		for _, line := range lines[from:to] {
+			if line.op != '+' {
+				oldCount++
+			}
+			if line.op != '-' {
+				newCount++
+			}
+		}
+		oldStart, newStart := lines[from].oldLine+1, lines[from].newLine+1
+		// An empty side starts at the line before it
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, line := range lines[from:to] {
+			b.WriteByte(line.op)
+			b.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// buildRunPatch is the unified diff of a run's files against the contents
+// they replace, files a run leaves as they are are left out
+func buildRunPatch(run *Run) string {
+	var b strings.Builder
+	for _, artifact := range run.Response.Artifacts {
+		original, exists := run.Originals[artifact.Path]
+		if exists && original == artifact.Content {
+			continue
+		}
+		fmt.Fprintf(&b, "diff --git a/%s b/%s\n", artifact.Path, artifact.Path)
+		if exists {
+			fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", artifact.Path, artifact.Path)
+		} else {
+			fmt.Fprintf(&b, "new file mode 100644\n--- /dev/null\n+++ b/%s\n", artifact.Path)
+		}
+		writeHunks(&b, diffFileLines(original, artifact.Content))
+	}
+	return b.String()
+}
+
+// runOriginals keeps the context contents of the files a run replaces,
+// for its patch
+func runOriginals(artifacts []GeneratedArtifact, codeContext string) map[string]string {
+	paths := map[string]bool{}
+	for _, artifact := range artifacts {
+		paths[artifact.Path] = true
+	}
+	originals := map[string]string{}
+	for _, file := range splitContextFiles(codeContext) {
+		if filePath := slashPath(file.Path); paths[filePath] {
+			originals[filePath] = file.Content
+		}
+	}
+	return originals
+}
@@ -0,0 +1,22 @@
+package main
+
+import "strings"
+
+// Paths are kept with forward slashes and contents with LF line endings
+// from the moment they enter the server, whatever the host OS or the
+// client, so contexts, digests and generated files match across platforms.
+
+// slashPath converts a path from any OS to forward slashes. Unlike
+// filepath.ToSlash it also converts backslashes on Unix hosts, where
+// paths written on Windows clients still arrive with them.
+func slashPath(p string) string {
+	return strings.ReplaceAll(p, "\\", "/")
+}
+
+// normalizeLineEndings converts CRLF and lone CR line endings to LF
+func normalizeLineEndings(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
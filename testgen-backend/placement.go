@@ -0,0 +1,182 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Every test case carries a suggestedPath, the test file it belongs in.
+// The model's suggestion is kept when it fits the repository, a test file
+// in a package or directory the context has. Otherwise the path is derived
+// from the source file that declares the code under test, following the
+// test layout the repository already uses.
+
+var calledName = regexp.MustCompile(`([A-Za-z_$][\w$]*)\s*\(`)
+
+var testDirs = map[string]bool{"__tests__": true, "tests": true, "test": true}
+
+// testLayout is what the context shows of where a repository keeps tests
+type testLayout struct {
+	files    []FileContent
+	dirs     map[string]bool
+	declared map[string]string // source files by declared name, "" when none
+	pyTests  bool              // Python tests live in a top-level tests directory
+	jsNested bool              // JavaScript tests live in __tests__ directories
+	jsSpec   bool              // JavaScript tests are named .spec. rather than .test.
+}
+
+func detectTestLayout(files []FileContent) *testLayout {
+	layout := &testLayout{files: files, dirs: map[string]bool{".": true}, declared: map[string]string{}}
+	for _, file := range files {
+		filePath := slashPath(file.Path)
+		for dir := path.Dir(filePath); dir != "." && !layout.dirs[dir]; dir = path.Dir(dir) {
+			layout.dirs[dir] = true
+		}
+		if !isTestSource(filePath) {
+			continue
+		}
+		base := path.Base(filePath)
+		switch strings.ToLower(path.Ext(filePath)) {
+		case ".py":
+			if strings.HasPrefix(filePath, "tests/") {
+				layout.pyTests = true
+			}
+		case ".js", ".jsx", ".ts", ".tsx", ".mjs":
+			if pathHasDir(filePath, []string{"__tests__"}) {
+				layout.jsNested = true
+			}
+			if strings.Contains(base, ".spec.") {
+				layout.jsSpec = true
+			}
+		}
+	}
+	return layout
+}
+
+// testPathFor is the conventional test file of a source file, or "" for
+// languages without one
+func (layout *testLayout) testPathFor(sourcePath string) string {
+	dir, base := path.Split(sourcePath)
+	ext := path.Ext(base)
+	name := strings.TrimSuffix(base, ext)
+	switch strings.ToLower(ext) {
+	case ".go":
+		// Same directory, so the test compiles into the package
+		return dir + name + "_test.go"
+	case ".py":
+		if layout.pyTests {
+			return "tests/test_" + name + ".py"
+		}
+		return dir + "test_" + name + ".py"
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs":
+		kind := ".test"
+		if layout.jsSpec {
+			kind = ".spec"
+		}
+		if layout.jsNested {
+			return dir + "__tests__/" + name + kind + ext
+		}
+		return dir + name + kind + ext
+	case ".java", ".kt":
+		if strings.Contains("/"+dir, "/src/main/") {
+			dir = strings.Replace("/"+dir, "/src/main/", "/src/test/", 1)[1:]
+		}
+		return dir + name + "Test" + ext
+	}
+	return ""
+}
+
+// fits reports whether a suggested test path belongs to the repository
+func (layout *testLayout) fits(testPath, sourcePath string) bool {
+	if !isTestSource(testPath) {
+		return false
+	}
+	if strings.HasSuffix(testPath, ".go") {
+		// Go tests must be in the package they test
+		if !strings.HasSuffix(testPath, "_test.go") {
+			return false
+		}
+		if sourcePath != "" {
+			return path.Dir(testPath) == path.Dir(sourcePath)
+		}
+		return layout.dirs[path.Dir(testPath)]
+	}
+	if sourcePath != "" && path.Ext(testPath) != path.Ext(sourcePath) {
+		return false
+	}
+	// A test directory right below an existing directory is fine, the
+	// materializer creates it
+	dir := path.Dir(testPath)
+	return layout.dirs[dir] || layout.dirs[path.Dir(dir)] && testDirs[path.Base(dir)]
+}
+
+// declarationOf finds the source file declaring a function or type
+func (layout *testLayout) declarationOf(name string) string {
+	if sourcePath, ok := layout.declared[name]; ok {
+		return sourcePath
+	}
+	layout.declared[name] = ""
+	decl, err := regexp.Compile(`(?m)^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:public\s+|private\s+|protected\s+|static\s+)*` +
+		`(?:func(?:\s*\([^)]*\))?|def|function\*?|class|interface|type|const|let|var|fun)\s+` + regexp.QuoteMeta(name) + `\b`)
+	if err != nil {
+		return ""
+	}
+	for _, file := range layout.files {
+		if !isTestSource(file.Path) && decl.MatchString(file.Content) {
+			layout.declared[name] = slashPath(file.Path)
+			break
+		}
+	}
+	return layout.declared[name]
+}
+
+// sourceOf guesses the source file a test case exercises, from the names
+// called in its code and, failing that, in its name
+func (layout *testLayout) sourceOf(testCase GeminiTestCase) string {
+	for _, text := range []string{testCase.Code, testCase.Name} {
+		for _, match := range calledName.FindAllStringSubmatch(text, -1) {
+			if sourcePath := layout.declarationOf(match[1]); sourcePath != "" {
+				return sourcePath
+			}
+		}
+	}
+	for _, word := range strings.FieldsFunc(testCase.Name, func(r rune) bool { return r == '_' || r == ' ' || r == '.' }) {
+		word = strings.TrimSuffix(strings.TrimPrefix(word, "Test"), "Test")
+		if len(word) < 3 {
+			continue
+		}
+		if sourcePath := layout.declarationOf(word); sourcePath != "" {
+			return sourcePath
+		}
+	}
+	return ""
+}
+
+// placeTestCases sets the suggestedPath of every test case, keeping the
+// model's suggestion where it fits the repository
+func placeTestCases(testCases []GeminiTestCase, codeContext string) {
+	files := splitContextFiles(codeContext)
+	if len(files) == 0 {
+		return
+	}
+	layout := detectTestLayout(files)
+	for i := range testCases {
+		testCase := &testCases[i]
+		suggested := ""
+		if testCase.SuggestedPath != "" {
+			if cleaned, ok := cleanSessionFilePath(testCase.SuggestedPath); ok {
+				suggested = cleaned
+			}
+		}
+		sourcePath := layout.sourceOf(*testCase)
+		switch {
+		case suggested != "" && layout.fits(suggested, sourcePath):
+			testCase.SuggestedPath = suggested
+		case sourcePath != "":
+			testCase.SuggestedPath = layout.testPathFor(sourcePath)
+		default:
+			testCase.SuggestedPath = ""
+		}
+	}
+}
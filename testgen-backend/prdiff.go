@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Generations for a change instead of a whole repository: the base and
+// head commits of a pull request are fetched without a checkout, their
+// trees diffed, and only the changed source files go into the context,
+// with the prompt naming the functions whose lines changed. This is what
+// CI runs on every pull request, the context is the size of the change and
+// not of the repository. Like git diff base head, the tips are compared,
+// a base that moved on since the branch was cut shows its own changes
+// reverted.
+
+// Source files of a change that tests are generated for, configuration,
+// markup and styles are left out
+var changeSourceExts = []string{".go", ".py", ".js", ".jsx", ".mjs", ".ts", ".tsx", ".java", ".kt", ".cs", ".rb", ".php", ".rs", ".swift", ".c", ".cpp", ".vue", ".svelte"}
+
+// Changed files larger than this are left out, as when reading a clone
+const maxChangedFileSize = 1024 * 1024
+
+// Where providers keep the head of a pull request, by the path of its page
+var pullRequestRefs = []struct {
+	provider string
+	path     *regexp.Regexp
+	ref      string
+}{
+	{"github", regexp.MustCompile(`/pull/([0-9]+)(?:[/?#]|$)`), "refs/pull/%s/head"},
+	{"gitlab", regexp.MustCompile(`/-/merge_requests/([0-9]+)(?:[/?#]|$)`), "refs/merge-requests/%s/head"},
+	// Bitbucket Data Center only, Bitbucket Cloud publishes no such refs
+	{"bitbucket", regexp.MustCompile(`/pull-requests/([0-9]+)(?:[/?#]|$)`), "refs/pull-requests/%s/from"},
+}
+
+// diffTestsRequest is the body of POST /api/generate-tests/diff: a
+// repository with two refs or a pull request URL, and the settings of the
+// generation
+type diffTestsRequest struct {
+	GeminiRequest
+	RepoURL string `json:"repoUrl,omitempty"`
+	// Branches, tags, commits or full refs such as refs/pull/12/head
+	Base string `json:"base,omitempty"`
+	Head string `json:"head,omitempty"`
+	// GitHub pull request or GitLab merge request page, the head of the
+	// request is diffed against base or the default branch
+	PullRequestURL string `json:"pullRequestUrl,omitempty"`
+	// Token for fetching from private repositories, never stored or logged
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+func (req *diffTestsRequest) validate() fieldErrors {
+	errs := req.validateGeneration()
+	switch {
+	case req.PullRequestURL != "":
+		if req.RepoURL != "" {
+			errs.add("repoUrl", "excluded_with", "repoUrl and pullRequestUrl are exclusive")
+		}
+		if req.Head != "" {
+			errs.add("head", "excluded_with", "head is read from pullRequestUrl")
+		}
+		if _, _, err := pullRequestHead(req.PullRequestURL); err != nil {
+			errs.add("pullRequestUrl", "pull_request_url", "pullRequestUrl must be a GitHub pull request, GitLab merge request or Bitbucket Data Center pull request URL")
+		}
+	case req.RepoURL != "":
+		if _, err := parseRepoURL(req.RepoURL); err != nil {
+			errs.add("repoUrl", "repo_url", "repoUrl must be a GitHub, GitLab or Bitbucket repository URL like https://github.com/owner/repo")
+		}
+		errs.required("base", req.Base)
+		errs.required("head", req.Head)
+	default:
+		errs.add("repoUrl", "required", "repoUrl with base and head, or pullRequestUrl is required")
+	}
+	if req.Base != "" && !validGitRef(req.Base) {
+		errs.add("base", "ref", "base must be a branch, tag, commit or ref name")
+	}
+	if req.Head != "" && !validGitRef(req.Head) {
+		errs.add("head", "ref", "head must be a branch, tag, commit or ref name")
+	}
+	if req.CodeContext != "" || req.ContextID != "" {
+		errs.add("codeContext", "excluded", "the code context is built from the diff, codeContext and contextId are not taken")
+	}
+	validateAccessToken(&errs, req.AccessToken)
+	return errs
+}
+
+// ChangeHunk is a changed range of a file, numbered like unified diff hunks
+type ChangeHunk struct {
+	OldStart int `json:"oldStart"`
+	OldLines int `json:"oldLines"`
+	NewStart int `json:"newStart"`
+	NewLines int `json:"newLines"`
+}
+
+// ChangeFile is a file a change added, modified, renamed or deleted
+type ChangeFile struct {
+	Path    string `json:"path"`
+	OldPath string `json:"oldPath,omitempty"` // before a rename
+	// added, modified, renamed or deleted
+	Status string       `json:"status"`
+	Hunks  []ChangeHunk `json:"hunks,omitempty"`
+	// Why the file is not in the context: deleted, binary, too-large,
+	// not-source, excluded, test or generated
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// ChangeFunction is a function of the head commit whose lines a change
+// touched
+type ChangeFunction struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"` // Type.Name for Go methods
+	Line    int    `json:"line"`
+	EndLine int    `json:"endLine"`
+}
+
+// ChangeDiff is what changed between the base and head of a request
+type ChangeDiff struct {
+	Repo       string           `json:"repo"` // owner/repo
+	Base       string           `json:"base"`
+	Head       string           `json:"head"`
+	BaseCommit string           `json:"baseCommit"`
+	HeadCommit string           `json:"headCommit"`
+	Files      []ChangeFile     `json:"files"`
+	Functions  []ChangeFunction `json:"functions"`
+}
+
+// DiffTestsResponse is a generation for a change, with the change
+type DiffTestsResponse struct {
+	GeminiResponse
+	Diff *ChangeDiff `json:"diff"`
+}
+
+// diffTestsHandler serves POST /api/generate-tests/diff
+func diffTestsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req diffTestsRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	var loc *RepoLocation
+	var err error
+	head := req.Head
+	if req.PullRequestURL != "" {
+		loc, head, err = pullRequestHead(req.PullRequestURL)
+	} else {
+		loc, err = parseRepoURL(req.RepoURL)
+	}
+	if err != nil {
+		http.Error(w, "Invalid repository URL", http.StatusBadRequest)
+		return
+	}
+
+	diff, files, err := diffChange(loc, req.Base, head, req.AccessToken)
+	if err != nil {
+		log.Printf("Error diffing %s/%s: %v", loc.Owner, loc.Repo, err)
+		writeRequestError(w, err)
+		return
+	}
+	response := DiffTestsResponse{Diff: diff}
+
+	if len(diff.Functions) == 0 && len(files) == 0 {
+		log.Printf("No source changes between %s and %s of %s", diff.Base, diff.Head, diff.Repo)
+		response.TestCases = []GeminiTestCase{}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	gen := req.GeminiRequest
+	extras := contextExtras{Sources: []string{diff.Repo + "@" + diff.HeadCommit}}
+	gen.CodeContext = buildContext(files, extras, "")
+	gen.AdditionalPrompt = changePromptSection(diff) + gen.AdditionalPrompt
+	if gen.Repo == "" && repoRefPattern.MatchString(diff.Repo) {
+		gen.Repo = diff.Repo
+	}
+	if err := gen.resolveCodeContext(); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	log.Printf("Generating tests for %d changed functions in %d files of %s", len(diff.Functions), len(files), diff.Repo)
+
+	response.GeminiResponse, err = generateTests(gen, requestTenant(r, gen.Tenant))
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// pullRequestHead parses a pull or merge request URL into its repository
+// and the ref its provider keeps the head of the request under
+func pullRequestHead(raw string) (*RepoLocation, string, error) {
+	loc, err := parseRepoURL(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, pr := range pullRequestRefs {
+		if pr.provider != loc.Provider || (pr.provider == "bitbucket" && strings.EqualFold(loc.Host, "bitbucket.org")) {
+			continue
+		}
+		if match := pr.path.FindStringSubmatch(raw); match != nil {
+			loc.Ref = ""
+			return loc, fmt.Sprintf(pr.ref, match[1]), nil
+		}
+	}
+	return nil, "", fmt.Errorf("not a pull request URL: %s", raw)
+}
+
+// diffChange fetches the base and head commits of a repository, base
+// defaulting to the default branch, and diffs them. It returns the diff
+// and the changed source files as of head.
+func diffChange(loc *RepoLocation, base, head, accessToken string) (*ChangeDiff, []FileContent, error) {
+	host, _, err := net.SplitHostPort(loc.Host)
+	if err != nil {
+		host = loc.Host
+	}
+	if err := checkEgress(host); err != nil {
+		return nil, nil, err
+	}
+
+	var auth transport.AuthMethod
+	var header string
+	if accessToken != "" {
+		header = providerFor(loc).AuthHeader(loc, accessToken)
+		auth = headerAuth{header: header}
+	}
+	failed := func(err error) error {
+		return errors.New(redactSecrets(err.Error(), accessToken, header))
+	}
+
+	if err := os.MkdirAll("repos", 0755); err != nil {
+		return nil, nil, errors.New("Failed to create repos directory")
+	}
+	clonePath, err := os.MkdirTemp("repos", repoSlug(loc.Owner, loc.Repo)+"-diff-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create clone directory: %v", err)
+	}
+	defer os.RemoveAll(clonePath)
+	storer, _, err := cloneTarget(clonePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := git.Init(storer, nil)
+	if err != nil {
+		return nil, nil, failed(err)
+	}
+
+	baseCommit, headCommit, base, err := fetchChange(repo, providerFor(loc).CloneURL(loc), auth, base, head)
+	if err != nil {
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			return nil, nil, err
+		}
+		return nil, nil, failed(err)
+	}
+	log.Printf("Diffing %s/%s from %s to %s", loc.Owner, loc.Repo, base, head)
+
+	diff := &ChangeDiff{
+		Repo:       loc.Owner + "/" + loc.Repo,
+		Base:       base,
+		Head:       head,
+		BaseCommit: baseCommit.Hash.String(),
+		HeadCommit: headCommit.Hash.String(),
+		Files:      []ChangeFile{},
+		Functions:  []ChangeFunction{},
+	}
+	files, err := diffCommits(diff, baseCommit, headCommit)
+	if err != nil {
+		return nil, nil, failed(err)
+	}
+	return diff, files, nil
+}
+
+// fetchChange fetches the commits of base and head, only them and their
+// trees, and returns the ref base was resolved to
+func fetchChange(repo *git.Repository, cloneURL string, auth transport.AuthMethod, base, head string) (*object.Commit, *object.Commit, string, error) {
+	remote, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{cloneURL}})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if base == "" {
+		if base = remoteDefaultBranch(refs); base == "" {
+			return nil, nil, "", &requestError{http.StatusUnprocessableEntity, "The repository has no default branch, pass base"}
+		}
+	}
+
+	targets := []plumbing.ReferenceName{"refs/testgen/base", "refs/testgen/head"}
+	var specs []config.RefSpec
+	for i, ref := range []string{base, head} {
+		name := findRemoteRef(refs, ref)
+		if strings.HasPrefix(ref, "refs/") {
+			name = ""
+			for _, r := range refs {
+				if r.Name().String() == ref {
+					name = r.Name()
+				}
+			}
+		}
+		if name == "" {
+			return nil, nil, "", &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("No branch, tag, commit or ref %s in the repository", ref)}
+		}
+		specs = append(specs, config.RefSpec(name.String()+":"+targets[i].String()))
+	}
+	err = remote.Fetch(&git.FetchOptions{Auth: auth, RefSpecs: specs, Depth: 1, Tags: git.NoTags})
+	if errors.Is(err, git.ErrExactSHA1NotSupported) {
+		return nil, nil, "", &requestError{http.StatusUnprocessableEntity, "The server does not fetch commits by hash, pass branches, tags or refs as base and head"}
+	}
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, nil, "", err
+	}
+
+	var commits []*object.Commit
+	for _, target := range targets {
+		ref, err := repo.Reference(target, true)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return nil, nil, "", err
+		}
+		commits = append(commits, commit)
+	}
+	return commits[0], commits[1], base, nil
+}
+
+// remoteDefaultBranch is the branch HEAD of a remote points at
+func remoteDefaultBranch(refs []*plumbing.Reference) string {
+	for _, ref := range refs {
+		if ref.Name() != plumbing.HEAD {
+			continue
+		}
+		if ref.Type() == plumbing.SymbolicReference {
+			return ref.Target().Short()
+		}
+		for _, branch := range refs {
+			if branch.Name().IsBranch() && branch.Hash() == ref.Hash() {
+				return branch.Name().Short()
+			}
+		}
+	}
+	return ""
+}
+
+// diffCommits fills in the changed files and functions of a diff and
+// returns the changed source files as of head
+func diffCommits(diff *ChangeDiff, baseCommit, headCommit *object.Commit) ([]FileContent, error) {
+	baseTree, err := baseCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTreeWithOptions(context.Background(), baseTree, headTree, object.DefaultDiffTreeOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileContent
+	for _, change := range changes {
+		from, to, err := change.Files()
+		if err != nil {
+			return nil, err
+		}
+		changed := ChangeFile{Status: "modified"}
+		switch {
+		case from == nil:
+			changed.Path, changed.Status = to.Name, "added"
+		case to == nil:
+			changed.Path, changed.Status, changed.Skipped = from.Name, "deleted", "deleted"
+		default:
+			changed.Path = to.Name
+			if from.Name != to.Name {
+				changed.OldPath, changed.Status = from.Name, "renamed"
+			}
+		}
+		if to != nil {
+			changed.Skipped = changeSkipReason(to)
+		}
+
+		var oldContent, newContent string
+		if from != nil && changed.Skipped == "" {
+			if oldContent, err = from.Contents(); err != nil {
+				return nil, err
+			}
+		}
+		if to != nil && changed.Skipped == "" {
+			if newContent, err = to.Contents(); err != nil {
+				return nil, err
+			}
+			oldContent, newContent = normalizeLineEndings(oldContent), normalizeLineEndings(newContent)
+			changed.Hunks = changeHunks(diffFileLines(oldContent, newContent))
+			file := FileContent{Path: changed.Path, Content: newContent, Size: len(newContent)}
+			if kept, _ := excludeNonAuthoredFiles([]FileContent{file}); len(kept) == 0 {
+				changed.Skipped = "generated"
+			} else if len(changed.Hunks) > 0 {
+				files = append(files, file)
+				diff.Functions = append(diff.Functions, changedFunctions(file, changed.Hunks)...)
+			}
+		}
+		diff.Files = append(diff.Files, changed)
+	}
+	sort.Slice(diff.Files, func(i, j int) bool { return diff.Files[i].Path < diff.Files[j].Path })
+	return files, nil
+}
+
+// changeSkipReason tells why a changed file stays out of the context, or
+// returns "" for the source files tests are generated for
+func changeSkipReason(file *object.File) string {
+	ext := strings.ToLower(path.Ext(file.Name))
+	switch {
+	case !containsString(changeSourceExts, ext):
+		return "not-source"
+	case shouldExcludeFile(file.Name):
+		return "excluded"
+	case isTestSource(file.Name):
+		return "test"
+	case file.Size > maxChangedFileSize:
+		return "too-large"
+	}
+	if binary, err := file.IsBinary(); err != nil || binary {
+		return "binary"
+	}
+	return ""
+}
+
+// changeHunks are the changed ranges of a file diff, without context lines
+func changeHunks(lines []diffLine) []ChangeHunk {
+	var hunks []ChangeHunk
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			i++
+			continue
+		}
+		hunk := ChangeHunk{OldStart: lines[i].oldLine + 1, NewStart: lines[i].newLine + 1}
+		for ; i < len(lines) && lines[i].op != ' '; i++ {
+			if lines[i].op == '-' {
+				hunk.OldLines++
+			} else {
+				hunk.NewLines++
+			}
+		}
+		// An empty side starts at the line before it, as in unified diffs
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+// touches reports whether a hunk changed any of the lines from first to
+// last of the new file. Removed lines touch the lines around them.
+func (h ChangeHunk) touches(first, last int) bool {
+	from, to := h.NewStart, h.NewStart+h.NewLines-1
+	if h.NewLines == 0 {
+		to = h.NewStart + 1
+	}
+	return from <= last && to >= first
+}
+
+// changedFunctions lists the functions of a file any hunk touched. Go
+// files are parsed, Python and JavaScript functions run from their
+// definition to the next one, as for the recursion check, and other
+// languages report none.
+func changedFunctions(file FileContent, hunks []ChangeHunk) []ChangeFunction {
+	var functions []ChangeFunction
+	for _, fn := range fileFunctions(file) {
+		for _, hunk := range hunks {
+			if hunk.touches(fn.Line, fn.EndLine) {
+				functions = append(functions, fn)
+				break
+			}
+		}
+	}
+	return functions
+}
+
+// fileFunctions lists the functions of a file with their lines, doc
+// comments included for Go
+func fileFunctions(file FileContent) []ChangeFunction {
+	var functions []ChangeFunction
+	switch strings.ToLower(path.Ext(file.Path)) {
+	case ".go":
+		fset := token.NewFileSet()
+		parsed, err := parser.ParseFile(fset, file.Path, file.Content, parser.ParseComments|parser.SkipObjectResolution)
+		if err != nil {
+			return nil
+		}
+		for _, decl := range parsed.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			start := fn.Pos()
+			if fn.Doc != nil {
+				start = fn.Doc.Pos()
+			}
+			functions = append(functions, ChangeFunction{
+				Path:    file.Path,
+				Name:    funcDisplayName(fn),
+				Line:    fset.Position(start).Line,
+				EndLine: fset.Position(fn.End()).Line,
+			})
+		}
+		return functions
+	case ".py", ".js", ".ts", ".jsx", ".tsx":
+	default:
+		return nil
+	}
+
+	lines := patchLines(file.Content)
+	lineOf := func(offset int) int { return strings.Count(file.Content[:offset], "\n") + 1 }
+	matches := scriptFuncDecl.FindAllStringSubmatchIndex(file.Content, -1)
+	for i, match := range matches {
+		name := file.Content[match[2]:match[3]]
+		end := len(lines)
+		if i+1 < len(matches) {
+			end = lineOf(matches[i+1][0]) - 1
+		}
+		for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+		functions = append(functions, ChangeFunction{Path: file.Path, Name: name, Line: lineOf(match[2]), EndLine: end})
+	}
+	return functions
+}
+
+// changePromptSection tells the model which functions of the context the
+// change touched, and the changed lines of files without known functions
+func changePromptSection(diff *ChangeDiff) string {
+	var b strings.Builder
+	b.WriteString("=== CHANGE UNDER TEST ===\n\n")
+	fmt.Fprintf(&b, "The code context holds the source files changed between %s (%s) and %s (%s) of %s. ",
+		diff.Base, shortCommit(diff.BaseCommit), diff.Head, shortCommit(diff.HeadCommit), diff.Repo)
+	b.WriteString("Generate tests only for the functions the change added or modified, listed below. The rest of the code is there to understand them and needs no tests of its own.\n\n")
+	withFunctions := map[string]bool{}
+	for _, fn := range diff.Functions {
+		withFunctions[fn.Path] = true
+		if fn.Line == fn.EndLine {
+			fmt.Fprintf(&b, "- %s: %s (line %d)\n", fn.Path, fn.Name, fn.Line)
+		} else {
+			fmt.Fprintf(&b, "- %s: %s (lines %d-%d)\n", fn.Path, fn.Name, fn.Line, fn.EndLine)
+		}
+	}
+	for _, file := range diff.Files {
+		if file.Skipped != "" || withFunctions[file.Path] || len(file.Hunks) == 0 {
+			continue
+		}
+		var ranges []string
+		for _, hunk := range file.Hunks {
+			switch {
+			case hunk.NewLines == 0:
+				ranges = append(ranges, fmt.Sprintf("removed after %d", hunk.NewStart))
+			case hunk.NewLines == 1:
+				ranges = append(ranges, fmt.Sprint(hunk.NewStart))
+			default:
+				ranges = append(ranges, fmt.Sprintf("%d-%d", hunk.NewStart, hunk.NewStart+hunk.NewLines-1))
+			}
+		}
+		fmt.Fprintf(&b, "- %s: changed lines %s\n", file.Path, strings.Join(ranges, ", "))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// shortCommit abbreviates a commit hash like git log --oneline
+func shortCommit(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Files are weighted by how much they tell about the behavior worth
+// testing. Contexts are ordered by weight and, with a budget, the lowest
+// weighted files are left out first.
+const baseFileWeight = 50
+
+var (
+	generatedCodePattern = regexp.MustCompile(`(?m)^(//|#|/\*|--) ?(Code generated .* DO NOT EDIT|@generated|Generated by|This file was automatically generated|auto-generated)`)
+	routePattern         = regexp.MustCompile(`\.(HandleFunc|Handle|GET|POST|PUT|PATCH|DELETE|Get|Post|Put|Patch|Delete|Route|Group)\(\s*["'/]|@(app|router|bp|blueprint)\.(route|get|post|put|patch|delete)\(|@(Get|Post|Put|Patch|Delete|Request)Mapping|\b(app|router)\.(get|post|put|patch|delete|use)\(\s*['"]`)
+)
+
+var entrypointNames = map[string]bool{
+	"main.go": true, "main.py": true, "__main__.py": true, "app.py": true, "manage.py": true,
+	"server.go": true, "server.js": true, "server.ts": true, "index.js": true, "index.ts": true,
+	"app.js": true, "app.ts": true, "main.js": true, "main.ts": true, "main.rs": true, "lib.rs": true,
+	"program.cs": true, "application.java": true,
+}
+
+var (
+	routeDirs     = []string{"routes", "router", "routers", "handlers", "handler", "controllers", "controller", "api", "endpoints"}
+	domainDirs    = []string{"internal", "pkg", "domain", "core", "service", "services", "models", "model", "entities", "usecases"}
+	vendoredDirs  = []string{"vendor", "third_party", "third-party", "external", "bower_components"}
+	migrationDirs = []string{"migrations", "migration", "migrate", "db/migrate", "alembic"}
+)
+
+func pathHasDir(filePath string, dirs []string) bool {
+	slashed := "/" + strings.ToLower(path.Dir(slashPath(filePath))) + "/"
+	for _, dir := range dirs {
+		if strings.Contains(slashed, "/"+dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isVendoredFile reports whether a file is third-party code copied into the repo
+func isVendoredFile(filePath string) bool {
+	return pathHasDir(filePath, vendoredDirs)
+}
+
+// isGeneratedFile reports whether a file was produced by a code generator
+func isGeneratedFile(file FileContent) bool {
+	base := strings.ToLower(filepath.Base(file.Path))
+	if strings.HasSuffix(base, ".pb.go") || strings.HasSuffix(base, "_pb.go") || strings.HasSuffix(base, "_gen.go") ||
+		strings.HasSuffix(base, ".gen.go") || strings.HasSuffix(base, "_generated.go") ||
+		strings.HasSuffix(base, "_pb2.py") || strings.Contains(base, ".generated.") {
+		return true
+	}
+	// Generator markers are in the header
+	head := file.Content
+	if len(head) > 2048 {
+		head = head[:2048]
+	}
+	return generatedCodePattern.MatchString(head)
+}
+
+// isMockFile reports whether a file holds generated or hand-written mocks
+func isMockFile(filePath string) bool {
+	base := strings.ToLower(filepath.Base(filePath))
+	return pathHasDir(filePath, []string{"mocks", "mock", "__mocks__"}) ||
+		strings.HasPrefix(base, "mock_") || strings.HasSuffix(base, "_mock.go") ||
+		strings.HasSuffix(base, "_mocks.go") || strings.HasSuffix(base, ".mock.ts") ||
+		strings.HasSuffix(base, ".mock.js")
+}
+
+// Average line length above which JavaScript and CSS count as minified
+const minifiedLineLength = 300
+
+// isMinifiedFile reports whether a file is a minified or bundled build output
+func isMinifiedFile(file FileContent) bool {
+	base := strings.ToLower(filepath.Base(file.Path))
+	ext := filepath.Ext(base)
+	if ext != ".js" && ext != ".css" && ext != ".mjs" && ext != ".cjs" {
+		return false
+	}
+	if strings.Contains(base, ".min.") || strings.Contains(base, ".bundle.") || strings.Contains(base, ".chunk.") {
+		return true
+	}
+	lines := strings.Count(file.Content, "\n") + 1
+	return len(file.Content) > 2*minifiedLineLength && len(file.Content)/lines > minifiedLineLength
+}
+
+// excludedReason names why a file is left out of contexts by default, or
+// returns "" for files that belong in the context
+func excludedReason(file FileContent) string {
+	switch {
+	case isVendoredFile(file.Path):
+		return "vendored"
+	case isGeneratedFile(file):
+		return "generated"
+	case isMockFile(file.Path):
+		return "mock"
+	case isMinifiedFile(file):
+		return "minified"
+	}
+	return ""
+}
+
+// excludeNonAuthoredFiles removes vendored, generated, mock and minified
+// files, returning the kept files and the paths of the removed ones
+func excludeNonAuthoredFiles(files []FileContent) ([]FileContent, []string) {
+	var kept []FileContent
+	var excluded []string
+	for _, file := range files {
+		if reason := excludedReason(file); reason != "" {
+			excluded = append(excluded, file.Path)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept, excluded
+}
+
+func isMigrationFile(filePath string) bool {
+	return pathHasDir(filePath, migrationDirs)
+}
+
+// fileWeight scores a file, higher is more important for test generation
+func fileWeight(file FileContent) int {
+	weight := baseFileWeight
+	base := strings.ToLower(filepath.Base(file.Path))
+
+	if entrypointNames[base] || pathHasDir(file.Path, []string{"cmd"}) {
+		weight += 30
+	}
+	if pathHasDir(file.Path, routeDirs) || routePattern.MatchString(file.Content) {
+		weight += 30
+	}
+	if pathHasDir(file.Path, domainDirs) {
+		weight += 15
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(base)); ext {
+	case ".json", ".yaml", ".yml", ".toml", ".ini", ".env", ".lock", ".mod", ".sum":
+		weight -= 15
+	case ".css", ".scss", ".sass", ".less", ".html":
+		weight -= 20
+	}
+
+	if isMigrationFile(file.Path) {
+		weight -= 35
+	}
+	if isGeneratedFile(file) || isMockFile(file.Path) || isMinifiedFile(file) {
+		weight -= 40
+	}
+	if isVendoredFile(file.Path) {
+		weight -= 50
+	}
+	return weight
+}
+
+// prioritizeFiles orders files by weight, heaviest first, keeping the
+// repository order between equal weights. With a positive token budget the
+// files that do not fit are dropped, lowest weight first.
+func prioritizeFiles(files []FileContent, budget int) ([]FileContent, []FileContent) {
+	weights := make(map[string]int, len(files))
+	for _, file := range files {
+		weights[file.Path] = fileWeight(file)
+	}
+
+	ordered := append([]FileContent(nil), files...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return weights[ordered[i].Path] > weights[ordered[j].Path]
+	})
+	if budget <= 0 {
+		return ordered, nil
+	}
+
+	var kept, dropped []FileContent
+	used := 0
+	for _, file := range ordered {
+		tokens := estimateTokens(file.Content)
+		if used+tokens > budget {
+			dropped = append(dropped, file)
+			continue
+		}
+		used += tokens
+		kept = append(kept, file)
+	}
+	return kept, dropped
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Version of the generator recorded in the provenance of generated files
+const toolVersion = "1.0.0"
+
+// Provenance traces generated files back to the run that produced them
+type Provenance struct {
+	ToolVersion  string `json:"toolVersion"`
+	Model        string `json:"model,omitempty"` // empty for deterministic output
+	RunID        string `json:"runId,omitempty"`
+	Source       string `json:"source,omitempty"` // owner/repo@sha
+	PromptSHA256 string `json:"promptSha256,omitempty"`
+}
+
+// Source lines written into the context header, in the text, XML and JSONL
+// context formats
+var contextSourceLine = regexp.MustCompile(`(?m)^(?:Source: |<source>|\{"type":"source","content":")([^\s"<]+@[0-9a-f]{7,64})(?:"\}|</source>)?$`)
+
+func newProvenance(model, prompt string) *Provenance {
+	provenance := &Provenance{ToolVersion: toolVersion, Model: model}
+	if prompt != "" {
+		provenance.PromptSHA256 = sha256Hex([]byte(prompt))
+	}
+	return provenance
+}
+
+// contextSources returns the owner/repo@sha sources named in a context
+func contextSources(codeContext string) []string {
+	if doc, ok := decodeJSONContext(codeContext); ok {
+		return doc.Sources
+	}
+	var sources []string
+	for _, match := range contextSourceLine.FindAllStringSubmatch(codeContext, -1) {
+		sources = append(sources, match[1])
+	}
+	return sources
+}
+
+// commentPrefix returns the line comment syntax for a generated file, or
+// "" for files that cannot carry a comment, such as golden files
+func commentPrefix(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".go", ".js", ".mjs", ".ts", ".tsx", ".jsx", ".java", ".kt", ".rs", ".cs", ".swift", ".c", ".cpp", ".php":
+		return "//"
+	case ".py", ".sh", ".rb", ".yaml", ".yml", ".toml":
+		return "#"
+	case ".sql":
+		return "--"
+	}
+	return ""
+}
+
+func (p *Provenance) header(prefix string) string {
+	var header strings.Builder
+	line := func(key, value string) {
+		if value != "" {
+			header.WriteString(prefix + "   " + key + ": " + value + "\n")
+		}
+	}
+	header.WriteString(prefix + " testgen provenance:\n")
+	line("tool", "testgen "+p.ToolVersion)
+	line("model", p.Model)
+	line("run", p.RunID)
+	line("source", p.Source)
+	line("prompt-sha256", p.PromptSHA256)
+	// The blank line keeps the header apart from a package doc comment
+	return header.String() + "\n"
+}
+
+// stampProvenance adds the provenance header to every artifact that can
+// carry a comment, keeping a leading shebang line first
+func stampProvenance(artifacts []GeneratedArtifact, provenance *Provenance) {
+	for i, artifact := range artifacts {
+		prefix := commentPrefix(artifact.Path)
+		if prefix == "" {
+			continue
+		}
+		header := provenance.header(prefix)
+		content := artifact.Content
+		if strings.HasPrefix(content, "#!") {
+			shebang, rest, _ := strings.Cut(content, "\n")
+			artifacts[i].Content = shebang + "\n" + header + rest
+			continue
+		}
+		artifacts[i].Content = header + content
+	}
+}
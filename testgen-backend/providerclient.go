@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Model providers are called through one tuned client. Without timeouts a
+// provider that accepts the connection and never answers holds the handler
+// forever, and pooled keep-alive connections save a TLS handshake per call.
+// The settings are read from the environment variables below.
+type providerClientConfig struct {
+	ConnectTimeout  time.Duration // TESTGEN_PROVIDER_CONNECT_TIMEOUT, dialing and the TLS handshake
+	ReadTimeout     time.Duration // TESTGEN_PROVIDER_READ_TIMEOUT, from sending the request to the response headers
+	Timeout         time.Duration // TESTGEN_PROVIDER_TIMEOUT, the whole call including the body
+	IdleTimeout     time.Duration // TESTGEN_PROVIDER_IDLE_TIMEOUT, keep-alive connections are closed after
+	MaxConnsPerHost int           // TESTGEN_PROVIDER_MAX_CONNS, 0 is unlimited
+	HTTP2           bool          // TESTGEN_PROVIDER_HTTP2, on unless off
+	Retry           providerRetryPolicy
+}
+
+// providerRetryPolicy is how calls answered with 429 or 503, or failing to
+// connect, are retried
+type providerRetryPolicy struct {
+	MaxAttempts int           // TESTGEN_PROVIDER_MAX_ATTEMPTS, 1 never retries
+	BaseDelay   time.Duration // TESTGEN_PROVIDER_RETRY_DELAY, doubled after every attempt
+	MaxDelay    time.Duration // TESTGEN_PROVIDER_MAX_RETRY_DELAY, a longer Retry-After is not waited for
+}
+
+var defaultProviderClientConfig = providerClientConfig{
+	ConnectTimeout:  10 * time.Second,
+	ReadTimeout:     2 * time.Minute,
+	Timeout:         3 * time.Minute,
+	IdleTimeout:     90 * time.Second,
+	MaxConnsPerHost: 32,
+	HTTP2:           true,
+	Retry:           providerRetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 30 * time.Second},
+}
+
+// providerClient calls the model providers. It is replaced at startup, the
+// default keeps calls made before bounded as well.
+var providerClient = newProviderClient(defaultProviderClientConfig)
+
+// providerRetry is replaced at startup along with the client
+var providerRetry = defaultProviderClientConfig.Retry
+
+func loadProviderClientConfig() (providerClientConfig, error) {
+	cfg := defaultProviderClientConfig
+	for name, timeout := range map[string]*time.Duration{
+		"TESTGEN_PROVIDER_CONNECT_TIMEOUT": &cfg.ConnectTimeout,
+		"TESTGEN_PROVIDER_READ_TIMEOUT":    &cfg.ReadTimeout,
+		"TESTGEN_PROVIDER_TIMEOUT":         &cfg.Timeout,
+		"TESTGEN_PROVIDER_IDLE_TIMEOUT":    &cfg.IdleTimeout,
+		"TESTGEN_PROVIDER_RETRY_DELAY":     &cfg.Retry.BaseDelay,
+		"TESTGEN_PROVIDER_MAX_RETRY_DELAY": &cfg.Retry.MaxDelay,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("%s must be a positive duration such as 30s, got %q", name, value)
+		}
+		*timeout = d
+	}
+	if value := os.Getenv("TESTGEN_PROVIDER_MAX_CONNS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("TESTGEN_PROVIDER_MAX_CONNS must be a number of connections, got %q", value)
+		}
+		cfg.MaxConnsPerHost = n
+	}
+	if value := os.Getenv("TESTGEN_PROVIDER_MAX_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 10 {
+			return cfg, fmt.Errorf("TESTGEN_PROVIDER_MAX_ATTEMPTS must be a number of attempts from 1 to 10, got %q", value)
+		}
+		cfg.Retry.MaxAttempts = n
+	}
+	switch value := strings.ToLower(os.Getenv("TESTGEN_PROVIDER_HTTP2")); value {
+	case "", "on":
+	case "off":
+		cfg.HTTP2 = false
+	default:
+		return cfg, fmt.Errorf("TESTGEN_PROVIDER_HTTP2 must be on or off, got %q", value)
+	}
+	if cfg.ReadTimeout > cfg.Timeout {
+		return cfg, errors.New("TESTGEN_PROVIDER_READ_TIMEOUT must not be above TESTGEN_PROVIDER_TIMEOUT")
+	}
+	if cfg.Retry.BaseDelay > cfg.Retry.MaxDelay {
+		return cfg, errors.New("TESTGEN_PROVIDER_RETRY_DELAY must not be above TESTGEN_PROVIDER_MAX_RETRY_DELAY")
+	}
+	return cfg, nil
+}
+
+// newProviderClient builds the client, behind the egress allowlist when one
+// is configured
+func newProviderClient(cfg providerClientConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       cfg.IdleTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+	}
+	if cfg.MaxConnsPerHost == 0 {
+		transport.MaxIdleConnsPerHost = 100
+	}
+	if !cfg.HTTP2 {
+		// A non-nil empty map is what turns HTTP/2 off
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if egressAllowlist != nil {
+		roundTripper = &egressTransport{base: transport}
+	}
+	return &http.Client{Transport: roundTripper, Timeout: cfg.Timeout}
+}
+
+// isTimeout reports whether a provider call failed on one of the timeouts
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryableStatus reports whether a provider answer is worth another try:
+// rate limited, or overloaded for the moment
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// delay is how long to wait before the attempt after the given one, a
+// jittered exponential backoff unless the provider said how long. ok is
+// false when the provider asked for a longer wait than the policy allows.
+func (policy providerRetryPolicy) delay(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	if retryAfter > 0 {
+		return retryAfter, retryAfter <= policy.MaxDelay
+	}
+	backoff := policy.BaseDelay << (attempt - 1)
+	if backoff > policy.MaxDelay || backoff <= 0 {
+		backoff = policy.MaxDelay
+	}
+	// Between half and all of the backoff, so callers limited at the same
+	// time do not come back at the same time
+	return backoff/2 + rand.N(backoff/2+1), true
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// providerBusyError is a provider that still rate limited or was overloaded
+// after the retries. It is answered with the provider's status, 429 or
+// 503, and a Retry-After when known, so clients can tell users to slow
+// down rather than report a failure.
+type providerBusyError struct {
+	label      string
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *providerBusyError) Error() string {
+	reason := "is overloaded"
+	if e.status == http.StatusTooManyRequests {
+		reason = "rate limit or quota is exceeded"
+	}
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("%s API %s, try again in %s", e.label, reason, e.retryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("%s API %s, try again later", e.label, reason)
+}
+
+// Unwrap answers the error with the provider's status
+func (e *providerBusyError) Unwrap() error {
+	return &requestError{e.status, e.Error()}
+}
+
+// retryAfterSeconds is the wait a busy provider asked for, rounded up
+func (e *providerBusyError) retryAfterSeconds() int {
+	return int((e.retryAfter + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pull requests opened with a run's tests get a commit message and a
+// description written for them: what the tests cover, how coverage moves
+// and what reviewers should check before merging. The model only sees a
+// summary of the run, never its code, so the call stays small. Without a
+// model the same sections are filled in from the run alone.
+
+// pullRequestTextRequest is the body of POST /api/runs/{id}/pull-request
+type pullRequestTextRequest struct {
+	// Model settings as for generations, see GeminiRequest
+	Provider        string `json:"provider,omitempty"`
+	APIKey          string `json:"apiKey,omitempty"`
+	KeyAlias        string `json:"keyAlias,omitempty"`
+	Model           string `json:"model,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	Deployment      string `json:"deployment,omitempty"`
+	APIVersion      string `json:"apiVersion,omitempty"`
+	MaxOutputTokens int    `json:"maxOutputTokens,omitempty"`
+	// Language tag of the title and description, the commit message is
+	// always written in English
+	DescriptionLanguage string `json:"descriptionLanguage,omitempty"`
+	// Fill the text in from the run without calling a model
+	Template bool `json:"template,omitempty"`
+}
+
+// generation is the request as a generation request, for its validation
+// and the model call
+func (req *pullRequestTextRequest) generation() GeminiRequest {
+	gen := GeminiRequest{
+		Provider:            req.Provider,
+		APIKey:              req.APIKey,
+		KeyAlias:            req.KeyAlias,
+		Model:               req.Model,
+		Endpoint:            req.Endpoint,
+		Deployment:          req.Deployment,
+		APIVersion:          req.APIVersion,
+		MaxOutputTokens:     req.MaxOutputTokens,
+		DescriptionLanguage: req.DescriptionLanguage,
+	}
+	if req.Template {
+		gen.Mode = "skeleton"
+	}
+	return gen
+}
+
+func (req *pullRequestTextRequest) validate() fieldErrors {
+	gen := req.generation()
+	return gen.validateGeneration()
+}
+
+// PullRequestText is the commit message and pull request of a run
+type PullRequestText struct {
+	CommitMessage string      `json:"commitMessage"`
+	Title         string      `json:"title"`
+	Body          string      `json:"body"`
+	Model         string      `json:"model,omitempty"` // empty when filled in from the run
+	Usage         *TokenUsage `json:"usage,omitempty"`
+	CreatedAt     time.Time   `json:"createdAt"`
+}
+
+// Commit subjects are cut to fit git's one-line views
+const maxCommitSubjectLength = 72
+
+// pullRequestTextHandler serves POST /api/runs/{id}/pull-request
+func pullRequestTextHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pullRequestTextRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	var run Run
+	if err := loadJSON("runs", runID, &run); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+
+	// Written for the accepted test cases of a reviewed run
+	accepted, err := acceptedRun(&run)
+	if err != nil {
+		log.Printf("Error selecting the accepted tests of run %s: %v", run.ID, err)
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+	text, err := writePullRequestText(accepted, req.generation())
+	if err != nil {
+		log.Printf("Error writing pull request text for run %s: %v", run.ID, err)
+		writeRequestError(w, err)
+		return
+	}
+
+	// Read again, the run may have been reviewed during the model call
+	runReviews.Lock()
+	defer runReviews.Unlock()
+	var current Run
+	if err := loadJSON("runs", runID, &current); err != nil {
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+	current.PullRequest = &text
+	if err := saveJSON("runs", current.ID, current); err != nil {
+		log.Printf("Error saving pull request text of run %s: %v", current.ID, err)
+		http.Error(w, "Failed to save pull request text", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(text)
+}
+
+// writePullRequestText writes the text of a run with the request's model,
+// or from the run alone in skeleton mode
+func writePullRequestText(run *Run, req GeminiRequest) (PullRequestText, error) {
+	summary := summarizeRunForPullRequest(run)
+	if req.Mode == "skeleton" {
+		text := templatePullRequestText(summary)
+		text.CreatedAt = time.Now().UTC()
+		return text, nil
+	}
+
+	if err := req.resolveAPIKey(); err != nil {
+		return PullRequestText{}, err
+	}
+	if req.APIKey == "" && req.needsAPIKey() {
+		return PullRequestText{}, &requestError{http.StatusBadRequest, "API Key is required"}
+	}
+	encoded, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return PullRequestText{}, err
+	}
+	prompt := pullRequestPrompt(string(encoded), req.DescriptionLanguage)
+	meter := newTokenMeter(req.MaxOutputTokens)
+	req.Model = req.selectModel(prompt)
+
+	generatedText, err := generateText(req, prompt, meter)
+	if err != nil {
+		return PullRequestText{}, err
+	}
+	jsonStart := strings.Index(generatedText, "{")
+	jsonEnd := strings.LastIndex(generatedText, "}")
+	if jsonStart == -1 || jsonEnd == -1 || jsonStart >= jsonEnd {
+		return PullRequestText{}, &requestError{http.StatusBadGateway, "No valid JSON found in model response"}
+	}
+	var text PullRequestText
+	if err := json.Unmarshal([]byte(generatedText[jsonStart:jsonEnd+1]), &text); err != nil {
+		return PullRequestText{}, &requestError{http.StatusBadGateway, fmt.Sprintf("Failed to parse pull request text from model response: %v", err)}
+	}
+	if strings.TrimSpace(text.CommitMessage) == "" || strings.TrimSpace(text.Title) == "" || strings.TrimSpace(text.Body) == "" {
+		return PullRequestText{}, &requestError{http.StatusBadGateway, "model response lacks a commit message, title or body"}
+	}
+
+	text.CommitMessage = fitCommitSubject(strings.TrimSpace(text.CommitMessage))
+	text.Title = strings.TrimSpace(text.Title)
+	text.Model = req.Model
+	text.Usage = meter.usage()
+	text.Usage.CostUSD = usageCost(text.Usage, req.Model)
+	text.CreatedAt = time.Now().UTC()
+	return text, nil
+}
+
+func pullRequestPrompt(summary, language string) string {
+	languageRule := ""
+	if language != "" {
+		languageRule = fmt.Sprintf("\n- Write the title and body in %s, keep the commit message in English.", languageLabel(language))
+	}
+	return fmt.Sprintf(`Write the commit message and pull request description for adding the generated tests summarized in the JSON below.
+
+Rules:
+- The commit message has a subject of at most %d characters in the imperative mood, such as "Add tests for the order parser", a blank line and a short body listing what the tests cover.
+- The title is a single line. The body is markdown with the sections "## Summary", "## Coverage" and "## Caveats".
+- Summary says what behavior the tests cover, grouped by file, without listing every test.
+- Coverage gives the coverage before and after when the JSON has it, and says coverage was not measured otherwise.
+- Caveats lists every warning, required service and assumed refactor a reviewer must check, or says there are none.
+- Only state what the JSON says. Never invent test results, numbers or files.%s
+
+Return only JSON of the form {"commitMessage": "...", "title": "...", "body": "..."}.
+
+%s`, maxCommitSubjectLength, languageRule, summary)
+}
+
+// pullRequestSummary is what the pull request prompt is told about a run
+type pullRequestSummary struct {
+	RunID     string                `json:"runId"`
+	Source    string                `json:"source,omitempty"`
+	Generated string                `json:"generatedBy"` // model, or "templates" for skeletons
+	Tests     []pullRequestTest     `json:"tests"`
+	Counts    map[string]int        `json:"testsByType,omitempty"`
+	Files     []pullRequestFile     `json:"files,omitempty"`
+	Coverage  []pullRequestCoverage `json:"coverage,omitempty"`
+	Services  []string              `json:"requiredServices,omitempty"`
+	Refactors []RefactorSuggestion  `json:"assumedRefactors,omitempty"`
+	Warnings  []pullRequestWarning  `json:"warnings,omitempty"`
+	Unfilled  bool                  `json:"unfilledSkeletons,omitempty"`
+}
+
+type pullRequestTest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type"`
+	File        string `json:"file,omitempty"`
+}
+
+type pullRequestFile struct {
+	Path        string `json:"path"`
+	Description string `json:"description,omitempty"`
+	Modified    bool   `json:"modified,omitempty"` // an existing file the tests were merged into
+}
+
+type pullRequestCoverage struct {
+	Repo             string  `json:"repo"`
+	Percent          float64 `json:"percent"`
+	ProjectedPercent float64 `json:"projectedPercent"`
+	GapsClosed       int     `json:"untestedFunctionsCovered"`
+}
+
+type pullRequestWarning struct {
+	Kind    string `json:"kind"`
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+// summarizeRunForPullRequest collects what a pull request of the run should
+// mention
+func summarizeRunForPullRequest(run *Run) pullRequestSummary {
+	resp := run.Response
+	summary := pullRequestSummary{RunID: run.ID, Generated: "templates", Counts: resp.Summary.Categories}
+	if resp.Provenance != nil {
+		summary.Source = resp.Provenance.Source
+		if resp.Provenance.Model != "" {
+			summary.Generated = resp.Provenance.Model
+		}
+	}
+
+	services := map[string]bool{}
+	for _, testCase := range resp.TestCases {
+		summary.Tests = append(summary.Tests, pullRequestTest{
+			Name:        testCase.Name,
+			Description: testCase.Description,
+			Type:        testCase.TestType,
+			File:        testCase.SuggestedPath,
+		})
+		for _, service := range testCase.Services {
+			if !services[service] {
+				services[service] = true
+				summary.Services = append(summary.Services, service)
+			}
+		}
+	}
+	for _, artifact := range resp.Artifacts {
+		_, modified := run.Originals[artifact.Path]
+		summary.Files = append(summary.Files, pullRequestFile{Path: artifact.Path, Description: artifact.Description, Modified: modified})
+	}
+	summary.Refactors = resp.RefactorSuggestions
+	for _, warning := range resp.Warnings {
+		if warning.Kind == "fallback" {
+			summary.Unfilled = true
+		}
+		summary.Warnings = append(summary.Warnings, pullRequestWarning{Kind: warning.Kind, File: warning.File, Message: warning.Message})
+	}
+	summary.Coverage = runCoverageDelta(run)
+	return summary
+}
+
+// runCoverageDelta is the static coverage of each source repository of a
+// run, before and with its tests
+func runCoverageDelta(run *Run) []pullRequestCoverage {
+	if run.Response.Provenance == nil || run.Response.Provenance.Source == "" {
+		return nil
+	}
+	var delta []pullRequestCoverage
+	for _, source := range strings.Split(run.Response.Provenance.Source, ",") {
+		owner, repo, _, ok := parseSource(source)
+		if !ok {
+			continue
+		}
+		var history RepoCoverage
+		if err := loadJSON("coverage", coverageID(owner, repo), &history); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Warning: Could not read coverage of %s/%s: %v", owner, repo, err)
+			}
+			continue
+		}
+		for _, sample := range history.Samples {
+			if sample.RunID != run.ID || sample.Method != "static" || sample.ProjectedPercent == nil {
+				continue
+			}
+			delta = append(delta, pullRequestCoverage{
+				Repo:             owner + "/" + repo,
+				Percent:          sample.Percent,
+				ProjectedPercent: *sample.ProjectedPercent,
+				GapsClosed:       sample.ProjectedCovered - sample.Covered,
+			})
+		}
+	}
+	return delta
+}
+
+// templatePullRequestText fills the commit message and description in from
+// the run summary alone
+func templatePullRequestText(summary pullRequestSummary) PullRequestText {
+	var paths []string
+	for _, file := range summary.Files {
+		paths = append(paths, file.Path)
+	}
+	tests := fmt.Sprintf("%d generated tests", len(summary.Tests))
+	if len(summary.Tests) == 1 {
+		tests = "a generated test"
+	}
+	subject := "Add " + tests
+	if len(paths) == 1 {
+		subject += " in " + paths[0]
+	}
+
+	var commit strings.Builder
+	commit.WriteString(fitCommitSubject(subject))
+	commit.WriteString("\n\n")
+	for _, file := range summary.Files {
+		fmt.Fprintf(&commit, "- %s\n", file.Path)
+	}
+	for _, coverage := range summary.Coverage {
+		fmt.Fprintf(&commit, "\nStatic coverage of %s: %.1f%% -> %.1f%%.\n", coverage.Repo, coverage.Percent, coverage.ProjectedPercent)
+	}
+	fmt.Fprintf(&commit, "\nGenerated by testgen run %s.\n", summary.RunID)
+
+	var body strings.Builder
+	body.WriteString("## Summary\n\n")
+	if summary.Generated == "templates" {
+		fmt.Fprintf(&body, "Adds %s filled in from templates", tests)
+	} else {
+		fmt.Fprintf(&body, "Adds %s written by %s", tests, summary.Generated)
+	}
+	if summary.Source != "" {
+		fmt.Fprintf(&body, " for `%s`", summary.Source)
+	}
+	fmt.Fprintf(&body, ", run `%s`.\n\n", summary.RunID)
+	for _, file := range summary.Files {
+		verb := "new"
+		if file.Modified {
+			verb = "extended"
+		}
+		fmt.Fprintf(&body, "- `%s` (%s) %s\n", file.Path, verb, file.Description)
+	}
+	if len(summary.Files) == 0 {
+		for _, test := range summary.Tests {
+			fmt.Fprintf(&body, "- %s: %s\n", test.Name, test.Description)
+		}
+	}
+
+	body.WriteString("\n## Coverage\n\n")
+	if len(summary.Coverage) == 0 {
+		body.WriteString("Coverage was not measured for this run.\n")
+	}
+	for _, coverage := range summary.Coverage {
+		fmt.Fprintf(&body, "- %s: %.1f%% -> %.1f%% (%+.1f points, %d untested functions covered)\n",
+			coverage.Repo, coverage.Percent, coverage.ProjectedPercent, coverage.ProjectedPercent-coverage.Percent, coverage.GapsClosed)
+	}
+
+	body.WriteString("\n## Caveats\n\n")
+	caveats := 0
+	caveat := func(format string, args ...interface{}) {
+		fmt.Fprintf(&body, "- "+format+"\n", args...)
+		caveats++
+	}
+	if summary.Unfilled {
+		caveat("The model call failed, some tests are unfilled skeletons.")
+	}
+	if len(summary.Services) > 0 {
+		caveat("The tests need these services: %s.", strings.Join(summary.Services, ", "))
+	}
+	for _, refactor := range summary.Refactors {
+		caveat("Assumes a refactor: %s", refactor.Description)
+	}
+	for _, warning := range summary.Warnings {
+		if warning.Kind == "fallback" {
+			continue
+		}
+		if warning.File != "" {
+			caveat("%s (`%s`): %s", warning.Kind, warning.File, warning.Message)
+		} else {
+			caveat("%s: %s", warning.Kind, warning.Message)
+		}
+	}
+	if caveats == 0 {
+		body.WriteString("None found. The tests have not been run.\n")
+	}
+
+	return PullRequestText{CommitMessage: commit.String(), Title: fitCommitSubject(subject), Body: body.String()}
+}
+
+// fitCommitSubject cuts the first line of a commit message to
+// maxCommitSubjectLength characters
+func fitCommitSubject(message string) string {
+	subject, rest, _ := strings.Cut(message, "\n")
+	if runes := []rune(subject); len(runes) > maxCommitSubjectLength {
+		subject = strings.TrimSpace(string(runes[:maxCommitSubjectLength-3])) + "..."
+	}
+	if rest == "" {
+		return subject
+	}
+	return subject + "\n" + rest
+}
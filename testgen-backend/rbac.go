@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Access control for team deployments. Users authenticate with a bearer
+// token listed in the access file named by TESTGEN_ACCESS_FILE, or through
+// single sign-on when an OIDC provider is configured. Without either every
+// request is allowed, as for a local single-user setup.
+
+type role string
+
+const (
+	roleViewer     role = "viewer"
+	roleManager    role = "manager"
+	roleMaintainer role = "maintainer"
+	roleAdmin      role = "admin"
+)
+
+type permission string
+
+const (
+	permViewSource permission = "view-source" // read stored contexts, sessions and glossaries
+	permEdit       permission = "edit"        // clone repositories and edit sessions
+	permSpend      permission = "spend-tokens"
+	permConfigure  permission = "configure" // tenant instructions, glossaries and providers
+	permDelete     permission = "delete-data"
+	permAnalytics  permission = "view-analytics" // team metrics across runs
+)
+
+var rolePermissions = map[role][]permission{
+	roleViewer:     {permViewSource},
+	roleManager:    {permViewSource, permAnalytics},
+	roleMaintainer: {permViewSource, permEdit, permSpend, permAnalytics},
+	roleAdmin:      {permViewSource, permEdit, permSpend, permConfigure, permDelete, permAnalytics},
+}
+
+func (r role) can(perm permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name string `json:"name"`
+	Role role   `json:"role"`
+}
+
+type accessUser struct {
+	Name string `json:"name"`
+	Role role   `json:"role"`
+	// Hex SHA-256 of the bearer token, so the file holds no secrets
+	TokenSHA256 string `json:"tokenSha256"`
+}
+
+// accessControl maps token hashes to users, nil disables access control
+type accessControl struct {
+	users map[string]Principal
+	oidc  *oidcProvider
+}
+
+func loadAccessControl(path string) (*accessControl, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Users []accessUser `json:"users"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid access file %s: %v", path, err)
+	}
+
+	ac := &accessControl{users: map[string]Principal{}}
+	for _, user := range file.Users {
+		if _, ok := rolePermissions[user.Role]; !ok {
+			return nil, fmt.Errorf("unknown role %q for user %s", user.Role, user.Name)
+		}
+		hash := strings.ToLower(user.TokenSHA256)
+		if len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid tokenSha256 for user %s", user.Name)
+		}
+		ac.users[hash] = Principal{Name: user.Name, Role: user.Role}
+	}
+	return ac, nil
+}
+
+func (ac *accessControl) authenticate(r *http.Request) (Principal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		if principal, ok := ac.users[hex.EncodeToString(sum[:])]; ok {
+			return principal, true
+		}
+		// API clients may present an ID token from the identity provider
+		if ac.oidc != nil && strings.Count(token, ".") == 2 {
+			claims, err := ac.oidc.verifyIDToken(token)
+			if err != nil {
+				log.Printf("Rejected bearer ID token: %v", err)
+				return Principal{}, false
+			}
+			return ac.oidc.principal(claims)
+		}
+		return Principal{}, false
+	}
+	if ac.oidc != nil {
+		return ac.oidc.sessionPrincipal(r)
+	}
+	return Principal{}, false
+}
+
+// requiredPermission returns the permission an API request needs, or ""
+// for requests any authenticated user may make. Some handlers accept a
+// trailing slash, so the path is matched without them as a precaution.
+func requiredPermission(r *http.Request) permission {
+	path := strings.TrimRight(r.URL.Path, "/")
+	switch {
+	case r.Method == "DELETE" && under(path, "/api/sessions") && strings.Contains(path, "/files/"):
+		return permEdit
+	case path == "/api/keys":
+		// Lists the aliases generations may name
+		return permSpend
+	case under(path, "/api/keys"):
+		return permConfigure
+	case r.Method == "DELETE":
+		return permDelete
+	case path == "/api/clone-repo", path == "/api/jobs":
+		return permEdit
+	case under(path, "/api/jobs"):
+		// Results carry the source of the repositories
+		return permViewSource
+	case path == "/api/generate-tests", path == "/api/generate-tests/diff":
+		return permSpend
+	case under(path, "/api/runs") && strings.HasSuffix(path, "/pull-request"):
+		// Writes the text with a model
+		return permSpend
+	case under(path, "/api/runs") && (strings.HasSuffix(path, "/publish") || strings.HasSuffix(path, "/outcome")):
+		return permEdit
+	case under(path, "/api/runs") && strings.HasSuffix(path, "/review") && r.Method == "POST":
+		return permEdit
+	case under(path, "/api/runs") && strings.HasSuffix(path, "/review/live"):
+		// Live reviewers change the review
+		return permEdit
+	case under(path, "/api/analytics"), path == "/api/usage":
+		return permAnalytics
+	case under(path, "/api/orgs"):
+		if r.Method == "GET" {
+			return permViewSource
+		}
+		return permEdit
+	case under(path, "/api/sandbox") && path != "/api/sandbox":
+		// Compiles and runs the caller's code
+		return permEdit
+	case under(path, "/api/offline"):
+		// Exporting a bundle and importing its responses both write, reading
+		// bundles hands out the source
+		if r.Method == "POST" {
+			return permEdit
+		}
+		return permViewSource
+	case under(path, "/api/tenants"):
+		if r.Method == "GET" {
+			return permViewSource
+		}
+		return permConfigure
+	case under(path, "/api/context") && (strings.HasSuffix(path, "/coverage") || strings.HasSuffix(path, "/refresh")) && r.Method == "POST":
+		return permEdit
+	case under(path, "/api/context") && strings.HasSuffix(path, "/glossary"):
+		if r.Method == "GET" {
+			return permViewSource
+		}
+		return permConfigure
+	case under(path, "/api/context"), under(path, "/api/runs"), under(path, "/api/hooks"), under(path, "/api/ci"):
+		return permViewSource
+	case under(path, "/api/sessions"):
+		if strings.HasSuffix(path, "/generate") {
+			return permSpend
+		}
+		if r.Method == "GET" {
+			return permViewSource
+		}
+		return permEdit
+	}
+	return ""
+}
+
+// under reports whether path is prefix or below it
+func under(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns the authenticated caller, if access control is on
+func requestPrincipal(r *http.Request) (Principal, bool) {
+	principal, ok := r.Context().Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// withAccessControl authenticates API requests and checks the caller's role
+// before handing them to next
+func withAccessControl(next http.Handler, ac *accessControl) http.Handler {
+	if ac == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" || !strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/api/auth/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, ok := ac.authenticate(r)
+		if !ok {
+			enableCORS(w, "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="testgen"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if perm := requiredPermission(r); perm != "" && !principal.Role.can(perm) {
+			log.Printf("Denied %s %s to %s (%s): requires %s", r.Method, r.URL.Path, principal.Name, principal.Role, perm)
+			enableCORS(w, "GET, POST, PUT, DELETE, OPTIONS")
+			http.Error(w, fmt.Sprintf("Role %s may not %s", principal.Role, perm), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// meHandler returns the caller's identity and role
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	principal, ok := requestPrincipal(r)
+	if !ok {
+		// Access control is off, everyone acts as admin
+		principal = Principal{Role: roleAdmin}
+	}
+	var permissions []permission
+	permissions = append(permissions, rolePermissions[principal.Role]...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":        principal.Name,
+		"role":        principal.Role,
+		"permissions": permissions,
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRequiredPermission checks the permission of requests as the server
+// sees them, after the API version is taken off the path. The check trims
+// trailing slashes as a precaution, whether or not the handler accepts
+// them, so routes are also checked with one.
+func TestRequiredPermission(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   permission
+	}{
+		{"GET", "/api/me", ""},
+		{"GET", "/api/versions", ""},
+
+		{"POST", "/api/clone-repo", permEdit},
+		{"POST", "/api/clone-repo/", permEdit},
+		{"POST", "/api/jobs", permEdit},
+		{"POST", "/api/jobs/", permEdit},
+		{"POST", "/api/v1/jobs/", permEdit},
+		{"GET", "/api/jobs/job-1", permViewSource},
+		{"GET", "/api/jobs/job-1/result/", permViewSource},
+		{"DELETE", "/api/jobs/job-1", permDelete},
+
+		{"POST", "/api/generate-tests", permSpend},
+		{"POST", "/api/generate-tests/", permSpend},
+		{"POST", "/api/v1/generate-tests", permSpend},
+		{"POST", "/api/v2/generate-tests/diff/", permSpend},
+
+		{"GET", "/api/sandbox", ""},
+		{"GET", "/api/sandbox/", ""},
+		{"POST", "/api/sandbox/run", permEdit},
+		{"POST", "/api/sandbox/run/", permEdit},
+		{"POST", "/api/v1/sandbox/run/", permEdit},
+
+		{"POST", "/api/offline/bundles", permEdit},
+		{"POST", "/api/offline/bundles/", permEdit},
+		{"POST", "/api/offline/bundles/b-1/responses", permEdit},
+		{"POST", "/api/offline/bundles/b-1/responses/", permEdit},
+		{"POST", "/api/v1/offline/bundles/b-1/responses/", permEdit},
+		{"GET", "/api/offline/bundles/b-1", permViewSource},
+		{"GET", "/api/offline/bundles/b-1/archive/", permViewSource},
+		{"DELETE", "/api/offline/bundles/b-1", permDelete},
+
+		{"GET", "/api/keys", permSpend},
+		{"GET", "/api/keys/", permSpend},
+		{"GET", "/api/v1/keys", permSpend},
+		{"PUT", "/api/keys/payments", permConfigure},
+		{"PUT", "/api/keys/payments/", permConfigure},
+		{"DELETE", "/api/keys/payments", permConfigure},
+
+		{"GET", "/api/runs/r-1", permViewSource},
+		{"GET", "/api/runs/r-1/archive/", permViewSource},
+		{"GET", "/api/runs/r-1/review", permViewSource},
+		{"POST", "/api/runs/r-1/review", permEdit},
+		{"POST", "/api/runs/r-1/review/", permEdit},
+		{"GET", "/api/runs/r-1/review/live", permEdit},
+		{"GET", "/api/v1/runs/r-1/review/live/", permEdit},
+		{"POST", "/api/runs/r-1/publish/", permEdit},
+		{"POST", "/api/runs/r-1/outcome", permEdit},
+		{"POST", "/api/runs/r-1/pull-request", permSpend},
+		{"POST", "/api/v1/runs/r-1/pull-request/", permSpend},
+
+		{"GET", "/api/analytics/teams", permAnalytics},
+		{"GET", "/api/analytics/", permAnalytics},
+		{"GET", "/api/usage", permAnalytics},
+		{"GET", "/api/usage/", permAnalytics},
+
+		{"GET", "/api/orgs/acme/onboardings/o-1", permViewSource},
+		{"POST", "/api/orgs/acme/discover", permEdit},
+		{"POST", "/api/v1/orgs/acme/onboard/", permEdit},
+
+		{"GET", "/api/tenants/acme/instructions", permViewSource},
+		{"PUT", "/api/tenants/acme/instructions/", permConfigure},
+
+		{"GET", "/api/context/ctx-1", permViewSource},
+		{"GET", "/api/context/owner/repo/", permViewSource},
+		{"POST", "/api/context/ctx-1/refresh", permEdit},
+		{"POST", "/api/context/ctx-1/refresh/", permEdit},
+		{"POST", "/api/context/owner/repo/coverage/", permEdit},
+		{"GET", "/api/context/owner/repo/glossary", permViewSource},
+		{"PUT", "/api/context/owner/repo/glossary/", permConfigure},
+
+		{"GET", "/api/hooks/pre-commit", permViewSource},
+		{"GET", "/api/ci/gitlab/", permViewSource},
+
+		{"POST", "/api/sessions", permEdit},
+		{"POST", "/api/sessions/", permEdit},
+		{"GET", "/api/sessions/s-1", permViewSource},
+		{"POST", "/api/sessions/s-1/generate", permSpend},
+		{"POST", "/api/v1/sessions/s-1/generate/", permSpend},
+		{"DELETE", "/api/sessions/s-1/files/main.go", permEdit},
+		{"DELETE", "/api/sessions/s-1", permDelete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var got permission
+			reached := false
+			handler := withAPIVersions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, reached = requiredPermission(r), true
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			if !reached {
+				t.Fatalf("request did not reach the access check")
+			}
+			if got != tt.want {
+				t.Errorf("requiredPermission() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
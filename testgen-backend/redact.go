@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Redaction keeps secrets and proprietary names out of what is sent to the
+// model. Identifiers are swapped for numbered placeholders and swapped back
+// in the generated tests, so the output compiles against the real code.
+// Secrets are never written back, tests should not embed them.
+
+const maxRedactedIdentifiers = 200
+
+var validRedactIdentifier = regexp.MustCompile(`^[A-Za-z0-9_$.-]{3,128}$`)
+
+// Placeholders have a fixed width so Redacted0001 is never read as the
+// start of Redacted00012
+var (
+	redactedPlaceholder = regexp.MustCompile(`[Rr]edacted[0-9]{4}`)
+	secretPlaceholder   = regexp.MustCompile(`^REDACTED_SECRET_[0-9]{4}$`)
+)
+
+// RedactOptions selects what is replaced before a generation is sent to
+// the model
+type RedactOptions struct {
+	// API keys, access tokens, private keys and password literals
+	Secrets bool `json:"secrets,omitempty"`
+	// Proprietary names, replaced wherever they occur, also inside longer
+	// identifiers, and restored in the output
+	Identifiers []string `json:"identifiers,omitempty"`
+}
+
+func (opts *RedactOptions) validate(errs *fieldErrors) {
+	if len(opts.Identifiers) > maxRedactedIdentifiers {
+		errs.add("redact.identifiers", "max", "redact.identifiers must have at most %d entries", maxRedactedIdentifiers)
+	}
+	for i, identifier := range opts.Identifiers {
+		if !validRedactIdentifier.MatchString(identifier) {
+			field := fmt.Sprintf("redact.identifiers[%d]", i)
+			errs.add(field, "identifier", "%s must be 3 to 128 letters, digits, '_', '$', '.' or '-'", field)
+		}
+	}
+}
+
+// RedactionSummary reports what a generation had redacted
+type RedactionSummary struct {
+	Secrets     int `json:"secrets"`
+	Identifiers int `json:"identifiers"`
+	// Placeholders rewritten back to identifiers in the output
+	Restored int `json:"restored"`
+}
+
+// secretPattern finds a kind of secret, group is the submatch holding the
+// secret itself or 0 for the whole match
+type secretPattern struct {
+	re    *regexp.Regexp
+	group int
+}
+
+var secretPatterns = []secretPattern{
+	{re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{re: regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`)},
+	{re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{re: regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`)},
+	{re: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`)},
+	{re: regexp.MustCompile(`\bxox[baprs]-[A-Za-z0-9-]{10,}\b`)},
+	{re: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{re: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\b`)},
+	// Literals assigned to password, secret, token or key variables
+	{re: regexp.MustCompile(`(?i)(?:password|passwd|secret|api[_-]?key|access[_-]?key|auth[_-]?token|token)["']?\s*[:=]\s*["'` + "`" + `]([^"'` + "`" + `\s]{8,})["'` + "`" + `]`), group: 1},
+}
+
+// redactionMap replaces the secrets and identifiers of one generation and
+// restores the identifiers afterwards
+type redactionMap struct {
+	secretsEnabled bool
+	// Matches the identifiers and the placeholders already in the text, so
+	// a short identifier such as "act" never cuts into one
+	identifierPattern *regexp.Regexp
+	// Placeholder number of each identifier, keyed with a lower case first
+	// letter. Numbers start above the placeholders the source already has.
+	numbers    map[string]int
+	numberBase int
+	// Placeholder to identifier, one entry per letter case of the placeholder
+	identifiers map[string]string
+	// Secret to placeholder
+	secrets map[string]string
+	summary RedactionSummary
+}
+
+// redactRequest redacts the code context and prompt of a generation in
+// place. It returns nil when nothing is to be redacted, skeletons never
+// reach a model.
+func redactRequest(req *GeminiRequest) *redactionMap {
+	if req.Redact == nil || req.Mode == "skeleton" || (!req.Redact.Secrets && len(req.Redact.Identifiers) == 0) {
+		return nil
+	}
+	m := &redactionMap{
+		secretsEnabled: req.Redact.Secrets,
+		numbers:        map[string]int{},
+		identifiers:    map[string]string{},
+		secrets:        map[string]string{},
+	}
+	if len(req.Redact.Identifiers) > 0 {
+		// Longest first, so AcmeBillingClient is not cut up by AcmeBilling
+		var variants []string
+		for _, identifier := range req.Redact.Identifiers {
+			variants = append(variants, caseVariants(identifier)...)
+		}
+		sort.Slice(variants, func(i, j int) bool { return len(variants[i]) > len(variants[j]) })
+		alternatives := []string{`REDACTED_SECRET_[0-9]{4}`, redactedPlaceholder.String()}
+		for _, variant := range variants {
+			alternatives = append(alternatives, regexp.QuoteMeta(variant))
+		}
+		m.identifierPattern = regexp.MustCompile(strings.Join(alternatives, "|"))
+		for _, text := range []string{req.CodeContext, req.AdditionalPrompt} {
+			for _, placeholder := range redactedPlaceholder.FindAllString(text, -1) {
+				if number, _ := strconv.Atoi(placeholder[len("redacted"):]); number > m.numberBase {
+					m.numberBase = number
+				}
+			}
+		}
+	}
+
+	req.CodeContext = m.redact(req.CodeContext)
+	req.AdditionalPrompt = m.redact(req.AdditionalPrompt)
+	log.Printf("Redacted %d secrets and %d identifiers before generation", m.summary.Secrets, m.summary.Identifiers)
+	return m
+}
+
+func (m *redactionMap) redact(text string) string {
+	if text == "" {
+		return text
+	}
+	if m.secretsEnabled {
+		for _, pattern := range secretPatterns {
+			text = m.redactSecrets(text, pattern)
+		}
+	}
+	if m.identifierPattern == nil {
+		return text
+	}
+	return m.identifierPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if secretPlaceholder.MatchString(match) || redactedPlaceholder.MatchString(match) {
+			return match
+		}
+		first, size := utf8.DecodeRuneInString(match)
+		key := string(unicode.ToLower(first)) + match[size:]
+		number, ok := m.numbers[key]
+		if !ok {
+			m.summary.Identifiers++
+			number = m.numberBase + m.summary.Identifiers
+			m.numbers[key] = number
+		}
+		placeholder := casedPlaceholder(match, number)
+		m.identifiers[placeholder] = match
+		return placeholder
+	})
+}
+
+func (m *redactionMap) redactSecrets(text string, pattern secretPattern) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range pattern.re.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2*pattern.group], match[2*pattern.group+1]
+		if start < 0 {
+			continue
+		}
+		secret := text[start:end]
+		if secretPlaceholder.MatchString(secret) {
+			continue
+		}
+		placeholder, ok := m.secrets[secret]
+		if !ok {
+			m.summary.Secrets++
+			placeholder = fmt.Sprintf("REDACTED_SECRET_%04d", m.summary.Secrets)
+			m.secrets[secret] = placeholder
+		}
+		out.WriteString(text[last:start])
+		out.WriteString(placeholder)
+		last = end
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// caseVariants returns an identifier as given and with its first letter
+// flipped, as exported and unexported Go names or a type and its instance
+func caseVariants(identifier string) []string {
+	first, size := utf8.DecodeRuneInString(identifier)
+	var flipped rune
+	if unicode.IsUpper(first) {
+		flipped = unicode.ToLower(first)
+	} else {
+		flipped = unicode.ToUpper(first)
+	}
+	if flipped == first {
+		return []string{identifier}
+	}
+	return []string{identifier, string(flipped) + identifier[size:]}
+}
+
+// casedPlaceholder keeps the case of the first letter, which decides
+// whether a Go name is exported
+func casedPlaceholder(identifier string, number int) string {
+	first, _ := utf8.DecodeRuneInString(identifier)
+	if unicode.IsUpper(first) {
+		return fmt.Sprintf("Redacted%04d", number)
+	}
+	return fmt.Sprintf("redacted%04d", number)
+}
+
+// restore rewrites the identifier placeholders of a response back to the
+// identifiers, in every field from test names to artifact contents
+func (m *redactionMap) restore(testResponse *GeminiResponse) {
+	if m == nil {
+		return
+	}
+	if len(m.identifiers) > 0 {
+		encoded, err := json.Marshal(testResponse)
+		if err != nil {
+			log.Printf("Warning: Could not restore redacted identifiers: %v", err)
+			return
+		}
+		restored := redactedPlaceholder.ReplaceAllStringFunc(string(encoded), func(placeholder string) string {
+			if original, ok := m.identifiers[placeholder]; ok {
+				m.summary.Restored++
+				return original
+			}
+			return placeholder
+		})
+		var response GeminiResponse
+		if err := json.Unmarshal([]byte(restored), &response); err != nil {
+			log.Printf("Warning: Could not restore redacted identifiers: %v", err)
+			return
+		}
+		// Token probabilities are not encoded
+		for i := range response.TestCases {
+			response.TestCases[i].tokenProb = testResponse.TestCases[i].tokenProb
+		}
+		*testResponse = response
+	}
+	summary := m.summary
+	testResponse.Redaction = &summary
+}
+
+// restoreTestCase restores the identifiers of a test case streamed before
+// the response is complete, without counting them
+func (m *redactionMap) restoreTestCase(testCase GeminiTestCase) GeminiTestCase {
+	if m == nil || len(m.identifiers) == 0 {
+		return testCase
+	}
+	encoded, err := json.Marshal(testCase)
+	if err != nil {
+		return testCase
+	}
+	restored := redactedPlaceholder.ReplaceAllStringFunc(string(encoded), func(placeholder string) string {
+		if original, ok := m.identifiers[placeholder]; ok {
+			return original
+		}
+		return placeholder
+	})
+	var restoredCase GeminiTestCase
+	if err := json.Unmarshal([]byte(restored), &restoredCase); err != nil {
+		return testCase
+	}
+	return restoredCase
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// During iterative development only a few files change between builds.
+// POST /api/context/{id}/refresh fetches the named files again from the
+// head of the repository and replaces just their entries in the stored
+// context, the rest of it stays as built. The summary and version that
+// depend on the files are rebuilt with it.
+
+const maxRefreshPaths = 200
+
+// ContextBuild records what a stored context was built from, so files can
+// be refreshed without the original request
+type ContextBuild struct {
+	ContextID string        `json:"contextId"`
+	Request   RepoRequest   `json:"request"` // without the access token
+	Extras    contextExtras `json:"extras"`
+	Version   string        `json:"version,omitempty"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+type contextRefreshRequest struct {
+	Paths []string `json:"paths"`
+	// Token for private repositories, the build's token was not kept
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+func (req *contextRefreshRequest) validate() fieldErrors {
+	var errs fieldErrors
+	if len(req.Paths) == 0 {
+		errs.add("paths", "required", "paths is required")
+	}
+	if len(req.Paths) > maxRefreshPaths {
+		errs.add("paths", "max", "paths must have at most %d entries", maxRefreshPaths)
+	}
+	for i, filePath := range req.Paths {
+		if _, ok := cleanSessionFilePath(filePath); !ok {
+			field := fmt.Sprintf("paths[%d]", i)
+			errs.add(field, "path", "%s must be a relative path like pkg/handler.go", field)
+		}
+	}
+	validateAccessToken(&errs, req.AccessToken)
+	return errs
+}
+
+// ContextRefreshResponse lists what a refresh did to each path
+type ContextRefreshResponse struct {
+	ContextID  string   `json:"contextId"`
+	Version    string   `json:"version,omitempty"`
+	FilesCount int      `json:"filesCount"`
+	Updated    []string `json:"updated,omitempty"`
+	Added      []string `json:"added,omitempty"`   // not in the context before, such as files left out by the budget
+	Removed    []string `json:"removed,omitempty"` // deleted or excluded at the head
+	Unchanged  []string `json:"unchanged,omitempty"`
+	Missing    []string `json:"missing,omitempty"` // neither in the context nor at the head
+}
+
+// Refreshes of one context would otherwise overwrite each other's entries
+var contextRefreshes sync.Mutex
+
+// contextBuildID is the store id of a context's build. Multi-repo context
+// ids can be longer than store ids and contain +, they are hashed.
+func contextBuildID(contextID string) string {
+	if validStoreID.MatchString(contextID) {
+		return contextID
+	}
+	sum := sha256.Sum256([]byte(contextID))
+	return hex.EncodeToString(sum[:20])
+}
+
+// saveContextBuild records the request and extras a context was built with
+func saveContextBuild(contextID string, req RepoRequest, extras contextExtras, version string) error {
+	req.AccessToken = ""
+	return saveJSON("context-builds", contextBuildID(contextID), ContextBuild{
+		ContextID: contextID,
+		Request:   req,
+		Extras:    extras,
+		Version:   version,
+		UpdatedAt: time.Now().UTC(),
+	})
+}
+
+func contextRefreshHandler(w http.ResponseWriter, r *http.Request, contextID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validContextID.MatchString(contextID) {
+		http.Error(w, "Invalid context id", http.StatusBadRequest)
+		return
+	}
+
+	var req contextRefreshRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	response, err := refreshContext(contextID, req)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// refreshContext fetches the paths from the repositories of a context and
+// rewrites the context with their current content
+func refreshContext(contextID string, req contextRefreshRequest) (*ContextRefreshResponse, error) {
+	var build ContextBuild
+	if err := loadJSON("context-builds", contextBuildID(contextID), &build); err != nil || build.ContextID != contextID {
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil, &requestError{http.StatusNotFound, "No refreshable context " + contextID + ", clone the repository again"}
+		}
+		return nil, err
+	}
+
+	// Each path belongs to one repository of the context
+	repoURLs := build.Request.repoURLs()
+	locations := make([]*RepoLocation, len(repoURLs))
+	for i, repoURL := range repoURLs {
+		loc, err := parseRepoURL(repoURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid repository URL %s in the build of %s", repoURL, contextID)
+		}
+		locations[i] = loc
+	}
+	requested := map[int][]string{}
+	var paths []string
+	seen := map[string]bool{}
+	for _, filePath := range req.Paths {
+		filePath, _ = cleanSessionFilePath(filePath)
+		if seen[filePath] {
+			continue
+		}
+		seen[filePath] = true
+		paths = append(paths, filePath)
+		repo := 0
+		if len(repoURLs) > 1 {
+			repo = -1
+			for i, loc := range locations {
+				if strings.HasPrefix(filePath, loc.Owner+"/"+loc.Repo+"/") {
+					repo = i
+				}
+			}
+			if repo == -1 {
+				return nil, &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("Path %s is in none of the repositories of %s", filePath, contextID)}
+			}
+		}
+		requested[repo] = append(requested[repo], filePath)
+	}
+
+	// Fetched before taking the lock, a clone can take a while
+	reposDir := "repos"
+	if err := os.MkdirAll(reposDir, 0755); err != nil {
+		return nil, errors.New("Failed to create repos directory")
+	}
+	cloneReq := build.Request
+	cloneReq.AccessToken = req.AccessToken
+	fresh := map[string]FileContent{}
+	heads := map[string]string{}
+	for i, repoURL := range repoURLs {
+		if len(requested[i]) == 0 {
+			continue
+		}
+		ref, subPath := "", ""
+		if i == 0 && build.Request.RepoURL != "" {
+			ref = build.Request.Ref
+			subPath, _ = cleanSubPath(build.Request.SubPath)
+		}
+		snapshot, err := snapshotRepository(reposDir, repoURL, ref, subPath, cloneReq, nil)
+		if err != nil {
+			return nil, err
+		}
+		heads[snapshot.Owner+"/"+snapshot.Repo] = snapshot.Commit
+		if build.Request.GoMode == "api" {
+			snapshot.Files, _ = extractGoAPI(snapshot.Files)
+		}
+		for _, file := range snapshot.Files {
+			if len(repoURLs) > 1 {
+				file.Path = snapshot.Owner + "/" + snapshot.Repo + "/" + file.Path
+			}
+			fresh[file.Path] = file
+		}
+	}
+
+	contextRefreshes.Lock()
+	defer contextRefreshes.Unlock()
+
+	contextPath := filepath.Join(reposDir, contextID+"-context.txt")
+	content, err := os.ReadFile(contextPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &requestError{http.StatusNotFound, "Context file not found"}
+		}
+		return nil, errors.New("Failed to read context file")
+	}
+	files := splitContextFiles(string(content))
+
+	response := &ContextRefreshResponse{ContextID: contextID}
+	for _, filePath := range paths {
+		index := -1
+		for i, file := range files {
+			if file.Path == filePath {
+				index = i
+				break
+			}
+		}
+		file, ok := fresh[filePath]
+		switch {
+		case ok && index == -1:
+			files = append(files, file)
+			response.Added = append(response.Added, filePath)
+		case ok && files[index].Content == file.Content:
+			response.Unchanged = append(response.Unchanged, filePath)
+		case ok:
+			files[index] = file
+			response.Updated = append(response.Updated, filePath)
+		case index != -1:
+			files = append(files[:index], files[index+1:]...)
+			response.Removed = append(response.Removed, filePath)
+		default:
+			response.Missing = append(response.Missing, filePath)
+		}
+	}
+	response.FilesCount = len(files)
+	changed := len(response.Updated) + len(response.Added) + len(response.Removed)
+	if changed == 0 {
+		response.Version = build.Version
+		return response, nil
+	}
+
+	// The summary is derived from the files, the rest of the extras stay
+	// as built, including the commits the context names as its source
+	extras := build.Extras
+	if !build.Request.SkipSummary {
+		extras.Summary = renderSummary(summarizeProject(files))
+	}
+	updated := buildContext(files, extras, build.Request.Format)
+	if err := os.WriteFile(contextPath, []byte(updated), 0644); err != nil {
+		log.Printf("Error saving context file: %v", err)
+		return nil, errors.New("Failed to save context file")
+	}
+
+	// The new version takes the head commits of the refreshed repositories
+	var previous ContextVersion
+	if build.Version != "" {
+		if err := loadJSON("context-versions", build.Version, &previous); err != nil {
+			log.Printf("Warning: Could not read context version %s: %v", build.Version, err)
+		}
+	}
+	var snapshots []*repoSnapshot
+	for _, loc := range locations {
+		repo := loc.Owner + "/" + loc.Repo
+		commit := heads[repo]
+		if commit == "" {
+			commit = previous.Commits[repo]
+		}
+		snapshots = append(snapshots, &repoSnapshot{Host: loc.Host, Owner: loc.Owner, Repo: loc.Repo, Commit: commit})
+	}
+	version, err := saveContextVersion(contextID, snapshots, files)
+	if err != nil {
+		log.Printf("Warning: Could not save context version: %v", err)
+	}
+	response.Version = version
+
+	build.Extras = extras
+	build.Version = version
+	build.UpdatedAt = time.Now().UTC()
+	if err := saveJSON("context-builds", contextBuildID(contextID), build); err != nil {
+		log.Printf("Warning: Could not save context build: %v", err)
+	}
+
+	log.Printf("Refreshed %d of %d files of context %s", changed, len(paths), contextID)
+	return response, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Repositories can be cloned from GitHub, GitLab and Bitbucket, in the
+// cloud or self-hosted. Each provider knows the URL layout of its web UI
+// and where to clone from.
+
+// RepoLocation identifies a repository on a hosting provider
+type RepoLocation struct {
+	Provider string
+	Host     string
+	Owner    string // GitLab groups may be nested, as group/subgroup
+	Repo     string
+	Ref      string // branch, tag or commit from a tree or src URL, empty for the default branch
+}
+
+// RepoProvider parses the repository URLs of one hosting provider
+type RepoProvider interface {
+	Name() string
+	// Matches reports whether the provider serves a host
+	Matches(host string) bool
+	// Parse reads the repository from the path of a URL on a matching host
+	Parse(u *url.URL) (*RepoLocation, error)
+	CloneURL(loc *RepoLocation) string
+	// AuthHeader is the HTTP Authorization header cloning with an access
+	// token sends
+	AuthHeader(loc *RepoLocation, token string) string
+}
+
+var repoProviders = []RepoProvider{githubProvider{}, gitlabProvider{}, bitbucketProvider{}}
+
+var errUnknownHost = errors.New("not a GitHub, GitLab or Bitbucket host")
+
+// selfHostedHosts reads a comma separated host list from an environment
+// variable, for GitHub Enterprise, GitLab and Bitbucket Data Center servers
+func selfHostedHosts(name string) []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv(name), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func hostListed(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// scpLikeURL matches the SSH shorthand git@host:owner/repo.git
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@([A-Za-z0-9.-]+):(.+)$`)
+
+// parseRepoURL finds the provider of a repository URL and parses it. URLs
+// without a scheme and SSH clone URLs are accepted too.
+func parseRepoURL(raw string) (*RepoLocation, error) {
+	raw = strings.TrimSpace(raw)
+	if match := scpLikeURL.FindStringSubmatch(raw); match != nil {
+		raw = "https://" + match[1] + "/" + match[2]
+	} else if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid repository URL: %s", raw)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, provider := range repoProviders {
+		if !provider.Matches(host) {
+			continue
+		}
+		loc, err := provider.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if loc.Ref != "" && !validGitRef(loc.Ref) {
+			return nil, fmt.Errorf("invalid ref %q", loc.Ref)
+		}
+		loc.Provider = provider.Name()
+		loc.Host = u.Host
+		return loc, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownHost, host)
+}
+
+// gitRefChars are the characters allowed in branch, tag and commit names.
+// Git allows more, but these cover real names without letting a ref pass
+// for an option or a refspec.
+var gitRefChars = regexp.MustCompile(`^[A-Za-z0-9._/+@-]{1,255}$`)
+
+// commitSHA matches full and abbreviated commit hashes
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+func validGitRef(ref string) bool {
+	return gitRefChars.MatchString(ref) && !strings.HasPrefix(ref, "-") && !strings.Contains(ref, "..") &&
+		!strings.HasSuffix(ref, "/") && !strings.HasSuffix(ref, ".lock")
+}
+
+// providerFor returns the provider of a parsed location
+func providerFor(loc *RepoLocation) RepoProvider {
+	for _, provider := range repoProviders {
+		if provider.Name() == loc.Provider {
+			return provider
+		}
+	}
+	return nil
+}
+
+// pathSegments splits a URL path, dropping empty segments
+func pathSegments(u *url.URL) []string {
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+func trimGitSuffix(repo string) string {
+	return strings.TrimSuffix(repo, ".git")
+}
+
+func invalidRepoPath(provider string, u *url.URL) error {
+	return fmt.Errorf("invalid %s repository URL: %s", provider, u.String())
+}
+
+func basicAuth(user, token string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+token))
+}
+
+// repoSlug names a repository in context ids and store ids
+func repoSlug(owner, repo string) string {
+	return fmt.Sprintf("%s-%s", strings.ReplaceAll(owner, "/", "-"), repo)
+}
+
+// githubProvider parses github.com/owner/repo, optionally followed by
+// /tree/<branch> or /blob/<branch>/<path>
+type githubProvider struct{}
+
+func (githubProvider) Name() string { return "github" }
+
+func (githubProvider) Matches(host string) bool {
+	return host == "github.com" || host == "www.github.com" || hostListed(host, selfHostedHosts("TESTGEN_GITHUB_HOSTS"))
+}
+
+func (githubProvider) Parse(u *url.URL) (*RepoLocation, error) {
+	segments := pathSegments(u)
+	if len(segments) < 2 {
+		return nil, invalidRepoPath("GitHub", u)
+	}
+	loc := &RepoLocation{Owner: segments[0], Repo: trimGitSuffix(segments[1])}
+	if len(segments) > 3 {
+		switch segments[2] {
+		case "tree":
+			// Branch names may contain slashes, as in feature/login
+			loc.Ref = strings.Join(segments[3:], "/")
+		case "blob":
+			loc.Ref = segments[3]
+		}
+	}
+	return loc, nil
+}
+
+func (githubProvider) CloneURL(loc *RepoLocation) string {
+	return fmt.Sprintf("https://%s/%s/%s.git", loc.Host, loc.Owner, loc.Repo)
+}
+
+// Personal access tokens and GitHub App installation tokens both work as
+// the password of any user name
+func (githubProvider) AuthHeader(loc *RepoLocation, token string) string {
+	return basicAuth("x-access-token", token)
+}
+
+// gitlabProvider parses gitlab.com/group/subgroup/project, optionally
+// followed by /-/tree/<branch> or /-/blob/<branch>/<path>
+type gitlabProvider struct{}
+
+func (gitlabProvider) Name() string { return "gitlab" }
+
+func (gitlabProvider) Matches(host string) bool {
+	return host == "gitlab.com" || strings.HasPrefix(host, "gitlab.") || hostListed(host, selfHostedHosts("TESTGEN_GITLAB_HOSTS"))
+}
+
+func (gitlabProvider) Parse(u *url.URL) (*RepoLocation, error) {
+	segments := pathSegments(u)
+	project := segments
+	var rest []string
+	for i, segment := range segments {
+		if segment == "-" {
+			project, rest = segments[:i], segments[i+1:]
+			break
+		}
+	}
+	if len(project) < 2 {
+		return nil, invalidRepoPath("GitLab", u)
+	}
+	loc := &RepoLocation{
+		Owner: strings.Join(project[:len(project)-1], "/"),
+		Repo:  trimGitSuffix(project[len(project)-1]),
+	}
+	if len(rest) > 1 {
+		switch rest[0] {
+		case "tree":
+			loc.Ref = strings.Join(rest[1:], "/")
+		case "blob":
+			loc.Ref = rest[1]
+		}
+	}
+	return loc, nil
+}
+
+func (gitlabProvider) CloneURL(loc *RepoLocation) string {
+	return fmt.Sprintf("https://%s/%s/%s.git", loc.Host, loc.Owner, loc.Repo)
+}
+
+func (gitlabProvider) AuthHeader(loc *RepoLocation, token string) string {
+	return basicAuth("oauth2", token)
+}
+
+// bitbucketProvider parses Bitbucket Cloud URLs, bitbucket.org/workspace/repo
+// optionally followed by /src/<branch> or /branch/<branch>, and Bitbucket
+// Data Center URLs, /projects/KEY/repos/slug with the branch in ?at= or
+// /scm/key/slug.git
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) Name() string { return "bitbucket" }
+
+func (bitbucketProvider) Matches(host string) bool {
+	return host == "bitbucket.org" || hostListed(host, selfHostedHosts("TESTGEN_BITBUCKET_HOSTS"))
+}
+
+func (bitbucketProvider) Parse(u *url.URL) (*RepoLocation, error) {
+	segments := pathSegments(u)
+	if !strings.EqualFold(u.Hostname(), "bitbucket.org") {
+		switch {
+		case len(segments) >= 4 && segments[0] == "projects" && segments[2] == "repos":
+			loc := &RepoLocation{Owner: segments[1], Repo: trimGitSuffix(segments[3])}
+			loc.Ref = strings.TrimPrefix(strings.TrimPrefix(u.Query().Get("at"), "refs/heads/"), "refs/tags/")
+			return loc, nil
+		case len(segments) >= 3 && segments[0] == "scm":
+			return &RepoLocation{Owner: segments[1], Repo: trimGitSuffix(segments[2])}, nil
+		}
+		return nil, invalidRepoPath("Bitbucket", u)
+	}
+
+	if len(segments) < 2 {
+		return nil, invalidRepoPath("Bitbucket", u)
+	}
+	loc := &RepoLocation{Owner: segments[0], Repo: trimGitSuffix(segments[1])}
+	if len(segments) > 3 {
+		switch segments[2] {
+		case "src":
+			loc.Ref = segments[3]
+		case "branch":
+			loc.Ref = strings.Join(segments[3:], "/")
+		}
+	}
+	return loc, nil
+}
+
+func (bitbucketProvider) CloneURL(loc *RepoLocation) string {
+	if strings.EqualFold(loc.Host, "bitbucket.org") {
+		return fmt.Sprintf("https://bitbucket.org/%s/%s.git", loc.Owner, loc.Repo)
+	}
+	return fmt.Sprintf("https://%s/scm/%s/%s.git", loc.Host, strings.ToLower(loc.Owner), loc.Repo)
+}
+
+// Bitbucket Cloud takes repository and workspace access tokens as the
+// password of x-token-auth, Data Center takes HTTP access tokens as bearer
+// tokens
+func (bitbucketProvider) AuthHeader(loc *RepoLocation, token string) string {
+	if strings.EqualFold(loc.Host, "bitbucket.org") {
+		return basicAuth("x-token-auth", token)
+	}
+	return "Bearer " + token
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reviewers triage the test cases of a run before anything leaves it. Each
+// test case goes from generated to reviewed to accepted or rejected, and a
+// run is in review from the first decision until every case is accepted or
+// rejected. Once any case is decided, the archive, the patch, publishing
+// and pull request texts only carry the accepted cases: Go test functions
+// of the other cases are cut from their files and files left without an
+// accepted case are dropped. Reviewers may also correct the description,
+// input or expected value of a case. Every change raises the version of
+// the cases it touches, a change made against an older version than the
+// current one is refused, so reviewers working on the same run at the same
+// time never overwrite each other unseen. Live reviewers get each change
+// as it is made, see livereview.go.
+
+// TestReview is the review state of one test case
+type TestReview struct {
+	// generated, reviewed, accepted or rejected
+	Status     string     `json:"status"`
+	ReviewedBy string     `json:"reviewedBy,omitempty"`
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	// Changes made to the case, 0 while untouched
+	Version int `json:"version"`
+	// Fields of the case reviewers changed
+	Edited []string `json:"edited,omitempty"`
+}
+
+// RunReview is the review state of a run, by test case id. Cases without an
+// entry are generated.
+type RunReview struct {
+	TestCases map[string]TestReview `json:"testCases"`
+	// Changes made to the review, one per request
+	Version int `json:"version"`
+}
+
+// TestCaseEdit corrects a test case. Names and code stay as generated, the
+// generated files hold them.
+type TestCaseEdit struct {
+	Description *string         `json:"description,omitempty"`
+	Input       json.RawMessage `json:"input,omitempty"`
+	Expected    json.RawMessage `json:"expected,omitempty"`
+}
+
+func (edit *TestCaseEdit) validate(errs *fieldErrors) {
+	if edit.Description == nil && edit.Input == nil && edit.Expected == nil {
+		errs.add("edit", "required", "edit must change the description, input or expected value")
+	}
+	if edit.Description != nil {
+		errs.required("edit.description", *edit.Description)
+		errs.maxLen("edit.description", *edit.Description, 2000)
+	}
+}
+
+// Transitions of a test case, decisions may be changed but not taken back
+var reviewTransitions = map[string][]string{
+	"generated": {"reviewed", "accepted", "rejected"},
+	"reviewed":  {"accepted", "rejected"},
+	"accepted":  {"rejected"},
+	"rejected":  {"accepted"},
+}
+
+// Serializes review changes, each rewrites the whole run
+var runReviews sync.Mutex
+
+// runReviewRequest moves a subset of a run's test cases to a status, or
+// edits one of them
+type runReviewRequest struct {
+	Status string `json:"status,omitempty"` // may be left out with an edit
+	// The test cases, or those with the confidence level when empty
+	TestIDs    []string `json:"testIds,omitempty"`
+	Confidence string   `json:"confidence,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+	// Correction of the one test case in testIds
+	Edit *TestCaseEdit `json:"edit,omitempty"`
+	// Version of each test case as the reviewer last saw it, cases
+	// changed since are a conflict. Cases left out are not checked.
+	Versions map[string]int `json:"versions,omitempty"`
+}
+
+func (req *runReviewRequest) validate() fieldErrors {
+	var errs fieldErrors
+	if req.Edit == nil {
+		errs.required("status", req.Status)
+	}
+	errs.oneOf("status", req.Status, "reviewed", "accepted", "rejected")
+	errs.oneOf("confidence", req.Confidence, "high", "medium", "low")
+	if len(req.TestIDs) == 0 && req.Confidence == "" {
+		errs.add("testIds", "required", "testIds or confidence is required")
+	}
+	if req.Edit != nil {
+		if len(req.TestIDs) != 1 {
+			errs.add("testIds", "len", "an edit names exactly one test case in testIds")
+		}
+		req.Edit.validate(&errs)
+	}
+	errs.maxLen("comment", req.Comment, 2000)
+	return errs
+}
+
+// RunReviewResponse is the review state of a run and each of its cases
+type RunReviewResponse struct {
+	RunID   string `json:"runId"`
+	Version int    `json:"version"`
+	// generated, in-review or reviewed
+	Status    string           `json:"status"`
+	Counts    map[string]int   `json:"counts"`
+	TestCases []TestCaseReview `json:"testCases"`
+}
+
+// TestCaseReview is a test case with its review state
+type TestCaseReview struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Input       interface{} `json:"input,omitempty"`
+	Expected    interface{} `json:"expected,omitempty"`
+	Confidence  string      `json:"confidence,omitempty"` // level
+	TestReview
+}
+
+// testReview is the review state of a test case
+func (review *RunReview) testReview(id string) TestReview {
+	if review != nil {
+		if test, ok := review.TestCases[id]; ok {
+			return test
+		}
+	}
+	return TestReview{Status: "generated"}
+}
+
+// testStatus is the review status of a test case
+func (review *RunReview) testStatus(id string) string {
+	return review.testReview(id).Status
+}
+
+// decided reports whether any test case was accepted or rejected, from
+// which on only accepted cases leave the run
+func (review *RunReview) decided() bool {
+	if review == nil {
+		return false
+	}
+	for _, test := range review.TestCases {
+		if test.Status == "accepted" || test.Status == "rejected" {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewResponse reports the review state of a run
+func reviewResponse(run *Run) RunReviewResponse {
+	response := RunReviewResponse{
+		RunID:     run.ID,
+		Counts:    map[string]int{"generated": 0, "reviewed": 0, "accepted": 0, "rejected": 0},
+		TestCases: []TestCaseReview{},
+	}
+	if run.Review != nil {
+		response.Version = run.Review.Version
+	}
+	for _, testCase := range run.Response.TestCases {
+		item := testCaseReview(run, testCase)
+		response.Counts[item.Status]++
+		response.TestCases = append(response.TestCases, item)
+	}
+	switch total := len(run.Response.TestCases); {
+	case response.Counts["generated"] == total:
+		response.Status = "generated"
+	case response.Counts["accepted"]+response.Counts["rejected"] == total:
+		response.Status = "reviewed"
+	default:
+		response.Status = "in-review"
+	}
+	return response
+}
+
+// testCaseReview is a test case of a run with its review state
+func testCaseReview(run *Run, testCase GeminiTestCase) TestCaseReview {
+	item := TestCaseReview{
+		ID:          testCase.ID,
+		Name:        testCase.Name,
+		Description: testCase.Description,
+		Input:       testCase.Input,
+		Expected:    testCase.Expected,
+		TestReview:  run.Review.testReview(testCase.ID),
+	}
+	if testCase.Confidence != nil {
+		item.Confidence = testCase.Confidence.Level
+	}
+	return item
+}
+
+// runReviewHandler serves GET and POST /api/runs/{id}/review
+func runReviewHandler(w http.ResponseWriter, r *http.Request, runID string) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == "POST" {
+		var req runReviewRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		run, errs, err := updateReview(runID, req, requestReviewer(r))
+		if len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+		if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reviewResponse(run))
+		return
+	}
+
+	runReviews.Lock()
+	defer runReviews.Unlock()
+	run, err := loadReviewedRun(runID)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviewResponse(run))
+}
+
+// requestReviewer is the name reviews of a request are recorded under,
+// empty without access control
+func requestReviewer(r *http.Request) string {
+	if principal, ok := requestPrincipal(r); ok {
+		return principal.Name
+	}
+	return ""
+}
+
+// loadReviewedRun reads a run for its review. The caller holds runReviews.
+func loadReviewedRun(runID string) (*Run, error) {
+	var run Run
+	if err := loadJSON("runs", runID, &run); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			return nil, &requestError{http.StatusNotFound, "Run not found"}
+		}
+		return nil, &requestError{http.StatusInternalServerError, "Failed to read run"}
+	}
+	return &run, nil
+}
+
+// updateReview applies a review request to a run, saves it and tells the
+// run's live reviewers. The run is returned as stored, also when the
+// request conflicts with it.
+func updateReview(runID string, req runReviewRequest, reviewer string) (*Run, fieldErrors, error) {
+	runReviews.Lock()
+	defer runReviews.Unlock()
+
+	run, err := loadReviewedRun(runID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, errs := selectTestCases(run, req)
+	if len(errs) > 0 {
+		return run, errs, nil
+	}
+	if err := reviewTestCases(run, ids, req, reviewer); err != nil {
+		return run, nil, err
+	}
+	if err := saveJSON("runs", run.ID, run); err != nil {
+		log.Printf("Error saving review of run %s: %v", run.ID, err)
+		return nil, nil, &requestError{http.StatusInternalServerError, "Failed to save review"}
+	}
+	publishReviewEvent(run, ids, reviewer)
+	return run, nil, nil
+}
+
+// selectTestCases lists the test cases a review request names, or those
+// with its confidence level
+func selectTestCases(run *Run, req runReviewRequest) ([]string, fieldErrors) {
+	var ids []string
+	var errs fieldErrors
+	if len(req.TestIDs) > 0 {
+		known := map[string]bool{}
+		for _, testCase := range run.Response.TestCases {
+			known[testCase.ID] = true
+		}
+		for i, id := range req.TestIDs {
+			if !known[id] {
+				field := fmt.Sprintf("testIds[%d]", i)
+				errs.add(field, "test", "%s is not a test case of run %s", id, run.ID)
+			}
+		}
+		return req.TestIDs, errs
+	}
+	for _, testCase := range run.Response.TestCases {
+		if testCase.Confidence != nil && testCase.Confidence.Level == req.Confidence {
+			ids = append(ids, testCase.ID)
+		}
+	}
+	return ids, errs
+}
+
+// reviewTestCases moves test cases to the status of a request and applies
+// its edit. Nothing changes when any of them changed since the version the
+// request saw or cannot make the transition.
+func reviewTestCases(run *Run, ids []string, req runReviewRequest, reviewer string) error {
+	for _, id := range ids {
+		test := run.Review.testReview(id)
+		if seen, ok := req.Versions[id]; ok && seen != test.Version {
+			message := fmt.Sprintf("Test case %s changed since version %d, it is at version %d", id, seen, test.Version)
+			if test.ReviewedBy != "" {
+				message += " by " + test.ReviewedBy
+			}
+			return &requestError{http.StatusConflict, message}
+		}
+		if req.Status != "" && test.Status != req.Status && !containsString(reviewTransitions[test.Status], req.Status) {
+			return &requestError{http.StatusConflict, fmt.Sprintf("Test case %s is %s and cannot become %s", id, test.Status, req.Status)}
+		}
+	}
+	if run.Review == nil {
+		run.Review = &RunReview{TestCases: map[string]TestReview{}}
+	}
+	now := time.Now().UTC()
+	for _, id := range ids {
+		test := run.Review.testReview(id)
+		if req.Status != "" {
+			test.Status = req.Status
+		}
+		if req.Edit != nil {
+			for _, field := range editTestCase(run, id, req.Edit) {
+				if !containsString(test.Edited, field) {
+					test.Edited = append(test.Edited, field)
+				}
+			}
+		}
+		test.ReviewedBy, test.ReviewedAt, test.Comment = reviewer, &now, req.Comment
+		test.Version++
+		run.Review.TestCases[id] = test
+	}
+	run.Review.Version++
+	if req.Edit != nil {
+		log.Printf("Run %s: test case %s edited", run.ID, ids[0])
+	}
+	if req.Status != "" {
+		log.Printf("Run %s: %d test cases %s", run.ID, len(ids), req.Status)
+	}
+	return nil
+}
+
+// editTestCase applies an edit to a test case of a run and returns the
+// fields it changed
+func editTestCase(run *Run, id string, edit *TestCaseEdit) []string {
+	var edited []string
+	for i := range run.Response.TestCases {
+		testCase := &run.Response.TestCases[i]
+		if testCase.ID != id {
+			continue
+		}
+		if edit.Description != nil {
+			testCase.Description = *edit.Description
+			edited = append(edited, "description")
+		}
+		// Valid JSON, the request decoded
+		if edit.Input != nil {
+			var input interface{}
+			json.Unmarshal(edit.Input, &input)
+			testCase.Input = input
+			edited = append(edited, "input")
+		}
+		if edit.Expected != nil {
+			var expected interface{}
+			json.Unmarshal(edit.Expected, &expected)
+			testCase.Expected = expected
+			edited = append(edited, "expected")
+		}
+	}
+	return edited
+}
+
+// acceptedRun is the run as it leaves the server: the run itself until a
+// test case is decided, and from then on a copy with the accepted test
+// cases and the files they need, under a manifest signed for those files
+func acceptedRun(run *Run) (*Run, error) {
+	if !run.Review.decided() {
+		return run, nil
+	}
+	resp := *run.Response
+	resp.TestCases = nil
+	dropped := map[string][]string{} // names of the cases left out, by test file
+	accepted := map[string]bool{}
+	for _, testCase := range run.Response.TestCases {
+		if run.Review.testStatus(testCase.ID) == "accepted" {
+			resp.TestCases = append(resp.TestCases, testCase)
+			accepted[testCase.SuggestedPath] = true
+		} else {
+			dropped[testCase.SuggestedPath] = append(dropped[testCase.SuggestedPath], testCase.Name)
+		}
+	}
+	countTestSummary(&resp)
+
+	// Files of no test case, such as helpers and go.mod, go with any
+	// accepted case
+	resp.Artifacts = nil
+	for _, artifact := range run.Response.Artifacts {
+		switch {
+		case accepted[artifact.Path] && len(dropped[artifact.Path]) > 0:
+			artifact.Content = cutGoTests(artifact.Path, artifact.Content, dropped[artifact.Path])
+		case len(dropped[artifact.Path]) > 0:
+			continue
+		case len(resp.TestCases) == 0:
+			continue
+		}
+		resp.Artifacts = append(resp.Artifacts, artifact)
+	}
+	if resp.GoTestFiles != nil {
+		resp.GoTestFiles = goTestFileMap(resp.Artifacts)
+	}
+
+	key, err := loadSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(run.Signed.Manifest, &manifest); err != nil {
+		return nil, fmt.Errorf("reading the manifest of run %s: %v", run.ID, err)
+	}
+	manifest.TestCases = len(resp.TestCases)
+	manifest.AcceptedOnly = true
+	manifest.Files = manifestFiles(resp.Artifacts)
+	manifest.KeyID = key.id
+	signed, err := signManifest(manifest, key)
+	if err != nil {
+		return nil, err
+	}
+	resp.Manifest = &signed
+
+	view := *run
+	view.Response = &resp
+	view.Signed = signed
+	return &view, nil
+}
+
+// cutGoTests removes the top-level functions of the named test cases from a
+// generated Go file and the imports only they used. Test cases that are
+// rows of a table, named by the row or as TestFunc/row, lose their row and
+// the comment lines above it. Other files and files that do not parse are
+// kept whole.
+func cutGoTests(filePath, content string, names []string) string {
+	if path.Ext(filePath) != ".go" {
+		return content
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return content
+	}
+	type cut struct{ start, end int }
+	var cuts []cut
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil {
+			continue
+		}
+		if containsString(names, fn.Name.Name) {
+			start := fn.Pos()
+			if fn.Doc != nil {
+				start = fn.Doc.Pos()
+			}
+			cuts = append(cuts, cut{fset.Position(start).Offset, fset.Position(fn.End()).Offset})
+			continue
+		}
+		ast.Inspect(fn, func(n ast.Node) bool {
+			table, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			for _, elt := range table.Elts {
+				row := tableRowName(elt)
+				if row == "" || !containsString(names, row) && !containsString(names, fn.Name.Name+"/"+row) {
+					continue
+				}
+				start, end := rowSpan(content, fset.Position(elt.Pos()).Offset, fset.Position(elt.End()).Offset)
+				cuts = append(cuts, cut{start, end})
+			}
+			return true
+		})
+	}
+	if len(cuts) == 0 {
+		return content
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].start > cuts[j].start })
+	for _, c := range cuts {
+		content = content[:c.start] + content[c.end:]
+	}
+	fixed, _ := newGoImportIndex(nil).fixFile(filePath, content)
+	return fixed
+}
+
+// tableRowName is the name field of a row of a test table, "" for other
+// elements
+func tableRowName(elt ast.Expr) string {
+	row, ok := elt.(*ast.CompositeLit)
+	if !ok {
+		return ""
+	}
+	for _, field := range row.Elts {
+		kv, ok := field.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		value, isLit := kv.Value.(*ast.BasicLit)
+		if ok && isLit && key.Name == "name" && value.Kind == token.STRING {
+			name, _ := strconv.Unquote(value.Value)
+			return name
+		}
+	}
+	return ""
+}
+
+// rowSpan widens a table row to its whole lines, its trailing comma and
+// the comment lines above it, when nothing else shares its lines
+func rowSpan(content string, start, end int) (int, int) {
+	if i := strings.IndexFunc(content[end:], func(r rune) bool { return r != ' ' && r != '\t' }); i != -1 && content[end+i] == ',' {
+		end += i + 1
+	}
+	lineStart := strings.LastIndex(content[:start], "\n") + 1
+	lineEnd := strings.Index(content[end:], "\n")
+	if lineEnd == -1 || strings.TrimSpace(content[lineStart:start]) != "" || strings.TrimSpace(content[end:end+lineEnd]) != "" {
+		return start, end
+	}
+	start, end = lineStart, end+lineEnd+1
+	for start > 0 {
+		above := strings.LastIndex(content[:start-1], "\n") + 1
+		if !strings.HasPrefix(strings.TrimSpace(content[above:start]), "//") {
+			break
+		}
+		start = above
+	}
+	return start, end
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCutGoTests removes rejected test cases from a generated Go file,
+// whole functions by name and table rows by their name or as TestFunc/row
+func TestCutGoTests(t *testing.T) {
+	const file = `package calc
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestAdd adds numbers
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b int
+		want int
+	}{
+		// Zero is neutral
+		{name: "zero", a: 0, b: 1, want: 1},
+		{name: "negative", a: -1, b: -1, want: -2},
+		{name: "large", a: 1 << 30, b: 1, want: 1<<30 + 1},
+	}
+	for _, tt := range tests {
+		if got := Add(tt.a, tt.b); got != tt.want {
+			t.Errorf("Add() = %d", got)
+		}
+	}
+}
+
+// TestUpper upper-cases
+func TestUpper(t *testing.T) {
+	if strings.ToUpper("a") != "A" {
+		t.Fail()
+	}
+}
+`
+	tests := []struct {
+		name      string
+		path      string
+		content   string
+		names     []string
+		gone      []string
+		kept      []string
+		unchanged bool
+	}{
+		{"function", "calc_test.go", file, []string{"TestUpper"}, []string{"TestUpper", "upper-cases", `"strings"`}, []string{"TestAdd", `"testing"`}, false},
+		{"row by name", "calc_test.go", file, []string{"negative"}, []string{`"negative"`}, []string{`"zero"`, `"large"`, "TestUpper"}, false},
+		{"row with its comment", "calc_test.go", file, []string{"TestAdd/zero"}, []string{`"zero"`, "Zero is neutral"}, []string{`"negative"`, `"large"`}, false},
+		{"row of another function", "calc_test.go", file, []string{"TestUpper/zero"}, nil, nil, true},
+		{"unknown name", "calc_test.go", file, []string{"TestSub"}, nil, nil, true},
+		{"not Go", "calc.test.ts", file, []string{"TestUpper"}, nil, nil, true},
+		{"does not parse", "calc_test.go", file + "func {", []string{"TestUpper"}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cutGoTests(tt.path, tt.content, tt.names)
+			if tt.unchanged {
+				if got != tt.content {
+					t.Errorf("cutGoTests() changed the file:\n%s", got)
+				}
+				return
+			}
+			for _, s := range tt.gone {
+				if strings.Contains(got, s) {
+					t.Errorf("cutGoTests() kept %s:\n%s", s, got)
+				}
+			}
+			for _, s := range tt.kept {
+				if !strings.Contains(got, s) {
+					t.Errorf("cutGoTests() removed %s:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
+
+// TestRowSpan widens the span of a row, given as the text between « and »,
+// and checks what is left once the span is cut
+func TestRowSpan(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"whole line", "{\n\t«{1}»,\n\t{2},\n}", "{\n\t{2},\n}"},
+		{"space before comma", "{\n\t«{1}» ,\n\t{2},\n}", "{\n\t{2},\n}"},
+		{"without comma", "{\n\t{2},\n\t«{1}»\n}", "{\n\t{2},\n}"},
+		{"comment lines above", "{\n\t{2},\n\t// one\n\t// first\n\t«{1}»,\n}", "{\n\t{2},\n}"},
+		{"comment above a blank line", "{\n\t// group\n\n\t«{1}»,\n}", "{\n\t// group\n\n}"},
+		{"shares its line", "{«{1}», {2}}", "{ {2}}"},
+		{"trailing comment", "{\n\t«{1}», // one\n}", "{\n\t // one\n}"},
+		{"last line", "\t«{1}»,", "\t"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := strings.Index(tt.content, "«")
+			content := strings.Replace(tt.content, "«", "", 1)
+			end := strings.Index(content, "»")
+			content = strings.Replace(content, "»", "", 1)
+			start, end = rowSpan(content, start, end)
+			if got := content[:start] + content[end:]; got != tt.want {
+				t.Errorf("rowSpan() leaves %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
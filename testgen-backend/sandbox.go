@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// The sandbox computes the expected values of pure functions by running
+// them, instead of trusting what the model claims they return. Snippets run
+// as WebAssembly in the embedded wazero runtime, with no file system beyond
+// their own source, no network, no environment and limits on memory, time
+// and output. Go is compiled to WASI with TinyGo or the Go toolchain,
+// JavaScript and Python run on WASI builds of QuickJS and CPython.
+// Pyodide targets browsers and Node.js and needs a JavaScript host, so the
+// CPython WASI build stands in for it.
+
+const (
+	maxSandboxCodeBytes = 256 * 1024
+	maxSandboxInputs    = 100
+	maxSandboxOutput    = 1024 * 1024
+
+	defaultSandboxTimeout  = 2 * time.Second
+	maxSandboxTimeoutMs    = 10000
+	defaultSandboxMemoryMB = 64
+	maxSandboxMemoryMB     = 256
+
+	sandboxCompileTimeout = time.Minute
+)
+
+var sandboxLanguages = []string{"go", "javascript", "python"}
+
+var sandboxFunctionName = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// sandboxRequest asks for a function to be called once per input
+type sandboxRequest struct {
+	Language string `json:"language"`
+	// Source declaring the function, a Go file with or without its package
+	// clause, or a script
+	Code string `json:"code"`
+	// Function to call, optional when the code declares only one
+	Function string `json:"function,omitempty"`
+	// The argument list of each call, as JSON arrays
+	Inputs    []json.RawMessage `json:"inputs"`
+	TimeoutMs int               `json:"timeoutMs,omitempty"` // for all calls, default 2000
+	MemoryMB  int               `json:"memoryMb,omitempty"`  // default 64
+}
+
+func (req *sandboxRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.required("language", req.Language)
+	errs.oneOf("language", req.Language, sandboxLanguages...)
+	errs.required("code", req.Code)
+	errs.maxLen("code", req.Code, maxSandboxCodeBytes)
+	if req.Function != "" && !sandboxFunctionName.MatchString(req.Function) {
+		errs.add("function", "identifier", "function must be a function name")
+	}
+	if len(req.Inputs) == 0 {
+		errs.add("inputs", "required", "inputs is required")
+	}
+	if len(req.Inputs) > maxSandboxInputs {
+		errs.add("inputs", "max", "inputs must have at most %d entries", maxSandboxInputs)
+	}
+	for i, input := range req.Inputs {
+		var args []json.RawMessage
+		if err := json.Unmarshal(input, &args); err != nil {
+			field := fmt.Sprintf("inputs[%d]", i)
+			errs.add(field, "array", "%s must be an array of arguments", field)
+		}
+	}
+	errs.min("timeoutMs", req.TimeoutMs, 0)
+	if req.TimeoutMs > maxSandboxTimeoutMs {
+		errs.add("timeoutMs", "max", "timeoutMs must be at most %d", maxSandboxTimeoutMs)
+	}
+	errs.min("memoryMb", req.MemoryMB, 0)
+	if req.MemoryMB > maxSandboxMemoryMB {
+		errs.add("memoryMb", "max", "memoryMb must be at most %d", maxSandboxMemoryMB)
+	}
+	return errs
+}
+
+// SandboxResult is the outcome of one call, its output or why it failed
+type SandboxResult struct {
+	Input  json.RawMessage `json:"input"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// SandboxResponse answers a sandbox run
+type SandboxResponse struct {
+	Language   string          `json:"language"`
+	Function   string          `json:"function"`
+	Toolchain  string          `json:"toolchain"` // compiler or interpreter the snippet ran with
+	Results    []SandboxResult `json:"results"`
+	DurationMs int64           `json:"durationMs"`
+	// Standard error of the snippet, cut to the last 4 KB
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// sandboxProgram is a snippet ready to run: a WASI module, the arguments
+// it is started with and the files it may read
+type sandboxProgram struct {
+	wasm      []byte
+	args      []string
+	env       map[string]string
+	mounts    map[string]fs.FS // guest path to read-only file system
+	toolchain string
+}
+
+var (
+	sandboxCache = wazero.NewCompilationCache()
+	// One run per CPU, snippets are CPU bound
+	sandboxSlots = make(chan struct{}, runtime.NumCPU())
+
+	interpretersMu sync.Mutex
+	interpreters   = map[string][]byte{}
+)
+
+// sandboxToolchains reports what each language runs with, empty when the
+// language is not available
+func sandboxToolchains() map[string]string {
+	toolchains := map[string]string{}
+	if compiler, _ := goWASMCompiler(); compiler != "" {
+		toolchains["go"] = filepath.Base(compiler)
+	}
+	if path := os.Getenv("TESTGEN_QUICKJS_WASM"); path != "" {
+		toolchains["javascript"] = "quickjs"
+	}
+	if path := os.Getenv("TESTGEN_PYTHON_WASM"); path != "" {
+		toolchains["python"] = "cpython-wasi"
+	}
+	return toolchains
+}
+
+// goWASMCompiler finds TinyGo, TESTGEN_TINYGO or on the PATH, or else the
+// Go toolchain, whose wasip1 port needs nothing else
+func goWASMCompiler() (string, bool) {
+	if path := os.Getenv("TESTGEN_TINYGO"); path != "" {
+		return path, true
+	}
+	if path, err := exec.LookPath("tinygo"); err == nil {
+		return path, true
+	}
+	if path, err := exec.LookPath("go"); err == nil {
+		return path, false
+	}
+	return "", false
+}
+
+// loadInterpreter reads a WASI interpreter once, wazero caches its
+// compiled code
+func loadInterpreter(path string) ([]byte, error) {
+	interpretersMu.Lock()
+	defer interpretersMu.Unlock()
+	if wasm, ok := interpreters[path]; ok {
+		return wasm, nil
+	}
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	interpreters[path] = wasm
+	return wasm, nil
+}
+
+// singleFunction picks the function to call from the declared ones
+func singleFunction(function string, declared []string, language string) (string, error) {
+	if function != "" {
+		for _, name := range declared {
+			if name == function {
+				return function, nil
+			}
+		}
+		return "", &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("The code declares no function %s", function)}
+	}
+	switch len(declared) {
+	case 1:
+		return declared[0], nil
+	case 0:
+		return "", &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("The code declares no %s function", language)}
+	}
+	return "", &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("The code declares %s, function is required", strings.Join(declared, ", "))}
+}
+
+// goHarness is the main of a Go snippet. It calls the function once per
+// line of JSON arguments on stdin and writes one result line per call.
+const goHarness = `package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func main() {
+	sandboxIn := bufio.NewScanner(os.Stdin)
+	sandboxIn.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	sandboxOut := bufio.NewWriter(os.Stdout)
+	for sandboxIn.Scan() {
+		sandboxOut.Write(sandboxCall(sandboxIn.Bytes()))
+		sandboxOut.WriteString("\n")
+		sandboxOut.Flush()
+	}
+}
+
+func sandboxError(format string, args ...interface{}) []byte {
+	line, _ := json.Marshal(map[string]string{"error": fmt.Sprintf(format, args...)})
+	return line
+}
+
+func sandboxCall(line []byte) (sandboxResult []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			sandboxResult = sandboxError("panic: %%v", r)
+		}
+	}()
+	var sandboxArgs []json.RawMessage
+	if err := json.Unmarshal(line, &sandboxArgs); err != nil {
+		return sandboxError("arguments: %%v", err)
+	}
+%s
+	sandboxLine, err := json.Marshal(map[string]interface{}{"output": %s})
+	if err != nil {
+		return sandboxError("output: %%v", err)
+	}
+	return sandboxLine
+}
+`
+
+// goProgram compiles a Go snippet with a harness calling its function
+func goProgram(ctx context.Context, req *sandboxRequest) (*sandboxProgram, string, error) {
+	compiler, tinygo := goWASMCompiler()
+	if compiler == "" {
+		return nil, "", &requestError{http.StatusNotImplemented, "No TinyGo or Go toolchain is installed to compile Go to WebAssembly"}
+	}
+
+	code := req.Code
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "code.go", code, parser.ParseComments)
+	if err != nil {
+		code = "package main\n\n" + req.Code
+		if file, err = parser.ParseFile(fset, "code.go", code, parser.ParseComments); err != nil {
+			return nil, "", &requestError{http.StatusUnprocessableEntity, fmt.Sprintf("The code does not parse: %v", err)}
+		}
+	}
+	file.Name.Name = "main"
+
+	funcs := map[string]*ast.FuncDecl{}
+	var declared []string
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil {
+			if fn.Name.Name == "main" || fn.Name.Name == "init" {
+				if fn.Name.Name == "main" {
+					return nil, "", &requestError{http.StatusUnprocessableEntity, "The code must not declare main"}
+				}
+				continue
+			}
+			funcs[fn.Name.Name] = fn
+			declared = append(declared, fn.Name.Name)
+		}
+	}
+	function, err := singleFunction(req.Function, declared, "Go")
+	if err != nil {
+		return nil, "", err
+	}
+	fn := funcs[function]
+	if fn.Type.TypeParams != nil {
+		return nil, "", &requestError{http.StatusUnprocessableEntity, "Generic functions cannot be called with JSON arguments"}
+	}
+
+	typeString := func(expr ast.Expr) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, expr)
+		return buf.String()
+	}
+
+	// Decode each argument into a variable of its parameter type
+	var call strings.Builder
+	var params []string
+	variadic := false
+	for _, field := range fn.Type.Params.List {
+		names := len(field.Names)
+		if names == 0 {
+			names = 1
+		}
+		for i := 0; i < names; i++ {
+			typ := field.Type
+			if ellipsis, ok := typ.(*ast.Ellipsis); ok {
+				typ = &ast.ArrayType{Elt: ellipsis.Elt}
+				variadic = true
+			}
+			params = append(params, typeString(typ))
+		}
+	}
+	if variadic {
+		fmt.Fprintf(&call, "\tif len(sandboxArgs) < %d {\n\t\treturn sandboxError(\"want at least %d arguments, got %%d\", len(sandboxArgs))\n\t}\n", len(params)-1, len(params)-1)
+		fmt.Fprintf(&call, "\tif len(sandboxArgs) == %d {\n\t\tsandboxArgs = append(sandboxArgs, json.RawMessage(\"null\"))\n\t} else {\n", len(params)-1)
+		fmt.Fprintf(&call, "\t\trest, _ := json.Marshal(sandboxArgs[%d:])\n\t\tsandboxArgs = append(sandboxArgs[:%d], rest)\n\t}\n", len(params)-1, len(params)-1)
+	} else {
+		fmt.Fprintf(&call, "\tif len(sandboxArgs) != %d {\n\t\treturn sandboxError(\"want %d arguments, got %%d\", len(sandboxArgs))\n\t}\n", len(params), len(params))
+	}
+	var args []string
+	for i, typ := range params {
+		fmt.Fprintf(&call, "\tvar sandboxArg%d %s\n", i, typ)
+		fmt.Fprintf(&call, "\tif err := json.Unmarshal(sandboxArgs[%d], &sandboxArg%d); err != nil {\n\t\treturn sandboxError(\"argument %d: %%v\", err)\n\t}\n", i, i, i+1)
+		args = append(args, fmt.Sprintf("sandboxArg%d", i))
+	}
+	if variadic {
+		args[len(args)-1] += "..."
+	}
+
+	// A trailing error result fails the call instead of being an output
+	var results []string
+	if fn.Type.Results != nil {
+		for _, field := range fn.Type.Results.List {
+			names := len(field.Names)
+			if names == 0 {
+				names = 1
+			}
+			for i := 0; i < names; i++ {
+				results = append(results, typeString(field.Type))
+			}
+		}
+	}
+	var resultVars []string
+	for i := range results {
+		resultVars = append(resultVars, fmt.Sprintf("sandboxResult%d", i))
+	}
+	target := fmt.Sprintf("%s(%s)", function, strings.Join(args, ", "))
+	if len(resultVars) > 0 {
+		fmt.Fprintf(&call, "\t%s := %s\n", strings.Join(resultVars, ", "), target)
+	} else {
+		fmt.Fprintf(&call, "\t%s\n", target)
+	}
+	if len(results) > 0 && results[len(results)-1] == "error" {
+		last := resultVars[len(resultVars)-1]
+		fmt.Fprintf(&call, "\tif %s != nil {\n\t\treturn sandboxError(\"%%v\", %s)\n\t}\n", last, last)
+		resultVars = resultVars[:len(resultVars)-1]
+	}
+	output := "nil"
+	switch len(resultVars) {
+	case 0:
+	case 1:
+		output = resultVars[0]
+	default:
+		output = "[]interface{}{" + strings.Join(resultVars, ", ") + "}"
+	}
+
+	var source bytes.Buffer
+	if err := format.Node(&source, fset, file); err != nil {
+		return nil, "", err
+	}
+
+	dir, err := os.MkdirTemp("", "testgen-sandbox-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod":          "module sandbox\n\ngo 1.21\n",
+		"code.go":         source.String(),
+		"sandbox_main.go": fmt.Sprintf(goHarness, call.String(), output),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return nil, "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sandboxCompileTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if tinygo {
+		cmd = exec.CommandContext(ctx, compiler, "build", "-target=wasip1", "-o", "main.wasm", ".")
+	} else {
+		cmd = exec.CommandContext(ctx, compiler, "build", "-o", "main.wasm", ".")
+	}
+	cmd.Dir = dir
+	// Standard library only, modules are never downloaded
+	cmd.Env = append(compilerEnv(), "GOOS=wasip1", "GOARCH=wasm", "GOPROXY=off", "GOFLAGS=-mod=mod", "GOTOOLCHAIN=local", "CGO_ENABLED=0")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		message := strings.TrimSpace(strings.ReplaceAll(string(output), dir+string(filepath.Separator), ""))
+		if ctx.Err() != nil {
+			message = "compilation timed out"
+		}
+		return nil, "", &requestError{http.StatusUnprocessableEntity, "The code does not compile: " + message}
+	}
+	wasm, err := os.ReadFile(filepath.Join(dir, "main.wasm"))
+	if err != nil {
+		return nil, "", err
+	}
+	return &sandboxProgram{wasm: wasm, args: []string{"main"}, toolchain: filepath.Base(compiler)}, function, nil
+}
+
+// compilerEnvVars are the variables of the server's environment a
+// compiler gets. The code it builds is the caller's and its errors go back
+// to the caller, so keys and other secrets of the server stay out.
+var compilerEnvVars = []string{"PATH", "HOME", "TMPDIR", "XDG_CACHE_HOME", "GOROOT", "GOPATH", "GOCACHE", "GOMODCACHE", "GOTMPDIR", "GOENV", "GOEXPERIMENT", "TINYGOROOT"}
+
+// compilerEnv is the environment of the sandbox compilers
+func compilerEnv() []string {
+	var env []string
+	for _, name := range compilerEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// jsHarness calls a JavaScript function once per line of JSON arguments,
+// with the std module of the QuickJS command line
+const jsHarness = `
+;(() => {
+  let line;
+  while ((line = std.in.getline()) !== null) {
+    if (line.trim() === "") continue;
+    let result;
+    try {
+      const output = %s(...JSON.parse(line));
+      result = JSON.stringify({ output: output === undefined ? null : output });
+    } catch (e) {
+      result = JSON.stringify({ error: String(e) });
+    }
+    std.out.puts(result + "\n");
+    std.out.flush();
+  }
+})();
+`
+
+// pythonHarness calls a Python function once per line of JSON arguments
+const pythonHarness = `
+
+import json as _sandbox_json
+import sys as _sandbox_sys
+
+for _sandbox_line in _sandbox_sys.stdin:
+    if not _sandbox_line.strip():
+        continue
+    try:
+        _sandbox_result = _sandbox_json.dumps({"output": %s(*_sandbox_json.loads(_sandbox_line))})
+    except BaseException as _sandbox_error:
+        _sandbox_result = _sandbox_json.dumps({"error": repr(_sandbox_error)})
+    print(_sandbox_result, flush=True)
+`
+
+// scriptProgram runs a script on a WASI interpreter, its source mounted
+// read-only at /sandbox
+func scriptProgram(req *sandboxRequest) (*sandboxProgram, string, error) {
+	var declared []string
+	for _, match := range scriptFuncDecl.FindAllStringSubmatch(req.Code, -1) {
+		declared = append(declared, match[1])
+	}
+
+	switch req.Language {
+	case "javascript":
+		path := os.Getenv("TESTGEN_QUICKJS_WASM")
+		if path == "" {
+			return nil, "", &requestError{http.StatusNotImplemented, "No QuickJS WebAssembly module is configured, set TESTGEN_QUICKJS_WASM"}
+		}
+		function, err := singleFunction(req.Function, declared, "JavaScript")
+		if err != nil {
+			return nil, "", err
+		}
+		wasm, err := loadInterpreter(path)
+		if err != nil {
+			return nil, "", err
+		}
+		source := fstest.MapFS{"main.js": {Data: []byte(req.Code + "\n" + fmt.Sprintf(jsHarness, function)), Mode: 0444}}
+		return &sandboxProgram{
+			wasm:      wasm,
+			args:      []string{"qjs", "--std", "/sandbox/main.js"},
+			mounts:    map[string]fs.FS{"/sandbox": source},
+			toolchain: "quickjs",
+		}, function, nil
+
+	default:
+		path := os.Getenv("TESTGEN_PYTHON_WASM")
+		if path == "" {
+			return nil, "", &requestError{http.StatusNotImplemented, "No CPython WebAssembly module is configured, set TESTGEN_PYTHON_WASM"}
+		}
+		function, err := singleFunction(req.Function, declared, "Python")
+		if err != nil {
+			return nil, "", err
+		}
+		wasm, err := loadInterpreter(path)
+		if err != nil {
+			return nil, "", err
+		}
+		source := fstest.MapFS{"main.py": {Data: []byte(req.Code + fmt.Sprintf(pythonHarness, function)), Mode: 0444}}
+		program := &sandboxProgram{
+			wasm:      wasm,
+			args:      []string{"python", "-I", "-B", "/sandbox/main.py"},
+			mounts:    map[string]fs.FS{"/sandbox": source},
+			toolchain: "cpython-wasi",
+		}
+		// Builds without an embedded standard library read it from a
+		// directory of their prefix
+		if home := os.Getenv("TESTGEN_PYTHON_WASM_HOME"); home != "" {
+			program.mounts["/usr/local"] = os.DirFS(home)
+			program.env = map[string]string{"PYTHONHOME": "/usr/local"}
+		}
+		return program, function, nil
+	}
+}
+
+// limitedBuffer keeps up to max bytes and fails writes beyond them
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		b.exceeded = true
+		return 0, errors.New("output limit exceeded")
+	}
+	return b.Buffer.Write(p)
+}
+
+// runSandbox instantiates the program with one line of arguments per input
+// on stdin and reads one result line per input from stdout
+func runSandbox(ctx context.Context, program *sandboxProgram, inputs []json.RawMessage, timeout time.Duration, memoryMB int) ([]SandboxResult, string, error) {
+	var stdin bytes.Buffer
+	for _, input := range inputs {
+		var compact bytes.Buffer
+		json.Compact(&compact, input)
+		stdin.Write(compact.Bytes())
+		stdin.WriteString("\n")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	config := wazero.NewRuntimeConfig().
+		WithCompilationCache(sandboxCache).
+		WithMemoryLimitPages(uint32(memoryMB * 16)). // 64 KiB pages
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, config)
+	defer rt.Close(context.Background())
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+
+	compiled, err := rt.CompileModule(ctx, program.wasm)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid WebAssembly module: %v", err)
+	}
+	fsConfig := wazero.NewFSConfig()
+	for guestPath, files := range program.mounts {
+		fsConfig = fsConfig.WithFSMount(files, guestPath)
+	}
+	stdout := &limitedBuffer{max: maxSandboxOutput}
+	stderr := &limitedBuffer{max: maxSandboxOutput}
+	module := wazero.NewModuleConfig().
+		WithArgs(program.args...).
+		WithStdin(&stdin).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithFSConfig(fsConfig).
+		WithSysWalltime().
+		WithSysNanotime()
+	for name, value := range program.env {
+		module = module.WithEnv(name, value)
+	}
+
+	_, runErr := rt.InstantiateModule(ctx, compiled, module)
+
+	// Calls without a result line share the reason the run ended
+	failure := ""
+	var exitErr *sys.ExitError
+	switch {
+	case ctx.Err() != nil:
+		failure = fmt.Sprintf("time limit of %s exceeded", timeout)
+	case stdout.exceeded:
+		failure = fmt.Sprintf("output limit of %d bytes exceeded", maxSandboxOutput)
+	case strings.Contains(strings.ToLower(stderr.String()), "out of memory"), strings.Contains(stderr.String(), "MemoryError"):
+		failure = fmt.Sprintf("memory limit of %d MB exceeded", memoryMB)
+	case errors.As(runErr, &exitErr) && exitErr.ExitCode() == 0:
+	case errors.As(runErr, &exitErr):
+		failure = fmt.Sprintf("exited with status %d", exitErr.ExitCode())
+	case runErr != nil:
+		failure = runErr.Error()
+	default:
+		failure = "no result"
+	}
+
+	results := make([]SandboxResult, len(inputs))
+	scanner := bufio.NewScanner(bytes.NewReader(stdout.Bytes()))
+	scanner.Buffer(make([]byte, 64*1024), maxSandboxOutput)
+	i := 0
+	for scanner.Scan() && i < len(inputs) {
+		var line struct {
+			Output json.RawMessage `json:"output"`
+			Error  *string         `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || (line.Output == nil && line.Error == nil) {
+			// Output printed by the function itself, not a result
+			continue
+		}
+		results[i] = SandboxResult{Input: inputs[i], Output: line.Output}
+		if line.Error != nil {
+			results[i] = SandboxResult{Input: inputs[i], Error: *line.Error}
+		}
+		i++
+	}
+	for ; i < len(inputs); i++ {
+		results[i] = SandboxResult{Input: inputs[i], Error: failure}
+	}
+
+	stderrText := stderr.String()
+	if len(stderrText) > 4096 {
+		stderrText = stderrText[len(stderrText)-4096:]
+	}
+	return results, stderrText, nil
+}
+
+// sandboxHandler runs pure functions in the WebAssembly sandbox:
+//
+//	GET  /api/sandbox        languages and what they run with
+//	POST /api/sandbox/run    call a function once per input
+func sandboxHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/api/sandbox":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"languages": sandboxToolchains()})
+		return
+	case "/api/sandbox/run":
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req sandboxRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	response, err := executeSandbox(r.Context(), &req)
+	if err != nil && r.Context().Err() != nil {
+		// The client is gone
+		return
+	}
+	if err != nil {
+		log.Printf("Sandbox %s: %v", req.Language, err)
+		writeRequestError(w, err)
+		return
+	}
+
+	log.Printf("Sandbox ran %s %s with %d inputs", req.Language, response.Function, len(req.Inputs))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// executeSandbox calls the function of a validated request once per input,
+// waiting for a free sandbox slot first
+func executeSandbox(ctx context.Context, req *sandboxRequest) (*SandboxResponse, error) {
+	select {
+	case sandboxSlots <- struct{}{}:
+		defer func() { <-sandboxSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	started := time.Now()
+	var program *sandboxProgram
+	var function string
+	var err error
+	if req.Language == "go" {
+		program, function, err = goProgram(ctx, req)
+	} else {
+		program, function, err = scriptProgram(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultSandboxTimeout
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	memoryMB := defaultSandboxMemoryMB
+	if req.MemoryMB > 0 {
+		memoryMB = req.MemoryMB
+	}
+	results, stderr, err := runSandbox(ctx, program, req.Inputs, timeout, memoryMB)
+	if err != nil {
+		return nil, err
+	}
+	return &SandboxResponse{
+		Language:   req.Language,
+		Function:   function,
+		Toolchain:  program.toolchain,
+		Results:    results,
+		DurationMs: time.Since(started).Milliseconds(),
+		Stderr:     stderr,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestSandboxRequestLimits checks the limits a run request is validated
+// against, as field and constraint of each error
+func TestSandboxRequestLimits(t *testing.T) {
+	inputs := func(n int) []json.RawMessage {
+		list := make([]json.RawMessage, n)
+		for i := range list {
+			list[i] = json.RawMessage(`[1]`)
+		}
+		return list
+	}
+	valid := func() sandboxRequest {
+		return sandboxRequest{Language: "go", Code: "func Double(n int) int { return 2 * n }", Inputs: inputs(1)}
+	}
+
+	tests := []struct {
+		name   string
+		change func(req *sandboxRequest)
+		want   []string
+	}{
+		{"valid", func(req *sandboxRequest) {}, nil},
+		{"limits at their maximum", func(req *sandboxRequest) {
+			req.Code = strings.Repeat("x", maxSandboxCodeBytes)
+			req.Inputs = inputs(maxSandboxInputs)
+			req.TimeoutMs, req.MemoryMB = maxSandboxTimeoutMs, maxSandboxMemoryMB
+		}, nil},
+		{"unknown language", func(req *sandboxRequest) { req.Language = "ruby" }, []string{"language oneof"}},
+		{"code too long", func(req *sandboxRequest) { req.Code = strings.Repeat("x", maxSandboxCodeBytes+1) }, []string{"code max"}},
+		{"no inputs", func(req *sandboxRequest) { req.Inputs = nil }, []string{"inputs required"}},
+		{"too many inputs", func(req *sandboxRequest) { req.Inputs = inputs(maxSandboxInputs + 1) }, []string{"inputs max"}},
+		{"input not an array", func(req *sandboxRequest) {
+			req.Inputs = []json.RawMessage{json.RawMessage(`[1]`), json.RawMessage(`1`)}
+		}, []string{"inputs[1] array"}},
+		{"function not a name", func(req *sandboxRequest) { req.Function = "os.Exit" }, []string{"function identifier"}},
+		{"negative timeout", func(req *sandboxRequest) { req.TimeoutMs = -1 }, []string{"timeoutMs min"}},
+		{"timeout too long", func(req *sandboxRequest) { req.TimeoutMs = maxSandboxTimeoutMs + 1 }, []string{"timeoutMs max"}},
+		{"negative memory", func(req *sandboxRequest) { req.MemoryMB = -1 }, []string{"memoryMb min"}},
+		{"memory too large", func(req *sandboxRequest) { req.MemoryMB = maxSandboxMemoryMB + 1 }, []string{"memoryMb max"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.change(&req)
+			var got []string
+			for _, err := range req.validate() {
+				got = append(got, err.Field+" "+err.Constraint)
+			}
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSandboxRunLimits runs Go snippets that exceed the limits of a run.
+// Each compiles to WebAssembly first, so they are left out with -short.
+// Loading the module counts against the time limit, the snippets not
+// testing it get the longest one.
+func TestSandboxRunLimits(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles Go snippets")
+	}
+	if compiler, _ := goWASMCompiler(); compiler == "" {
+		t.Skip("no Go compiler")
+	}
+
+	tests := []struct {
+		name      string
+		code      string
+		input     string
+		timeoutMs int
+		memoryMB  int
+		want      string
+	}{
+		{"within the limits", "func Double(n int) int { return 2 * n }", `[21]`, maxSandboxTimeoutMs, 0, ""},
+		{"time limit", "func Spin(n int) int { for { n++ } }", `[0]`, 500, 0, "time limit of 500ms exceeded"},
+		{"memory limit", "func Grow(n int) int { b := make([]byte, n<<20); return len(b) }", `[64]`, maxSandboxTimeoutMs, 32, "memory limit of 32 MB exceeded"},
+		{"output limit", `import "strings"
+
+func Repeat(n int) string { return strings.Repeat("x", n) }`, `[2097152]`, maxSandboxTimeoutMs, 0, "output limit of 1048576 bytes exceeded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &sandboxRequest{Language: "go", Code: tt.code, Inputs: []json.RawMessage{json.RawMessage(tt.input)}, TimeoutMs: tt.timeoutMs, MemoryMB: tt.memoryMB}
+			if errs := req.validate(); len(errs) > 0 {
+				t.Fatalf("validate() = %v", errs)
+			}
+			response, err := executeSandbox(context.Background(), req)
+			if err != nil {
+				t.Fatalf("executeSandbox() error = %v", err)
+			}
+			result := response.Results[0]
+			if result.Error != tt.want {
+				t.Errorf("executeSandbox() error %q, want %q (stderr %s)", result.Error, tt.want, response.Stderr)
+			}
+			if tt.want == "" && string(result.Output) != "42" {
+				t.Errorf("executeSandbox() output %s, want 42", result.Output)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// The server checks its environment before it accepts requests, so a
+// read-only data directory, no usable model provider or state written by
+// an incompatible version stops the start with what to fix instead of
+// failing the first request that needs it. -validate-config runs the same
+// checks, prints them and exits, for deploy pipelines.
+
+// checkResult is the outcome of a startup check, failed ones stop the
+// server
+type checkResult struct {
+	Check   string
+	Status  string // "ok", "warning" or "failed"
+	Message string
+}
+
+// startupCheck verifies one part of the environment
+type startupCheck struct {
+	name string
+	run  func() []checkResult
+}
+
+var startupChecks = []startupCheck{
+	{"repos", checkReposDir},
+	{"git", checkGit},
+	{"providers", checkProviders},
+	{"templates", checkTemplates},
+	{"stored-data", checkStoredData},
+}
+
+// How long a provider has to answer the reachability probe
+const providerProbeTimeout = 5 * time.Second
+
+// Base URLs of the hosted providers, self-hosted ones are probed at their
+// default endpoint
+var providerProbeURLs = map[string]string{
+	"gemini": "https://generativelanguage.googleapis.com",
+	"openai": "https://api.openai.com",
+	"claude": "https://api.anthropic.com",
+}
+
+// storedKinds are the data subdirectories and the type each document
+// decodes into. State is kept as JSON without schema migrations, a
+// document this version cannot decode fails the request that reads it.
+var storedKinds = map[string]func() interface{}{
+	"runs":             func() interface{} { return new(Run) },
+	"jobs":             func() interface{} { return new(Job) },
+	"job-requests":     func() interface{} { return new(GeminiRequest) },
+	"job-results":      func() interface{} { return new(json.RawMessage) }, // generations or contexts
+	"sessions":         func() interface{} { return new(Session) },
+	"auth-sessions":    func() interface{} { return new(authSession) },
+	"bundles":          func() interface{} { return new(OfflineBundle) },
+	"onboardings":      func() interface{} { return new(Onboarding) },
+	"api-keys":         func() interface{} { return new(storedAPIKey) },
+	"tenants":          func() interface{} { return new(TenantInstructions) },
+	"coverage":         func() interface{} { return new(RepoCoverage) },
+	"glossaries":       func() interface{} { return new(RepoGlossary) },
+	"context-builds":   func() interface{} { return new(ContextBuild) },
+	"context-versions": func() interface{} { return new(ContextVersion) },
+}
+
+// Undecodable documents named in a failure, the rest are counted
+const maxReportedDocuments = 3
+
+// loadSkippedChecks reads TESTGEN_SKIP_CHECKS, a comma-separated list of
+// startup checks to leave out, such as providers on air-gapped networks
+func loadSkippedChecks() (map[string]bool, error) {
+	skipped := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("TESTGEN_SKIP_CHECKS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, check := range startupChecks {
+			known = known || check.name == name
+		}
+		if !known {
+			names := make([]string, len(startupChecks))
+			for i, check := range startupChecks {
+				names[i] = check.name
+			}
+			return nil, fmt.Errorf("TESTGEN_SKIP_CHECKS names unknown check %q, checks are %s", name, strings.Join(names, ", "))
+		}
+		skipped[name] = true
+	}
+	return skipped, nil
+}
+
+// runStartupChecks runs the checks not skipped, in order
+func runStartupChecks(skipped map[string]bool) []checkResult {
+	var results []checkResult
+	for _, check := range startupChecks {
+		if skipped[check.name] {
+			results = append(results, checkResult{check.name, "warning", "skipped by TESTGEN_SKIP_CHECKS"})
+			continue
+		}
+		results = append(results, check.run()...)
+	}
+	return results
+}
+
+// checksFailed reports whether any check failed
+func checksFailed(results []checkResult) bool {
+	for _, result := range results {
+		if result.Status == "failed" {
+			return true
+		}
+	}
+	return false
+}
+
+// printCheckResults writes one line per result for -validate-config
+func printCheckResults(w io.Writer, results []checkResult) {
+	for _, result := range results {
+		fmt.Fprintf(w, "%-8s %-12s %s\n", result.Status, result.Check, result.Message)
+	}
+}
+
+// checkReposDir makes sure contexts, clones and stored state can be
+// written
+func checkReposDir() []checkResult {
+	dir, err := filepath.Abs(dataDir)
+	if err != nil {
+		dir = dataDir
+	}
+	fail := func(err error) []checkResult {
+		return []checkResult{{"repos", "failed", fmt.Sprintf("%s is not writable: %v. Start the server from a directory its user may write to, contexts and state are kept in ./%s", dir, err, dataDir)}}
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fail(err)
+	}
+	f, err := os.CreateTemp(dataDir, ".write-check-")
+	if err != nil {
+		return fail(err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fail(err)
+	}
+	return []checkResult{{"repos", "ok", dir + " is writable"}}
+}
+
+// checkGit creates a repository the way clones are made. go-git runs in
+// process, so this covers the clone storage rather than a git binary.
+func checkGit() []checkResult {
+	storage := "disk"
+	if cloneInMemory {
+		storage = "memory"
+	}
+	fail := func(err error) []checkResult {
+		return []checkResult{{"git", "failed", fmt.Sprintf("cannot create a repository in %s clone storage: %v. Fix the permissions of ./%s or set TESTGEN_CLONE_STORAGE=memory", storage, err, dataDir)}}
+	}
+	dir, err := os.MkdirTemp(dataDir, ".git-check-")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+	storer, worktree, err := cloneTarget(dir)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := git.Init(storer, worktree); err != nil {
+		return fail(err)
+	}
+	return []checkResult{{"git", "ok", "repositories are cloned with go-git in " + storage + " clone storage"}}
+}
+
+// Variables setting the endpoint of the keyless providers, which are only
+// counted as configured when these are set
+var providerEndpointEnvs = map[string]string{
+	"ollama": "TESTGEN_OLLAMA_URL",
+}
+
+// checkProviders probes every model provider with an endpoint. Any HTTP
+// answer counts as reachable. Unreachable providers are warnings, since a
+// network may come up after the server, the start only fails when no
+// provider is configured at all.
+func checkProviders() []checkResult {
+	results := make([]checkResult, len(llmProviders))
+	reachable := make([]bool, len(llmProviders))
+	client := &http.Client{
+		Timeout: providerProbeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var wg sync.WaitGroup
+	for i, provider := range llmProviders {
+		wg.Add(1)
+		go func(i int, provider LLMProvider) {
+			defer wg.Done()
+			results[i], reachable[i] = probeProvider(client, provider)
+		}(i, provider)
+	}
+	wg.Wait()
+
+	var probed []checkResult
+	anyReachable := false
+	for i, result := range results {
+		if result.Check == "" {
+			continue
+		}
+		probed = append(probed, result)
+		anyReachable = anyReachable || reachable[i]
+	}
+	configured, err := configuredProviders()
+	if err != nil {
+		return append(probed, checkResult{"providers", "failed", fmt.Sprintf("cannot list the stored API keys: %v", err)})
+	}
+	switch {
+	case len(configured) == 0:
+		probed = append(probed, checkResult{"providers", "failed", "no model provider is configured: requests may not bring keys and the server has none. Set TESTGEN_<PROVIDER>_API_KEY, TESTGEN_API_KEYS_FILE or TESTGEN_OLLAMA_URL, or unset TESTGEN_DISABLE_REQUEST_KEYS"})
+	case len(probed) > 0 && !anyReachable:
+		probed = append(probed, checkResult{"providers", "warning", "no model provider is reachable yet, only skeleton generations and offline bundles work until one is. Check the network, proxy and TESTGEN_EGRESS_HOSTS, or set TESTGEN_SKIP_CHECKS=providers on air-gapped networks"})
+	}
+	return probed
+}
+
+// configuredProviders names the providers requests can use: all of them
+// when requests bring their own keys, otherwise those with a key on the
+// server and the keyless ones with an endpoint set
+func configuredProviders() ([]string, error) {
+	if !requestKeysDisabled {
+		return llmProviderNames(), nil
+	}
+	keys, err := listAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	withKey := map[string]bool{}
+	for _, key := range keys {
+		withKey[key.Provider] = true
+	}
+	var names []string
+	for _, provider := range llmProviders {
+		name := provider.Name()
+		keyless, ok := provider.(keylessProvider)
+		if withKey[name] || ok && keyless.KeyOptional() && providerEndpointEnvs[name] != "" && os.Getenv(providerEndpointEnvs[name]) != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// probeProvider checks one provider, an empty result when it has no
+// endpoint to probe
+func probeProvider(client *http.Client, provider LLMProvider) (checkResult, bool) {
+	name := provider.Name()
+	probeURL := providerProbeURLs[name]
+	if p, ok := provider.(endpointProvider); ok {
+		probeURL = p.DefaultEndpoint()
+	}
+	if probeURL == "" {
+		return checkResult{}, false
+	}
+	u, err := url.Parse(probeURL)
+	if err != nil || u.Host == "" {
+		return checkResult{"providers", "failed", fmt.Sprintf("%s endpoint %q is not a URL", name, probeURL)}, false
+	}
+	if err := checkEgress(u.Hostname()); err != nil {
+		return checkResult{"providers", "warning", fmt.Sprintf("%s at %s is blocked by the network policy, add %s to TESTGEN_EGRESS_HOSTS to use it", name, probeURL, u.Hostname())}, false
+	}
+	resp, err := client.Get(probeURL)
+	if err != nil {
+		return checkResult{"providers", "warning", fmt.Sprintf("%s at %s is unreachable: %v", name, probeURL, err)}, false
+	}
+	resp.Body.Close()
+	return checkResult{"providers", "ok", fmt.Sprintf("%s at %s is reachable", name, probeURL)}, true
+}
+
+// checkTemplates renders the CI and hook templates with every field they
+// are served with, so a field they name and are not given fails here
+func checkTemplates() []checkResult {
+	render := func(tmpl *template.Template, data interface{}) error {
+		strict, err := tmpl.Clone()
+		if err != nil {
+			return err
+		}
+		return strict.Option("missingkey=error").Execute(io.Discard, data)
+	}
+
+	var results []checkResult
+	var names []string
+	for name := range ciTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := render(ciTemplates[name], map[string]string{
+			"Version":     toolVersion,
+			"Server":      `"http://localhost:3001"`,
+			"ShellServer": shellQuote("http://localhost:3001"),
+			"Self":        "http://localhost:3001/api/v1/ci/" + name,
+			"Script":      ciScript,
+		})
+		if err != nil {
+			results = append(results, checkResult{"templates", "failed", fmt.Sprintf("CI template %s does not render: %v", name, err)})
+		}
+	}
+	for hook := range hookTypes {
+		err := render(hookScript, map[string]interface{}{
+			"Hook":      hook,
+			"Version":   toolVersion,
+			"Server":    shellQuote("http://localhost:3001"),
+			"Threshold": defaultHookThreshold,
+		})
+		if err != nil {
+			results = append(results, checkResult{"templates", "failed", fmt.Sprintf("%s hook template does not render: %v", hook, err)})
+		}
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{"templates", "ok", fmt.Sprintf("%d CI and %d hook templates render", len(ciTemplates), len(hookTypes))})
+	}
+	return results
+}
+
+// checkStoredData decodes every stored document with this version's types
+func checkStoredData() []checkResult {
+	var kinds []string
+	for kind := range storedKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var results []checkResult
+	documents := 0
+	for _, kind := range kinds {
+		ids, err := listJSON(kind)
+		if err != nil {
+			results = append(results, checkResult{"stored-data", "failed", fmt.Sprintf("cannot list %s: %v", filepath.Join(dataDir, kind), err)})
+			continue
+		}
+		var broken []string
+		for _, id := range ids {
+			if err := loadJSON(kind, id, storedKinds[kind]()); err != nil {
+				broken = append(broken, fmt.Sprintf("%s: %v", filepath.Join(dataDir, kind, id+".json"), err))
+			}
+		}
+		documents += len(ids)
+		if len(broken) == 0 {
+			continue
+		}
+		count, more := len(broken), ""
+		if count > maxReportedDocuments {
+			more = fmt.Sprintf(" and %d more", count-maxReportedDocuments)
+			broken = broken[:maxReportedDocuments]
+		}
+		results = append(results, checkResult{"stored-data", "failed", fmt.Sprintf("%d stored %s do not decode with this version (%s%s). Restore them from a backup or move them out of %s", count, kind, strings.Join(broken, "; "), more, filepath.Join(dataDir, kind))})
+	}
+	if len(results) == 0 {
+		results = append(results, checkResult{"stored-data", "ok", fmt.Sprintf("%d stored documents decode", documents)})
+	}
+	return results
+}
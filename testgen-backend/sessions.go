@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions are live contexts a user builds up file by file, previewing the
+// token count and generating tests as they go. They expire when unused.
+const (
+	defaultSessionTTL     = 24 * time.Hour
+	maxSessionTTL         = 7 * 24 * time.Hour
+	maxSessionBytes       = 2 * 1024 * 1024
+	maxSessionGenerations = 20
+)
+
+// Serializes the load, modify and save of sessions
+var sessionsMu sync.Mutex
+
+type Session struct {
+	ID          string              `json:"id"`
+	Tenant      string              `json:"tenant,omitempty"`
+	Repo        string              `json:"repo,omitempty"` // owner/repo whose glossary is included
+	Files       []FileContent       `json:"files"`
+	Generations []SessionGeneration `json:"generations,omitempty"`
+	TTLSeconds  int                 `json:"ttlSeconds"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	UpdatedAt   time.Time           `json:"updatedAt"`
+	ExpiresAt   time.Time           `json:"expiresAt"`
+}
+
+// SessionGeneration is one generation triggered within a session
+type SessionGeneration struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Mode      string          `json:"mode,omitempty"`
+	Files     int             `json:"files"`
+	Result    *GeminiResponse `json:"result"`
+}
+
+// SessionPreview is the context a generation in the session would use
+type SessionPreview struct {
+	Tokens  int          `json:"tokens"`
+	Files   []FileTokens `json:"files"`
+	Context string       `json:"context"`
+}
+
+type FileTokens struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	Tokens int    `json:"tokens"`
+}
+
+type createSessionRequest struct {
+	Tenant     string        `json:"tenant,omitempty"`
+	Repo       string        `json:"repo,omitempty"`
+	ContextID  string        `json:"contextId,omitempty"` // seed the session from a cloned context
+	Files      []FileContent `json:"files,omitempty"`
+	TTLMinutes int           `json:"ttlMinutes,omitempty"`
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// touch extends the session's expiry after it was used
+func (s *Session) touch() {
+	s.UpdatedAt = time.Now().UTC()
+	s.ExpiresAt = s.UpdatedAt.Add(time.Duration(s.TTLSeconds) * time.Second)
+}
+
+func (s *Session) size() int {
+	total := 0
+	for _, file := range s.Files {
+		total += len(file.Content)
+	}
+	return total
+}
+
+// putFile adds a file or snippet, replacing one with the same path
+func (s *Session) putFile(file FileContent) {
+	file.Content = normalizeLineEndings(file.Content)
+	file.Size = len(file.Content)
+	for i := range s.Files {
+		if s.Files[i].Path == file.Path {
+			s.Files[i] = file
+			return
+		}
+	}
+	s.Files = append(s.Files, file)
+}
+
+func (s *Session) removeFile(filePath string) bool {
+	for i := range s.Files {
+		if s.Files[i].Path == filePath {
+			s.Files = append(s.Files[:i], s.Files[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Session) context() string {
+	extras := contextExtras{}
+	if owner, repo, ok := strings.Cut(s.Repo, "/"); ok {
+		extras.Glossary = loadGlossary(owner, repo)
+	}
+	return generatePromptContext(s.Files, extras)
+}
+
+// loadSession returns a stored session, treating expired ones as missing
+func loadSession(id string) (*Session, error) {
+	var session Session
+	if err := loadJSON("sessions", id, &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		deleteJSON("sessions", id)
+		return nil, os.ErrNotExist
+	}
+	return &session, nil
+}
+
+// cleanSessionFilePath normalizes a session file path, rejecting paths that
+// are empty or leave the session root
+func cleanSessionFilePath(filePath string) (string, bool) {
+	cleaned := path.Clean("/" + slashPath(filePath))[1:]
+	return cleaned, cleaned != "" && cleaned == strings.TrimPrefix(slashPath(filePath), "/")
+}
+
+// expireSessions removes expired sessions every interval
+func expireSessions(interval time.Duration) {
+	for range time.Tick(interval) {
+		ids, err := listJSON("sessions")
+		if err != nil {
+			log.Printf("Warning: Could not list sessions: %v", err)
+			continue
+		}
+		sessionsMu.Lock()
+		for _, id := range ids {
+			var session Session
+			if err := loadJSON("sessions", id, &session); err == nil && time.Now().After(session.ExpiresAt) {
+				deleteJSON("sessions", id)
+				log.Printf("Expired session %s", id)
+			}
+		}
+		sessionsMu.Unlock()
+	}
+}
+
+func writeSession(w http.ResponseWriter, session *Session) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// sessionsHandler serves the session API:
+//
+//	POST   /api/sessions                      create a session
+//	GET    /api/sessions/{id}                 read a session
+//	DELETE /api/sessions/{id}                 delete a session
+//	POST   /api/sessions/{id}/files           add or replace files and snippets
+//	DELETE /api/sessions/{id}/files/{path}    remove a file
+//	GET    /api/sessions/{id}/preview         context and token counts
+//	POST   /api/sessions/{id}/generate        generate tests from the session context
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, DELETE, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+	if rest == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createSessionHandler(w, r)
+		return
+	}
+
+	parts := strings.SplitN(rest, "/", 3)
+	id := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		sessionsMu.Lock()
+		session, err := loadSession(id)
+		sessionsMu.Unlock()
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		writeSession(w, session)
+
+	case action == "" && r.Method == "DELETE":
+		sessionsMu.Lock()
+		err := deleteJSON("sessions", id)
+		sessionsMu.Unlock()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeSessionError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "files" && r.Method == "POST" && len(parts) == 2:
+		var body struct {
+			Files []FileContent `json:"files"`
+		}
+		if !decodeRequest(w, r, &body) {
+			return
+		}
+		var errs fieldErrors
+		validateSessionFiles(&errs, body.Files)
+		if len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+		updateSession(w, id, func(session *Session) error {
+			for _, file := range body.Files {
+				cleaned, ok := cleanSessionFilePath(file.Path)
+				if !ok {
+					return &requestError{http.StatusBadRequest, fmt.Sprintf("Invalid file path: %q", file.Path)}
+				}
+				file.Path = cleaned
+				session.putFile(file)
+			}
+			return nil
+		})
+
+	case action == "files" && r.Method == "DELETE" && len(parts) == 3:
+		updateSession(w, id, func(session *Session) error {
+			if !session.removeFile(parts[2]) {
+				return &requestError{http.StatusNotFound, "File not found in session"}
+			}
+			return nil
+		})
+
+	case action == "preview" && r.Method == "GET":
+		sessionsMu.Lock()
+		session, err := loadSession(id)
+		sessionsMu.Unlock()
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		preview := SessionPreview{Context: session.context(), Files: []FileTokens{}}
+		preview.Tokens = estimateTokens(preview.Context)
+		for _, file := range session.Files {
+			preview.Files = append(preview.Files, FileTokens{
+				Path:   file.Path,
+				Size:   file.Size,
+				Tokens: estimateTokens(file.Content),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(preview)
+
+	case action == "generate" && r.Method == "POST":
+		generateInSessionHandler(w, r, id)
+
+	case action == "" || action == "files" || action == "preview" || action == "generate":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+	}
+}
+
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, errInvalidID):
+		http.Error(w, "Session not found", http.StatusNotFound)
+	default:
+		log.Printf("Error accessing session: %v", err)
+		writeRequestError(w, err)
+	}
+}
+
+// updateSession applies change to a stored session and saves it
+func updateSession(w http.ResponseWriter, id string, change func(*Session) error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	session, err := loadSession(id)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	if err := change(session); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	if session.size() > maxSessionBytes {
+		http.Error(w, fmt.Sprintf("Session larger than %d bytes", maxSessionBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	session.touch()
+	if err := saveJSON("sessions", id, session); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	writeSession(w, session)
+}
+
+func createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var req createSessionRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ttl := defaultSessionTTL
+	if req.TTLMinutes > 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+	if ttl > maxSessionTTL {
+		ttl = maxSessionTTL
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	session := &Session{
+		ID:         id,
+		Tenant:     requestTenant(r, req.Tenant),
+		Repo:       req.Repo,
+		Files:      []FileContent{},
+		TTLSeconds: int(ttl / time.Second),
+		CreatedAt:  now,
+	}
+
+	// Seed from a context built by the clone endpoint
+	if req.ContextID != "" {
+		if !validContextID.MatchString(req.ContextID) {
+			http.Error(w, "Invalid context id", http.StatusBadRequest)
+			return
+		}
+		content, err := os.ReadFile(filepath.Join("repos", req.ContextID+"-context.txt"))
+		if err != nil {
+			http.Error(w, "Context file not found", http.StatusNotFound)
+			return
+		}
+		for _, file := range splitContextFiles(string(content)) {
+			session.putFile(file)
+		}
+	}
+	for _, file := range req.Files {
+		cleaned, ok := cleanSessionFilePath(file.Path)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid file path: %q", file.Path), http.StatusBadRequest)
+			return
+		}
+		file.Path = cleaned
+		session.putFile(file)
+	}
+	if session.size() > maxSessionBytes {
+		http.Error(w, fmt.Sprintf("Session larger than %d bytes", maxSessionBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	session.touch()
+
+	sessionsMu.Lock()
+	err = saveJSON("sessions", id, session)
+	sessionsMu.Unlock()
+	if err != nil {
+		log.Printf("Error saving session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Created session %s with %d files", id, len(session.Files))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// sessionGenerationRequest is a GeminiRequest without its validation, which
+// requires a code context
+type sessionGenerationRequest GeminiRequest
+
+// generateInSessionHandler runs a generation on the session's current
+// context and records the result in the session
+func generateInSessionHandler(w http.ResponseWriter, r *http.Request, id string) {
+	// The session supplies the code context, validate everything else
+	var body sessionGenerationRequest
+	if !decodeRequest(w, r, &body) {
+		return
+	}
+	req := GeminiRequest(body)
+	errs := req.validateGeneration()
+	if req.ContextID != "" {
+		errs.add("contextId", "unsupported", "contextId is not used, the session supplies the context")
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+
+	sessionsMu.Lock()
+	session, err := loadSession(id)
+	sessionsMu.Unlock()
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	if len(session.Files) == 0 {
+		http.Error(w, "Session has no files", http.StatusBadRequest)
+		return
+	}
+
+	// Overrides apply to this generation only, files posted to the session stay
+	req.CodeContext = session.context()
+	if len(req.Overrides) > 0 {
+		req.CodeContext = overrideContextFiles(req.CodeContext, req.Overrides)
+	}
+	tenant := session.Tenant
+	if tenant == "" {
+		tenant = requestTenant(r, req.Tenant)
+	}
+
+	// The model call can take a while, do not hold the lock during it
+	testResponse, err := generateTests(req, tenant)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	generationID, err := newSessionID()
+	if err != nil {
+		http.Error(w, "Failed to record generation", http.StatusInternalServerError)
+		return
+	}
+	generation := SessionGeneration{
+		ID:        generationID,
+		CreatedAt: time.Now().UTC(),
+		Mode:      req.Mode,
+		Files:     len(session.Files),
+		Result:    &testResponse,
+	}
+
+	sessionsMu.Lock()
+	if session, err = loadSession(id); err == nil {
+		session.Generations = append(session.Generations, generation)
+		if len(session.Generations) > maxSessionGenerations {
+			session.Generations = session.Generations[len(session.Generations)-maxSessionGenerations:]
+		}
+		session.touch()
+		err = saveJSON("sessions", id, session)
+	}
+	sessionsMu.Unlock()
+	if err != nil {
+		log.Printf("Warning: Could not record generation in session %s: %v", id, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(generation)
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every generation is recorded as a run whose manifest lists the checksums
+// of the generated files, signed with the server key, so CI can check that
+// test files came from a given run and were not changed since.
+
+const manifestFileName = "testgen-manifest.json"
+
+// RunManifest describes the files produced by a generation run
+type RunManifest struct {
+	RunID         string         `json:"runId"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	Mode          string         `json:"mode"`
+	ContextSHA256 string         `json:"contextSha256"`
+	TestCases     int            `json:"testCases"`
+	Files         []ManifestFile `json:"files"`
+	KeyID         string         `json:"keyId"`
+	Algorithm     string         `json:"algorithm"`
+	// Only the test cases reviewers accepted, see review.go
+	AcceptedOnly bool `json:"acceptedOnly,omitempty"`
+}
+
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SignedManifest pairs a manifest with the Ed25519 signature of its JSON
+// encoding. Payload holds the signed bytes, as re-encoding JSON may not
+// reproduce them exactly.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Payload   string          `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// Run is a stored generation with its signed manifest
+type Run struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Signed    SignedManifest    `json:"signed"`
+	Response  *GeminiResponse   `json:"response"`
+	Tenant    string            `json:"tenant,omitempty"` // team the run is attributed to
+	Tags      map[string]string `json:"tags,omitempty"`
+	Outcome   *RunOutcome       `json:"outcome,omitempty"`
+	// Context contents of the files the run replaces, for its patch
+	Originals map[string]string `json:"originals,omitempty"`
+	// Commit message and description last written for its pull request
+	PullRequest *PullRequestText `json:"pullRequest,omitempty"`
+	Review      *RunReview       `json:"review,omitempty"`
+}
+
+type signingKey struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	id      string
+}
+
+var (
+	serverKeyOnce sync.Once
+	serverKey     *signingKey
+	serverKeyErr  error
+)
+
+// loadSigningKey uses the base64 Ed25519 seed in TESTGEN_SIGNING_KEY, or a
+// key generated on first use and kept in the data directory
+func loadSigningKey() (*signingKey, error) {
+	serverKeyOnce.Do(func() {
+		var seed []byte
+		if encoded := os.Getenv("TESTGEN_SIGNING_KEY"); encoded != "" {
+			seed, serverKeyErr = base64.StdEncoding.DecodeString(encoded)
+			if serverKeyErr == nil && len(seed) != ed25519.SeedSize {
+				serverKeyErr = fmt.Errorf("TESTGEN_SIGNING_KEY must be a %d byte seed", ed25519.SeedSize)
+			}
+		} else {
+			seed, serverKeyErr = loadOrCreateKeySeed(filepath.Join(dataDir, "keys", "signing.key"))
+		}
+		if serverKeyErr != nil {
+			return
+		}
+		private := ed25519.NewKeyFromSeed(seed)
+		public := private.Public().(ed25519.PublicKey)
+		sum := sha256.Sum256(public)
+		serverKey = &signingKey{private: private, public: public, id: hex.EncodeToString(sum[:8])}
+	})
+	return serverKey, serverKeyErr
+}
+
+func loadOrCreateKeySeed(path string) ([]byte, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid key in %s", path)
+		}
+		return seed, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(seed)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated key in %s", path)
+	return seed, nil
+}
+
+func (k *signingKey) sign(data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(k.private, data))
+}
+
+func (k *signingKey) publicKeyPEM() string {
+	der, _ := x509.MarshalPKIXPublicKey(k.public)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordRun stores a generation as a run and attaches its id and signed
+// manifest to the response
+func recordRun(resp *GeminiResponse, req GeminiRequest) error {
+	key, err := loadSigningKey()
+	if err != nil {
+		return err
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	// Stamp the files before they are checksummed
+	if resp.Provenance == nil {
+		resp.Provenance = newProvenance("", "")
+	}
+	resp.Provenance.RunID = id
+	resp.Provenance.Source = req.Source
+	if resp.Provenance.Source == "" {
+		resp.Provenance.Source = strings.Join(contextSources(req.CodeContext), ", ")
+	}
+	stampProvenance(resp.Artifacts, resp.Provenance)
+
+	mode := req.Mode
+	if mode == "" {
+		mode = "llm"
+	}
+	manifest := RunManifest{
+		RunID:         id,
+		CreatedAt:     time.Now().UTC(),
+		Mode:          mode,
+		ContextSHA256: sha256Hex([]byte(req.CodeContext)),
+		TestCases:     len(resp.TestCases),
+		Files:         manifestFiles(resp.Artifacts),
+		KeyID:         key.id,
+		Algorithm:     "ed25519",
+	}
+	signed, err := signManifest(manifest, key)
+	if err != nil {
+		return err
+	}
+
+	resp.RunID = id
+	resp.Manifest = &signed
+	run := Run{ID: id, CreatedAt: manifest.CreatedAt, Signed: *resp.Manifest, Response: resp, Tenant: req.Tenant, Tags: req.Tags,
+		Originals: runOriginals(resp.Artifacts, req.CodeContext)}
+	return saveJSON("runs", id, run)
+}
+
+// manifestFiles lists the checksums of the files of a run
+func manifestFiles(artifacts []GeneratedArtifact) []ManifestFile {
+	files := []ManifestFile{}
+	for _, artifact := range artifacts {
+		files = append(files, ManifestFile{
+			Path:   artifact.Path,
+			Size:   len(artifact.Content),
+			SHA256: sha256Hex([]byte(artifact.Content)),
+		})
+	}
+	return files
+}
+
+// signManifest signs the JSON encoding of a manifest with the server key
+func signManifest(manifest RunManifest, key *signingKey) (SignedManifest, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return SignedManifest{}, err
+	}
+	return SignedManifest{
+		Manifest:  data,
+		Payload:   base64.StdEncoding.EncodeToString(data),
+		Signature: key.sign(data),
+	}, nil
+}
+
+// buildRunArchive packs the run's files and its signed manifest into a
+// gzipped tarball
+func buildRunArchive(run *Run) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	add := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: run.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	for _, artifact := range run.Response.Artifacts {
+		if err := add(artifact.Path, []byte(artifact.Content)); err != nil {
+			return nil, err
+		}
+	}
+	manifest, err := json.MarshalIndent(run.Signed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := add(manifestFileName, manifest); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildRunZip packs the generated files of a run and its signed manifest
+// into a zip, for tools that do not read tarballs
+func buildRunZip(run *Run) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	add := func(name string, content []byte) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: run.CreatedAt}
+		header.SetMode(0644)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	}
+
+	for _, artifact := range run.Response.Artifacts {
+		if err := add(artifact.Path, []byte(artifact.Content)); err != nil {
+			return nil, err
+		}
+	}
+	manifest, err := json.MarshalIndent(run.Signed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := add(manifestFileName, manifest); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runsHandler serves GET /api/runs/{id}, GET /api/runs/{id}/archive,
+// GET /api/runs/{id}/patch, GET /api/runs/{id}/checklist,
+// GET and POST /api/runs/{id}/review, the WebSocket of
+// /api/runs/{id}/review/live, POST /api/runs/{id}/publish,
+// POST /api/runs/{id}/outcome and POST /api/runs/{id}/pull-request
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, POST, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+	if len(parts) == 2 && parts[1] == "publish" {
+		publishRunHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "outcome" {
+		runOutcomeHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "pull-request" {
+		pullRequestTextHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "review" {
+		runReviewHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "review" && parts[2] == "live" {
+		liveReviewHandler(w, r, parts[0])
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "archive" && parts[1] != "patch" && parts[1] != "checklist") {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	var run Run
+	if err := loadJSON("runs", parts[0], &run); err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+			http.Error(w, "Run not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to read run", http.StatusInternalServerError)
+		return
+	}
+
+	if len(parts) == 1 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(run)
+		return
+	}
+	if parts[1] == "checklist" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(renderReviewChecklist(&run)))
+		return
+	}
+
+	// Only the accepted test cases leave a reviewed run
+	accepted, err := acceptedRun(&run)
+	if err != nil {
+		log.Printf("Error selecting the accepted tests of run %s: %v", run.ID, err)
+		http.Error(w, "Failed to sign archive", http.StatusInternalServerError)
+		return
+	}
+	if parts[1] == "patch" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"testgen-run-%s.patch\"", run.ID))
+		w.Write([]byte(buildRunPatch(accepted)))
+		return
+	}
+
+	key, err := loadSigningKey()
+	if err != nil {
+		log.Printf("Error loading signing key: %v", err)
+		http.Error(w, "Failed to sign archive", http.StatusInternalServerError)
+		return
+	}
+	// A tarball, or a zip with ?format=zip
+	build, contentType, extension := buildRunArchive, "application/gzip", "tar.gz"
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "tar.gz":
+	case "zip":
+		build, contentType, extension = buildRunZip, "application/zip", "zip"
+	default:
+		http.Error(w, "format must be tar.gz or zip", http.StatusBadRequest)
+		return
+	}
+	archive, err := build(accepted)
+	if err != nil {
+		log.Printf("Error building archive for run %s: %v", run.ID, err)
+		http.Error(w, "Failed to build archive", http.StatusInternalServerError)
+		return
+	}
+
+	// The signature covers the archive bytes, the manifest inside covers
+	// each file
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"testgen-run-%s.%s\"", run.ID, extension))
+	w.Header().Set("X-Testgen-Key-Id", key.id)
+	w.Header().Set("X-Testgen-Archive-Sha256", sha256Hex(archive))
+	w.Header().Set("X-Testgen-Archive-Signature", key.sign(archive))
+	w.Write(archive)
+}
+
+// signingKeyHandler serves the public key runs are signed with
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	key, err := loadSigningKey()
+	if err != nil {
+		log.Printf("Error loading signing key: %v", err)
+		http.Error(w, "Signing key unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"keyId":        key.id,
+		"algorithm":    "ed25519",
+		"publicKey":    base64.StdEncoding.EncodeToString(key.public),
+		"publicKeyPem": key.publicKeyPEM(),
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Skeleton mode builds table-driven Go test stubs purely from the AST of the
+// code context, without calling any model
+
+type skeletonParam struct {
+	Name     string
+	Type     string
+	Variadic bool
+}
+
+type skeletonFunc struct {
+	File      string
+	Name      string
+	TestName  string
+	Receiver  string
+	Params    []skeletonParam
+	Results   []string
+	ReturnErr bool
+	Signature string
+}
+
+var versionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// importName guesses the package name an import path is referred by
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	importPath, _ := strconv.Unquote(spec.Path.Value)
+	parts := strings.Split(importPath, "/")
+	name := parts[len(parts)-1]
+	if versionSuffix.MatchString(name) && len(parts) > 1 {
+		name = parts[len(parts)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	name = strings.TrimSuffix(name, "-go")
+	name = strings.TrimSuffix(name, ".go")
+	return strings.ReplaceAll(name, "-", "")
+}
+
+// usedPackages lists the package qualifiers referenced by the expressions
+func usedPackages(exprs ...ast.Expr) []string {
+	seen := map[string]bool{}
+	for _, expr := range exprs {
+		ast.Inspect(expr, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if ident, ok := sel.X.(*ast.Ident); ok {
+					seen[ident.Name] = true
+				}
+				return false
+			}
+			return true
+		})
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// skeletonFuncs extracts the testable functions of a parsed file along with
+// the import lines their signatures need. Functions whose types cannot be
+// resolved to an import, and generic ones, are skipped.
+func skeletonFuncs(fset *token.FileSet, goFile parsedGoFile) ([]skeletonFunc, map[string]string) {
+	node := func(n ast.Node) string {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, fset, n)
+		return buf.String()
+	}
+
+	imports := map[string]string{}
+	for _, spec := range goFile.File.Imports {
+		name := importName(spec)
+		if name == "_" || name == "." {
+			continue
+		}
+		line := spec.Path.Value
+		if spec.Name != nil || name != path.Base(strings.Trim(spec.Path.Value, `"`)) {
+			line = name + " " + spec.Path.Value
+		}
+		imports[name] = line
+	}
+
+	var funcs []skeletonFunc
+	needed := map[string]string{}
+
+	for _, decl := range goFile.File.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name == "init" || fn.Name.Name == "main" || fn.Name.Name == "_" {
+			continue
+		}
+		if fn.Type.TypeParams != nil && len(fn.Type.TypeParams.List) > 0 {
+			continue
+		}
+
+		var exprs []ast.Expr
+		sf := skeletonFunc{
+			File:     goFile.Path,
+			Name:     fn.Name.Name,
+			TestName: "Test" + strings.ToUpper(fn.Name.Name[:1]) + fn.Name.Name[1:],
+		}
+
+		if fn.Recv != nil && len(fn.Recv.List) > 0 {
+			recv := fn.Recv.List[0].Type
+			base := recv
+			if star, ok := base.(*ast.StarExpr); ok {
+				base = star.X
+			}
+			ident, ok := base.(*ast.Ident)
+			if !ok {
+				// Generic receiver
+				continue
+			}
+			sf.Receiver = node(recv)
+			sf.TestName = "Test" + ident.Name + "_" + fn.Name.Name
+			exprs = append(exprs, recv)
+		}
+
+		if fn.Type.Params != nil {
+			for _, field := range fn.Type.Params.List {
+				fieldType := field.Type
+				variadic := false
+				if ellipsis, ok := fieldType.(*ast.Ellipsis); ok {
+					fieldType = ellipsis.Elt
+					variadic = true
+				}
+				exprs = append(exprs, fieldType)
+				typeStr := node(fieldType)
+				if variadic {
+					typeStr = "[]" + typeStr
+				}
+				names := field.Names
+				if len(names) == 0 {
+					names = []*ast.Ident{{Name: "_"}}
+				}
+				for _, name := range names {
+					paramName := name.Name
+					if paramName == "_" {
+						paramName = fmt.Sprintf("arg%d", len(sf.Params))
+					}
+					sf.Params = append(sf.Params, skeletonParam{Name: paramName, Type: typeStr, Variadic: variadic})
+				}
+			}
+		}
+
+		if fn.Type.Results != nil {
+			for _, field := range fn.Type.Results.List {
+				count := len(field.Names)
+				if count == 0 {
+					count = 1
+				}
+				for i := 0; i < count; i++ {
+					sf.Results = append(sf.Results, node(field.Type))
+				}
+				exprs = append(exprs, field.Type)
+			}
+		}
+		if n := len(sf.Results); n > 0 && sf.Results[n-1] == "error" {
+			sf.ReturnErr = true
+			sf.Results = sf.Results[:n-1]
+		}
+
+		resolved := true
+		fnImports := map[string]string{}
+		for _, pkg := range usedPackages(exprs...) {
+			line, ok := imports[pkg]
+			if !ok {
+				resolved = false
+				break
+			}
+			fnImports[pkg] = line
+		}
+		if !resolved {
+			continue
+		}
+		for pkg, line := range fnImports {
+			needed[pkg] = line
+		}
+
+		sf.Signature = strings.TrimSpace(strings.Split(node(&ast.FuncDecl{Recv: fn.Recv, Name: fn.Name, Type: fn.Type}), "\n")[0])
+		funcs = append(funcs, sf)
+	}
+
+	return funcs, needed
+}
+
+// renderSkeletonTest writes a gotests style table-driven stub for one function
+func renderSkeletonTest(buf *bytes.Buffer, sf skeletonFunc) bool {
+	usesReflect := len(sf.Results) > 0
+
+	fmt.Fprintf(buf, "func %s(t *testing.T) {\n", sf.TestName)
+	if len(sf.Params) > 0 {
+		buf.WriteString("\ttype args struct {\n")
+		for _, param := range sf.Params {
+			fmt.Fprintf(buf, "\t\t%s %s\n", param.Name, param.Type)
+		}
+		buf.WriteString("\t}\n")
+	}
+
+	buf.WriteString("\ttests := []struct {\n\t\tname string\n")
+	if sf.Receiver != "" {
+		fmt.Fprintf(buf, "\t\treceiver %s\n", sf.Receiver)
+	}
+	if len(sf.Params) > 0 {
+		buf.WriteString("\t\targs args\n")
+	}
+	var wants, gots []string
+	for i, result := range sf.Results {
+		suffix := ""
+		if i > 0 {
+			suffix = strconv.Itoa(i)
+		}
+		wants = append(wants, "want"+suffix)
+		gots = append(gots, "got"+suffix)
+		fmt.Fprintf(buf, "\t\twant%s %s\n", suffix, result)
+	}
+	if sf.ReturnErr {
+		buf.WriteString("\t\twantErr bool\n")
+	}
+	buf.WriteString("\t}{\n\t\t// TODO: add test cases.\n\t}\n")
+
+	buf.WriteString("\tfor _, tt := range tests {\n\t\tt.Run(tt.name, func(t *testing.T) {\n")
+
+	var args []string
+	for _, param := range sf.Params {
+		arg := "tt.args." + param.Name
+		if param.Variadic {
+			arg += "..."
+		}
+		args = append(args, arg)
+	}
+	callee := sf.Name
+	if sf.Receiver != "" {
+		callee = "tt.receiver." + sf.Name
+	}
+	call := fmt.Sprintf("%s(%s)", callee, strings.Join(args, ", "))
+
+	lhs := append([]string{}, gots...)
+	if sf.ReturnErr {
+		lhs = append(lhs, "err")
+	}
+	if len(lhs) > 0 {
+		fmt.Fprintf(buf, "\t\t\t%s := %s\n", strings.Join(lhs, ", "), call)
+	} else {
+		fmt.Fprintf(buf, "\t\t\t%s\n", call)
+		buf.WriteString("\t\t\t// TODO: assert side effects.\n")
+	}
+	if sf.ReturnErr {
+		fmt.Fprintf(buf, "\t\t\tif (err != nil) != tt.wantErr {\n\t\t\t\tt.Fatalf(\"%s() error = %%v, wantErr %%v\", err, tt.wantErr)\n\t\t\t}\n", sf.Name)
+	}
+	for i := range gots {
+		fmt.Fprintf(buf, "\t\t\tif !reflect.DeepEqual(%s, tt.%s) {\n\t\t\t\tt.Errorf(\"%s() %s = %%v, want %%v\", %s, tt.%s)\n\t\t\t}\n", gots[i], wants[i], sf.Name, gots[i], gots[i], wants[i])
+	}
+	buf.WriteString("\t\t})\n\t}\n}\n\n")
+
+	return usesReflect
+}
+
+// skeletonTestPath picks the test file name for a source file, avoiding
+// test files already present in the context
+func skeletonTestPath(sourcePath string, existing map[string]bool) string {
+	base := strings.TrimSuffix(sourcePath, ".go")
+	candidate := base + "_test.go"
+	for i := 1; existing[candidate]; i++ {
+		candidate = fmt.Sprintf("%s_gen%d_test.go", base, i)
+	}
+	return candidate
+}
+
+// generateSkeletons emits compilable test stubs for every Go function in
+// the context, one test file per source file
+func generateSkeletons(codeContext string) ([]GeminiTestCase, []GeneratedArtifact) {
+	files := splitContextFiles(codeContext)
+	fset, goFiles := parseGoFiles(files)
+
+	existing := map[string]bool{}
+	for _, file := range files {
+		existing[file.Path] = true
+	}
+
+	var testCases []GeminiTestCase
+	var artifacts []GeneratedArtifact
+	testNames := map[string]map[string]bool{}
+
+	for _, goFile := range goFiles {
+		if strings.HasSuffix(goFile.Path, "_test.go") {
+			continue
+		}
+		funcs, imports := skeletonFuncs(fset, goFile)
+		if len(funcs) == 0 {
+			continue
+		}
+
+		// Test names must be unique per package, e.g. for foo and Foo
+		dir := path.Dir(goFile.Path)
+		if testNames[dir] == nil {
+			testNames[dir] = map[string]bool{}
+		}
+		for i := range funcs {
+			name := funcs[i].TestName
+			for n := 2; testNames[dir][name]; n++ {
+				name = fmt.Sprintf("%s%d", funcs[i].TestName, n)
+			}
+			funcs[i].TestName = name
+			testNames[dir][name] = true
+		}
+
+		var body bytes.Buffer
+		usesReflect := false
+		for _, sf := range funcs {
+			if renderSkeletonTest(&body, sf) {
+				usesReflect = true
+			}
+		}
+
+		var src bytes.Buffer
+		fmt.Fprintf(&src, "package %s\n\nimport (\n", goFile.File.Name.Name)
+		if usesReflect {
+			src.WriteString("\t\"reflect\"\n")
+		}
+		src.WriteString("\t\"testing\"\n")
+		var pkgs []string
+		for pkg := range imports {
+			pkgs = append(pkgs, pkg)
+		}
+		sort.Strings(pkgs)
+		for _, pkg := range pkgs {
+			fmt.Fprintf(&src, "\t%s\n", imports[pkg])
+		}
+		src.WriteString(")\n\n")
+		src.Write(body.Bytes())
+
+		formatted, err := format.Source(src.Bytes())
+		if err != nil {
+			continue
+		}
+
+		testPath := skeletonTestPath(goFile.Path, existing)
+		existing[testPath] = true
+		artifacts = append(artifacts, GeneratedArtifact{
+			Type:        "test-skeleton",
+			Path:        testPath,
+			Language:    "go",
+			Description: fmt.Sprintf("Table-driven test stubs for %s", goFile.Path),
+			Content:     string(formatted),
+		})
+
+		for _, sf := range funcs {
+			testCases = append(testCases, GeminiTestCase{
+				ID:            fmt.Sprintf("skeleton_%d", len(testCases)+1),
+				Name:          sf.TestName,
+				Description:   fmt.Sprintf("Table-driven stub for %s in %s; fill in the test cases.", sf.Name, sf.File),
+				Code:          sf.Signature,
+				TestType:      "unit",
+				Priority:      "medium",
+				SuggestedPath: testPath,
+			})
+		}
+	}
+
+	return testCases, artifacts
+}
+
+// skeletonResponse wraps the skeletons in a regular test response
+func skeletonResponse(codeContext string) GeminiResponse {
+	var response GeminiResponse
+	response.TestCases, response.Artifacts = generateSkeletons(codeContext)
+	response.Summary.TotalTests = len(response.TestCases)
+	response.Summary.UnitTests = len(response.TestCases)
+	return response
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Server-side state lives next to the generated contexts
+const dataDir = "repos"
+
+var validStoreID = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+var errInvalidID = errors.New("invalid id")
+
+// storePath returns the JSON file for id inside a data subdirectory,
+// rejecting ids that could escape it
+func storePath(kind, id string) (string, error) {
+	if !validStoreID.MatchString(id) || id == "." || id == ".." {
+		return "", errInvalidID
+	}
+	return filepath.Join(dataDir, kind, id+".json"), nil
+}
+
+func saveJSON(kind, id string, v interface{}) error {
+	path, err := storePath(kind, id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so readers never see a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadJSON reads a stored value, returning os.ErrNotExist when missing
+func loadJSON(kind, id string, v interface{}) error {
+	path, err := storePath(kind, id)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func deleteJSON(kind, id string) error {
+	path, err := storePath(kind, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// listJSON returns the ids stored in a data subdirectory
+func listJSON(kind string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, kind))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		ids = append(ids, name[:len(name)-len(".json")])
+	}
+	return ids, nil
+}
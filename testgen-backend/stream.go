@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Generations can be streamed instead of answered with one JSON document
+// once the model is done, which takes a minute and more for large
+// contexts. Test cases are sent as soon as the model has written them,
+// read off the streamed text, as NDJSON or Server-Sent Events. The stream
+// ends with the complete response, which stays the one to keep: it has the
+// test cases placed, checked and translated.
+
+// GenerationEvent is one line of a streamed generation
+type GenerationEvent struct {
+	Event    string          `json:"event"` // progress, testCase, result or error
+	Progress *JobProgress    `json:"progress,omitempty"`
+	TestCase *GeminiTestCase `json:"testCase,omitempty"`
+	Result   *GeminiResponse `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Status   int             `json:"status,omitempty"` // HTTP status the error would have been answered with
+	// Seconds a rate limited or overloaded provider asked to wait
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// streamFormat is the stream a request asked for, "ndjson", "sse" or ""
+// for none, by the stream query parameter or the Accept header. Unknown
+// formats are answered with 400 and false.
+func streamFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch format := r.URL.Query().Get("stream"); format {
+	case "ndjson", "sse":
+		return format, true
+	case "":
+	default:
+		http.Error(w, "stream must be ndjson or sse", http.StatusBadRequest)
+		return "", false
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson", true
+	case strings.Contains(accept, "text/event-stream"):
+		return "sse", true
+	}
+	return "", true
+}
+
+// streamGeneration runs a generation and streams its progress and test
+// cases. The status is only sent with the first event, so requests that
+// fail before the model is called are answered with their usual error.
+func streamGeneration(w http.ResponseWriter, req GeminiRequest, tenant string, format string) {
+	rc := http.NewResponseController(w)
+	started := false
+	seq := 0
+	send := func(event GenerationEvent) {
+		if !started {
+			if format == "sse" {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("X-Accel-Buffering", "no")
+			} else {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding stream event: %v", err)
+			return
+		}
+		seq++
+		if format == "sse" {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, event.Event, data)
+		} else {
+			fmt.Fprintf(w, "%s\n", data)
+		}
+		// A client that went away only stops getting events
+		rc.Flush()
+	}
+
+	req.progress = func(progress JobProgress) {
+		send(GenerationEvent{Event: "progress", Progress: &progress})
+	}
+	req.onTestCase = func(testCase GeminiTestCase) {
+		send(GenerationEvent{Event: "testCase", TestCase: &testCase})
+	}
+
+	testResponse, err := generateTests(req, tenant)
+	if err != nil {
+		if !started {
+			writeRequestError(w, err)
+			return
+		}
+		status := http.StatusInternalServerError
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			status = reqErr.status
+		}
+		event := GenerationEvent{Event: "error", Error: err.Error(), Status: status}
+		var busy *providerBusyError
+		if errors.As(err, &busy) {
+			event.RetryAfter = busy.retryAfterSeconds()
+		}
+		send(event)
+		return
+	}
+	send(GenerationEvent{Event: "result", Result: &testResponse})
+}
+
+// generateTestCases calls the model for the test cases of an llm mode
+// generation, streaming them to the request's onTestCase where the
+// provider can stream
+func generateTestCases(req GeminiRequest, prompt string, meter *tokenMeter) (string, error) {
+	provider, ok := req.provider().(streamingProvider)
+	if req.onTestCase == nil || !ok {
+		return generateText(req, prompt, meter)
+	}
+	opts, err := req.generateOptions(prompt, meter)
+	if err != nil {
+		return "", err
+	}
+	scanner := &testCaseScanner{}
+	return provider.StreamTests(context.Background(), prompt, opts, func(text string) {
+		for _, testCase := range scanner.write(text) {
+			req.onTestCase(testCase)
+		}
+	})
+}
+
+// testCaseScanner picks the complete objects of the testCases array out of
+// a response as it is being written
+type testCaseScanner struct {
+	text    strings.Builder
+	pos     int // where the next test case starts, 0 until the array is found
+	done    bool
+	scanned int
+}
+
+// write adds streamed text and returns the test cases it completed
+func (s *testCaseScanner) write(chunk string) []GeminiTestCase {
+	s.text.WriteString(chunk)
+	if s.done {
+		return nil
+	}
+	text := s.text.String()
+	if s.pos == 0 {
+		key := strings.Index(text, `"testCases"`)
+		if key == -1 {
+			return nil
+		}
+		open := strings.IndexByte(text[key:], '[')
+		if open == -1 {
+			return nil
+		}
+		s.pos = key + open + 1
+	}
+
+	var testCases []GeminiTestCase
+	for {
+		// Between the elements only whitespace and commas
+		for s.pos < len(text) && strings.IndexByte(" \t\r\n,", text[s.pos]) != -1 {
+			s.pos++
+		}
+		if s.pos == len(text) {
+			return testCases
+		}
+		if text[s.pos] != '{' {
+			s.done = true
+			return testCases
+		}
+		end := jsonObjectEnd(text, s.pos)
+		if end == -1 {
+			return testCases
+		}
+		var testCase GeminiTestCase
+		if err := json.Unmarshal([]byte(text[s.pos:end]), &testCase); err == nil {
+			fillTestCaseDefaults(&testCase, s.scanned)
+			testCases = append(testCases, testCase)
+		}
+		s.scanned++
+		s.pos = end
+	}
+}
+
+// jsonObjectEnd is the offset after the object starting at start, or -1
+// when the text ends before it does
+func jsonObjectEnd(text string, start int) int {
+	depth := 0
+	inString, escaped := false, false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
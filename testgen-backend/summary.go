@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A one page summary of the project goes at the top of the context, so the
+// model knows where the program starts, which packages are its public API
+// and where requests are routed before it reads thousands of lines. It is
+// derived from the files alone, without a model call.
+
+const (
+	// Entries listed per section, the rest are counted
+	maxSummaryEntries = 15
+	// Examples of routes or exported names per entry
+	maxSummaryExamples = 5
+)
+
+// ProjectSummary orients the model in a repository
+type ProjectSummary struct {
+	Languages   []LanguageShare `json:"languages"`
+	Entrypoints []Entrypoint    `json:"entrypoints,omitempty"`
+	Routing     []RoutingFile   `json:"routing,omitempty"`
+	APIPackages []APIPackage    `json:"apiPackages,omitempty"`
+	TestFiles   int             `json:"testFiles"`
+}
+
+// LanguageShare is the number of files in a language
+type LanguageShare struct {
+	Language string `json:"language"`
+	Files    int    `json:"files"`
+}
+
+// Entrypoint is a file a program starts from
+type Entrypoint struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // e.g. "Go main", "package.json bin"
+}
+
+// RoutingFile is a file registering HTTP routes
+type RoutingFile struct {
+	Path      string   `json:"path"`
+	Framework string   `json:"framework"`
+	Routes    int      `json:"routes"`
+	Examples  []string `json:"examples"`
+}
+
+// APIPackage is a directory exporting identifiers to other packages
+type APIPackage struct {
+	Dir      string   `json:"dir"`
+	Exported int      `json:"exported"`
+	Examples []string `json:"examples"`
+}
+
+var summaryLanguages = map[string]string{
+	".go": "Go", ".js": "JavaScript", ".jsx": "JavaScript", ".mjs": "JavaScript",
+	".ts": "TypeScript", ".tsx": "TypeScript", ".py": "Python", ".java": "Java",
+	".kt": "Kotlin", ".rs": "Rust", ".rb": "Ruby", ".php": "PHP", ".cs": "C#",
+	".c": "C", ".cpp": "C++", ".swift": "Swift",
+}
+
+// routeSyntax finds the routes a framework registers, the first group
+// being the path
+type routeSyntax struct {
+	framework  string
+	extensions []string
+	pattern    *regexp.Regexp
+}
+
+var routeSyntaxes = []routeSyntax{
+	{"Go net/http", []string{".go"}, regexp.MustCompile(`\.Handle(?:Func)?\(\s*"([^"]+)"`)},
+	{"Go router", []string{".go"}, regexp.MustCompile(`\.(?:GET|POST|PUT|PATCH|DELETE|Get|Post|Put|Patch|Delete|Group|Route)\(\s*"(/[^"]*)"`)},
+	{"Express", []string{".js", ".jsx", ".mjs", ".ts"}, regexp.MustCompile(`\b(?:app|router|server)\.(?:get|post|put|patch|delete|all|use|route)\(\s*['"` + "`" + `](/[^'"` + "`" + `]*)`)},
+	{"Flask/FastAPI", []string{".py"}, regexp.MustCompile(`@\w+\.(?:route|get|post|put|patch|delete|api_route)\(\s*['"](/[^'"]*)`)},
+	{"Django", []string{".py"}, regexp.MustCompile(`\b(?:path|re_path)\(\s*r?['"]([^'"]*)['"]\s*,`)},
+	{"Spring", []string{".java", ".kt"}, regexp.MustCompile(`@(?:Get|Post|Put|Patch|Delete|Request)Mapping\(\s*(?:(?:value|path)\s*=\s*)?\{?\s*"([^"]*)"`)},
+}
+
+var (
+	goMainFunc       = regexp.MustCompile(`(?m)^func main\(\)`)
+	pythonMainGuard  = regexp.MustCompile(`(?m)^if __name__ == ['"]__main__['"]`)
+	jvmMainFunc      = regexp.MustCompile(`public\s+static\s+void\s+main\s*\(|(?m)^fun main\(`)
+	scriptExportDecl = regexp.MustCompile(`(?m)^export\s+(?:default\s+)?(?:async\s+)?(?:function\*?|class|const|let|interface|type|enum)\s+([A-Za-z_$][\w$]*)`)
+	pythonPublicDecl = regexp.MustCompile(`(?m)^(?:async\s+)?(?:def|class)\s+([A-Za-z]\w*)`)
+)
+
+// isTestSource reports test files of the common layouts
+func isTestSource(filePath string) bool {
+	filePath = slashPath(filePath)
+	base := path.Base(filePath)
+	return strings.HasSuffix(base, "_test.go") || strings.Contains(base, ".test.") || strings.Contains(base, ".spec.") ||
+		strings.HasPrefix(base, "test_") || strings.HasSuffix(base, "_test.py") ||
+		pathHasDir(filePath, []string{"__tests__", "tests", "test"})
+}
+
+// summarizeProject finds the languages, entrypoints, routing layers and
+// public API packages of the files
+func summarizeProject(files []FileContent) *ProjectSummary {
+	summary := &ProjectSummary{Languages: []LanguageShare{}}
+	languages := map[string]int{}
+
+	for _, file := range files {
+		filePath := slashPath(file.Path)
+		ext := strings.ToLower(path.Ext(filePath))
+		if language, ok := summaryLanguages[ext]; ok {
+			languages[language]++
+		}
+		if isTestSource(filePath) {
+			if _, ok := summaryLanguages[ext]; ok {
+				summary.TestFiles++
+			}
+			continue
+		}
+		summary.Entrypoints = append(summary.Entrypoints, findEntrypoints(filePath, file.Content)...)
+		if routing, ok := findRoutes(filePath, file.Content); ok {
+			summary.Routing = append(summary.Routing, routing)
+		}
+	}
+
+	for language, count := range languages {
+		summary.Languages = append(summary.Languages, LanguageShare{Language: language, Files: count})
+	}
+	sort.Slice(summary.Languages, func(i, j int) bool {
+		if summary.Languages[i].Files != summary.Languages[j].Files {
+			return summary.Languages[i].Files > summary.Languages[j].Files
+		}
+		return summary.Languages[i].Language < summary.Languages[j].Language
+	})
+	sort.SliceStable(summary.Routing, func(i, j int) bool {
+		return summary.Routing[i].Routes > summary.Routing[j].Routes
+	})
+	summary.APIPackages = findAPIPackages(files)
+	return summary
+}
+
+// findEntrypoints reports the programs a file starts
+func findEntrypoints(filePath, content string) []Entrypoint {
+	base := path.Base(filePath)
+	switch ext := path.Ext(filePath); {
+	case ext == ".go" && strings.Contains(content, "package main") && goMainFunc.MatchString(content):
+		return []Entrypoint{{Path: filePath, Kind: "Go main"}}
+	case ext == ".py" && (base == "__main__.py" || base == "manage.py" || pythonMainGuard.MatchString(content)):
+		return []Entrypoint{{Path: filePath, Kind: "Python main"}}
+	case (ext == ".java" || ext == ".kt") && jvmMainFunc.MatchString(content):
+		return []Entrypoint{{Path: filePath, Kind: "JVM main"}}
+	case ext == ".rs" && (base == "main.rs" || strings.Contains(filePath, "src/bin/")):
+		return []Entrypoint{{Path: filePath, Kind: "Rust binary"}}
+	case base == "package.json":
+		return packageJSONEntrypoints(filePath, content)
+	}
+	return nil
+}
+
+// packageJSONEntrypoints reads the main module and executables of a Node
+// package, relative to the repository
+func packageJSONEntrypoints(filePath, content string) []Entrypoint {
+	var pkg struct {
+		Main    string          `json:"main"`
+		Bin     json.RawMessage `json:"bin"`
+		Scripts struct {
+			Start string `json:"start"`
+		} `json:"scripts"`
+	}
+	if json.Unmarshal([]byte(content), &pkg) != nil {
+		return nil
+	}
+	dir := path.Dir(filePath)
+	var entrypoints []Entrypoint
+	if pkg.Main != "" {
+		entrypoints = append(entrypoints, Entrypoint{Path: path.Join(dir, pkg.Main), Kind: "package.json main"})
+	}
+	var bin string
+	var bins map[string]string
+	if json.Unmarshal(pkg.Bin, &bin) == nil && bin != "" {
+		bins = map[string]string{"": bin}
+	} else {
+		json.Unmarshal(pkg.Bin, &bins)
+	}
+	var names []string
+	for name := range bins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entrypoints = append(entrypoints, Entrypoint{Path: path.Join(dir, bins[name]), Kind: "package.json bin"})
+	}
+	if pkg.Scripts.Start != "" {
+		entrypoints = append(entrypoints, Entrypoint{Path: filePath, Kind: "npm start: " + pkg.Scripts.Start})
+	}
+	return entrypoints
+}
+
+// findRoutes counts the routes a file registers with the framework
+// matching most of them
+func findRoutes(filePath, content string) (RoutingFile, bool) {
+	ext := strings.ToLower(path.Ext(filePath))
+	var best RoutingFile
+	for _, p := range routeSyntaxes {
+		if !containsString(p.extensions, ext) {
+			continue
+		}
+		matches := p.pattern.FindAllStringSubmatch(content, -1)
+		if len(matches) <= best.Routes {
+			continue
+		}
+		best = RoutingFile{Path: filePath, Framework: p.framework, Routes: len(matches), Examples: []string{}}
+		for _, m := range matches {
+			if len(best.Examples) < maxSummaryExamples && !containsString(best.Examples, m[1]) {
+				best.Examples = append(best.Examples, m[1])
+			}
+		}
+	}
+	return best, best.Routes > 0
+}
+
+// findAPIPackages lists the directories exporting the most identifiers:
+// Go library packages, and directories of exporting JavaScript, TypeScript
+// and Python modules
+func findAPIPackages(files []FileContent) []APIPackage {
+	byDir := map[string]*APIPackage{}
+	add := func(dir string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		pkg, ok := byDir[dir]
+		if !ok {
+			pkg = &APIPackage{Dir: dir, Examples: []string{}}
+			byDir[dir] = pkg
+		}
+		pkg.Exported += len(names)
+		for _, name := range names {
+			if len(pkg.Examples) < maxSummaryExamples {
+				pkg.Examples = append(pkg.Examples, name)
+			}
+		}
+	}
+
+	_, goPackages := libraryPackages(files)
+	for _, pkg := range goPackages {
+		add(pkg.Dir, goExportedNames(pkg.Files))
+	}
+	for _, file := range files {
+		filePath := slashPath(file.Path)
+		if isTestSource(filePath) {
+			continue
+		}
+		var names []string
+		switch strings.ToLower(path.Ext(filePath)) {
+		case ".js", ".jsx", ".mjs", ".ts", ".tsx":
+			names = submatches(scriptExportDecl, file.Content)
+		case ".py":
+			// Modules of a package, scripts are not imported
+			if !pythonMainGuard.MatchString(file.Content) && path.Base(filePath) != "__main__.py" {
+				names = submatches(pythonPublicDecl, file.Content)
+			}
+		}
+		add(path.Dir(filePath), names)
+	}
+
+	var packages []APIPackage
+	for _, pkg := range byDir {
+		packages = append(packages, *pkg)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Exported != packages[j].Exported {
+			return packages[i].Exported > packages[j].Exported
+		}
+		return packages[i].Dir < packages[j].Dir
+	})
+	return packages
+}
+
+// goExportedNames lists the exported functions, types, constants and
+// variables of a package in declaration order
+func goExportedNames(files []*ast.File) []string {
+	var names []string
+	for _, f := range files {
+		for _, d := range f.Decls {
+			switch decl := d.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil && decl.Name.IsExported() {
+					names = append(names, decl.Name.Name)
+				}
+			case *ast.GenDecl:
+				if decl.Tok == token.IMPORT {
+					continue
+				}
+				for _, spec := range decl.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if s.Name.IsExported() {
+							names = append(names, s.Name.Name)
+						}
+					case *ast.ValueSpec:
+						for _, name := range s.Names {
+							if name.IsExported() {
+								names = append(names, name.Name)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+func submatches(pattern *regexp.Regexp, content string) []string {
+	var names []string
+	for _, m := range pattern.FindAllStringSubmatch(content, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// plural formats a count with its noun, "1 file" or "2 files"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// renderSummary writes the summary as text, empty when nothing orients
+// more than the file list does
+func renderSummary(summary *ProjectSummary) string {
+	if summary == nil || (len(summary.Entrypoints) == 0 && len(summary.Routing) == 0 && len(summary.APIPackages) == 0) {
+		return ""
+	}
+	var section strings.Builder
+	if len(summary.Languages) > 0 {
+		var shares []string
+		for _, l := range summary.Languages {
+			shares = append(shares, fmt.Sprintf("%s (%s)", l.Language, plural(l.Files, "file")))
+		}
+		section.WriteString("Languages: " + strings.Join(shares, ", ") + "\n")
+	}
+	section.WriteString(fmt.Sprintf("Existing test files: %d\n", summary.TestFiles))
+
+	list := func(title string, n int, line func(i int) string) {
+		if n == 0 {
+			return
+		}
+		section.WriteString("\n" + title + ":\n")
+		for i := 0; i < n && i < maxSummaryEntries; i++ {
+			section.WriteString("- " + line(i) + "\n")
+		}
+		if n > maxSummaryEntries {
+			section.WriteString(fmt.Sprintf("- and %d more\n", n-maxSummaryEntries))
+		}
+	}
+	list("Entrypoints", len(summary.Entrypoints), func(i int) string {
+		e := summary.Entrypoints[i]
+		return fmt.Sprintf("%s (%s)", e.Path, e.Kind)
+	})
+	list("Routing", len(summary.Routing), func(i int) string {
+		r := summary.Routing[i]
+		return fmt.Sprintf("%s: %s (%s), e.g. %s", r.Path, plural(r.Routes, "route"), r.Framework, strings.Join(r.Examples, ", "))
+	})
+	list("Public API packages", len(summary.APIPackages), func(i int) string {
+		p := summary.APIPackages[i]
+		return fmt.Sprintf("%s: %d exported, e.g. %s", p.Dir, p.Exported, strings.Join(p.Examples, ", "))
+	})
+
+	section.WriteString("\nPrioritize tests for the public API packages and the handlers behind the routes. Entrypoints mostly wire these together and need few unit tests of their own.\n")
+	return section.String()
+}
+
+// summarySection is the summary section of a text context
+func summarySection(summary string) string {
+	if summary == "" {
+		return ""
+	}
+	return "=== PROJECT SUMMARY ===\n\n" +
+		"An overview of the repository, derived from its files, to orient you before the code.\n\n" +
+		summary + "\n"
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// Public GitHub repositories are downloaded as a tarball from codeload and
+// unpacked in memory, which is much faster than cloning large repositories
+// and works behind proxies that only let HTTPS through. Anything the fast
+// path cannot serve, private repositories or other hosts, is cloned.
+
+const (
+	codeloadHost = "codeload.github.com"
+	// Largest tarball downloaded, larger repositories are cloned
+	maxTarballBytes = 1 << 30
+	// Files above the context limits are not kept in memory
+	maxTarballFileBytes = 1024 * 1024
+	// Bytes unpacked in total, larger repositories are cloned
+	maxTarballContentBytes = 256 << 20
+)
+
+var tarballClient = &http.Client{Timeout: 5 * time.Minute}
+
+// tarballEligible reports whether a repository can take the fast path. It
+// is on unless TESTGEN_TARBALL_DOWNLOAD is off.
+func tarballEligible(loc *RepoLocation, accessToken string) bool {
+	if strings.EqualFold(os.Getenv("TESTGEN_TARBALL_DOWNLOAD"), "off") {
+		return false
+	}
+	host := strings.ToLower(loc.Host)
+	return loc.Provider == "github" && (host == "github.com" || host == "www.github.com") &&
+		accessToken == "" && checkEgress(codeloadHost) == nil
+}
+
+// downloadTarball fetches a repository at its ref, or the default branch,
+// and unpacks the files under subPath, or all of them, in memory. Only
+// files the context reads are kept, the documentation when includeDocs.
+func downloadTarball(loc *RepoLocation, subPath string, includeDocs bool) (*repoClone, error) {
+	ref := loc.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	// Branches keep their slashes, codeload splits on the first ref it knows
+	segments := strings.Split(ref, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	tarballURL := fmt.Sprintf("https://%s/%s/%s/tar.gz/%s", codeloadHost, url.PathEscape(loc.Owner), url.PathEscape(loc.Repo), strings.Join(segments, "/"))
+	resp, err := tarballClient.Get(tarballURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("codeload answered %s", resp.Status)
+	}
+	if resp.ContentLength > maxTarballBytes {
+		return nil, fmt.Errorf("tarball of %d bytes is above the limit of %d", resp.ContentLength, maxTarballBytes)
+	}
+
+	gz, err := gzip.NewReader(io.LimitReader(resp.Body, maxTarballBytes))
+	if err != nil {
+		return nil, err
+	}
+	files := memfs.New()
+	clone := &repoClone{Files: files}
+	var unpacked int64
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// GitHub records the commit in the global header
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			clone.Commit = header.PAXRecords["comment"]
+			continue
+		}
+
+		// Entries sit below a directory named owner-repo-sha
+		_, name, ok := strings.Cut(header.Name, "/")
+		if !ok || name == "" {
+			continue
+		}
+		name = path.Clean(name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid path %s in tarball", header.Name)
+		}
+		if subPath != "" && name != subPath && !strings.HasPrefix(name, subPath+"/") {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Directories of kept files are made with them, subPath is
+			// looked up even when nothing below it is kept
+			if name == subPath {
+				if err := files.MkdirAll(name, 0755); err != nil {
+					return nil, err
+				}
+			}
+		case tar.TypeReg:
+			// Symlinks are left out as in a clone's walk
+			if header.Size > maxTarballFileBytes || !tarballKeeps(name, includeDocs) {
+				continue
+			}
+			unpacked += header.Size
+			if unpacked > maxTarballContentBytes {
+				return nil, fmt.Errorf("tarball unpacks to more than %d bytes", maxTarballContentBytes)
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if err := util.WriteFile(files, name, content, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !commitSHA.MatchString(clone.Commit) || len(clone.Commit) != 40 {
+		return nil, errors.New("tarball does not name its commit")
+	}
+	return clone, nil
+}
+
+// tarballKeeps reports whether a file of a tarball is read into the
+// context, as readRepositoryFiles and readDocumentationFiles would
+func tarballKeeps(name string, includeDocs bool) bool {
+	if !shouldExcludeFile(name) && isContextFile(name) {
+		return true
+	}
+	return includeDocs && isDocFile(name) && !shouldExcludeDocFile(name)
+}
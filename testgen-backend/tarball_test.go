@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// roundTripFunc answers requests without a network
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestDownloadTarballPaths unpacks tarballs with the entries given, each
+// holding a small Go file, the way codeload would serve them. Entries
+// leaving the repository fail the download, the rest are cleaned.
+func TestDownloadTarballPaths(t *testing.T) {
+	saved := tarballClient
+	t.Cleanup(func() { tarballClient = saved })
+
+	tests := []struct {
+		name      string
+		entries   []string
+		subPath   string
+		wantFiles []string
+		wantErr   bool
+	}{
+		{"files", []string{"o-r-abc/main.go", "o-r-abc/pkg/util.go"}, "", []string{"main.go", "pkg/util.go"}, false},
+		{"cleaned path", []string{"o-r-abc/pkg/./sub/../util.go"}, "", []string{"pkg/util.go"}, false},
+		{"entry outside the top directory", []string{"main.go"}, "", nil, false},
+		{"sub path", []string{"o-r-abc/main.go", "o-r-abc/pkg/util.go", "o-r-abc/pkgs/other.go"}, "pkg", []string{"pkg/util.go"}, false},
+		{"parent directory", []string{"o-r-abc/../evil.go"}, "", nil, true},
+		{"parent directory after cleaning", []string{"o-r-abc/pkg/../../evil.go"}, "", nil, true},
+		{"absolute path", []string{"o-r-abc//etc/evil.go"}, "", nil, true},
+		{"parent directory in sub path", []string{"o-r-abc/pkg/../../evil.go"}, "pkg", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := tarballOf(t, tt.entries)
+			tarballClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(archive)), ContentLength: int64(len(archive)), Request: r}, nil
+			})}
+
+			clone, err := downloadTarball(&RepoLocation{Provider: "github", Host: "github.com", Owner: "o", Repo: "r"}, tt.subPath, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid path") {
+					t.Fatalf("downloadTarball() error = %v, want an invalid path", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadTarball() error = %v", err)
+			}
+			var got []string
+			err = util.Walk(clone.Files, "", func(name string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					got = append(got, name)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("downloadTarball() files = %v, want %v", got, tt.wantFiles)
+			}
+		})
+	}
+}
+
+// tarballOf builds a gzipped tarball with a Go file at each name, after
+// the global header GitHub records the commit in
+func tarballOf(t *testing.T, names []string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": strings.Repeat("a", 40)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		content := []byte("package main\n")
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// TenantInstructions are organization-wide standing instructions prepended
+// to every generation made for the tenant
+type TenantInstructions struct {
+	Tenant          string    `json:"tenant"`
+	CodingStandards string    `json:"codingStandards,omitempty"`
+	BannedLibraries []string  `json:"bannedLibraries,omitempty"`
+	AssertionStyle  string    `json:"assertionStyle,omitempty"`
+	Instructions    string    `json:"instructions,omitempty"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// requestTenant returns the tenant of a request, from the body field or
+// the X-Tenant-ID header
+func requestTenant(r *http.Request, bodyTenant string) string {
+	if bodyTenant != "" {
+		return bodyTenant
+	}
+	return r.Header.Get("X-Tenant-ID")
+}
+
+func loadTenantInstructions(tenant string) (*TenantInstructions, error) {
+	if tenant == "" {
+		return nil, nil
+	}
+	var instructions TenantInstructions
+	if err := loadJSON("tenants", tenant, &instructions); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &instructions, nil
+}
+
+// tenantPromptSection renders the standing instructions for the prompt
+func tenantPromptSection(instructions *TenantInstructions) string {
+	if instructions == nil {
+		return ""
+	}
+
+	var section strings.Builder
+	section.WriteString("Organization standing instructions (always follow these, they override any other guideline):\n")
+	if instructions.CodingStandards != "" {
+		section.WriteString("- Coding standards: " + instructions.CodingStandards + "\n")
+	}
+	if len(instructions.BannedLibraries) > 0 {
+		section.WriteString("- Never use these libraries: " + strings.Join(instructions.BannedLibraries, ", ") + "\n")
+	}
+	if instructions.AssertionStyle != "" {
+		section.WriteString("- Assertion style: " + instructions.AssertionStyle + "\n")
+	}
+	if instructions.Instructions != "" {
+		section.WriteString(instructions.Instructions + "\n")
+	}
+	return section.String() + "\n"
+}
+
+// tenantInstructionsHandler serves GET, PUT and DELETE on
+// /api/tenants/{tenant}/instructions
+func tenantInstructionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, PUT, DELETE, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/tenants/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[1] != "instructions" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	tenant := parts[0]
+	if _, err := storePath("tenants", tenant); err != nil {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		instructions, err := loadTenantInstructions(tenant)
+		if err != nil {
+			http.Error(w, "Failed to read tenant instructions", http.StatusInternalServerError)
+			return
+		}
+		if instructions == nil {
+			http.Error(w, "Tenant instructions not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(instructions)
+
+	case "PUT":
+		var instructions TenantInstructions
+		if !decodeRequest(w, r, &instructions) {
+			return
+		}
+		instructions.Tenant = tenant
+		instructions.UpdatedAt = time.Now().UTC()
+		if err := saveJSON("tenants", tenant, instructions); err != nil {
+			log.Printf("Error saving tenant instructions: %v", err)
+			http.Error(w, "Failed to save tenant instructions", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Updated standing instructions for tenant %s", tenant)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(instructions)
+
+	case "DELETE":
+		if err := deleteJSON("tenants", tenant); err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "Failed to delete tenant instructions", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
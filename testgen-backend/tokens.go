@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+var errOutputBudgetExceeded = errors.New("output token budget exceeded")
+
+// Response envelopes carry JSON escaping and metadata on top of the
+// generated text, allow for it before aborting on the estimate
+const envelopeTokenSlack = 512
+
+// TokenUsage reports the tokens spent by a generation request
+type TokenUsage struct {
+	PromptTokens int `json:"promptTokens"`
+	OutputTokens int `json:"outputTokens"`
+	Budget       int `json:"budget,omitempty"`
+	// Estimated tokens of the prompt sent and the budget it was fitted to,
+	// see contextbudget.go
+	ContextTokens int `json:"contextTokens,omitempty"`
+	ContextBudget int `json:"contextBudget,omitempty"`
+	// Priced at the model's list price, see TESTGEN_PRICING_FILE
+	CostUSD float64 `json:"costUsd,omitempty"`
+}
+
+// tokenMeter counts the output tokens of the model calls made for one
+// request and enforces its output budget. A zero budget is unlimited.
+type tokenMeter struct {
+	mu           sync.Mutex
+	budget       int
+	promptTokens int
+	outputTokens int
+	streamed     int
+	// The prompt as fitted to the context budget
+	contextTokens int
+	contextBudget int
+	// Output tokens of the last call with their log probabilities, nil when
+	// its provider reported none
+	logprobs []tokenLogprob
+}
+
+// tokenLogprob is an output token and the log probability the model gave it
+type tokenLogprob struct {
+	Token   string
+	Logprob float64
+}
+
+func newTokenMeter(budget int) *tokenMeter {
+	return &tokenMeter{budget: budget}
+}
+
+// observe adds the estimated tokens of a streamed chunk and reports whether
+// the budget is exceeded
+func (m *tokenMeter) observe(chunk []byte) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streamed += len(chunk)
+	if m.budget > 0 && m.outputTokens+(m.streamed+3)/4 > m.budget+envelopeTokenSlack {
+		return fmt.Errorf("%w: more than %d tokens", errOutputBudgetExceeded, m.budget)
+	}
+	return nil
+}
+
+// record replaces the streamed estimate with the counts reported by the
+// provider once a call completes
+func (m *tokenMeter) record(promptTokens, outputTokens int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if outputTokens == 0 {
+		outputTokens = (m.streamed + 3) / 4
+	}
+	m.promptTokens += promptTokens
+	m.outputTokens += outputTokens
+	m.streamed = 0
+	m.logprobs = nil
+}
+
+// recordLogprobs keeps the log probabilities of the output tokens of the
+// call just recorded
+func (m *tokenMeter) recordLogprobs(tokens []tokenLogprob) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logprobs = tokens
+}
+
+// lastLogprobs returns the output tokens of the last call with their log
+// probabilities, nil when its provider reported none
+func (m *tokenMeter) lastLogprobs() []tokenLogprob {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logprobs
+}
+
+func (m *tokenMeter) usage() *TokenUsage {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &TokenUsage{
+		PromptTokens:  m.promptTokens,
+		OutputTokens:  m.outputTokens,
+		Budget:        m.budget,
+		ContextTokens: m.contextTokens,
+		ContextBudget: m.contextBudget,
+	}
+}
+
+// recordContext keeps the estimated size of the prompt and the budget it
+// was fitted to
+func (m *tokenMeter) recordContext(tokens, budget int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.contextTokens = tokens
+	m.contextBudget = budget
+}
+
+// remaining returns the output tokens left in the budget, or fallback when
+// the budget is unlimited
+func (m *tokenMeter) remaining(fallback int) int {
+	if m == nil || m.budget <= 0 {
+		return fallback
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	left := m.budget - m.outputTokens
+	if left < fallback {
+		return left
+	}
+	return fallback
+}
+
+// meteredBody wraps a provider response body, counting tokens as they are
+// read and aborting the read once the meter's budget is exceeded
+type meteredBody struct {
+	io.ReadCloser
+	meter *tokenMeter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if budgetErr := b.meter.observe(p[:n]); budgetErr != nil {
+			return n, budgetErr
+		}
+	}
+	return n, err
+}
+
+// estimateTokens counts tokens the way the BPE tokenizers of the providers
+// split text, without their vocabularies: identifiers break at case changes
+// and underscores and long words into pieces, digits go in threes,
+// punctuation in pairs and other scripts a character each. A single space
+// is part of the token after it, other whitespace runs are one. It runs
+// somewhat above the providers' counts for code, which keeps prompts
+// fitted to it under their limits.
+func estimateTokens(s string) int {
+	tokens := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case isASCIILetter(c):
+			start := i
+			for i < len(s) && isASCIILetter(s[i]) {
+				// A new piece at lower to upper case, and before the last
+				// capital of an acronym followed by a word, as in HTTPServer
+				if i > start && isUpper(s[i]) && (!isUpper(s[i-1]) || i+1 < len(s) && isLower(s[i+1])) {
+					tokens += wordTokens(i - start)
+					start = i
+				}
+				i++
+			}
+			tokens += wordTokens(i - start)
+		case isASCIIDigit(c):
+			start := i
+			for i < len(s) && isASCIIDigit(s[i]) {
+				i++
+			}
+			tokens += (i - start + 2) / 3
+		case c == ' ' && i+1 < len(s) && !isASCIISpace(s[i+1]):
+			i++
+		case isASCIISpace(c):
+			for i < len(s) && isASCIISpace(s[i]) {
+				i++
+			}
+			tokens++
+		case c == '_':
+			// A piece boundary, not a token of its own
+			i++
+		case c < utf8.RuneSelf:
+			start := i
+			for i < len(s) && isASCIIPunct(s[i]) {
+				i++
+			}
+			tokens += (i - start + 1) / 2
+		default:
+			_, size := utf8.DecodeRuneInString(s[i:])
+			i += size
+			tokens++
+		}
+	}
+	return tokens
+}
+
+// wordTokens is the tokens of one piece of an identifier or word, common
+// words are one token and longer ones split about every eight letters
+func wordTokens(letters int) int {
+	return (letters + 7) / 8
+}
+
+func isLower(c byte) bool       { return c >= 'a' && c <= 'z' }
+func isUpper(c byte) bool       { return c >= 'A' && c <= 'Z' }
+func isASCIILetter(c byte) bool { return isLower(c) || isUpper(c) }
+func isASCIIDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isASCIISpace(c byte) bool  { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && c != '_' && !isASCIILetter(c) && !isASCIIDigit(c) && !isASCIISpace(c)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Request bodies are decoded and validated in one step. Malformed JSON is
+// a 400 naming where it broke, well-formed bodies with bad values are a 422
+// listing every offending field.
+
+// FieldError is one failed constraint on a request field
+type FieldError struct {
+	Field      string `json:"field"`
+	Constraint string `json:"constraint"`
+	Message    string `json:"message"`
+}
+
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, constraint, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{Field: field, Constraint: constraint, Message: fmt.Sprintf(format, args...)})
+}
+
+func (errs *fieldErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		errs.add(field, "required", "%s is required", field)
+	}
+}
+
+func (errs *fieldErrors) oneOf(field, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	errs.add(field, "oneof", "%s must be one of %s", field, strings.Join(allowed, ", "))
+}
+
+func (errs *fieldErrors) min(field string, value, min int) {
+	if value < min {
+		errs.add(field, "min", "%s must be at least %d", field, min)
+	}
+}
+
+func (errs *fieldErrors) maxLen(field, value string, max int) {
+	if len(value) > max {
+		errs.add(field, "max", "%s must be at most %d bytes", field, max)
+	}
+}
+
+// validatable is implemented by request bodies with constraints
+type validatable interface {
+	validate() fieldErrors
+}
+
+// decodeRequest decodes a JSON body into v and validates it, answering the
+// request and returning false when it is not acceptable
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case isBodyTooLarge(err):
+			var maxErr *http.MaxBytesError
+			errors.As(err, &maxErr)
+			writeBodyTooLarge(w, maxErr.Limit)
+		case errors.As(err, &typeErr):
+			field := typeErr.Field
+			if field == "" {
+				field = "body"
+			}
+			writeFieldErrors(w, fieldErrors{{
+				Field:      field,
+				Constraint: "type",
+				Message:    fmt.Sprintf("%s must be %s, not %s", field, jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value),
+			}})
+		case errors.As(err, &syntaxErr):
+			http.Error(w, fmt.Sprintf("Invalid JSON at offset %d: %v", syntaxErr.Offset, err), http.StatusBadRequest)
+		case errors.Is(err, io.EOF):
+			http.Error(w, "Invalid JSON: empty request body", http.StatusBadRequest)
+		default:
+			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		}
+		return false
+	}
+	if target, ok := v.(validatable); ok {
+		if errs := target.validate(); len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return false
+		}
+	}
+	return true
+}
+
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "int", "int64", "int32", "float64", "uint":
+		return "a number"
+	case "bool":
+		return "a boolean"
+	case "slice", "array":
+		return "an array"
+	case "struct", "map":
+		return "an object"
+	}
+	return "a " + kind
+}
+
+func writeFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Validation failed",
+		"fields": errs,
+	})
+}
+
+var repoRefPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// Upper bound on the repositories merged into one context
+const maxRepoURLs = 10
+
+// Longest access token accepted, provider tokens are far shorter
+const maxAccessTokenLength = 1024
+
+func (req *RepoRequest) validate() fieldErrors {
+	var errs fieldErrors
+	if req.RepoURL == "" && len(req.RepoURLs) == 0 {
+		errs.add("repoUrl", "required", "repoUrl or repoUrls is required")
+	}
+	if req.RepoURL != "" {
+		if _, err := parseRepoURL(req.RepoURL); err != nil {
+			errs.add("repoUrl", "repo_url", "repoUrl must be a GitHub, GitLab or Bitbucket repository URL like https://github.com/owner/repo")
+		}
+	}
+	if len(req.RepoURLs) > maxRepoURLs {
+		errs.add("repoUrls", "max", "repoUrls must have at most %d entries", maxRepoURLs)
+	}
+	for i, repoURL := range req.RepoURLs {
+		if _, err := parseRepoURL(repoURL); err != nil {
+			field := fmt.Sprintf("repoUrls[%d]", i)
+			errs.add(field, "repo_url", "%s must be a GitHub, GitLab or Bitbucket repository URL like https://github.com/owner/repo", field)
+		}
+	}
+	errs.oneOf("docsMode", req.DocsMode, "raw", "summary")
+	errs.oneOf("goMode", req.GoMode, "source", "api")
+	errs.oneOf("format", req.Format, contextFormats...)
+	errs.min("docsBudget", req.DocsBudget, 0)
+	errs.min("contextBudget", req.ContextBudget, 0)
+	if req.Normalize != nil {
+		errs.min("normalize.maxStringLength", req.Normalize.MaxStringLength, 0)
+	}
+	if req.Ref != "" {
+		if req.RepoURL == "" {
+			errs.add("ref", "required_with", "ref needs repoUrl, repoUrls take the branch from their URL")
+		} else if !validGitRef(req.Ref) {
+			errs.add("ref", "ref", "ref must be a branch, tag or commit name")
+		}
+	}
+	if req.SubPath != "" {
+		if req.RepoURL == "" {
+			errs.add("subPath", "required_with", "subPath needs repoUrl, repoUrls are read whole")
+		} else if _, ok := cleanSubPath(req.SubPath); !ok {
+			errs.add("subPath", "path", "subPath must be a directory inside the repository like services/payments")
+		}
+	}
+	validateAccessToken(&errs, req.AccessToken)
+	return errs
+}
+
+func validateAccessToken(errs *fieldErrors, token string) {
+	errs.maxLen("accessToken", token, maxAccessTokenLength)
+	if strings.IndexFunc(token, func(r rune) bool { return r <= ' ' || r == 0x7f }) != -1 {
+		errs.add("accessToken", "token", "accessToken must not contain spaces or control characters")
+	}
+}
+
+func (req *GeminiRequest) validate() fieldErrors {
+	errs := req.validateGeneration()
+	switch {
+	case req.ContextID == "":
+		errs.required("codeContext", req.CodeContext)
+	case !validContextID.MatchString(req.ContextID):
+		errs.add("contextId", "id", "contextId must be a context id returned by the clone endpoint")
+	case req.CodeContext != "":
+		errs.add("contextId", "excluded_with", "contextId and codeContext are exclusive")
+	}
+	return errs
+}
+
+// validateGeneration checks the fields of a generation request other than
+// the code context, which sessions supply themselves
+func (req *GeminiRequest) validateGeneration() fieldErrors {
+	var errs fieldErrors
+	errs.oneOf("mode", req.Mode, "llm", "skeleton", "hybrid")
+	errs.oneOf("provider", req.Provider, llmProviderNames()...)
+	validateModel(&errs, req)
+	validateEndpoint(&errs, req)
+	validateAzure(&errs, req)
+	validateOverrides(&errs, req.Overrides)
+	validateAPIKey(&errs, req)
+	for i, name := range req.Focus {
+		if _, ok := lookupTestFocus(name); !ok {
+			errs.add(fmt.Sprintf("focus[%d]", i), "focus", "unknown focus %q", name)
+		}
+	}
+	errs.min("maxOutputTokens", req.MaxOutputTokens, 0)
+	errs.min("contextBudget", req.ContextBudget, 0)
+	errs.oneOf("chunking", req.Chunking, "auto", "off")
+	errs.oneOf("output", req.Output, "cases", "go-files")
+	if req.Repo != "" && !repoRefPattern.MatchString(req.Repo) {
+		errs.add("repo", "repo", "repo must have the form owner/repo")
+	}
+	if req.Source != "" && !contextSourceLine.MatchString("Source: "+req.Source) {
+		errs.add("source", "source", "source must have the form owner/repo@sha")
+	}
+	if req.Tenant != "" && !validStoreID.MatchString(req.Tenant) {
+		errs.add("tenant", "id", "tenant may only contain letters, digits, '.', '_' and '-'")
+	}
+	validateTags(&errs, req.Tags)
+	validateLanguage(&errs, "descriptionLanguage", req.DescriptionLanguage)
+	validateLanguage(&errs, "commentLanguage", req.CommentLanguage)
+	if req.Redact != nil {
+		req.Redact.validate(&errs)
+	}
+	return errs
+}
+
+// Longest free text accepted in tenant instructions
+const maxInstructionLength = 16 * 1024
+
+func (instructions *TenantInstructions) validate() fieldErrors {
+	var errs fieldErrors
+	errs.maxLen("codingStandards", instructions.CodingStandards, maxInstructionLength)
+	errs.maxLen("assertionStyle", instructions.AssertionStyle, maxInstructionLength)
+	errs.maxLen("instructions", instructions.Instructions, maxInstructionLength)
+	for i, library := range instructions.BannedLibraries {
+		errs.required(fmt.Sprintf("bannedLibraries[%d]", i), library)
+	}
+	return errs
+}
+
+func validateSessionFiles(errs *fieldErrors, files []FileContent) {
+	for i, file := range files {
+		if _, ok := cleanSessionFilePath(file.Path); !ok {
+			field := fmt.Sprintf("files[%d].path", i)
+			errs.add(field, "path", "%s must be a relative path inside the session", field)
+		}
+	}
+}
+
+func (req *createSessionRequest) validate() fieldErrors {
+	var errs fieldErrors
+	errs.min("ttlMinutes", req.TTLMinutes, 0)
+	if req.ContextID != "" && !validContextID.MatchString(req.ContextID) {
+		errs.add("contextId", "id", "contextId is not a valid context id")
+	}
+	if req.Repo != "" && !repoRefPattern.MatchString(req.Repo) {
+		errs.add("repo", "repo", "repo must have the form owner/repo")
+	}
+	validateSessionFiles(&errs, req.Files)
+	return errs
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API versions are selected with a path prefix (/api/v1/...) or, on the
+// unversioned paths, with Accept: application/vnd.testgen.v1+json. Every
+// version serves the same routes, handlers that change their schema in a
+// later version branch on apiVersionOf. Unversioned paths are answered as
+// v1 with deprecation headers.
+
+type apiVersion struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"` // "stable", "preview" or "deprecated"
+	Deprecated *time.Time `json:"deprecated,omitempty"`
+	Sunset     *time.Time `json:"sunset,omitempty"`
+}
+
+const defaultAPIVersion = "v1"
+
+var (
+	legacyDeprecated = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+var apiVersions = []apiVersion{
+	{Name: "v1", Status: "stable"},
+	{Name: "v2", Status: "preview"},
+}
+
+var (
+	versionPrefix   = regexp.MustCompile(`^/api/(v[0-9]+)(/.*)?$`)
+	versionMimeType = regexp.MustCompile(`application/vnd\.testgen\.(v[0-9]+)\+json`)
+)
+
+func lookupAPIVersion(name string) (apiVersion, bool) {
+	for _, v := range apiVersions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return apiVersion{}, false
+}
+
+type apiVersionKey struct{}
+
+// apiVersionOf returns the API version a request was made against
+func apiVersionOf(r *http.Request) string {
+	if v, ok := r.Context().Value(apiVersionKey{}).(string); ok {
+		return v
+	}
+	return defaultAPIVersion
+}
+
+func setVersionHeaders(w http.ResponseWriter, v apiVersion) {
+	w.Header().Set("API-Version", v.Name)
+	if v.Deprecated != nil {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.Deprecated.Unix(), 10))
+	}
+	if v.Sunset != nil {
+		w.Header().Set("Sunset", v.Sunset.Format(http.TimeFormat))
+	}
+}
+
+// withAPIVersions strips the version prefix from API paths so the routes
+// are shared by all versions, and records the version for the handlers
+func withAPIVersions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var version apiVersion
+		if match := versionPrefix.FindStringSubmatch(r.URL.Path); match != nil {
+			v, ok := lookupAPIVersion(match[1])
+			if !ok {
+				http.Error(w, "Unsupported API version "+match[1], http.StatusNotFound)
+				return
+			}
+			version = v
+			r = r.Clone(r.Context())
+			r.URL.Path = "/api" + match[2]
+			r.URL.RawPath = ""
+		} else if match := versionMimeType.FindStringSubmatch(r.Header.Get("Accept")); match != nil {
+			v, ok := lookupAPIVersion(match[1])
+			if !ok {
+				http.Error(w, "Unsupported API version "+match[1], http.StatusNotAcceptable)
+				return
+			}
+			version = v
+		} else {
+			// Unversioned paths are the deprecated original API
+			version, _ = lookupAPIVersion(defaultAPIVersion)
+			version.Status = "deprecated"
+			version.Deprecated = &legacyDeprecated
+			version.Sunset = &legacySunset
+			w.Header().Set("Link", "</api/"+defaultAPIVersion+strings.TrimPrefix(r.URL.Path, "/api")+`>; rel="successor-version"`)
+		}
+
+		setVersionHeaders(w, version)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version.Name)))
+	})
+}
+
+// apiVersionsHandler lists the supported API versions
+func apiVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, "GET, OPTIONS")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	legacy, _ := lookupAPIVersion(defaultAPIVersion)
+	legacy.Name = "unversioned"
+	legacy.Status = "deprecated"
+	legacy.Deprecated = &legacyDeprecated
+	legacy.Sunset = &legacySunset
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  defaultAPIVersion,
+		"versions": append(append([]apiVersion(nil), apiVersions...), legacy),
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// ContextVersion records the files a context was built from at one commit,
+// so two builds can be compared without keeping every context around
+type ContextVersion struct {
+	ID        string            `json:"id"`
+	ContextID string            `json:"contextId"`
+	Commits   map[string]string `json:"commits"` // owner/repo -> commit SHA
+	CreatedAt time.Time         `json:"createdAt"`
+	Files     []FileDigest      `json:"files"`
+}
+
+// FileDigest identifies the content of a context file
+type FileDigest struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ContextDiff lists the files that differ between two context versions
+type ContextDiff struct {
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	Added       []FileDigest      `json:"added"`
+	Removed     []FileDigest      `json:"removed"`
+	Changed     []ChangedFile     `json:"changed"`
+	Unchanged   int               `json:"unchanged"`
+	FromCommits map[string]string `json:"fromCommits"`
+	ToCommits   map[string]string `json:"toCommits"`
+}
+
+// ChangedFile is a path present in both versions with different content
+type ChangedFile struct {
+	Path      string `json:"path"`
+	OldSize   int    `json:"oldSize"`
+	NewSize   int    `json:"newSize"`
+	OldSHA256 string `json:"oldSha256"`
+	NewSHA256 string `json:"newSha256"`
+}
+
+// contextVersionID is the commit SHA of a single repository, or a digest of
+// all commits for a multi-repo context
+func contextVersionID(contextID string, commits map[string]string) string {
+	if len(commits) == 1 {
+		for _, sha := range commits {
+			return sha
+		}
+	}
+	repos := make([]string, 0, len(commits))
+	for repo := range commits {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	h := sha256.New()
+	h.Write([]byte(contextID + "\n"))
+	for _, repo := range repos {
+		fmt.Fprintf(h, "%s@%s\n", repo, commits[repo])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:40]
+}
+
+// saveContextVersion stores the file digests of a context build and returns
+// its version id. Rebuilding the same commits replaces the stored version.
+func saveContextVersion(contextID string, snapshots []*repoSnapshot, files []FileContent) (string, error) {
+	commits := map[string]string{}
+	for _, s := range snapshots {
+		if s.Commit == "" {
+			return "", errors.New("missing commit for " + s.Owner + "/" + s.Repo)
+		}
+		commits[s.Owner+"/"+s.Repo] = s.Commit
+	}
+
+	version := ContextVersion{
+		ID:        contextVersionID(contextID, commits),
+		ContextID: contextID,
+		Commits:   commits,
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, file := range files {
+		sum := sha256.Sum256([]byte(file.Content))
+		version.Files = append(version.Files, FileDigest{
+			Path:   file.Path,
+			Size:   file.Size,
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	if err := saveJSON("context-versions", version.ID, version); err != nil {
+		return "", err
+	}
+	return version.ID, nil
+}
+
+func diffContextVersions(from, to ContextVersion) ContextDiff {
+	diff := ContextDiff{
+		From:        from.ID,
+		To:          to.ID,
+		Added:       []FileDigest{},
+		Removed:     []FileDigest{},
+		Changed:     []ChangedFile{},
+		FromCommits: from.Commits,
+		ToCommits:   to.Commits,
+	}
+
+	old := map[string]FileDigest{}
+	for _, file := range from.Files {
+		old[file.Path] = file
+	}
+	for _, file := range to.Files {
+		prev, ok := old[file.Path]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, file)
+		case prev.SHA256 != file.SHA256:
+			diff.Changed = append(diff.Changed, ChangedFile{
+				Path:      file.Path,
+				OldSize:   prev.Size,
+				NewSize:   file.Size,
+				OldSHA256: prev.SHA256,
+				NewSHA256: file.SHA256,
+			})
+		default:
+			diff.Unchanged++
+		}
+		delete(old, file.Path)
+	}
+	for _, file := range from.Files {
+		if _, ok := old[file.Path]; ok {
+			diff.Removed = append(diff.Removed, file)
+		}
+	}
+	return diff
+}
+
+// contextDiffHandler serves GET /api/context/{id}/diff/{otherId}, where the
+// ids are context versions as returned by the clone endpoint
+func contextDiffHandler(w http.ResponseWriter, r *http.Request, fromID, toID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var from, to ContextVersion
+	for _, v := range []struct {
+		id      string
+		version *ContextVersion
+	}{{fromID, &from}, {toID, &to}} {
+		if err := loadJSON("context-versions", v.id, v.version); err != nil {
+			if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidID) {
+				http.Error(w, fmt.Sprintf("Context version %s not found", v.id), http.StatusNotFound)
+				return
+			}
+			log.Printf("Error reading context version %s: %v", v.id, err)
+			http.Error(w, "Failed to read context version", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffContextVersions(from, to))
+}